@@ -8,17 +8,25 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/sapcc/go-bits/gopherpolicy"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/mock"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/osext"
 	"github.com/spf13/viper"
 
+	"github.com/sapcc/hermes/pkg/alerts"
 	"github.com/sapcc/hermes/pkg/api"
+	"github.com/sapcc/hermes/pkg/exportevents"
 	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/ingest"
+	"github.com/sapcc/hermes/pkg/integrity"
 	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/webhooks"
 )
 
 const version = "1.2.0"
@@ -38,10 +46,31 @@ func main() {
 
 	setDefaultConfig()
 	readConfig(configPath)
-	keystoneDriver := configuredKeystoneDriver()
+
+	// the schema must be migrated before the storage driver can connect
+	if flag.Arg(0) == "migrate" {
+		runMigrate()
+		return
+	}
 	storageDriver := configuredStorageDriver()
 
-	must.Succeed(api.Server(keystoneDriver, storageDriver))
+	switch command := flag.Arg(0); command {
+	case "", "api":
+		keystoneDriver := configuredKeystoneDriver()
+		must.Succeed(api.Server(keystoneDriver, storageDriver, configuredProjectLister(), configuredAlertEngine(storageDriver), configuredSealer(storageDriver)))
+	case "export-worker":
+		runExportWorker(storageDriver)
+	case "ingest":
+		runIngest(storageDriver)
+	case "integrity-worker":
+		runIntegrityWorker(storageDriver)
+	case "verify":
+		runVerify(storageDriver, flag.Args()[1:])
+	case "webhook-dispatcher":
+		runWebhookDispatcher(storageDriver)
+	default:
+		logg.Fatal("unknown command %q, must be api, export-worker, ingest, integrity-worker, migrate, verify or webhook-dispatcher", command)
+	}
 }
 
 func parseCmdlineFlags() {
@@ -49,7 +78,7 @@ func parseCmdlineFlags() {
 	configPath = flag.String("f", "hermes.conf", "specifies the location of the TOML-format configuration file")
 	showVersion = flag.Bool("version", false, "prints the version of the application")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s: %s [flags] [api|export-worker|ingest|integrity-worker|migrate|verify|webhook-dispatcher]\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -58,12 +87,48 @@ func parseCmdlineFlags() {
 func setDefaultConfig() {
 	viper.SetDefault("hermes.keystone_driver", "keystone")
 	viper.SetDefault("hermes.storage_driver", "elasticsearch")
+	viper.SetDefault("Keystone.project_cache_time", "5m")
 	viper.SetDefault("API.ListenAddress", "0.0.0.0:8788")
+	viper.SetDefault("API.query_timeout", "30s")
+	// exports stream all matching events, which takes much longer than a query
+	viper.SetDefault("API.query_timeouts.ExportEvents", "0")
+	viper.SetDefault("API.stream_poll_interval", "2s")
+	viper.SetDefault("API.stream_lookback", "30s")
+	viper.SetDefault("API.max_streams", 100)
+	viper.SetDefault("API.stream_token_check_interval", "1m")
 	viper.SetDefault("elasticsearch.url", "localhost:9200")
 	// index.max_result_window defaults to 10000, as per
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/index-modules.html
 	// Increasing max_result_window to 20000, with corresponding changes to Elasticsearch to handle the increase.
 	viper.SetDefault("elasticsearch.max_result_window", "20000")
+	// Point in time snapshots used for cursor based paging expire after this duration without further requests.
+	viper.SetDefault("elasticsearch.cursor_keep_alive", "5m")
+	viper.SetDefault("sqlite.path", "hermes.db")
+	viper.SetDefault("sqlite.max_result_window", "20000")
+	viper.SetDefault("postgres.max_result_window", "20000")
+	viper.SetDefault("export.ListenAddress", "0.0.0.0:8789")
+	viper.SetDefault("export.interval", "15m")
+	viper.SetDefault("export.settle_delay", "5m")
+	viper.SetDefault("export.s3_region", "us-east-1")
+	viper.SetDefault("ingest.ListenAddress", "0.0.0.0:8790")
+	viper.SetDefault("ingest.queue", "notifications.info")
+	viper.SetDefault("ingest.batch_size", 500)
+	viper.SetDefault("ingest.flush_interval", "1s")
+	viper.SetDefault("ingest.retry_interval", "1s")
+	viper.SetDefault("alerts.evaluation_interval", "1m")
+	viper.SetDefault("webhooks.ListenAddress", "0.0.0.0:8791")
+	viper.SetDefault("webhooks.sync_interval", "30s")
+	viper.SetDefault("webhooks.poll_interval", "5s")
+	viper.SetDefault("webhooks.lookback", "30s")
+	viper.SetDefault("webhooks.timeout", "10s")
+	viper.SetDefault("webhooks.max_attempts", 6)
+	viper.SetDefault("webhooks.retry_interval", "10s")
+	viper.SetDefault("webhooks.max_retry_interval", "10m")
+	viper.SetDefault("webhooks.delivery_log_retention", "720h")
+	viper.SetDefault("integrity.ListenAddress", "0.0.0.0:8792")
+	viper.SetDefault("integrity.interval", "1m")
+	viper.SetDefault("integrity.settle_delay", "1m")
+	viper.SetDefault("integrity.lookback", "1h")
 }
 
 func readConfig(configPath *string) {
@@ -79,6 +144,22 @@ func readConfig(configPath *string) {
 	if err != nil {
 		logg.Fatal(err.Error())
 	}
+	err = viper.BindEnv("export.s3_access_key_id", "HERMES_EXPORT_S3_ACCESS_KEY_ID")
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	err = viper.BindEnv("export.s3_secret_access_key", "HERMES_EXPORT_S3_SECRET_ACCESS_KEY")
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	err = viper.BindEnv("ingest.rabbitmq_url", "HERMES_INGEST_RABBITMQ_URL")
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	err = viper.BindEnv("postgres.url", "HERMES_POSTGRES_URL")
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
 
 	// Don't read config file if the default config file isn't there,
 	//  as we will just fall back to config defaults in that case
@@ -108,18 +189,249 @@ func configuredKeystoneDriver() gopherpolicy.Validator {
 	}
 }
 
-var elasticSearchStorage = storage.ElasticSearch{}
-var mockStorage = storage.Mock{}
-
-func configuredStorageDriver() storage.Storage {
-	driverName := viper.GetString("hermes.storage_driver")
+// configuredProjectLister returns the ProjectLister matching the configured
+// keystone driver. The mock driver knows no projects.
+func configuredProjectLister() identity.ProjectLister {
+	driverName := viper.GetString("hermes.keystone_driver")
 	switch driverName {
-	case "elasticsearch":
-		return elasticSearchStorage
+	case "keystone":
+		return must.Return(identity.NewProjectLister(context.TODO(), viper.GetDuration("Keystone.project_cache_time")))
 	case "mock":
-		return mockStorage
+		return identity.MockProjectLister{}
 	default:
-		logg.Error("Couldn't match a storage driver for configured value \"%s\"", driverName)
+		logg.Error("Couldn't match a keystone driver for configured value \"%s\"", driverName)
 		return nil
 	}
 }
+
+// configuredSealer returns the sealer for the events written by Hermes, or nil
+// if no integrity key is set.
+func configuredSealer(storageDriver storage.Storage) *integrity.Sealer {
+	sealer, err := integrity.NewSealer(storageDriver)
+	if err != nil {
+		logg.Fatal("cannot seal events with storage driver %q: %s", viper.GetString("hermes.storage_driver"), err.Error())
+	}
+	if sealer != nil {
+		sealer.SettleDelay = viper.GetDuration("integrity.settle_delay")
+		sealer.Lookback = viper.GetDuration("integrity.lookback")
+	}
+	return sealer
+}
+
+// requireIngestTime exits unless the storage driver records when events were
+// written, which the given feature needs to find the events written since its
+// last run.
+func requireIngestTime(storageDriver storage.Storage, feature string) {
+	recorder, ok := storageDriver.(storage.IngestTimeRecorder)
+	if !ok || !recorder.RecordsIngestTime() {
+		logg.Fatal("storage driver %q does not support %s, since it does not record when events were written",
+			viper.GetString("hermes.storage_driver"), feature)
+	}
+}
+
+// configuredAlertEngine returns the engine for the configured alerting rules,
+// or nil if there is no rules file.
+func configuredAlertEngine(storageDriver storage.Storage) *alerts.Engine {
+	rulesFile := viper.GetString("alerts.rules_file")
+	if rulesFile == "" {
+		return nil
+	}
+	aggregator, ok := storageDriver.(storage.EventAggregator)
+	if !ok {
+		logg.Fatal("storage driver %q does not support alerting rules", viper.GetString("hermes.storage_driver"))
+	}
+	rules, err := alerts.LoadRules(rulesFile)
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	logg.Info("loaded %d alerting rules from %s", len(rules), rulesFile)
+	return &alerts.Engine{
+		Rules:      rules,
+		Aggregator: aggregator,
+		Interval:   viper.GetDuration("alerts.evaluation_interval"),
+	}
+}
+
+func configuredStorageDriver() storage.Storage {
+	driverName := viper.GetString("hermes.storage_driver")
+	driver, err := storage.NewDriver(driverName)
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	return driver
+}
+
+// runMigrate creates or updates the database schema of the storage driver.
+func runMigrate() {
+	driverName := viper.GetString("hermes.storage_driver")
+	if driverName != "postgres" {
+		logg.Fatal("storage driver %q does not need to be migrated", driverName)
+	}
+	must.Succeed(storage.MigratePostgres(viper.GetString("postgres.url")))
+	logg.Info("database schema is up to date")
+}
+
+// runExportWorker periodically uploads the events of all projects with an
+// enabled export configuration, and serves Prometheus metrics in the meantime.
+func runExportWorker(storageDriver storage.Storage) {
+	configStore, ok := storageDriver.(storage.ExportConfigStore)
+	if !ok {
+		logg.Fatal("storage driver %q does not support the event export", viper.GetString("hermes.storage_driver"))
+	}
+	requireIngestTime(storageDriver, "the event export")
+
+	worker := exportevents.Worker{
+		Storage: storageDriver,
+		Configs: configStore,
+		Objects: exportevents.S3Client{
+			Endpoint:        viper.GetString("export.s3_endpoint"),
+			Region:          viper.GetString("export.s3_region"),
+			AccessKeyID:     viper.GetString("export.s3_access_key_id"),
+			SecretAccessKey: viper.GetString("export.s3_secret_access_key"),
+		},
+		SettleDelay: viper.GetDuration("export.settle_delay"),
+	}
+
+	logg.Info("Starting Hermes export worker")
+	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	go worker.CronJob(nil, viper.GetDuration("export.interval")).Run(ctx)
+
+	handler := httpapi.Compose(api.NewMetricsAPI())
+	must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("export.ListenAddress"), handler))
+}
+
+// runIngest consumes events from RabbitMQ and writes them to the storage, and
+// serves Prometheus metrics in the meantime.
+func runIngest(storageDriver storage.Storage) {
+	writer, ok := storageDriver.(storage.EventWriter)
+	if !ok {
+		logg.Fatal("storage driver %q does not support writing events", viper.GetString("hermes.storage_driver"))
+	}
+	if sealer := configuredSealer(storageDriver); sealer != nil {
+		writer = integrity.SealingWriter{Writer: writer, Sealer: sealer}
+	}
+	rabbitmqURL := viper.GetString("ingest.rabbitmq_url")
+	if rabbitmqURL == "" {
+		logg.Fatal("missing configuration value ingest.rabbitmq_url")
+	}
+
+	consumer := ingest.Consumer{
+		Queue:           viper.GetString("ingest.queue"),
+		DeadLetterQueue: viper.GetString("ingest.dead_letter_queue"),
+		Writer:          writer,
+		BatchSize:       max(viper.GetInt("ingest.batch_size"), 1),
+		FlushInterval:   viper.GetDuration("ingest.flush_interval"),
+		RetryInterval:   viper.GetDuration("ingest.retry_interval"),
+	}
+
+	logg.Info("Starting Hermes ingestion")
+	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	go func() {
+		must.Succeed(consumer.Serve(ctx, rabbitmqURL))
+	}()
+
+	handler := httpapi.Compose(api.NewMetricsAPI())
+	must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("ingest.ListenAddress"), handler))
+}
+
+// runWebhookDispatcher delivers the events of all enabled webhook
+// subscriptions, and serves Prometheus metrics in the meantime.
+func runWebhookDispatcher(storageDriver storage.Storage) {
+	subscriptionStore, ok := storageDriver.(storage.SubscriptionStore)
+	if !ok {
+		logg.Fatal("storage driver %q does not support webhook subscriptions", viper.GetString("hermes.storage_driver"))
+	}
+
+	allowedNetworks, err := webhooks.ParseNetworks(viper.GetStringSlice("webhooks.allowed_networks"))
+	if err != nil {
+		logg.Fatal("invalid webhooks.allowed_networks: %s", err.Error())
+	}
+	addressFilter := webhooks.AddressFilter{AllowedNetworks: allowedNetworks}
+
+	dispatcher := &webhooks.Dispatcher{
+		Storage:              storageDriver,
+		Subscriptions:        subscriptionStore,
+		Client:               webhooks.NewClient(viper.GetDuration("webhooks.timeout"), addressFilter),
+		SyncInterval:         viper.GetDuration("webhooks.sync_interval"),
+		PollInterval:         viper.GetDuration("webhooks.poll_interval"),
+		Lookback:             viper.GetDuration("webhooks.lookback"),
+		MaxAttempts:          viper.GetInt("webhooks.max_attempts"),
+		RetryInterval:        viper.GetDuration("webhooks.retry_interval"),
+		MaxRetryInterval:     viper.GetDuration("webhooks.max_retry_interval"),
+		DeliveryLogRetention: viper.GetDuration("webhooks.delivery_log_retention"),
+	}
+
+	logg.Info("Starting Hermes webhook dispatcher")
+	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	go dispatcher.Run(ctx)
+
+	handler := httpapi.Compose(api.NewMetricsAPI())
+	must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("webhooks.ListenAddress"), handler))
+}
+
+// runIntegrityWorker periodically seals the events of all tenants which were
+// not sealed while being written, e.g. because they were written by Logstash,
+// and serves Prometheus metrics in the meantime.
+func runIntegrityWorker(storageDriver storage.Storage) {
+	requireIngestTime(storageDriver, "the integrity worker")
+	sealer := configuredSealer(storageDriver)
+	if sealer == nil {
+		logg.Fatal("missing environment variable %s", integrity.KeyEnvVar)
+	}
+
+	logg.Info("Starting Hermes integrity worker")
+	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	go sealer.CronJob(nil, viper.GetDuration("integrity.interval")).Run(ctx)
+
+	handler := httpapi.Compose(api.NewMetricsAPI())
+	must.Succeed(httpext.ListenAndServeContext(ctx, viper.GetString("integrity.ListenAddress"), handler))
+}
+
+// runVerify re-reads the events written in a time range, prints all
+// differences to their anchors and exits with status 1 if there are any.
+func runVerify(storageDriver storage.Storage, args []string) {
+	requireIngestTime(storageDriver, "the verification of events")
+	sealer := configuredSealer(storageDriver)
+	if sealer == nil {
+		logg.Fatal("missing environment variable %s", integrity.KeyEnvVar)
+	}
+
+	// the events of the last settle delay might not be sealed yet
+	lastSealed := time.Now().Add(-sealer.SettleDelay).Truncate(time.Second)
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	tenantID := flags.String("tenant", "", "verifies only the events of this project or domain ID")
+	fromStr := flags.String("from", lastSealed.Add(-7*24*time.Hour).Format(time.RFC3339), "start of the time range to verify (RFC 3339 or YYYY-MM-DD)")
+	toStr := flags.String("to", lastSealed.Format(time.RFC3339), "end of the time range to verify, exclusive (RFC 3339 or YYYY-MM-DD)")
+	must.Succeed(flags.Parse(args))
+	from, err := parseVerifyTime(*fromStr)
+	if err != nil {
+		logg.Fatal("invalid value for -from: %s", err.Error())
+	}
+	to, err := parseVerifyTime(*toStr)
+	if err != nil {
+		logg.Fatal("invalid value for -to: %s", err.Error())
+	}
+
+	verifier := integrity.Verifier{Store: sealer.Store, Key: sealer.Key}
+	report, err := verifier.Verify(context.Background(), *tenantID, from, to)
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	for _, finding := range report.Findings {
+		fmt.Println(finding.String())
+	}
+	logg.Info("verified %d events and %d anchors from %s to %s: %d problems found",
+		report.Events, report.Anchors, from.Format(time.RFC3339), to.Format(time.RFC3339), len(report.Findings))
+	if len(report.Findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseVerifyTime parses a time in RFC 3339 format, or a date, which is
+// the start of the day in UTC.
+func parseVerifyTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,258 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package alerts evaluates alerting rules over the audit events with
+// aggregation queries, and keeps track of the alerts that are firing.
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// timeFormat is the format of the time range in the queries of rules.
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+	// maxGroups limits the number of groups, and therefore alerts, per rule.
+	maxGroups = 100
+	// sequenceBuckets is the number of intervals that the window of sequence
+	// rules is split into, for ordering the steps.
+	sequenceBuckets = 60
+)
+
+var (
+	firingAlertsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hermes_alerts_firing",
+		Help: "Number of firing alerts per alerting rule",
+	}, []string{"rule", "severity"})
+	evaluationFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hermes_alert_rule_evaluation_failures",
+		Help: "Number of failed evaluations per alerting rule",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(firingAlertsGauge, evaluationFailuresCounter)
+}
+
+// Alert is a firing alert of a rule. There is one alert per group of events,
+// i.e. per combination of values of the group_by fields of the rule.
+//
+//	The JSON annotations here are for the JSON to be returned by the API
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Severity    string            `json:"severity"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	// Count is the number of matching events in the window (threshold rules only).
+	Count int `json:"count,omitempty"`
+	// ActiveSince is the time of the first evaluation that found the alert.
+	ActiveSince time.Time `json:"active_since"`
+}
+
+// key identifies an alert across evaluations.
+func (a Alert) key() string {
+	var b strings.Builder
+	b.WriteString(a.Rule)
+	for _, name := range slices.Sorted(maps.Keys(a.Labels)) {
+		fmt.Fprintf(&b, "\x00%s=%s", name, a.Labels[name])
+	}
+	return b.String()
+}
+
+// Engine evaluates the rules periodically.
+type Engine struct {
+	Rules      []Rule
+	Aggregator storage.EventAggregator
+	// Interval is how often the rules are evaluated. Each evaluation has to
+	// finish within the interval.
+	Interval time.Duration
+	// TimeNow can be replaced in tests, defaults to time.Now.
+	TimeNow func() time.Time
+
+	mutex  sync.RWMutex
+	alerts map[string]Alert
+}
+
+// Run evaluates the rules every Interval until ctx is done.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		evalCtx, cancel := context.WithTimeout(ctx, e.Interval)
+		err := e.Evaluate(evalCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			logg.Error("could not evaluate alerting rules: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate evaluates all rules once. If a rule cannot be evaluated, its
+// alerts from the previous evaluation are kept.
+func (e *Engine) Evaluate(ctx context.Context) error {
+	now := e.now()
+	var errs []error
+	for _, rule := range e.Rules {
+		alerts, err := e.evaluateRule(ctx, rule, now)
+		if err != nil {
+			evaluationFailuresCounter.WithLabelValues(rule.Name).Inc()
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.Name, err))
+			continue
+		}
+		e.setAlerts(rule, alerts, now)
+	}
+	return errors.Join(errs...)
+}
+
+// Alerts returns the firing alerts, ordered by rule and labels.
+func (e *Engine) Alerts() []Alert {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	keys := slices.Sorted(maps.Keys(e.alerts))
+	result := make([]Alert, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, e.alerts[key])
+	}
+	return result
+}
+
+// setAlerts replaces the alerts of a rule, and keeps the time since when
+// alerts that were already firing are active.
+func (e *Engine) setAlerts(rule Rule, alerts []Alert, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.alerts == nil {
+		e.alerts = make(map[string]Alert)
+	}
+
+	firing := make(map[string]Alert, len(alerts))
+	for _, alert := range alerts {
+		alert.Rule = rule.Name
+		alert.Severity = rule.Severity
+		alert.Description = rule.Description
+		alert.ActiveSince = now
+		key := alert.key()
+		if previous, exists := e.alerts[key]; exists {
+			alert.ActiveSince = previous.ActiveSince
+		}
+		firing[key] = alert
+	}
+	maps.DeleteFunc(e.alerts, func(_ string, alert Alert) bool {
+		return alert.Rule == rule.Name
+	})
+	maps.Copy(e.alerts, firing)
+	firingAlertsGauge.WithLabelValues(rule.Name, rule.Severity).Set(float64(len(firing)))
+}
+
+func (e *Engine) evaluateRule(ctx context.Context, rule Rule, now time.Time) ([]Alert, error) {
+	switch rule.Type {
+	case RuleTypeThreshold:
+		return e.evaluateThreshold(ctx, rule, now)
+	case RuleTypeSequence:
+		return e.evaluateSequence(ctx, rule, now)
+	default:
+		return nil, fmt.Errorf("unknown rule type %q", rule.Type)
+	}
+}
+
+// windowFilter returns the filter for the events of the window before now.
+func windowFilter(filter storage.SubscriptionFilter, window Duration, now time.Time) *hermes.EventFilter {
+	result := hermes.SubscriptionEventFilter(filter)
+	result.Time = map[string]string{
+		"gte": now.Add(-time.Duration(window)).Format(timeFormat),
+		"lt":  now.Format(timeFormat),
+	}
+	return result
+}
+
+func (e *Engine) evaluateThreshold(ctx context.Context, rule Rule, now time.Time) ([]Alert, error) {
+	filter := windowFilter(rule.Filter, rule.Window, now)
+	if len(rule.GroupBy) == 0 {
+		// a histogram with a single interval counts all matching events
+		histogram, err := hermes.GetHistogram(ctx, filter, rule.TenantID, time.Duration(rule.Window), "", 0, e.Aggregator)
+		if err != nil {
+			return nil, err
+		}
+		if histogram.Total <= rule.Threshold {
+			return nil, nil
+		}
+		return []Alert{{Labels: map[string]string{}, Count: histogram.Total}}, nil
+	}
+
+	stats, err := hermes.GetStats(ctx, filter, rule.TenantID, rule.GroupBy, maxGroups, e.Aggregator)
+	if err != nil {
+		return nil, err
+	}
+	var alerts []Alert
+	for _, bucket := range stats.Buckets {
+		// buckets are ordered by their count
+		if bucket.Count <= rule.Threshold {
+			break
+		}
+		alerts = append(alerts, Alert{Labels: bucket.Key, Count: bucket.Count})
+	}
+	return alerts, nil
+}
+
+// evaluateSequence splits the window into intervals, and finds out in which
+// of them the events of each step happened for each value of the group_by
+// field. The steps are in order if each one happened in the same or a later
+// interval than the previous one.
+func (e *Engine) evaluateSequence(ctx context.Context, rule Rule, now time.Time) ([]Alert, error) {
+	field := rule.GroupBy[0]
+	interval := max(time.Duration(rule.Window)/sequenceBuckets, time.Minute).Truncate(time.Minute)
+
+	// for each value, the start of the first interval in which the sequence
+	// got to the current step
+	var reached map[string]time.Time
+	for idx, step := range rule.Steps {
+		histogram, err := hermes.GetHistogram(ctx, windowFilter(step, rule.Window, now), rule.TenantID, interval, field, maxGroups, e.Aggregator)
+		if err != nil {
+			return nil, err
+		}
+		next := make(map[string]time.Time)
+		for _, bucket := range histogram.Buckets {
+			for value := range bucket.Split {
+				if _, exists := next[value]; exists {
+					continue
+				}
+				previous, exists := reached[value]
+				if idx == 0 || (exists && !bucket.Time.Before(previous)) {
+					next[value] = bucket.Time
+				}
+			}
+		}
+		reached = next
+	}
+
+	var alerts []Alert
+	for _, value := range slices.Sorted(maps.Keys(reached)) {
+		alerts = append(alerts, Alert{Labels: map[string]string{field: value}})
+	}
+	return alerts, nil
+}
+
+func (e *Engine) now() time.Time {
+	if e.TimeNow != nil {
+		return e.TimeNow().UTC()
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package alerts
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// aggregator counts its events like a real storage for the queries of the
+// engine, which only filter by action, outcome and time.
+type aggregator struct {
+	events []*cadf.Event
+	fail   bool
+}
+
+func (a *aggregator) add(eventTime, initiatorID, action, outcome string) {
+	a.events = append(a.events, &cadf.Event{
+		EventTime: eventTime,
+		Action:    cadf.Action(action),
+		Outcome:   cadf.Outcome(outcome),
+		Initiator: cadf.Resource{ID: initiatorID},
+	})
+}
+
+func (a *aggregator) matching(filter *storage.EventFilter) ([]*cadf.Event, error) {
+	if a.fail {
+		return nil, errors.New("storage unavailable")
+	}
+	from, err := time.Parse(time.RFC3339Nano, filter.Time["gte"])
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse(time.RFC3339Nano, filter.Time["lt"])
+	if err != nil {
+		return nil, err
+	}
+	var events []*cadf.Event
+	for _, event := range a.events {
+		eventTime := must(time.Parse(time.RFC3339Nano, event.EventTime))
+		if eventTime.Before(from) || !eventTime.Before(to) ||
+			(filter.Action != "" && string(event.Action) != filter.Action) ||
+			(filter.Outcome != "" && string(event.Outcome) != filter.Outcome) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func fieldValue(event *cadf.Event, field string) string {
+	switch field {
+	case "initiator_id":
+		return event.Initiator.ID
+	case "action":
+		return string(event.Action)
+	default:
+		return ""
+	}
+}
+
+func (a *aggregator) CountEvents(ctx context.Context, filter *storage.EventFilter, tenantID string, groupBy []string, limit uint) (*storage.EventCounts, error) {
+	events, err := a.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	result := storage.EventCounts{Total: len(events)}
+	counts := make(map[string]int)
+	for _, event := range events {
+		var values []string
+		for _, field := range groupBy {
+			values = append(values, fieldValue(event, field))
+		}
+		counts[strings.Join(values, "\x00")]++
+	}
+	for key, count := range counts {
+		result.Groups = append(result.Groups, storage.EventGroup{Values: strings.Split(key, "\x00"), Count: count})
+	}
+	slices.SortFunc(result.Groups, func(a, b storage.EventGroup) int { return b.Count - a.Count })
+	result.Groups = result.Groups[:min(uint(len(result.Groups)), limit)]
+	return &result, nil
+}
+
+func (a *aggregator) HistogramEvents(ctx context.Context, filter *storage.EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*storage.EventHistogram, error) {
+	events, err := a.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	result := storage.EventHistogram{Total: len(events)}
+	for _, event := range events {
+		start := must(time.Parse(time.RFC3339Nano, event.EventTime)).UTC().Truncate(interval)
+		idx := slices.IndexFunc(result.Buckets, func(b storage.HistogramBucket) bool { return b.Start.Equal(start) })
+		if idx == -1 {
+			result.Buckets = append(result.Buckets, storage.HistogramBucket{Start: start})
+			idx = len(result.Buckets) - 1
+		}
+		result.Buckets[idx].Count++
+		if splitBy != "" {
+			result.Buckets[idx].Groups = append(result.Buckets[idx].Groups, storage.EventGroup{Values: []string{fieldValue(event, splitBy)}, Count: 1})
+		}
+	}
+	slices.SortFunc(result.Buckets, func(a, b storage.HistogramBucket) int { return a.Start.Compare(b.Start) })
+	return &result, nil
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+func Test_Engine_Threshold(t *testing.T) {
+	store := &aggregator{}
+	store.add("2024-05-01T11:50:00Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:56:00Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:57:00Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:58:00Z", "alice", "authenticate", "success")
+	store.add("2024-05-01T11:59:00Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:56:00Z", "bob", "authenticate", "failure")
+	store.add("2024-05-01T11:57:00Z", "bob", "authenticate", "failure")
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	engine := &Engine{
+		Rules: []Rule{{
+			Name:      "failed_authentications",
+			Severity:  "critical",
+			Type:      RuleTypeThreshold,
+			Filter:    storage.SubscriptionFilter{Action: "authenticate", Outcome: "failure"},
+			GroupBy:   []string{"initiator_id"},
+			Window:    Duration(5 * time.Minute),
+			Threshold: 2,
+		}, {
+			Name:      "authentications",
+			Severity:  "info",
+			Type:      RuleTypeThreshold,
+			Filter:    storage.SubscriptionFilter{Action: "authenticate"},
+			Window:    Duration(5 * time.Minute),
+			Threshold: 5,
+		}},
+		Aggregator: store,
+		TimeNow:    func() time.Time { return now },
+	}
+
+	require.Nil(t, engine.Evaluate(context.Background()))
+	assert.Equal(t, []Alert{
+		{Rule: "authentications", Severity: "info", Labels: map[string]string{}, Count: 6, ActiveSince: now},
+		{Rule: "failed_authentications", Severity: "critical", Labels: map[string]string{"initiator_id": "alice"}, Count: 3, ActiveSince: now},
+	}, engine.Alerts())
+
+	// alerts that keep firing keep the time since when they are active
+	firstEvaluation := now
+	now = now.Add(time.Minute)
+	store.add("2024-05-01T12:00:30Z", "alice", "authenticate", "failure")
+	require.Nil(t, engine.Evaluate(context.Background()))
+	assert.Equal(t, []Alert{
+		{Rule: "authentications", Severity: "info", Labels: map[string]string{}, Count: 7, ActiveSince: firstEvaluation},
+		{Rule: "failed_authentications", Severity: "critical", Labels: map[string]string{"initiator_id": "alice"}, Count: 4, ActiveSince: firstEvaluation},
+	}, engine.Alerts())
+
+	// alerts are kept while the rule cannot be evaluated
+	store.fail = true
+	assert.NotNil(t, engine.Evaluate(context.Background()))
+	assert.Len(t, engine.Alerts(), 2)
+
+	store.fail = false
+	now = now.Add(time.Hour)
+	require.Nil(t, engine.Evaluate(context.Background()))
+	assert.Empty(t, engine.Alerts())
+}
+
+func Test_Engine_Sequence(t *testing.T) {
+	store := &aggregator{}
+	// alice: failures followed by a success
+	store.add("2024-05-01T11:51:00Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:52:10Z", "alice", "authenticate", "failure")
+	store.add("2024-05-01T11:53:00Z", "alice", "authenticate", "success")
+	// bob: a success followed by a failure
+	store.add("2024-05-01T11:52:00Z", "bob", "authenticate", "success")
+	store.add("2024-05-01T11:55:00Z", "bob", "authenticate", "failure")
+	// carol: only failures
+	store.add("2024-05-01T11:55:00Z", "carol", "authenticate", "failure")
+	// dave: the failure is outside of the window
+	store.add("2024-05-01T11:40:00Z", "dave", "authenticate", "failure")
+	store.add("2024-05-01T11:55:00Z", "dave", "authenticate", "success")
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	engine := &Engine{
+		Rules: []Rule{{
+			Name:     "guessed_password",
+			Severity: "warning",
+			Type:     RuleTypeSequence,
+			Steps: []storage.SubscriptionFilter{
+				{Action: "authenticate", Outcome: "failure"},
+				{Action: "authenticate", Outcome: "success"},
+			},
+			GroupBy: []string{"initiator_id"},
+			Window:  Duration(10 * time.Minute),
+		}},
+		Aggregator: store,
+		TimeNow:    func() time.Time { return now },
+	}
+
+	require.Nil(t, engine.Evaluate(context.Background()))
+	assert.Equal(t, []Alert{
+		{Rule: "guessed_password", Severity: "warning", Labels: map[string]string{"initiator_id": "alice"}, ActiveSince: now},
+	}, engine.Alerts())
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/query"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// Rule types.
+const (
+	// RuleTypeThreshold fires for each group of events matching the filter
+	// within the window if there are more than Threshold of them.
+	RuleTypeThreshold = "threshold"
+	// RuleTypeSequence fires for each value of the group_by field for which
+	// events matching each of the steps happened in this order within the
+	// window.
+	RuleTypeSequence = "sequence"
+)
+
+const (
+	// maxWindow limits the time range that a rule looks at.
+	maxWindow = 7 * 24 * time.Hour
+	// maxGroupBy limits the number of group_by fields of threshold rules.
+	maxGroupBy = 4
+	// maxSequenceSteps limits the number of steps of sequence rules.
+	maxSequenceSteps = 5
+	// defaultSeverity is the severity of rules that do not have one.
+	defaultSeverity = "warning"
+)
+
+// ruleNameRx matches valid rule names, which are also used as metric labels.
+var ruleNameRx = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// RuleFile is the format of the rules file.
+type RuleFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule is an alerting rule. Filters have the same format as the filters of
+// webhook subscriptions, i.e. the filter parameters of ListEvents.
+type Rule struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Type        string `json:"type"`
+	// TenantID restricts the rule to the events of a project or domain. If it
+	// is empty, the events of all tenants are evaluated.
+	TenantID  string                       `json:"tenant_id,omitempty"`
+	Filter    storage.SubscriptionFilter   `json:"filter"`
+	Steps     []storage.SubscriptionFilter `json:"steps,omitempty"`
+	GroupBy   []string                     `json:"group_by,omitempty"`
+	Window    Duration                     `json:"window"`
+	Threshold int                          `json:"threshold,omitempty"`
+}
+
+// Duration is a time.Duration that is written like "5m" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// LoadRules reads and validates the rules file at path.
+func LoadRules(path string) ([]Rule, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	var file RuleFile
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	var errs []error
+	names := make(map[string]bool, len(file.Rules))
+	for idx := range file.Rules {
+		rule := &file.Rules[idx]
+		if rule.Severity == "" {
+			rule.Severity = defaultSeverity
+		}
+		err := rule.Validate()
+		if err == nil && names[rule.Name] {
+			err = errors.New("the name is used by another rule")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid rule %q in %s: %w", rule.Name, path, err))
+		}
+		names[rule.Name] = true
+	}
+	return file.Rules, errors.Join(errs...)
+}
+
+// Validate checks that the rule can be evaluated.
+func (r Rule) Validate() error {
+	if !ruleNameRx.MatchString(r.Name) {
+		return errors.New("the name must consist of letters, digits and underscores")
+	}
+	if r.Window <= 0 || time.Duration(r.Window) > maxWindow {
+		return fmt.Errorf("the window must be between 0 and %s", maxWindow)
+	}
+	for _, field := range r.GroupBy {
+		if !slices.Contains(hermes.StatsFields, field) {
+			return fmt.Errorf("cannot group by %s", field)
+		}
+	}
+
+	switch r.Type {
+	case RuleTypeThreshold:
+		switch {
+		case r.Threshold < 0:
+			return errors.New("the threshold cannot be negative")
+		case len(r.Steps) > 0:
+			return errors.New("threshold rules have no steps")
+		case len(r.GroupBy) > maxGroupBy:
+			return fmt.Errorf("cannot group by more than %d fields", maxGroupBy)
+		}
+		return validateFilter(r.Filter)
+	case RuleTypeSequence:
+		switch {
+		case len(r.Steps) < 2 || len(r.Steps) > maxSequenceSteps:
+			return fmt.Errorf("sequence rules must have 2 to %d steps", maxSequenceSteps)
+		case len(r.GroupBy) != 1:
+			return errors.New("sequence rules must group by exactly one field")
+		case r.Threshold != 0:
+			return errors.New("sequence rules have no threshold")
+		case r.Filter != storage.SubscriptionFilter{}:
+			return errors.New("sequence rules have a filter per step")
+		}
+		for idx, step := range r.Steps {
+			err := validateFilter(step)
+			if err != nil {
+				return fmt.Errorf("step %d: %w", idx+1, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("the type must be %s or %s", RuleTypeThreshold, RuleTypeSequence)
+	}
+}
+
+func validateFilter(filter storage.SubscriptionFilter) error {
+	if filter.Search == "" {
+		return nil
+	}
+	_, err := query.Parse(filter.Search)
+	if err != nil {
+		return fmt.Errorf("invalid search: %w", err)
+	}
+	return nil
+}
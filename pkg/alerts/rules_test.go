@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package alerts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func Test_LoadRules(t *testing.T) {
+	path := writeRules(t, `{"rules": [
+		{
+			"name": "failed_authentications",
+			"description": "Many failed logins of one user",
+			"type": "threshold",
+			"filter": {"action": "authenticate", "outcome": "failure"},
+			"group_by": ["initiator_id"],
+			"window": "5m",
+			"threshold": 20
+		},
+		{
+			"name": "role_granted_and_user_deleted",
+			"severity": "critical",
+			"type": "sequence",
+			"steps": [
+				{"action": "update/add", "target_type": "data/security/project"},
+				{"action": "delete", "target_type": "service/security/account/user"}
+			],
+			"group_by": ["initiator_id"],
+			"window": "1h"
+		}
+	]}`)
+	rules, err := LoadRules(path)
+	require.Nil(t, err)
+	assert.Equal(t, []Rule{{
+		Name:        "failed_authentications",
+		Description: "Many failed logins of one user",
+		Severity:    "warning",
+		Type:        RuleTypeThreshold,
+		Filter:      storage.SubscriptionFilter{Action: "authenticate", Outcome: "failure"},
+		GroupBy:     []string{"initiator_id"},
+		Window:      Duration(5 * time.Minute),
+		Threshold:   20,
+	}, {
+		Name:     "role_granted_and_user_deleted",
+		Severity: "critical",
+		Type:     RuleTypeSequence,
+		Steps: []storage.SubscriptionFilter{
+			{Action: "update/add", TargetType: "data/security/project"},
+			{Action: "delete", TargetType: "service/security/account/user"},
+		},
+		GroupBy: []string{"initiator_id"},
+		Window:  Duration(time.Hour),
+	}}, rules)
+}
+
+func Test_LoadRules_Invalid(t *testing.T) {
+	testCases := map[string]string{
+		"UnknownField":     `{"name": "a", "type": "threshold", "window": "5m", "limit": 5}`,
+		"UnknownFilter":    `{"name": "a", "type": "threshold", "window": "5m", "filter": {"project_id": "p"}}`,
+		"InvalidName":      `{"name": "failed logins", "type": "threshold", "window": "5m"}`,
+		"InvalidType":      `{"name": "a", "type": "anomaly", "window": "5m"}`,
+		"InvalidWindow":    `{"name": "a", "type": "threshold", "window": "5 minutes"}`,
+		"MissingWindow":    `{"name": "a", "type": "threshold"}`,
+		"LongWindow":       `{"name": "a", "type": "threshold", "window": "720h"}`,
+		"NegativeLimit":    `{"name": "a", "type": "threshold", "window": "5m", "threshold": -1}`,
+		"InvalidGroupBy":   `{"name": "a", "type": "threshold", "window": "5m", "group_by": ["time"]}`,
+		"InvalidSearch":    `{"name": "a", "type": "threshold", "window": "5m", "filter": {"search": "action:"}}`,
+		"ThresholdSteps":   `{"name": "a", "type": "threshold", "window": "5m", "steps": [{}, {}]}`,
+		"SingleStep":       `{"name": "a", "type": "sequence", "window": "5m", "group_by": ["initiator_id"], "steps": [{}]}`,
+		"SequenceGroupBy":  `{"name": "a", "type": "sequence", "window": "5m", "steps": [{}, {}]}`,
+		"SequenceFilter":   `{"name": "a", "type": "sequence", "window": "5m", "group_by": ["initiator_id"], "steps": [{}, {}], "filter": {"action": "delete"}}`,
+		"DuplicateName":    `{"name": "a", "type": "threshold", "window": "5m"}, {"name": "a", "type": "threshold", "window": "1m"}`,
+		"SequenceInSearch": `{"name": "a", "type": "sequence", "window": "5m", "group_by": ["initiator_id"], "steps": [{}, {"search": "("}]}`,
+	}
+	for name, rules := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadRules(writeRules(t, `{"rules": [`+rules+`]}`))
+			assert.NotNil(t, err)
+		})
+	}
+
+	_, err := LoadRules(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/gopherpolicy"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// maxProjectIDs limits the number of projects that a cluster viewer can
+	// read the events of in a single request.
+	maxProjectIDs = 100
+	// accessWriteTimeout limits how long the records of a tenant access may
+	// take to be written after the request was answered.
+	accessWriteTimeout = 30 * time.Second
+)
+
+// parseProjectIDs parses the comma-separated list of projects (or domains) in
+// the project_id parameter. The result is nil for "all".
+func parseProjectIDs(value string) ([]string, error) {
+	if value == "all" {
+		return nil, nil
+	}
+	var projectIDs []string
+	for projectID := range strings.SplitSeq(value, ",") {
+		projectID = strings.TrimSpace(projectID)
+		switch {
+		case projectID == "":
+			return nil, errors.New("invalid project_id: project ID cannot be empty")
+		case projectID == "all":
+			return nil, errors.New("invalid project_id: all cannot be combined with other project IDs")
+		case !slices.Contains(projectIDs, projectID):
+			projectIDs = append(projectIDs, projectID)
+		}
+	}
+	if len(projectIDs) > maxProjectIDs {
+		return nil, fmt.Errorf("invalid project_id: too many project IDs (maximum is %d)", maxProjectIDs)
+	}
+	return projectIDs, nil
+}
+
+// tenantAccessObserver is the observer of the events recording that a
+// cluster viewer read the events of other tenants.
+var tenantAccessObserver = cadf.Resource{
+	TypeURI: "service/audit",
+	Name:    "hermes",
+}
+
+// auditEventsTarget is the target of the events recording that a cluster
+// viewer read the events of other tenants.
+type auditEventsTarget struct {
+	tenantID string // "all" for all tenants
+}
+
+// Render implements the audittools.Target interface.
+func (t auditEventsTarget) Render() cadf.Resource {
+	return cadf.Resource{
+		TypeURI: "data/audit/events",
+		ID:      t.tenantID,
+	}
+}
+
+// recordTenantAccess records that a cluster viewer reads the events of other
+// tenants (all of them, if tenantIDs is empty). The access is logged, and
+// stored as an event in each of these tenants, so that their users can see
+// who read their events. An access to all tenants is stored in the tenant of
+// the cluster viewer instead. Following pages of a cursor are not recorded
+// again. The events are stored in the background, so that they do not delay
+// the response, and a failure to store them is only logged, since it must not
+// keep cloud admins from investigating.
+func (p *v1Provider) recordTenantAccess(token *gopherpolicy.Token, req *http.Request, tenantIDs []string) {
+	if len(tenantIDs) == 1 && tenantIDs[0] == token.ProjectScopeUUID() {
+		return
+	}
+	if req.FormValue("cursor") != "" {
+		return
+	}
+	description := "all tenants"
+	if len(tenantIDs) > 0 {
+		description = "tenants " + strings.Join(tenantIDs, ",")
+	}
+	logg.Info("cluster viewer %s (%s@%s) reads the events of %s with %s %s",
+		token.UserUUID(), token.UserName(), token.UserDomainName(), description, req.Method, req.URL.Path)
+
+	writer, ok := p.storage.(storage.EventWriter)
+	if !ok {
+		return
+	}
+	newEvent := func(tenantID string) cadf.Event {
+		return audittools.Event{
+			Time:       time.Now(),
+			Request:    req,
+			User:       token,
+			ReasonCode: http.StatusOK,
+			Action:     cadf.ReadAction,
+			Target:     auditEventsTarget{tenantID},
+		}.ToCADF(tenantAccessObserver)
+	}
+
+	var events []storage.TenantEvent
+	if len(tenantIDs) == 0 {
+		event := newEvent("all")
+		tenantID, err := hermes.EventTenantID(&event)
+		if err != nil {
+			logg.Error("cannot record access to the events of all tenants: %s", err.Error())
+			return
+		}
+		events = append(events, storage.TenantEvent{TenantID: tenantID, Event: &event})
+	}
+	for _, tenantID := range tenantIDs {
+		event := newEvent(tenantID)
+		events = append(events, storage.TenantEvent{TenantID: tenantID, Event: &event})
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), accessWriteTimeout)
+	p.accessWrites.Add(1)
+	go func() {
+		defer p.accessWrites.Done()
+		defer cancel()
+		writeErrors, err := writer.WriteEvents(ctx, events)
+		if err == nil {
+			err = errors.Join(writeErrors...)
+		}
+		if err != nil {
+			logg.Error("cannot record access to the events of %s: %s", description, err.Error())
+			storageErrorsCounter.Add(1)
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/sapcc/hermes/pkg/alerts"
+)
+
+// AlertList is the model for JSON returned by the ListAlerts API call
+type AlertList struct {
+	Alerts []alerts.Alert `json:"alerts"`
+}
+
+// ListAlerts handles GET /v1/alerts.
+func (p *v1Provider) ListAlerts(res http.ResponseWriter, req *http.Request) {
+	_, ok := p.AuthHandler(res, req, "alert:list")
+	if !ok {
+		return
+	}
+
+	// alerts can be filtered by rule and severity
+	ruleName := req.FormValue("rule")
+	severity := req.FormValue("severity")
+	result := AlertList{Alerts: []alerts.Alert{}}
+	if p.alerts != nil {
+		for _, alert := range p.alerts.Alerts() {
+			if (ruleName == "" || alert.Rule == ruleName) && (severity == "" || alert.Severity == severity) {
+				result.Alerts = append(result.Alerts, alert)
+			}
+		}
+	}
+	ReturnESJSON(res, http.StatusOK, result)
+}
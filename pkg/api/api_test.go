@@ -4,24 +4,55 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	policy "github.com/databus23/goslo.policy"
+	"github.com/gorilla/mux"
+	elastic "github.com/olivere/elastic/v7"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/gopherpolicy"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/mock"
 
+	"github.com/sapcc/hermes/pkg/alerts"
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/integrity"
 	"github.com/sapcc/hermes/pkg/storage"
 	"github.com/sapcc/hermes/pkg/test"
 )
 
 func setupTest(t *testing.T) http.Handler {
+	return setupTestWithStorage(t, storage.Mock{})
+}
+
+func setupTestWithStorage(t *testing.T, storageInterface storage.Storage) http.Handler {
+	return setupTestWithAuth(t, storageInterface, nil)
+}
+
+// setupTestWithAuth is like setupTestWithStorage, with the given auth
+// parameters in all tokens, e.g. the project_id of project-scoped tokens.
+func setupTestWithAuth(t *testing.T, storageInterface storage.Storage, auth map[string]string) http.Handler {
+	return setupRouter(t, storageInterface, auth, nil, nil)
+}
+
+func setupRouter(t *testing.T, storageInterface storage.Storage, auth map[string]string, alertEngine *alerts.Engine, sealer *integrity.Sealer) http.Handler {
 	// load test policy (where everything is allowed)
 	policyBytes, err := os.ReadFile("../test/policy.json")
 	if err != nil {
@@ -39,13 +70,12 @@ func setupTest(t *testing.T) http.Handler {
 	viper.Set("hermes.PolicyEnforcer", policyEnforcer)
 
 	// create test driver with the domains and projects from start-data.sql
-	validator := mock.NewValidator(mock.NewEnforcer(), nil)
-	storageInterface := storage.Mock{}
+	validator := mock.NewValidator(mock.NewEnforcer(), auth)
 
 	prometheus.DefaultRegisterer = prometheus.NewPedanticRegistry()
 
 	// Create API compositions using httpapi
-	v1API := NewV1API(validator, storageInterface)
+	v1API := NewV1API(validator, storageInterface, identity.MockProjectLister{}, alertEngine, sealer)
 	versionAPI := NewVersionAPI(v1API.VersionData())
 	metricsAPI := NewMetricsAPI()
 
@@ -54,6 +84,7 @@ func setupTest(t *testing.T) http.Handler {
 		v1API,
 		versionAPI,
 		metricsAPI,
+		httpapi.WithGlobalMiddleware(WithRequestID),
 	)
 
 	return router
@@ -71,7 +102,37 @@ func Test_API(t *testing.T) {
 		{"EventDetails", "GET", "/v1/events/7be6c4ff-b761-5f1f-b234-f5d41616c2cd", http.StatusOK, "fixtures/event-details.json"},
 		{"EventList", "GET", "/v1/events?event_type=identity.project.deleted&offset=10", http.StatusOK, "fixtures/event-list.json"},
 		{"Attributes", "GET", "/v1/attributes/resource_type", http.StatusOK, "fixtures/attributes.json"},
+		{"Search", "GET", "/v1/events?search=action:create+AND+NOT+outcome:failure&offset=10", http.StatusOK, ""},
+		{"InvalidSearchField", "GET", "/v1/events?search=password:secret", http.StatusBadRequest, ""},
+		{"InvalidSearchSyntax", "GET", "/v1/events?search=(action:create", http.StatusBadRequest, ""},
+		{"InvalidSearchWildcard", "GET", "/v1/events?search=action:*create", http.StatusBadRequest, ""},
+		{"RelativeTime", "GET", "/v1/events?time=gte:now-7d/d,lt:now/d&offset=10", http.StatusOK, ""},
+		{"DateOnlyTime", "GET", "/v1/events?time=gte:2017-11-01,lt:2017-12-01&offset=10", http.StatusOK, ""},
+		{"InvalidRelativeTime", "GET", "/v1/events?time=gte:now-7x", http.StatusBadRequest, ""},
+		{"EventListFields", "GET", "/v1/events?fields=id,eventTime,action,initiator.name&offset=10", http.StatusOK, "fixtures/event-list-fields.json"},
+		{"EventDetailsFields", "GET", "/v1/events/7be6c4ff-b761-5f1f-b234-f5d41616c2cd?fields=id,target.typeURI,attachments", http.StatusOK, "fixtures/event-details-fields.json"},
+		{"InvalidFields", "GET", "/v1/events?fields=id,password", http.StatusBadRequest, ""},
+		{"EventListFullDetails", "GET", "/v1/events?details=full&target_name=admin&initiator_address=10.0.*&tag=prod&offset=10", http.StatusOK, ""},
+		{"DomainScope", "GET", "/v1/events?scope=domain&domain_id=2ec4f3e2a1ce4e5a9bd3d9b7b1a2c3d4&offset=10", http.StatusOK, ""},
+		{"InvalidScope", "GET", "/v1/events?scope=cluster", http.StatusBadRequest, ""},
+		{"EventListProjects", "GET", "/v1/events?project_id=b3b70c8271a845709f9a03030e705da7,ba8304b657fb4568addf7116f41b4a16&offset=10", http.StatusOK, "fixtures/event-list-projects.json"},
+		{"InvalidProjectList", "GET", "/v1/events?project_id=all,b3b70c8271a845709f9a03030e705da7", http.StatusBadRequest, ""},
 		{"InvalidEventID", "GET", "/v1/events/invalid-uuid", http.StatusBadRequest, ""},
+		{"ExportJSON", "GET", "/v1/events/export?format=json", http.StatusOK, "fixtures/event-export.json"},
+		{"ExportInvalidFormat", "GET", "/v1/events/export?format=xml", http.StatusBadRequest, ""},
+		{"StreamInvalidTime", "GET", "/v1/events/stream?time=gte:now-1h", http.StatusBadRequest, ""},
+		{"StreamInvalidLastEventID", "GET", "/v1/events/stream?last_event_id=7be6c4ff-b761-5f1f-b234-f5d41616c2cd", http.StatusBadRequest, ""},
+		{"Stats", "GET", "/v1/stats?group_by=initiator_name,outcome", http.StatusOK, "fixtures/stats.json"},
+		{"StatsLimit", "GET", "/v1/stats?group_by=target_id&limit=2", http.StatusOK, "fixtures/stats-limit.json"},
+		{"Histogram", "GET", "/v1/events/histogram?interval=1d&split_by=target_type", http.StatusOK, "fixtures/histogram.json"},
+		{"HistogramInvalidInterval", "GET", "/v1/events/histogram?interval=1y", http.StatusBadRequest, ""},
+		{"HistogramIntervalTooLong", "GET", "/v1/events/histogram?interval=200000d", http.StatusBadRequest, ""},
+		{"HistogramInvalidSplitBy", "GET", "/v1/events/histogram?split_by=time", http.StatusBadRequest, ""},
+		{"HistogramTooManyIntervals", "GET", "/v1/events/histogram?interval=1m&time=gte:2017-01-01T00:00:00,lt:2018-01-01T00:00:00", http.StatusBadRequest, ""},
+		{"StatsMissingGroupBy", "GET", "/v1/stats", http.StatusBadRequest, ""},
+		{"StatsInvalidGroupBy", "GET", "/v1/stats?group_by=time", http.StatusBadRequest, ""},
+		{"StatsDuplicateGroupBy", "GET", "/v1/stats?group_by=action,action", http.StatusBadRequest, ""},
+		{"StatsInvalidLimit", "GET", "/v1/stats?group_by=action&limit=0", http.StatusBadRequest, ""},
 	}
 
 	for _, tc := range tt {
@@ -88,6 +149,770 @@ func Test_API(t *testing.T) {
 	}
 }
 
+// blockingStorage blocks all queries until their context is done.
+type blockingStorage struct {
+	storage.Mock
+}
+
+func (blockingStorage) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingStorage) CountEvents(ctx context.Context, filter *storage.EventFilter, tenantID string, groupBy []string, limit uint) (*storage.EventCounts, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func Test_QueryTimeout(t *testing.T) {
+	viper.Set("API.query_timeout", "10ms")
+	viper.Set("API.query_timeouts.ListEvents", "0")
+	t.Cleanup(func() {
+		viper.Set("API.query_timeout", nil)
+		viper.Set("API.query_timeouts.ListEvents", nil)
+	})
+
+	// without a timeout, only the shutdown of the server ends the query
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	router := CancelOnShutdown(shutdownCtx)(setupTestWithStorage(t, blockingStorage{}))
+
+	tt := []struct {
+		name       string
+		path       string
+		shutdown   bool
+		statuscode int
+	}{
+		{"Timeout", "/v1/stats?group_by=action", false, http.StatusGatewayTimeout},
+		{"Shutdown", "/v1/events", true, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.shutdown {
+				time.AfterFunc(10*time.Millisecond, shutdown)
+			}
+			test.APIRequest{
+				Method:           "GET",
+				Path:             tc.path,
+				ExpectStatusCode: tc.statuscode,
+			}.Check(t, router)
+		})
+	}
+}
+
+// failingStorage fails all queries for events with the given error.
+type failingStorage struct {
+	storage.Mock
+	err error
+}
+
+func (s failingStorage) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	return nil, s.err
+}
+
+// plainStorage hides the optional interfaces of a storage.
+type plainStorage struct {
+	storage.Storage
+}
+
+func Test_ErrorResponses(t *testing.T) {
+	tt := []struct {
+		name       string
+		path       string
+		eventStore storage.Storage
+		statuscode int
+		expected   string
+	}{
+		{"InvalidParameter", "/v1/events?limit=x", storage.Mock{}, http.StatusBadRequest,
+			`{"error":{"type":"bad_data","message":"Invalid limit value","request_id":"req-test"}}`},
+		{"NotSupported", "/v1/events/histogram", plainStorage{storage.Mock{}}, http.StatusNotImplemented,
+			`{"error":{"type":"not_supported","message":"histograms are not supported by this storage driver","request_id":"req-test"}}`},
+		{"StorageRejectsQuery", "/v1/events", failingStorage{err: &elastic.Error{Status: http.StatusBadRequest}}, http.StatusBadRequest,
+			`{"error":{"type":"bad_data","message":"elastic: Error 400 (Bad Request)","request_id":"req-test"}}`},
+		{"StorageFailure", "/v1/events", failingStorage{err: &elastic.Error{Status: http.StatusInternalServerError}}, http.StatusBadGateway,
+			`{"error":{"type":"execution","message":"elastic: Error 500 (Internal Server Error)","request_id":"req-test"}}`},
+		{"StorageUnavailable", "/v1/events", failingStorage{err: elastic.ErrNoClient}, http.StatusServiceUnavailable,
+			`{"error":{"type":"unavailable","message":"no Elasticsearch node available","request_id":"req-test"}}`},
+		{"InternalError", "/v1/events", failingStorage{err: errors.New("boom")}, http.StatusInternalServerError,
+			`{"error":{"type":"internal","message":"boom","request_id":"req-test"}}`},
+		{"StreamStorageFailure", "/v1/events/stream", failingStorage{err: &elastic.Error{Status: http.StatusInternalServerError}}, http.StatusBadGateway,
+			`{"error":{"type":"execution","message":"elastic: Error 500 (Internal Server Error)","request_id":"req-test"}}`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expected := tc.expected + "\n"
+			test.APIRequest{
+				Method:           "GET",
+				Path:             tc.path,
+				RequestHeaders:   map[string]string{"X-Request-Id": "req-test"},
+				ExpectStatusCode: tc.statuscode,
+				ExpectBody:       &expected,
+			}.Check(t, setupTestWithStorage(t, tc.eventStore))
+		})
+	}
+}
+
+func Test_RequestID(t *testing.T) {
+	router := setupTest(t)
+
+	for _, requestID := range []string{"", "invalid request ID"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/", http.NoBody)
+		req.Header.Set("X-Request-Id", requestID)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Regexp(t, "^req-[0-9a-f-]{36}$", res.Header().Get("X-Request-Id"))
+	}
+}
+
+func Test_ExportEvents(t *testing.T) {
+	tt := []struct {
+		name string
+		path string
+		file string
+	}{
+		{"NDJSON", "/v1/events/export", "fixtures/event-export.ndjson"},
+		{"CSV", "/v1/events/export?format=csv&outcome=success", "fixtures/event-export.csv"},
+	}
+
+	router := setupTest(t)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			test.APIRequest{
+				Method:           "GET",
+				Path:             tc.path,
+				ExpectStatusCode: http.StatusOK,
+				ExpectFile:       tc.file,
+			}.Check(t, router)
+		})
+	}
+
+	// the file name does not depend on the requested tenants
+	for _, query := range []string{"format=csv", "format=csv&project_id=all"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/events/export?"+query, http.NoBody)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, `attachment; filename="events.csv"`, res.Header().Get("Content-Disposition"), query)
+	}
+}
+
+func Test_CSVWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newCSVWriter(&buf)
+	event := &cadf.Event{ID: "1", Action: "update", Outcome: "success"}
+	event.Initiator.Name = `=HYPERLINK("https://example.com")`
+	event.Target.Name = "+1"
+	event.Observer.Name = "@SUM(A1)"
+	event.Reason.ReasonType = "-2"
+	event.Reason.ReasonCode = "\tcode"
+	event.Target.ID = "a-b"
+	require.NoError(t, writer.WriteEvent(event))
+	require.NoError(t, writer.Close())
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	row := make(map[string]string)
+	for idx, column := range csvColumns {
+		row[column] = rows[1][idx]
+	}
+	assert.Equal(t, `'=HYPERLINK("https://example.com")`, row["initiator.name"])
+	assert.Equal(t, "'+1", row["target.name"])
+	assert.Equal(t, "'@SUM(A1)", row["observer.name"])
+	assert.Equal(t, "'-2", row["reason.reasonType"])
+	assert.Equal(t, "'\tcode", row["reason.reasonCode"])
+	assert.Equal(t, "a-b", row["target.id"])
+	assert.Equal(t, "update", row["action"])
+}
+
+func Test_StreamEvents(t *testing.T) {
+	viper.Set("API.stream_poll_interval", "10ms")
+	t.Cleanup(func() {
+		viper.Set("API.stream_poll_interval", nil)
+	})
+	router := setupTest(t)
+
+	// the stream only ends when the client goes away
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/v1/events/stream?fields=id,action", http.NoBody)
+	req.Header.Set("Last-Event-ID", "2017-11-01T00:00:00.000Z/00000000-0000-0000-0000-000000000000")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "text/event-stream", res.Header().Get("Content-Type"))
+	expected, err := os.ReadFile("fixtures/event-stream.txt")
+	require.Nil(t, err)
+	assert.Equal(t, string(expected), res.Body.String(), "every event is sent once")
+}
+
+// switchingValidator checks each token with the next validator, and with
+// the last one after all validators were used.
+type switchingValidator struct {
+	validators []gopherpolicy.Validator
+	calls      int
+}
+
+func (v *switchingValidator) CheckToken(r *http.Request) *gopherpolicy.Token {
+	validator := v.validators[min(v.calls, len(v.validators)-1)]
+	v.calls++
+	return validator.CheckToken(r)
+}
+
+// rejectingValidator rejects all tokens, like expired or revoked ones.
+type rejectingValidator struct{}
+
+func (rejectingValidator) CheckToken(r *http.Request) *gopherpolicy.Token {
+	return &gopherpolicy.Token{Err: errors.New("token has expired")}
+}
+
+func Test_StreamEventsTokenRecheck(t *testing.T) {
+	viper.Set("API.stream_poll_interval", "10ms")
+	viper.Set("API.stream_token_check_interval", "20ms")
+	t.Cleanup(func() {
+		viper.Set("API.stream_poll_interval", nil)
+		viper.Set("API.stream_token_check_interval", nil)
+	})
+	forbiddingEnforcer := mock.NewEnforcer()
+	forbiddingEnforcer.Forbid("event:list")
+
+	tt := []struct {
+		name      string
+		validator gopherpolicy.Validator
+		errorType storage.ErrorType
+	}{
+		{"Expired", rejectingValidator{}, storage.ErrorUnauthorized},
+		{"PermissionRemoved", mock.NewValidator(forbiddingEnforcer, nil), storage.ErrorForbidden},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			validator := &switchingValidator{validators: []gopherpolicy.Validator{mock.NewValidator(mock.NewEnforcer(), nil), tc.validator}}
+			p := &v1Provider{validator: validator, storage: storage.Mock{}}
+
+			// the stream must end before the client goes away
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/v1/events/stream", http.NoBody)
+			req = mux.SetURLVars(req, map[string]string{})
+			res := httptest.NewRecorder()
+			p.StreamEvents(res, req)
+
+			require.NoError(t, ctx.Err(), "stream was not closed")
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.Contains(t, res.Body.String(), fmt.Sprintf("event: error\ndata: {\"error\":{\"type\":%q", tc.errorType))
+		})
+	}
+}
+
+func Test_ExportConfig(t *testing.T) {
+	path := "/v1/projects/b3b70c8271a845709f9a03030e705da7/export-events"
+	tt := []struct {
+		name       string
+		method     string
+		body       any
+		statuscode int
+		json       string
+	}{
+		{"Get", "GET", nil, http.StatusOK, "fixtures/export-config.json"},
+		{"Update", "POST", map[string]any{
+			"enabled":        true,
+			"bucket_name":    "b3b70c8271a845709f9a03030e705da7-archive",
+			"retention_days": 90,
+			"filters":        map[string]any{"event_types": []string{"create", "delete"}},
+		}, http.StatusOK, "fixtures/export-config-updated.json"},
+		{"Disable", "POST", map[string]any{"enabled": false}, http.StatusOK, ""},
+		{"MissingBucket", "POST", map[string]any{"enabled": true}, http.StatusBadRequest, ""},
+		{"InvalidBucket", "POST", map[string]any{"enabled": true, "bucket_name": "Audit/Archive"}, http.StatusBadRequest, ""},
+		{"ForeignBucket", "POST", map[string]any{"enabled": true, "bucket_name": "audit-archive"}, http.StatusBadRequest, ""},
+		{"OtherProjectBucket", "POST", map[string]any{"enabled": true, "bucket_name": "a0d5ffd4f9bd4d0c8b9ab52f2e1bb2a5-archive"}, http.StatusBadRequest, ""},
+		{"NegativeRetention", "POST", map[string]any{"bucket_name": "b3b70c8271a845709f9a03030e705da7", "retention_days": -1}, http.StatusBadRequest, ""},
+		{"EmptyFilterValue", "POST", map[string]any{"filters": map[string]any{"resource_types": []string{""}}}, http.StatusBadRequest, ""},
+		{"UnknownField", "POST", map[string]any{"last_run_time": "2017-11-17T09:00:00Z"}, http.StatusBadRequest, ""},
+		{"Delete", "DELETE", nil, http.StatusNoContent, ""},
+	}
+
+	router := setupTest(t)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			test.APIRequest{
+				Method:           tc.method,
+				Path:             path,
+				RequestJSON:      tc.body,
+				ExpectStatusCode: tc.statuscode,
+				ExpectJSON:       tc.json,
+			}.Check(t, router)
+		})
+	}
+}
+
+func Test_Subscriptions(t *testing.T) {
+	path := "/v1/subscriptions/5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21"
+	subscription := map[string]any{
+		"url":    "https://hooks.example.com/audit",
+		"secret": "0123456789abcdef",
+		"filter": map[string]string{"action": "delete", "target_type": "service/security/account/user"},
+	}
+	withFilter := func(filter map[string]string) map[string]any {
+		return map[string]any{"url": "https://hooks.example.com/audit", "filter": filter}
+	}
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		body       any
+		statuscode int
+		json       string
+	}{
+		{"List", "GET", "/v1/subscriptions", nil, http.StatusOK, "fixtures/subscription-list.json"},
+		{"Get", "GET", path, nil, http.StatusOK, "fixtures/subscription.json"},
+		{"GetUnknown", "GET", "/v1/subscriptions/unknown", nil, http.StatusNotFound, ""},
+		{"Update", "PUT", path, map[string]any{
+			"url":     "https://hooks.example.com/tickets",
+			"enabled": false,
+			"filter":  map[string]string{"action": "update", "outcome": "failure"},
+		}, http.StatusOK, ""},
+		{"UpdateUnknown", "PUT", "/v1/subscriptions/unknown", subscription, http.StatusNotFound, ""},
+		{"Create", "POST", "/v1/subscriptions", subscription, http.StatusCreated, ""},
+		{"CreateWithoutFilter", "POST", "/v1/subscriptions", withFilter(nil), http.StatusCreated, ""},
+		{"MissingURL", "POST", "/v1/subscriptions", map[string]any{"secret": "0123456789abcdef"}, http.StatusBadRequest, ""},
+		{"HTTPURL", "POST", "/v1/subscriptions", map[string]any{"url": "http://hooks.example.com/audit"}, http.StatusBadRequest, ""},
+		{"RelativeURL", "POST", "/v1/subscriptions", map[string]any{"url": "/audit"}, http.StatusBadRequest, ""},
+		{"ShortSecret", "POST", "/v1/subscriptions", map[string]any{"url": "https://hooks.example.com/audit", "secret": "short"}, http.StatusBadRequest, ""},
+		{"LoopbackURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://127.0.0.1:8443/audit"}, http.StatusBadRequest, ""},
+		{"LocalhostURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://localhost/audit"}, http.StatusBadRequest, ""},
+		{"PrivateURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://10.1.2.3/audit"}, http.StatusBadRequest, ""},
+		{"MetadataURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://169.254.169.254/latest/meta-data"}, http.StatusBadRequest, ""},
+		{"IPv6PrivateURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://[fd00::1]/audit"}, http.StatusBadRequest, ""},
+		{"PublicAddressURL", "POST", "/v1/subscriptions", map[string]any{"url": "https://203.0.113.7/audit"}, http.StatusCreated, ""},
+		{"UnknownFilter", "POST", "/v1/subscriptions", withFilter(map[string]string{"project_id": "other"}), http.StatusBadRequest, ""},
+		{"InvalidFilter", "POST", "/v1/subscriptions", withFilter(map[string]string{"outcome": "fail*"}), http.StatusBadRequest, ""},
+		{"InvalidSearch", "POST", "/v1/subscriptions", withFilter(map[string]string{"search": "action:"}), http.StatusBadRequest, ""},
+		{"UnknownField", "POST", "/v1/subscriptions", map[string]any{"url": "https://hooks.example.com/audit", "last_event_id": "x"}, http.StatusBadRequest, ""},
+		{"Delete", "DELETE", path, nil, http.StatusNoContent, ""},
+		{"DeleteUnknown", "DELETE", "/v1/subscriptions/unknown", nil, http.StatusNotFound, ""},
+		{"Deliveries", "GET", path + "/deliveries", nil, http.StatusOK, "fixtures/subscription-deliveries.json"},
+		{"DeliveriesLimit", "GET", path + "/deliveries?limit=0", nil, http.StatusBadRequest, ""},
+		{"DeliveriesUnknown", "GET", "/v1/subscriptions/unknown/deliveries", nil, http.StatusNotFound, ""},
+	}
+
+	router := setupTestWithAuth(t, storage.Mock{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7"})
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			test.APIRequest{
+				Method:           tc.method,
+				Path:             tc.path,
+				RequestJSON:      tc.body,
+				ExpectStatusCode: tc.statuscode,
+				ExpectJSON:       tc.json,
+			}.Check(t, router)
+		})
+	}
+}
+
+// deletingStorage deletes every subscription right before it is updated.
+type deletingStorage struct {
+	storage.Mock
+}
+
+func (deletingStorage) UpdateSubscription(ctx context.Context, subscription storage.Subscription) error {
+	return storage.ErrSubscriptionNotFound
+}
+
+func Test_UpdateDeletedSubscription(t *testing.T) {
+	router := setupTestWithAuth(t, deletingStorage{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7"})
+	test.APIRequest{
+		Method:           "PUT",
+		Path:             "/v1/subscriptions/5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21",
+		RequestJSON:      map[string]any{"url": "https://hooks.example.com/audit"},
+		ExpectStatusCode: http.StatusNotFound,
+	}.Check(t, router)
+}
+
+func Test_CreateSubscription(t *testing.T) {
+	router := setupTestWithAuth(t, storage.Mock{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7"})
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/subscriptions", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// the secret is only returned on creation, and generated if not given
+	res := create(`{"url":"https://hooks.example.com/audit","filter":{"action":"delete"}}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	var subscription storage.Subscription
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &subscription))
+	assert.Equal(t, "/v1/subscriptions/"+subscription.ID, res.Header().Get("Location"))
+	assert.Equal(t, "b3b70c8271a845709f9a03030e705da7", subscription.ProjectID)
+	assert.True(t, subscription.Enabled)
+	assert.Equal(t, storage.SubscriptionFilter{Action: "delete"}, subscription.Filter)
+	assert.GreaterOrEqual(t, len(subscription.Secret), minSecretLength)
+
+	res = create(`{"url":"https://hooks.example.com/audit","secret":"0123456789abcdef","enabled":false}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &subscription))
+	assert.Equal(t, "0123456789abcdef", subscription.Secret)
+	assert.False(t, subscription.Enabled)
+
+	// subscriptions belong to a project
+	router = setupTest(t)
+	req := httptest.NewRequest(http.MethodGet, "/v1/subscriptions", http.NoBody)
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func Test_ListAlerts(t *testing.T) {
+	engine := &alerts.Engine{
+		Rules: []alerts.Rule{{
+			// the mock storage does not filter events
+			Name:     "active_users",
+			Severity: "critical",
+			Type:     alerts.RuleTypeThreshold,
+			GroupBy:  []string{"initiator_id"},
+			Window:   alerts.Duration(time.Hour),
+		}, {
+			Name:      "frequent_actions",
+			Severity:  "warning",
+			Type:      alerts.RuleTypeThreshold,
+			GroupBy:   []string{"action"},
+			Window:    alerts.Duration(time.Hour),
+			Threshold: 3,
+		}},
+		Aggregator: storage.Mock{},
+		TimeNow:    func() time.Time { return time.Date(2017, 11, 17, 9, 0, 0, 0, time.UTC) },
+	}
+	require.Nil(t, engine.Evaluate(context.Background()))
+	router := setupRouter(t, storage.Mock{}, nil, engine, nil)
+
+	tt := []struct {
+		name string
+		path string
+		json string
+	}{
+		{"All", "/v1/alerts", "fixtures/alerts.json"},
+		{"ByRule", "/v1/alerts?rule=frequent_actions", "fixtures/alerts-rule.json"},
+		{"BySeverity", "/v1/alerts?severity=info", "fixtures/alerts-none.json"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			test.APIRequest{
+				Method:           "GET",
+				Path:             tc.path,
+				ExpectStatusCode: http.StatusOK,
+				ExpectJSON:       tc.json,
+			}.Check(t, router)
+		})
+	}
+
+	// without alerting rules, there are no alerts
+	test.APIRequest{
+		Method:           "GET",
+		Path:             "/v1/alerts",
+		ExpectStatusCode: http.StatusOK,
+		ExpectJSON:       "fixtures/alerts-none.json",
+	}.Check(t, setupTest(t))
+}
+
+func Test_SavedSearches(t *testing.T) {
+	path := "/v1/saved-searches/0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24"
+	withFilter := func(filter map[string]string) map[string]any {
+		return map[string]any{"name": "Deleted users", "filter": filter}
+	}
+	search := withFilter(map[string]string{"action": "delete", "time": "gte:now-7d", "sort": "time:desc"})
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		body       any
+		statuscode int
+		json       string
+	}{
+		{"List", "GET", "/v1/saved-searches", nil, http.StatusOK, "fixtures/saved-search-list.json"},
+		{"Get", "GET", path, nil, http.StatusOK, "fixtures/saved-search.json"},
+		{"GetPrivate", "GET", "/v1/saved-searches/7e1c9a4b-5d3f-4b2e-8c6a-1f9e7d5b3a68", nil, http.StatusOK, ""},
+		{"GetUnknown", "GET", "/v1/saved-searches/unknown", nil, http.StatusNotFound, ""},
+		{"Create", "POST", "/v1/saved-searches", search, http.StatusCreated, ""},
+		{"CreateShared", "POST", "/v1/saved-searches", map[string]any{"name": "Deleted users", "shared": true}, http.StatusCreated, ""},
+		{"MissingName", "POST", "/v1/saved-searches", map[string]any{"name": " ", "filter": map[string]string{"action": "delete"}}, http.StatusBadRequest, ""},
+		{"UnknownFilter", "POST", "/v1/saved-searches", withFilter(map[string]string{"details": "full"}), http.StatusBadRequest, ""},
+		{"InvalidFilter", "POST", "/v1/saved-searches", withFilter(map[string]string{"outcome": "fail*"}), http.StatusBadRequest, ""},
+		{"InvalidTime", "POST", "/v1/saved-searches", withFilter(map[string]string{"time": "since:now-7d"}), http.StatusBadRequest, ""},
+		{"InvalidSort", "POST", "/v1/saved-searches", withFilter(map[string]string{"sort": "time:up"}), http.StatusBadRequest, ""},
+		{"UnknownField", "POST", "/v1/saved-searches", map[string]any{"name": "Deleted users", "user_id": "other"}, http.StatusBadRequest, ""},
+		{"Update", "PUT", path, search, http.StatusOK, ""},
+		{"UpdateUnknown", "PUT", "/v1/saved-searches/unknown", search, http.StatusNotFound, ""},
+		{"Delete", "DELETE", path, nil, http.StatusNoContent, ""},
+		{"DeleteUnknown", "DELETE", "/v1/saved-searches/unknown", nil, http.StatusNotFound, ""},
+	}
+
+	router := setupTestWithAuth(t, storage.Mock{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7", "user_id": "e9141fb24eee4b3e9f25ae69cda31132"})
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			test.APIRequest{
+				Method:           tc.method,
+				Path:             tc.path,
+				RequestJSON:      tc.body,
+				ExpectStatusCode: tc.statuscode,
+				ExpectJSON:       tc.json,
+			}.Check(t, router)
+		})
+	}
+}
+
+func Test_SavedSearchOwners(t *testing.T) {
+	request := func(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+	privatePath := "/v1/saved-searches/7e1c9a4b-5d3f-4b2e-8c6a-1f9e7d5b3a68"
+
+	// searches are private to their owner unless they are shared
+	router := setupTestWithAuth(t, storage.Mock{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7", "user_id": "user1"})
+	res := request(router, http.MethodPost, "/v1/saved-searches", `{"name":" Failed logins ","filter":{"action":"authenticate","outcome":"failure","time":"gte:now-1d"}}`)
+	require.Equal(t, http.StatusCreated, res.Code, res.Body.String())
+	var search storage.SavedSearch
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &search))
+	assert.Equal(t, "/v1/saved-searches/"+search.ID, res.Header().Get("Location"))
+	assert.Equal(t, "b3b70c8271a845709f9a03030e705da7", search.ProjectID)
+	assert.Equal(t, "Failed logins", search.Name)
+	assert.Equal(t, "user1", search.UserID)
+	assert.Equal(t, "user1", search.CreatedBy)
+	assert.Equal(t, storage.SavedSearchFilter{
+		SubscriptionFilter: storage.SubscriptionFilter{Action: "authenticate", Outcome: "failure"},
+		Time:               "gte:now-1d",
+	}, search.Filter)
+
+	res = request(router, http.MethodPut, "/v1/saved-searches/0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24", `{"name":"Deleted users","shared":true,"filter":{"action":"delete"}}`)
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	var updated storage.SavedSearch
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &updated))
+	assert.Empty(t, updated.UserID)
+	assert.True(t, updated.UpdatedAt.After(updated.CreatedAt))
+
+	// the private searches of other users are neither listed nor accessible
+	res = request(router, http.MethodGet, "/v1/saved-searches", "")
+	require.Equal(t, http.StatusOK, res.Code, res.Body.String())
+	var list SavedSearchList
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &list))
+	require.Len(t, list.SavedSearches, 1)
+	assert.Equal(t, "0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24", list.SavedSearches[0].ID)
+	assert.Equal(t, http.StatusNotFound, request(router, http.MethodGet, privatePath, "").Code)
+	assert.Equal(t, http.StatusNotFound, request(router, http.MethodPut, privatePath, `{"name":"Mine now","shared":true}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(router, http.MethodDelete, privatePath, "").Code)
+
+	// private searches need a user, and all searches a project
+	router = setupTestWithAuth(t, storage.Mock{}, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7"})
+	assert.Equal(t, http.StatusBadRequest, request(router, http.MethodPost, "/v1/saved-searches", `{"name":"Private"}`).Code)
+	assert.Equal(t, http.StatusCreated, request(router, http.MethodPost, "/v1/saved-searches", `{"name":"Shared","shared":true}`).Code)
+	router = setupTest(t)
+	assert.Equal(t, http.StatusBadRequest, request(router, http.MethodGet, "/v1/saved-searches", "").Code)
+}
+
+func Test_SavedSearchSharedByOthers(t *testing.T) {
+	sharedPath := "/v1/saved-searches/0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24"
+	search := `{"name":"Deleted users","shared":true,"filter":{"action":"delete"}}`
+	// users who are not project admins
+	enforcer := mock.NewEnforcer()
+	enforcer.Forbid("saved_search:update_shared")
+	newRouter := func(userID string) http.Handler {
+		auth := map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7", "user_id": userID}
+		v1API := NewV1API(mock.NewValidator(enforcer, auth), storage.Mock{}, identity.MockProjectLister{}, nil, nil)
+		return httpapi.Compose(v1API, httpapi.WithGlobalMiddleware(WithRequestID))
+	}
+
+	tt := []struct {
+		name       string
+		userID     string
+		method     string
+		body       string
+		statuscode int
+	}{
+		{"Get", "user1", "GET", "", http.StatusOK},
+		{"Update", "user1", "PUT", search, http.StatusForbidden},
+		{"MakePrivate", "user1", "PUT", `{"name":"Deleted users","filter":{"action":"delete"}}`, http.StatusForbidden},
+		{"Delete", "user1", "DELETE", "", http.StatusForbidden},
+		{"UpdateByCreator", "e9141fb24eee4b3e9f25ae69cda31132", "PUT", search, http.StatusOK},
+		{"DeleteByCreator", "e9141fb24eee4b3e9f25ae69cda31132", "DELETE", "", http.StatusNoContent},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, sharedPath, strings.NewReader(tc.body))
+			res := httptest.NewRecorder()
+			newRouter(tc.userID).ServeHTTP(res, req)
+			assert.Equal(t, tc.statuscode, res.Code, res.Body.String())
+		})
+	}
+}
+
+// filterRecordingStorage remembers the filter of the last GetEvents call.
+type filterRecordingStorage struct {
+	storage.Mock
+	filter *storage.EventFilter
+}
+
+func (s *filterRecordingStorage) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	s.filter = filter
+	return s.Mock.GetEvents(ctx, filter, tenantID)
+}
+
+func Test_ListEventsWithSavedSearch(t *testing.T) {
+	search := "saved_search=0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24"
+	descendingTime := []storage.FieldOrder{{Fieldname: "time", Order: "desc"}}
+	tt := []struct {
+		name             string
+		query            string
+		expectStatusCode int
+		expectAction     string
+		expectTime       map[string]string
+		expectSort       []storage.FieldOrder
+	}{
+		{"SavedSearch", search, http.StatusOK, "delete", map[string]string{"gte": "now-7d"}, descendingTime},
+		{"OverrideFilter", search + "&action=update", http.StatusOK, "update", map[string]string{"gte": "now-7d"}, descendingTime},
+		{"OverrideTime", search + "&time=gte:now-1h,lt:now", http.StatusOK, "delete", map[string]string{"gte": "now-1h", "lt": "now"}, descendingTime},
+		{"OverrideSort", search + "&sort=initiator_name", http.StatusOK, "delete", map[string]string{"gte": "now-7d"}, []storage.FieldOrder{{Fieldname: "initiator_name", Order: "asc"}}},
+		{"UnknownSearch", "saved_search=unknown", http.StatusNotFound, "", nil, nil},
+		{"PrivateSearchOfOtherUser", "saved_search=7e1c9a4b-5d3f-4b2e-8c6a-1f9e7d5b3a68", http.StatusNotFound, "", nil, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			eventStore := &filterRecordingStorage{}
+			router := setupTestWithAuth(t, eventStore, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7", "user_id": "user1"})
+			req := httptest.NewRequest(http.MethodGet, "/v1/events?"+tc.query, http.NoBody)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			require.Equal(t, tc.expectStatusCode, res.Code, res.Body.String())
+			if tc.expectStatusCode != http.StatusOK {
+				assert.Nil(t, eventStore.filter)
+				return
+			}
+			require.NotNil(t, eventStore.filter)
+			assert.Equal(t, tc.expectAction, eventStore.filter.Action)
+			assert.Equal(t, "service/security/account/user", eventStore.filter.TargetType)
+			assert.Equal(t, tc.expectTime, eventStore.filter.Time)
+			assert.Equal(t, tc.expectSort, eventStore.filter.Sort)
+		})
+	}
+}
+
+// tamperedStorage returns the stored document of the mock event with a
+// modified outcome, and no anchors if unsealed is set.
+type tamperedStorage struct {
+	storage.Mock
+	unsealed bool
+}
+
+func (s tamperedStorage) GetEventDocuments(ctx context.Context, tenantID string, events []*cadf.Event) (map[string]json.RawMessage, error) {
+	documents, err := s.Mock.GetEventDocuments(ctx, tenantID, events)
+	for eventID, document := range documents {
+		documents[eventID] = bytes.Replace(document, []byte(`"success"`), []byte(`"failure"`), 1)
+	}
+	return documents, err
+}
+
+func (s tamperedStorage) FindAnchors(ctx context.Context, tenantID string, eventIDs []string) ([]storage.Anchor, error) {
+	if s.unsealed {
+		return nil, nil
+	}
+	return s.Mock.FindAnchors(ctx, tenantID, eventIDs)
+}
+
+func Test_GetEventProof(t *testing.T) {
+	path := "/v1/events/7be6c4ff-b761-5f1f-b234-f5d41616c2cd/proof"
+	tt := []struct {
+		name       string
+		storage    storage.Storage
+		key        string
+		path       string
+		statuscode int
+		json       string
+	}{
+		{"Proof", storage.Mock{}, "", path, http.StatusOK, "fixtures/event-proof.json"},
+		{"SignedAnchor", storage.Mock{}, "mock", path, http.StatusOK, "fixtures/event-proof.json"},
+		{"ForgedAnchor", storage.Mock{}, "other", path, http.StatusConflict, ""},
+		{"InvalidEventID", storage.Mock{}, "", "/v1/events/invalid-uuid/proof", http.StatusBadRequest, ""},
+		{"SeveralProjects", storage.Mock{}, "", path + "?project_id=b3b70c8271a845709f9a03030e705da7,ba8304b657fb4568addf7116f41b4a16", http.StatusBadRequest, ""},
+		{"Unsealed", tamperedStorage{unsealed: true}, "", path, http.StatusNotFound, ""},
+		{"ModifiedEvent", tamperedStorage{}, "", path, http.StatusConflict, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// without a sealer, the signature of the anchor is not checked
+			var sealer *integrity.Sealer
+			if tc.key != "" {
+				sealer = &integrity.Sealer{Store: storage.Mock{}, Key: []byte(tc.key)}
+			}
+			router := setupRouter(t, tc.storage, map[string]string{"project_id": "b3b70c8271a845709f9a03030e705da7"}, nil, sealer)
+
+			test.APIRequest{
+				Method:           "GET",
+				Path:             tc.path,
+				ExpectStatusCode: tc.statuscode,
+				ExpectJSON:       tc.json,
+			}.Check(t, router)
+		})
+	}
+}
+
+func Test_CreateEvents(t *testing.T) {
+	newEvent := func(id, projectID string) string {
+		return fmt.Sprintf(`{"id":%q,"eventTime":"2017-11-17T08:53:32.667973+00:00","action":"create","outcome":"success",`+
+			`"initiator":{"typeURI":"service/security/account/user","id":"user"},`+
+			`"target":{"typeURI":"compute/server","id":"server","project_id":%q},"observer":{"typeURI":"service/compute","id":"nova"}}`, id, projectID)
+	}
+	event1 := newEvent("7be6c4ff-b761-5f1f-b234-f5d41616c2cd", "b3b70c8271a845709f9a03030e705da7")
+	event2 := newEvent("f6f0ebf3-bf59-553a-9e38-788f714ccc46", "b3b70c8271a845709f9a03030e705da7")
+	invalidEvent := newEvent("f6f0ebf3-bf59-553a-9e38-788f714ccc46", "")
+
+	tt := []struct {
+		name        string
+		contentType string
+		body        string
+		statuscode  int
+		expected    string
+	}{
+		{"Single", "application/json", event1, http.StatusCreated, `{"created":1}`},
+		{"NoContentType", "", event1, http.StatusCreated, `{"created":1}`},
+		{"Batch", "application/x-ndjson", event1 + "\n\n" + event2 + "\n", http.StatusCreated, `{"created":2}`},
+		{"InvalidEvent", "application/x-ndjson", event1 + "\n" + invalidEvent + "\n{\n", http.StatusBadRequest,
+			`{"created":0,"errors":[{"line":2,"id":"f6f0ebf3-bf59-553a-9e38-788f714ccc46","error":"missing project_id or domain_id in target and initiator"},` +
+				`{"line":3,"error":"invalid JSON: unexpected end of JSON input"}]}`},
+		{"MissingAttribute", "application/json", `{"id":"7be6c4ff-b761-5f1f-b234-f5d41616c2cd","eventTime":"2017-11-17T08:53:32Z"}`, http.StatusBadRequest,
+			`{"created":0,"errors":[{"line":1,"id":"7be6c4ff-b761-5f1f-b234-f5d41616c2cd","error":"missing action"}]}`},
+		{"Empty", "application/x-ndjson", "", http.StatusBadRequest, ""},
+		{"UnsupportedContentType", "text/plain", event1, http.StatusUnsupportedMediaType, ""},
+	}
+
+	router := setupTest(t)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := test.APIRequest{
+				Method:             "POST",
+				Path:               "/v1/events",
+				RequestBody:        &tc.body,
+				RequestContentType: tc.contentType,
+				ExpectStatusCode:   tc.statuscode,
+			}
+			if tc.expected != "" {
+				var buf bytes.Buffer
+				err := json.Indent(&buf, []byte(tc.expected), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := buf.String()
+				req.ExpectBody = &expected
+			}
+			req.Check(t, router)
+		})
+	}
+}
+
 func TestListEvents_ParameterParsing(t *testing.T) {
 	validTimeStr := time.Now().UTC().Format(time.RFC3339)
 	anotherValidTimeStr := time.Now().UTC().Add(1 * time.Hour).Format(time.RFC3339)
@@ -129,6 +954,10 @@ func TestListEvents_ParameterParsing(t *testing.T) {
 		{"Time_EmptyElementLeading_FromCut", "?time=,lt:" + validTimeStr, http.StatusBadRequest, ""},
 		{"Time_OnlyCommas_FromCut", "?time=,,", http.StatusBadRequest, ""},
 		{"Time_EmptyOperatorNameExplicit", "?time=:" + validTimeStr, http.StatusBadRequest, ""},
+
+		// --- Cursor Parameter Parsing ---
+		{"Cursor_Start", "?cursor=", http.StatusOK, ""},
+		{"Cursor_WithOffset", "?cursor=&offset=10", http.StatusBadRequest, ""},
 	}
 
 	router := setupTest(t)
@@ -150,3 +979,245 @@ func TestListEvents_ParameterParsing(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseEventFilter(t *testing.T) {
+	tt := []struct {
+		name     string
+		query    string
+		expected hermes.EventFilter
+	}{
+		{"Single", "action=create", hermes.EventFilter{Action: "create"}},
+		{"Negated", "outcome=!success", hermes.EventFilter{Outcome: "!success"}},
+		{"List", "action=create,delete", hermes.EventFilter{Action: "create,delete"}},
+		{"NegatedList", "target_type=!network/port,!network/subnet", hermes.EventFilter{TargetType: "!network/port,!network/subnet"}},
+		{"Mixed", "action=create,+delete,!read", hermes.EventFilter{Action: "create,delete,!read"}},
+		{"Repeated", "initiator_id=a&initiator_id=b,c", hermes.EventFilter{InitiatorID: "a,b,c"}},
+		{"Alias", "action=create&event_type=delete", hermes.EventFilter{Action: "create,delete"}},
+		{"Prefix", "target_type=service/compute/*&observer_type=service/*", hermes.EventFilter{
+			TargetType: "service/compute/*", ObserverType: "service/*",
+		}},
+		{"NegatedPrefix", "action=update/*,!update/add/*&request_path=!/v3/auth/*", hermes.EventFilter{
+			Action: "update/*,!update/add/*", RequestPath: "!/v3/auth/*",
+		}},
+		{"NewFilters", "target_name=admin&initiator_address=10.0.*,!10.0.0.1&tag=prod,staging", hermes.EventFilter{
+			TargetName: "admin", InitiatorAddress: "10.0.*,!10.0.0.1", Tag: "prod,staging",
+		}},
+		{"FullDetails", "details=full", hermes.EventFilter{Details: true, FullDetails: true}},
+		{"Details", "details", hermes.EventFilter{Details: true}},
+		{"Combined", "action=create,delete&outcome=!success&request_path=/v3/users", hermes.EventFilter{
+			Action: "create,delete", Outcome: "!success", RequestPath: "/v3/users",
+		}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/events?"+tc.query, http.NoBody)
+			filter, err := parseEventFilter(req)
+			require.NoError(t, err)
+			tc.expected.Time = map[string]string{}
+			tc.expected.Sort = []hermes.FieldOrder{}
+			assert.Equal(t, tc.expected, *filter)
+		})
+	}
+
+	invalidQueries := []string{
+		"action=",
+		"action=create,",
+		"action=create,,delete",
+		"outcome=!",
+		"action=create&action=",
+		"initiator_id=" + strings.Repeat("a,", 100) + "a",
+		"target_type=*",
+		"target_type=!*",
+		"target_type=*/compute",
+		"action=up*date/*",
+		"initiator_id=abc*",
+		"outcome=fail*",
+		"target_name=adm*",
+	}
+	for _, query := range invalidQueries {
+		t.Run(query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/events?"+query, http.NoBody)
+			_, err := parseEventFilter(req)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_ParseHistogramInterval(t *testing.T) {
+	tt := []struct {
+		param    string
+		expected time.Duration
+		err      string
+	}{
+		{"15m", 15 * time.Minute, ""},
+		{"525600m", 365 * 24 * time.Hour, ""},
+		{"365d", 365 * 24 * time.Hour, ""},
+		{"366d", 0, "must not be longer than 365d"},
+		{"8761h", 0, "must not be longer than 365d"},
+		{"999999d", 0, "must not be longer than 365d"},
+		{"1y", 0, "must be a number"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.param, func(t *testing.T) {
+			interval, err := parseHistogramInterval(tc.param)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, interval)
+		})
+	}
+}
+
+func Test_LimitHistogramRange(t *testing.T) {
+	tt := []struct {
+		name      string
+		timeRange map[string]string
+		interval  time.Duration
+		expected  map[string]string
+		err       string
+	}{
+		{"WithinLimit", map[string]string{"gte": "2017-01-01T00:00:00Z", "lt": "2017-02-01T00:00:00Z"}, time.Hour,
+			map[string]string{"gte": "2017-01-01T00:00:00Z", "lt": "2017-02-01T00:00:00Z"}, ""},
+		{"TooManyIntervals", map[string]string{"gte": "2017-01-01T00:00:00Z", "lt": "2018-01-01T00:00:00Z"}, time.Minute,
+			nil, "too many intervals"},
+		{"NoLowerBound", map[string]string{"lt": "2018-01-01T00:00:00Z"}, time.Hour,
+			map[string]string{"gte": "2016-11-10T08:00:00Z", "lt": "2018-01-01T00:00:00Z"}, ""},
+		{"NoLowerBoundLongInterval", map[string]string{"lt": "2018-01-01T00:00:00Z"}, 30 * 24 * time.Hour,
+			map[string]string{"gte": "1970-01-01T00:00:00Z", "lt": "2018-01-01T00:00:00Z"}, ""},
+		{"InvalidTime", map[string]string{"gte": "yesterday"}, time.Hour, nil, "yesterday"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := hermes.EventFilter{Time: tc.timeRange}
+			err := limitHistogramRange(&filter, tc.interval)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, filter.Time)
+		})
+	}
+
+	// without any time range, the histogram ends now
+	filter := hermes.EventFilter{}
+	require.NoError(t, limitHistogramRange(&filter, time.Minute))
+	start, err := time.Parse(time.RFC3339, filter.Time["gte"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(-maxHistogramBuckets*time.Minute), start, time.Minute)
+}
+
+func Test_GetIndexID(t *testing.T) {
+	tt := []struct {
+		name             string
+		auth             map[string]string
+		forbid           string
+		query            string
+		expectIndexID    string
+		expectStatusCode int
+	}{
+		{"Project", map[string]string{"project_id": "project1"}, "", "", "project1", http.StatusOK},
+		{"Domain", map[string]string{"domain_id": "domain1"}, "", "", "domain1", http.StatusOK},
+		{"ProjectOverride", map[string]string{"project_id": "project1"}, "", "project_id=project9", "project9", http.StatusOK},
+		{"ProjectList", map[string]string{"project_id": "project1"}, "", "project_id=project9,+project8,project9", "project9,project8", http.StatusOK},
+		{"AllProjects", map[string]string{"project_id": "project1"}, "", "project_id=all", "", http.StatusOK},
+		{"ProjectListForbidden", map[string]string{"project_id": "project1"}, "cluster_viewer", "project_id=project9,project8", "", http.StatusForbidden},
+		{"ProjectListEmptyValue", map[string]string{"project_id": "project1"}, "", "project_id=project9,,project8", "", http.StatusBadRequest},
+		{"ProjectListWithAll", map[string]string{"project_id": "project1"}, "", "project_id=project9,all", "", http.StatusBadRequest},
+		{"ProjectOverrideForbidden", map[string]string{"project_id": "project1"}, "cluster_viewer", "project_id=project9", "", http.StatusForbidden},
+		{"DomainScope", map[string]string{"domain_id": "domain1"}, "", "scope=domain", "domain1,project1,project2", http.StatusOK},
+		{"DomainScopeWithDomainID", map[string]string{"project_id": "project1"}, "", "scope=domain&domain_id=domain2", "domain2,project3", http.StatusOK},
+		{"DomainScopeWithoutProjects", map[string]string{"domain_id": "domain3"}, "", "scope=domain", "domain3", http.StatusOK},
+		{"DomainScopeForbidden", map[string]string{"domain_id": "domain1"}, "domain_viewer", "scope=domain", "", http.StatusForbidden},
+		{"DomainScopeWithoutDomain", map[string]string{"project_id": "project1"}, "", "scope=domain", "", http.StatusBadRequest},
+		{"DomainScopeWithProjectID", map[string]string{"domain_id": "domain1"}, "", "scope=domain&project_id=project1", "", http.StatusBadRequest},
+		{"InvalidScope", map[string]string{"domain_id": "domain1"}, "", "scope=cluster", "", http.StatusBadRequest},
+	}
+
+	projects := identity.MockProjectLister{
+		"domain1": {"project1", "project2"},
+		"domain2": {"project3"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			enforcer := mock.NewEnforcer()
+			if tc.forbid != "" {
+				enforcer.Forbid(tc.forbid)
+			}
+			p := &v1Provider{validator: mock.NewValidator(enforcer, tc.auth), storage: storage.Mock{}, projects: projects}
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/events?"+tc.query, http.NoBody)
+			req = mux.SetURLVars(req, map[string]string{})
+			res := httptest.NewRecorder()
+			token, ok := p.AuthHandler(res, req, "event:list")
+			require.True(t, ok)
+
+			indexID, err := p.getIndexID(token, req, res)
+			assert.Equal(t, tc.expectStatusCode, res.Code)
+			if tc.expectStatusCode == http.StatusOK {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectIndexID, indexID)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+// writeRecordingStorage remembers the events written to it.
+type writeRecordingStorage struct {
+	storage.Mock
+	written []storage.TenantEvent
+}
+
+func (s *writeRecordingStorage) WriteEvents(ctx context.Context, events []storage.TenantEvent) ([]error, error) {
+	s.written = append(s.written, events...)
+	return make([]error, len(events)), nil
+}
+
+func Test_RecordTenantAccess(t *testing.T) {
+	auth := map[string]string{"project_id": "admin-project", "user_id": "user1", "user_name": "admin", "user_domain_name": "Default"}
+	tt := []struct {
+		name           string
+		projectIDs     string
+		expectTenants  []string
+		expectTargetID []string
+	}{
+		{"Project", "project1", []string{"project1"}, []string{"project1"}},
+		{"ProjectList", "project1,project2", []string{"project1", "project2"}, []string{"project1", "project2"}},
+		{"All", "all", []string{"admin-project"}, []string{"all"}},
+		{"OwnProject", "admin-project", nil, nil},
+		{"NextPage", "project1&cursor=abc", nil, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			eventStore := &writeRecordingStorage{}
+			p := &v1Provider{validator: mock.NewValidator(mock.NewEnforcer(), auth), storage: eventStore}
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/events?project_id="+tc.projectIDs, http.NoBody)
+			req = mux.SetURLVars(req, map[string]string{})
+			res := httptest.NewRecorder()
+			token, ok := p.AuthHandler(res, req, "event:list")
+			require.True(t, ok)
+			_, err := p.getIndexID(token, req, res)
+			require.NoError(t, err)
+			p.accessWrites.Wait()
+
+			var tenants, targetIDs []string
+			for _, written := range eventStore.written {
+				tenants = append(tenants, written.TenantID)
+				targetIDs = append(targetIDs, written.Event.Target.ID)
+				assert.NoError(t, hermes.ValidateEvent(written.Event))
+				assert.Equal(t, "user1", written.Event.Initiator.ID)
+				assert.Equal(t, "admin-project", written.Event.Initiator.ProjectID)
+				assert.Equal(t, "data/audit/events", written.Event.Target.TypeURI)
+				assert.Equal(t, cadf.ReadAction, written.Event.Action)
+			}
+			assert.Equal(t, tc.expectTenants, tenants)
+			assert.Equal(t, tc.expectTargetID, targetIDs)
+		})
+	}
+}
@@ -6,12 +6,16 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/mux"
 
 	"github.com/sapcc/go-bits/gopherpolicy"
 	"github.com/sapcc/go-bits/httpapi"
 
+	"github.com/sapcc/hermes/pkg/alerts"
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/integrity"
 	"github.com/sapcc/hermes/pkg/storage"
 )
 
@@ -34,10 +38,23 @@ type versionLinkData struct {
 type v1Provider struct {
 	validator gopherpolicy.Validator
 	storage   storage.Storage
+	projects  identity.ProjectLister
+	alerts    *alerts.Engine
+	sealer    *integrity.Sealer
+	// accessWrites tracks the records of tenant accesses that are still being written.
+	accessWrites sync.WaitGroup
 }
 
 // AuthHandler wraps endpoint handlers with consistent auth logic.
 func (p *v1Provider) AuthHandler(w http.ResponseWriter, r *http.Request, rule string) (*gopherpolicy.Token, bool) {
+	token := p.checkToken(r)
+	ok := requireRule(w, token, rule)
+	return token, ok
+}
+
+// checkToken validates the token of the request and fills the request
+// context of the token, which the policy rules are checked against.
+func (p *v1Provider) checkToken(r *http.Request) *gopherpolicy.Token {
 	token := p.validator.CheckToken(r)
 
 	// Initialize request context with URL vars
@@ -50,15 +67,33 @@ func (p *v1Provider) AuthHandler(w http.ResponseWriter, r *http.Request, rule st
 		token.Context.Request["domain_id"] = token.Context.Auth["domain_id"]
 	}
 
-	// Handle project_id with form value priority
-	if formProjectID := r.FormValue("project_id"); formProjectID != "" {
-		token.Context.Request["project_id"] = formProjectID
-	} else {
-		token.Context.Request["project_id"] = token.Context.Auth["project_id"]
+	// Handle project_id with URL var and form value priority. A project_id in
+	// the URL path must not be replaced, since it selects the affected project.
+	if _, isURLVar := token.Context.Request["project_id"]; !isURLVar {
+		if formProjectID := r.FormValue("project_id"); formProjectID != "" {
+			token.Context.Request["project_id"] = formProjectID
+		} else {
+			token.Context.Request["project_id"] = token.Context.Auth["project_id"]
+		}
 	}
+	return token
+}
 
-	ok := token.Require(w, rule)
-	return token, ok
+// requireRule is like token.Require, but writes an ErrorResponse if the token
+// is invalid or does not permit the rule.
+func requireRule(w http.ResponseWriter, token *gopherpolicy.Token, rule string) bool {
+	if token.Err != nil {
+		if token.Context.Logger != nil {
+			token.Context.Logger(fmt.Sprintf("returning %v because of error: %s", http.StatusUnauthorized, token.Err.Error()))
+		}
+		respondWithError(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !token.Enforcer.Enforce(rule, token.Context) {
+		respondWithError(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 // V1API implements the v1 API endpoints using httpapi patterns
@@ -69,20 +104,27 @@ type V1API struct {
 	provider    *v1Provider
 }
 
-// NewV1API creates a new V1API instance with the provided validator and storage.
+// NewV1API creates a new V1API instance with the provided validator and
+// storage. The project lister resolves the projects of a domain for queries
+// with scope=domain. The alert engine provides the alerts of ListAlerts, it is
+// nil if no alerting rules are configured. The sealer seals the events written
+// with CreateEvents, it is nil if no integrity key is configured.
 //
 // Example:
 //
 //	validator := gopherpolicy.NewValidator(enforcer, logger)
 //	storage := elasticsearch.NewStorage(config)
-//	api := NewV1API(validator, storage)
-func NewV1API(validator gopherpolicy.Validator, storageInterface storage.Storage) *V1API {
+//	api := NewV1API(validator, storage, identity.MockProjectLister{}, nil, nil)
+func NewV1API(validator gopherpolicy.Validator, storageInterface storage.Storage, projects identity.ProjectLister, alertEngine *alerts.Engine, sealer *integrity.Sealer) *V1API {
 	api := &V1API{
 		validator: validator,
 		storage:   storageInterface,
 		provider: &v1Provider{
 			validator: validator,
 			storage:   storageInterface,
+			projects:  projects,
+			alerts:    alertEngine,
+			sealer:    sealer,
 		},
 	}
 
@@ -116,13 +158,79 @@ func (api *V1API) AddTo(r *mux.Router) {
 		InstrumentDuration("version")(InstrumentResponseSize("version")(http.HandlerFunc(api.getVersion))))
 
 	r.Methods("GET").Path("/v1/events").Handler(
-		InstrumentDuration("ListEvents")(InstrumentResponseSize("ListEvents")(http.HandlerFunc(api.listEvents))))
+		InstrumentDuration("ListEvents")(InstrumentResponseSize("ListEvents")(WithQueryTimeout("ListEvents")(http.HandlerFunc(api.listEvents)))))
+
+	r.Methods("POST").Path("/v1/events").Handler(
+		InstrumentDuration("CreateEvents")(InstrumentResponseSize("CreateEvents")(http.HandlerFunc(api.createEvents))))
+
+	// must be registered before /v1/events/{event_id} to take precedence
+	r.Methods("GET").Path("/v1/events/export").Handler(
+		InstrumentDuration("ExportEvents")(InstrumentResponseSize("ExportEvents")(WithQueryTimeout("ExportEvents")(http.HandlerFunc(api.exportEvents)))))
+
+	// each poll of the stream has its own query timeout
+	r.Methods("GET").Path("/v1/events/stream").Handler(
+		InstrumentDuration("StreamEvents")(InstrumentResponseSize("StreamEvents")(http.HandlerFunc(api.streamEvents))))
+
+	r.Methods("GET").Path("/v1/events/histogram").Handler(
+		InstrumentDuration("GetHistogram")(InstrumentResponseSize("GetHistogram")(WithQueryTimeout("GetHistogram")(http.HandlerFunc(api.getHistogram)))))
 
 	r.Methods("GET").Path("/v1/events/{event_id}").Handler(
-		InstrumentDuration("GetEventDetails")(InstrumentResponseSize("GetEventDetails")(http.HandlerFunc(api.getEventDetails))))
+		InstrumentDuration("GetEventDetails")(InstrumentResponseSize("GetEventDetails")(WithQueryTimeout("GetEventDetails")(http.HandlerFunc(api.getEventDetails)))))
+
+	r.Methods("GET").Path("/v1/events/{event_id}/proof").Handler(
+		InstrumentDuration("GetEventProof")(InstrumentResponseSize("GetEventProof")(WithQueryTimeout("GetEventProof")(http.HandlerFunc(api.getEventProof)))))
+
+	r.Methods("GET").Path("/v1/stats").Handler(
+		InstrumentDuration("GetStats")(InstrumentResponseSize("GetStats")(WithQueryTimeout("GetStats")(http.HandlerFunc(api.getStats)))))
+
+	// alerts are evaluated in the background, so there is no query to time out
+	r.Methods("GET").Path("/v1/alerts").Handler(
+		InstrumentDuration("ListAlerts")(InstrumentResponseSize("ListAlerts")(http.HandlerFunc(api.listAlerts))))
 
 	r.Methods("GET").Path("/v1/attributes/{attribute_name}").Handler(
-		InstrumentDuration("GetAttributes")(InstrumentResponseSize("GetAttributes")(http.HandlerFunc(api.getAttributes))))
+		InstrumentDuration("GetAttributes")(InstrumentResponseSize("GetAttributes")(WithQueryTimeout("GetAttributes")(http.HandlerFunc(api.getAttributes)))))
+
+	r.Methods("GET").Path("/v1/projects/{project_id}/export-events").Handler(
+		InstrumentDuration("GetExportConfig")(InstrumentResponseSize("GetExportConfig")(WithQueryTimeout("GetExportConfig")(http.HandlerFunc(api.getExportConfig)))))
+
+	r.Methods("POST").Path("/v1/projects/{project_id}/export-events").Handler(
+		InstrumentDuration("UpdateExportConfig")(InstrumentResponseSize("UpdateExportConfig")(WithQueryTimeout("UpdateExportConfig")(http.HandlerFunc(api.updateExportConfig)))))
+
+	r.Methods("DELETE").Path("/v1/projects/{project_id}/export-events").Handler(
+		InstrumentDuration("DeleteExportConfig")(InstrumentResponseSize("DeleteExportConfig")(WithQueryTimeout("DeleteExportConfig")(http.HandlerFunc(api.deleteExportConfig)))))
+
+	r.Methods("GET").Path("/v1/subscriptions").Handler(
+		InstrumentDuration("ListSubscriptions")(InstrumentResponseSize("ListSubscriptions")(WithQueryTimeout("ListSubscriptions")(http.HandlerFunc(api.listSubscriptions)))))
+
+	r.Methods("POST").Path("/v1/subscriptions").Handler(
+		InstrumentDuration("CreateSubscription")(InstrumentResponseSize("CreateSubscription")(WithQueryTimeout("CreateSubscription")(http.HandlerFunc(api.createSubscription)))))
+
+	r.Methods("GET").Path("/v1/subscriptions/{subscription_id}").Handler(
+		InstrumentDuration("GetSubscription")(InstrumentResponseSize("GetSubscription")(WithQueryTimeout("GetSubscription")(http.HandlerFunc(api.getSubscription)))))
+
+	r.Methods("PUT").Path("/v1/subscriptions/{subscription_id}").Handler(
+		InstrumentDuration("UpdateSubscription")(InstrumentResponseSize("UpdateSubscription")(WithQueryTimeout("UpdateSubscription")(http.HandlerFunc(api.updateSubscription)))))
+
+	r.Methods("DELETE").Path("/v1/subscriptions/{subscription_id}").Handler(
+		InstrumentDuration("DeleteSubscription")(InstrumentResponseSize("DeleteSubscription")(WithQueryTimeout("DeleteSubscription")(http.HandlerFunc(api.deleteSubscription)))))
+
+	r.Methods("GET").Path("/v1/subscriptions/{subscription_id}/deliveries").Handler(
+		InstrumentDuration("ListDeliveries")(InstrumentResponseSize("ListDeliveries")(WithQueryTimeout("ListDeliveries")(http.HandlerFunc(api.listDeliveries)))))
+
+	r.Methods("GET").Path("/v1/saved-searches").Handler(
+		InstrumentDuration("ListSavedSearches")(InstrumentResponseSize("ListSavedSearches")(WithQueryTimeout("ListSavedSearches")(http.HandlerFunc(api.listSavedSearches)))))
+
+	r.Methods("POST").Path("/v1/saved-searches").Handler(
+		InstrumentDuration("CreateSavedSearch")(InstrumentResponseSize("CreateSavedSearch")(WithQueryTimeout("CreateSavedSearch")(http.HandlerFunc(api.createSavedSearch)))))
+
+	r.Methods("GET").Path("/v1/saved-searches/{saved_search_id}").Handler(
+		InstrumentDuration("GetSavedSearch")(InstrumentResponseSize("GetSavedSearch")(WithQueryTimeout("GetSavedSearch")(http.HandlerFunc(api.getSavedSearch)))))
+
+	r.Methods("PUT").Path("/v1/saved-searches/{saved_search_id}").Handler(
+		InstrumentDuration("UpdateSavedSearch")(InstrumentResponseSize("UpdateSavedSearch")(WithQueryTimeout("UpdateSavedSearch")(http.HandlerFunc(api.updateSavedSearch)))))
+
+	r.Methods("DELETE").Path("/v1/saved-searches/{saved_search_id}").Handler(
+		InstrumentDuration("DeleteSavedSearch")(InstrumentResponseSize("DeleteSavedSearch")(WithQueryTimeout("DeleteSavedSearch")(http.HandlerFunc(api.deleteSavedSearch)))))
 }
 
 // Handler methods for V1API
@@ -146,6 +254,34 @@ func (api *V1API) listEvents(w http.ResponseWriter, r *http.Request) {
 	api.provider.ListEvents(w, r)
 }
 
+// createEvents handles POST /v1/events
+func (api *V1API) createEvents(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/events")
+
+	api.provider.CreateEvents(w, r)
+}
+
+// exportEvents handles GET /v1/events/export
+func (api *V1API) exportEvents(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/events/export")
+
+	api.provider.ExportEvents(w, r)
+}
+
+// streamEvents handles GET /v1/events/stream
+func (api *V1API) streamEvents(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/events/stream")
+
+	api.provider.StreamEvents(w, r)
+}
+
+// getHistogram handles GET /v1/events/histogram
+func (api *V1API) getHistogram(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/events/histogram")
+
+	api.provider.GetHistogram(w, r)
+}
+
 // getEventDetails handles GET /v1/events/{event_id}
 func (api *V1API) getEventDetails(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v1/events/:event_id")
@@ -154,6 +290,27 @@ func (api *V1API) getEventDetails(w http.ResponseWriter, r *http.Request) {
 	api.provider.GetEventDetails(w, r)
 }
 
+// getEventProof handles GET /v1/events/{event_id}/proof
+func (api *V1API) getEventProof(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/events/:event_id/proof")
+
+	api.provider.GetEventProof(w, r)
+}
+
+// listAlerts handles GET /v1/alerts
+func (api *V1API) listAlerts(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/alerts")
+
+	api.provider.ListAlerts(w, r)
+}
+
+// getStats handles GET /v1/stats
+func (api *V1API) getStats(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/stats")
+
+	api.provider.GetStats(w, r)
+}
+
 // getAttributes handles GET /v1/attributes/{attribute_name}
 func (api *V1API) getAttributes(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v1/attributes/:attribute_name")
@@ -161,3 +318,101 @@ func (api *V1API) getAttributes(w http.ResponseWriter, r *http.Request) {
 	// Call existing v1Provider implementation for backward compatibility
 	api.provider.GetAttributes(w, r)
 }
+
+// getExportConfig handles GET /v1/projects/{project_id}/export-events
+func (api *V1API) getExportConfig(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/projects/:project_id/export-events")
+
+	api.provider.GetExportConfig(w, r)
+}
+
+// updateExportConfig handles POST /v1/projects/{project_id}/export-events
+func (api *V1API) updateExportConfig(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/projects/:project_id/export-events")
+
+	api.provider.UpdateExportConfig(w, r)
+}
+
+// deleteExportConfig handles DELETE /v1/projects/{project_id}/export-events
+func (api *V1API) deleteExportConfig(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/projects/:project_id/export-events")
+
+	api.provider.DeleteExportConfig(w, r)
+}
+
+// listSubscriptions handles GET /v1/subscriptions
+func (api *V1API) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions")
+
+	api.provider.ListSubscriptions(w, r)
+}
+
+// createSubscription handles POST /v1/subscriptions
+func (api *V1API) createSubscription(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions")
+
+	api.provider.CreateSubscription(w, r)
+}
+
+// getSubscription handles GET /v1/subscriptions/{subscription_id}
+func (api *V1API) getSubscription(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions/:subscription_id")
+
+	api.provider.GetSubscription(w, r)
+}
+
+// updateSubscription handles PUT /v1/subscriptions/{subscription_id}
+func (api *V1API) updateSubscription(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions/:subscription_id")
+
+	api.provider.UpdateSubscription(w, r)
+}
+
+// deleteSubscription handles DELETE /v1/subscriptions/{subscription_id}
+func (api *V1API) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions/:subscription_id")
+
+	api.provider.DeleteSubscription(w, r)
+}
+
+// listDeliveries handles GET /v1/subscriptions/{subscription_id}/deliveries
+func (api *V1API) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/subscriptions/:subscription_id/deliveries")
+
+	api.provider.ListDeliveries(w, r)
+}
+
+// listSavedSearches handles GET /v1/saved-searches
+func (api *V1API) listSavedSearches(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/saved-searches")
+
+	api.provider.ListSavedSearches(w, r)
+}
+
+// createSavedSearch handles POST /v1/saved-searches
+func (api *V1API) createSavedSearch(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/saved-searches")
+
+	api.provider.CreateSavedSearch(w, r)
+}
+
+// getSavedSearch handles GET /v1/saved-searches/{saved_search_id}
+func (api *V1API) getSavedSearch(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/saved-searches/:saved_search_id")
+
+	api.provider.GetSavedSearch(w, r)
+}
+
+// updateSavedSearch handles PUT /v1/saved-searches/{saved_search_id}
+func (api *V1API) updateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/saved-searches/:saved_search_id")
+
+	api.provider.UpdateSavedSearch(w, r)
+}
+
+// deleteSavedSearch handles DELETE /v1/saved-searches/{saved_search_id}
+func (api *V1API) deleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v1/saved-searches/:saved_search_id")
+
+	api.provider.DeleteSavedSearch(w, r)
+}
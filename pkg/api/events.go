@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -19,17 +21,22 @@ import (
 	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/gopherpolicy"
 	"github.com/sapcc/go-bits/logg"
-	"github.com/sapcc/go-bits/respondwith"
 
 	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/query"
+	"github.com/sapcc/hermes/pkg/storage"
 )
 
+// maxFilterValues limits the number of values of a single filter parameter.
+const maxFilterValues = 100
+
 // EventList is the model for JSON returned by the ListEvents API call
 type EventList struct {
-	NextURL string              `json:"next,omitempty"`
-	PrevURL string              `json:"previous,omitempty"`
-	Events  []*hermes.ListEvent `json:"events"`
-	Total   int                 `json:"total"`
+	NextURL string `json:"next,omitempty"`
+	PrevURL string `json:"previous,omitempty"`
+	Cursor  string `json:"cursor,omitempty"`
+	Events  any    `json:"events"` // []*hermes.ListEvent, or []hermes.EventProjection if fields are selected
+	Total   int    `json:"total"`
 }
 
 // ListEvents handles GET /v1/events.
@@ -49,7 +56,7 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 	if offsetStr != "" {
 		parsedOffset, err := strconv.ParseUint(offsetStr, 10, 32)
 		if err != nil {
-			http.Error(res, "Invalid offset value", http.StatusBadRequest)
+			respondWithError(res, "Invalid offset value", http.StatusBadRequest)
 			return
 		}
 		offset = uint(parsedOffset)
@@ -58,15 +65,121 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 	if limitStr != "" {
 		parsedLimit, err := strconv.ParseUint(limitStr, 10, 32)
 		if err != nil {
-			http.Error(res, "Invalid limit value", http.StatusBadRequest)
+			respondWithError(res, "Invalid limit value", http.StatusBadRequest)
 			return
 		}
 		limit = uint(parsedLimit)
 	}
 
-	// Parse the sort query string
-	// slice of a struct, key and direction.
+	// Cursor based paging is requested with the cursor parameter, which is
+	// empty for the first page. It cannot be combined with an offset.
+	useCursor := req.Form.Has("cursor")
+	cursor := req.FormValue("cursor")
+	if useCursor && offsetStr != "" {
+		respondWithError(res, "Invalid cursor: cannot be combined with offset", http.StatusBadRequest)
+		return
+	}
+
+	// A saved search provides the parameters that are not given in the request.
+	if req.Form.Has("saved_search") && !p.applySavedSearch(res, req, token) {
+		return
+	}
+
+	logg.Debug("api.ListEvents: Create filter")
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Fields, err = parseFields(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Offset = offset
+	filter.Limit = limit
+	filter.UseCursor = useCursor
+	filter.Cursor = cursor
+
+	logg.Debug("api.ListEvents: call hermes.GetEvents()")
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+	page, err := hermes.GetEvents(req.Context(), filter, indexID, p.storage)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.ListEvents: error calling hermes.GetEvents(): %s", err.Error())
+
+		// Check for UnmarshalTypeError and log it
+		if unmarshalErr, ok := errext.As[*json.UnmarshalTypeError](err); ok {
+			logg.Error("api.ListEvents: JSON unmarshal error: Type=%v, Value=%v, Offset=%v, Struct=%v, Field=%v",
+				unmarshalErr.Type, unmarshalErr.Value, unmarshalErr.Offset, unmarshalErr.Struct, unmarshalErr.Field)
+		}
+		return
+	}
+
+	eventList := EventList{Events: page.Events, Total: page.Total}
+	if page.Projections != nil {
+		eventList.Events = page.Projections
+	}
+	total := page.Total
 
+	// What protocol to use for PrevURL and NextURL?
+	protocol := getProtocol(req)
+
+	if filter.UseCursor {
+		// There is no way back with a cursor, only forward until it is exhausted.
+		if page.NextCursor != "" {
+			eventList.Cursor = page.NextCursor
+			req.Form.Set("cursor", page.NextCursor)
+			eventList.NextURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+		}
+		ReturnESJSON(res, http.StatusOK, eventList)
+		return
+	}
+
+	if total >= 0 && filter.Offset+filter.Limit < uint(total) {
+		nextOffset := filter.Offset + filter.Limit
+
+		// Update the offset in the query parameters and construct the NextURL
+		req.Form.Set("offset", strconv.FormatUint(uint64(nextOffset), 10))
+		eventList.NextURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+	}
+
+	if filter.Offset >= filter.Limit {
+		prevOffset := filter.Offset - filter.Limit
+
+		// Update the offset in the query parameters and construct the PrevURL
+		req.Form.Set("offset", strconv.FormatUint(uint64(prevOffset), 10))
+		eventList.PrevURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+	}
+
+	ReturnESJSON(res, http.StatusOK, eventList)
+}
+
+// parseEventFilter parses the filter and sort parameters shared by all
+// endpoints that select events. The returned errors are meant for the client.
+func parseEventFilter(req *http.Request) (*hermes.EventFilter, error) {
+	// details=full adds all fields that ListEvent has, any other value only the attachments.
+	// FormValue also parses the form if that did not happen yet.
+	fullDetails := req.FormValue("details") == "full"
+
+	filter, err := parseSearchParams(req.Form)
+	if err != nil {
+		return nil, err
+	}
+	filter.Details = req.Form.Has("details")
+	filter.FullDetails = fullDetails
+	return filter, nil
+}
+
+// parseSearchParams parses the filter parameters, the time range and the
+// sort order, i.e. all parameters that can be stored in a saved search.
+func parseSearchParams(form url.Values) (*hermes.EventFilter, error) {
 	sortSpec := []hermes.FieldOrder{}
 	validSortTopics := map[string]bool{
 		"time":           true,
@@ -91,15 +204,14 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 	// Parse the sort query string.
 	// The sort parameter is a comma-separated list of "field:direction" pairs.
 	// Example: "time:desc,initiator_name:asc"
-	sortParam := req.FormValue("sort")
+	sortParam := form.Get("sort")
 
 	for sortElement := range strings.SplitSeq(sortParam, ",") {
 		sortElement = strings.TrimSpace(sortElement)
 
 		if sortElement == "" {
 			if strings.TrimSpace(sortParam) != "" {
-				http.Error(res, "Invalid sort parameter", http.StatusBadRequest)
-				return
+				return nil, errors.New("invalid sort parameter")
 			}
 			continue
 		}
@@ -107,29 +219,22 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 		sortfield, direction, foundColon := strings.Cut(sortElement, ":")
 
 		if sortfield == "" {
-			http.Error(res, "Invalid sort parameter: field name cannot be empty", http.StatusBadRequest)
-			return
+			return nil, errors.New("invalid sort parameter: field name cannot be empty")
 		}
 
 		if !validSortTopics[sortfield] {
-			err := fmt.Errorf("not a valid topic: %s, valid topics: %v", sortfield, reflect.ValueOf(validSortTopics).MapKeys())
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("not a valid topic: %s, valid topics: %v", sortfield, reflect.ValueOf(validSortTopics).MapKeys())
 		}
 
 		defsortorder := "asc"
 		if foundColon {
 			sortDirection := strings.TrimSpace(direction)
 			if sortDirection == "" {
-				err := fmt.Errorf("sort direction for field %s cannot be empty", sortfield)
-				http.Error(res, err.Error(), http.StatusBadRequest)
-				return
+				return nil, fmt.Errorf("sort direction for field %s cannot be empty", sortfield)
 			}
 
 			if !validSortDirection[sortDirection] {
-				err := fmt.Errorf("sort direction %s is invalid, must be asc or desc", sortDirection)
-				http.Error(res, err.Error(), http.StatusBadRequest)
-				return
+				return nil, fmt.Errorf("sort direction %s is invalid, must be asc or desc", sortDirection)
 			}
 			defsortorder = sortDirection
 		}
@@ -142,130 +247,134 @@ func (p *v1Provider) ListEvents(res http.ResponseWriter, req *http.Request) {
 	timeRange := make(map[string]string)
 	validOperators := map[string]bool{"lt": true, "lte": true, "gt": true, "gte": true}
 
-	timeParam := req.FormValue("time")
+	timeParam := form.Get("time")
 	for timeElement := range strings.SplitSeq(timeParam, ",") {
 		timeElement = strings.TrimSpace(timeElement)
 
 		if timeElement == "" {
-			if strings.TrimSpace(req.FormValue("time")) != "" {
-				http.Error(res, "Invalid time parameter: an element is empty", http.StatusBadRequest)
-				return
+			if strings.TrimSpace(timeParam) != "" {
+				return nil, errors.New("invalid time parameter: an element is empty")
 			}
 			continue
 		}
 
 		operator, value, foundColon := strings.Cut(timeElement, ":")
 		if operator == "" {
-			http.Error(res, "Invalid time parameter: operator cannot be empty", http.StatusBadRequest)
-			return
+			return nil, errors.New("invalid time parameter: operator cannot be empty")
 		}
 
 		if !validOperators[operator] {
-			err := fmt.Errorf("time operator %s is not valid. Must be lt, lte, gt or gte", operator)
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("time operator %s is not valid. Must be lt, lte, gt or gte", operator)
 		}
 
 		if !foundColon {
-			err := fmt.Errorf("time operator %s missing :<timestamp>", operator)
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("time operator %s missing :<timestamp>", operator)
 		}
 
 		timeStr := strings.TrimSpace(value)
 		if timeStr == "" {
-			err := fmt.Errorf("time operator %s missing :<timestamp>", operator)
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("time operator %s missing :<timestamp>", operator)
 		}
 
 		_, exists := timeRange[operator]
 		if exists {
-			err := fmt.Errorf("time operator %s can only occur once", operator)
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("time operator %s can only occur once", operator)
 		}
 
-		validTimeFormats := []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05"}
-		var isValidTimeFormat bool
-		isValidTimeFormat = false
-		// Check if the timeStr matches any of the valid time formats
-		for _, timeFormat := range validTimeFormats {
-			_, err := time.Parse(timeFormat, timeStr)
-			if err == nil { // If parsing succeeds (no error)
-				isValidTimeFormat = true
-				break
-			}
-		}
-		if !isValidTimeFormat {
-			err := fmt.Errorf("invalid time format: %s", timeStr)
-			http.Error(res, err.Error(), http.StatusBadRequest)
-			return
+		_, err := query.ParseTime(timeStr, time.Now())
+		if err != nil {
+			return nil, err
 		}
 		timeRange[operator] = timeStr
 	}
 
-	details := req.Form.Has("details")
-
-	logg.Debug("api.ListEvents: Create filter")
-	filter := hermes.EventFilter{
-		ObserverType:  req.FormValue("observer_type") + req.FormValue("source"),
-		TargetType:    req.FormValue("target_type") + req.FormValue("resource_type"),
-		TargetID:      req.FormValue("target_id"),
-		InitiatorID:   req.FormValue("initiator_id") + req.FormValue("user_name"),
-		InitiatorType: req.FormValue("initiator_type"),
-		InitiatorName: req.FormValue("initiator_name"),
-		Action:        req.FormValue("action") + req.FormValue("event_type"),
-		Outcome:       req.FormValue("outcome"),
-		Search:        req.FormValue("search"),
-		RequestPath:   req.FormValue("request_path"),
-		Time:          timeRange,
-		Offset:        offset,
-		Limit:         limit,
-		Sort:          sortSpec,
-		Details:       details,
+	filter, err := parseFilterParams(form)
+	if err != nil {
+		return nil, err
 	}
+	filter.Time = timeRange
+	filter.Sort = sortSpec
+	return filter, nil
+}
 
-	logg.Debug("api.ListEvents: call hermes.GetEvents()")
-	indexID, err := getIndexID(token, req, res)
+// filterParamNames are the names of the parameters read by parseFilterParams,
+// without deprecated aliases.
+var filterParamNames = []string{
+	"observer_type", "target_type", "target_id", "initiator_id", "initiator_type", "initiator_name",
+	"action", "outcome", "search", "request_path", "target_name", "initiator_address", "tag",
+}
+
+// parseFilterParams parses the parameters which select events by their
+// attributes, i.e. all filter parameters except for the time range.
+func parseFilterParams(form url.Values) (*hermes.EventFilter, error) {
+	// the search query is compiled by the storage, but invalid queries are rejected here
+	search := form.Get("search")
+	_, err := query.Parse(search)
 	if err != nil {
-		return
+		return nil, err
 	}
-	events, total, err := hermes.GetEvents(&filter, indexID, p.storage)
-	if respondwith.ErrorText(res, err) {
-		logg.Error("api.ListEvents: error calling hermes.GetEvents(): %s", err.Error())
 
-		// Check for UnmarshalTypeError and log it
-		if unmarshalErr, ok := errext.As[*json.UnmarshalTypeError](err); ok {
-			logg.Error("api.ListEvents: JSON unmarshal error: Type=%v, Value=%v, Offset=%v, Struct=%v, Field=%v",
-				unmarshalErr.Type, unmarshalErr.Value, unmarshalErr.Offset, unmarshalErr.Struct, unmarshalErr.Field)
+	filter := hermes.EventFilter{Search: search}
+	filterParams := []struct {
+		value       *string
+		names       []string // including deprecated aliases
+		allowPrefix bool     // values can end with * to match by prefix
+	}{
+		{&filter.ObserverType, []string{"observer_type", "source"}, true},
+		{&filter.TargetType, []string{"target_type", "resource_type"}, true},
+		{&filter.TargetID, []string{"target_id"}, false},
+		{&filter.InitiatorID, []string{"initiator_id", "user_name"}, false},
+		{&filter.InitiatorType, []string{"initiator_type"}, false},
+		{&filter.InitiatorName, []string{"initiator_name"}, false},
+		{&filter.Action, []string{"action", "event_type"}, true},
+		{&filter.Outcome, []string{"outcome"}, false},
+		{&filter.RequestPath, []string{"request_path"}, true},
+		{&filter.TargetName, []string{"target_name"}, false},
+		{&filter.InitiatorAddress, []string{"initiator_address"}, true},
+		{&filter.Tag, []string{"tag"}, false},
+	}
+	for _, param := range filterParams {
+		*param.value, err = filterValues(form, param.allowPrefix, param.names...)
+		if err != nil {
+			return nil, err
 		}
-		storageErrorsCounter.Add(1)
-		return
 	}
+	return &filter, nil
+}
 
-	eventList := EventList{Events: events, Total: total}
-
-	// What protocol to use for PrevURL and NextURL?
-	protocol := getProtocol(req)
-
-	if total >= 0 && filter.Offset+filter.Limit < uint(total) {
-		nextOffset := filter.Offset + filter.Limit
-
-		// Update the offset in the query parameters and construct the NextURL
-		req.Form.Set("offset", strconv.FormatUint(uint64(nextOffset), 10))
-		eventList.NextURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+// filterValues collects the values of a filter parameter. The parameter can
+// be given multiple times, and each time with a comma-separated list of
+// values, which can be negated with a leading "!". If allowPrefix is set,
+// values ending with "*" match by prefix. The result is the comma-separated
+// list of all values, as expected by the storage.
+func filterValues(form url.Values, allowPrefix bool, names ...string) (string, error) {
+	var values []string
+	for _, name := range names {
+		for _, param := range form[name] {
+			for value := range strings.SplitSeq(param, ",") {
+				value = strings.TrimSpace(value)
+				if strings.TrimPrefix(value, "!") == "" {
+					return "", fmt.Errorf("invalid %s parameter: values cannot be empty", names[0])
+				}
+				if strings.Contains(value, "*") {
+					prefix, isPrefix := strings.CutSuffix(strings.TrimPrefix(value, "!"), "*")
+					switch {
+					case !allowPrefix:
+						return "", fmt.Errorf("invalid %s parameter: wildcards are only supported for action, initiator_address, observer_type, request_path and target_type", names[0])
+					case !isPrefix || strings.Contains(prefix, "*"):
+						return "", fmt.Errorf("invalid %s parameter: wildcards are only supported at the end of a value", names[0])
+					case prefix == "":
+						return "", fmt.Errorf("invalid %s parameter: a prefix cannot be empty", names[0])
+					}
+				}
+				values = append(values, value)
+			}
+		}
 	}
-
-	if filter.Offset >= filter.Limit {
-		prevOffset := filter.Offset - filter.Limit
-
-		// Update the offset in the query parameters and construct the PrevURL
-		req.Form.Set("offset", strconv.FormatUint(uint64(prevOffset), 10))
-		eventList.PrevURL = fmt.Sprintf("%s://%s%s?%s", protocol, req.Host, req.URL.Path, req.Form.Encode())
+	if len(values) > maxFilterValues {
+		return "", fmt.Errorf("invalid %s parameter: at most %d values are allowed", names[0], maxFilterValues)
 	}
-
-	ReturnESJSON(res, http.StatusOK, eventList)
+	return strings.Join(values, ","), nil
 }
 
 // GetEvent handles GET /v1/events/:event_id.
@@ -282,30 +391,63 @@ func (p *v1Provider) GetEventDetails(res http.ResponseWriter, req *http.Request)
 
 	// Validate if eventID is a valid UUID
 	if _, err := uuid.Parse(eventID); err != nil {
-		http.Error(res, "Invalid event ID format", http.StatusBadRequest)
+		respondWithError(res, "Invalid event ID format", http.StatusBadRequest)
+		return
+	}
+
+	fields, err := parseFields(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	indexID, err := getIndexID(token, req, res)
+	indexID, err := p.getIndexID(token, req, res)
 	if err != nil {
 		return
 	}
 
-	event, err := hermes.GetEvent(eventID, indexID, p.storage)
+	event, err := hermes.GetEvent(req.Context(), eventID, indexID, p.storage)
 
-	if respondwith.ErrorText(res, err) {
+	if respondWithStorageError(res, req, err) {
 		logg.Error("error getting events from Storage: %s", err)
-		storageErrorsCounter.Add(1)
 		return
 	}
 	if event == nil {
 		err := fmt.Errorf("event %s could not be found in project %s", eventID, indexID)
-		http.Error(res, err.Error(), http.StatusNotFound)
+		respondWithError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+	if len(fields) > 0 {
+		projection, err := hermes.ProjectEvent(event, fields)
+		if err != nil {
+			respondWithError(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ReturnESJSON(res, http.StatusOK, projection)
 		return
 	}
 	ReturnESJSON(res, http.StatusOK, event)
 }
 
+// parseFields parses the comma-separated list of fields in the fields parameter.
+func parseFields(req *http.Request) ([]string, error) {
+	var fields []string
+	for _, param := range req.Form["fields"] {
+		for field := range strings.SplitSeq(param, ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case field == "":
+				return nil, errors.New("invalid fields parameter: field name cannot be empty")
+			case !slices.Contains(hermes.ProjectionFields, field):
+				return nil, fmt.Errorf("invalid fields parameter: unknown field %s", field)
+			case !slices.Contains(fields, field):
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields, nil
+}
+
 // GetAttributes handles GET /v1/attributes/:attribute_name
 func (p *v1Provider) GetAttributes(res http.ResponseWriter, req *http.Request) {
 	token, ok := p.AuthHandler(res, req, "event:list")
@@ -336,27 +478,31 @@ func (p *v1Provider) GetAttributes(res http.ResponseWriter, req *http.Request) {
 		Limit:     uint(limit),
 	}
 
-	indexID, err := getIndexID(token, req, res)
+	indexID, err := p.getIndexID(token, req, res)
 	if err != nil {
 		return
 	}
 
-	attribute, err := hermes.GetAttributes(&filter, indexID, p.storage)
+	attribute, err := hermes.GetAttributes(req.Context(), &filter, indexID, p.storage)
 
-	if respondwith.ErrorText(res, err) {
+	if respondWithStorageError(res, req, err) {
 		logg.Error("could not get attributes from Storage: %s", err)
-		storageErrorsCounter.Add(1)
 		return
 	}
 	if attribute == nil {
 		err := fmt.Errorf("attribute %s could not be found in project %s", queryName, indexID)
-		http.Error(res, err.Error(), http.StatusNotFound)
+		respondWithError(res, err.Error(), http.StatusNotFound)
 		return
 	}
 	ReturnESJSON(res, http.StatusOK, attribute)
 }
 
-func getIndexID(token *gopherpolicy.Token, r *http.Request, w http.ResponseWriter) (string, error) {
+// getIndexID returns the tenant whose events are read. This is the project
+// or domain of the token, or the projects chosen by a cluster viewer. With
+// scope=domain, it is the domain together with all of its projects, as a
+// comma-separated list. If the tenant cannot be determined, an error response
+// has already been written.
+func (p *v1Provider) getIndexID(token *gopherpolicy.Token, r *http.Request, w http.ResponseWriter) (string, error) {
 	// Get index ID from a token
 	// Defaults to a token project scope
 	indexID := token.Context.Auth["project_id"]
@@ -375,15 +521,62 @@ func getIndexID(token *gopherpolicy.Token, r *http.Request, w http.ResponseWrite
 	projectid := r.FormValue("project_id")
 	projectid = strings.ReplaceAll(projectid, "\n", "")
 	projectid = strings.ReplaceAll(projectid, "\r", "")
+
+	if scope := r.FormValue("scope"); scope != "" {
+		var err error
+		switch {
+		case scope != "domain":
+			err = fmt.Errorf("invalid value for scope: %s (only domain is supported)", scope)
+		case projectid != "":
+			err = errors.New("project_id cannot be combined with scope=domain")
+		}
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusBadRequest)
+			return "", err
+		}
+		return p.getDomainIndexIDs(token, r, w)
+	}
+
 	// When the projectid argument is defined, check for the cluster_viewer rule
 	if v := projectid; v != "" {
-		if !token.Require(w, "cluster_viewer") {
+		if !requireRule(w, token, "cluster_viewer") {
 			// not a cloud admin, no possibility to override indexID
 			return "", errors.New("cannot override index ID")
 		}
-		// Index ID can be overridden with a query parameter, when a cluster_viewer rule is used
-		return v, nil
+		// Index ID can be overridden with a query parameter, when a cluster_viewer rule is used,
+		// also with a list of projects or with "all" (which is the empty index ID)
+		projectIDs, err := parseProjectIDs(v)
+		if err != nil {
+			respondWithError(w, err.Error(), http.StatusBadRequest)
+			return "", err
+		}
+		p.recordTenantAccess(token, r, projectIDs)
+		return strings.Join(projectIDs, ","), nil
 	}
 
 	return indexID, nil
 }
+
+// getDomainIndexIDs returns the domain of the request (from domain_id or from
+// the token) together with all projects in it, for domain viewers.
+func (p *v1Provider) getDomainIndexIDs(token *gopherpolicy.Token, r *http.Request, w http.ResponseWriter) (string, error) {
+	// AuthHandler has put the domain_id parameter or the domain of the token here
+	domainID := token.Context.Request["domain_id"]
+	if domainID == "" {
+		err := errors.New("scope=domain requires a domain-scoped token or a domain_id")
+		respondWithError(w, err.Error(), http.StatusBadRequest)
+		return "", err
+	}
+	if !requireRule(w, token, "domain_viewer") {
+		return "", errors.New("cannot read events of the whole domain")
+	}
+
+	projectIDs, err := p.projects.ListProjectIDs(r.Context(), domainID)
+	if err != nil {
+		logg.Error("could not list projects of domain %s: %s", domainID, err.Error())
+		respondWithError(w, err.Error(), http.StatusInternalServerError)
+		return "", err
+	}
+	// events on domain level, like the creation of projects, belong to the domain itself
+	return strings.Join(append([]string{domainID}, projectIDs...), ","), nil
+}
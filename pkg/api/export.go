@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// exportFlushInterval is the number of events after which the response is
+// flushed to the client while exporting.
+const exportFlushInterval = 500
+
+// eventWriter serializes a stream of events in one of the export formats.
+type eventWriter interface {
+	WriteEvent(event *cadf.Event) error
+	Close() error
+}
+
+// exportFormats maps the values of the format parameter to the Content-Type
+// and file extension of the export, and to the eventWriter that produces it.
+var exportFormats = map[string]struct {
+	ContentType string
+	Extension   string
+	NewWriter   func(w io.Writer) eventWriter
+}{
+	"ndjson": {"application/x-ndjson", "ndjson", newNDJSONWriter},
+	"json":   {"application/json", "json", newJSONArrayWriter},
+	"csv":    {"text/csv", "csv", newCSVWriter},
+}
+
+// ExportEvents handles GET /v1/events/export.
+func (p *v1Provider) ExportEvents(res http.ResponseWriter, req *http.Request) {
+	logg.Debug("* api.ExportEvents: Check token")
+	// exports contain the full CADF payload, just like the event details
+	token, ok := p.AuthHandler(res, req, "event:show")
+	if !ok {
+		return
+	}
+
+	formatName := req.FormValue("format")
+	if formatName == "" {
+		formatName = "ndjson"
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		respondWithError(res, fmt.Sprintf("invalid format %q, must be ndjson, json or csv", formatName), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+
+	res.Header().Set("Content-Type", format.ContentType)
+	// the index ID may be empty or a list of tenants, so it is not part of the file name
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="events.%s"`, format.Extension))
+
+	// The status code can only be chosen until the first event was written.
+	// Errors after that point can only be logged and end the response early.
+	writer := format.NewWriter(res)
+	controller := http.NewResponseController(res)
+	count := 0
+	err = hermes.ExportEvents(req.Context(), filter, indexID, p.storage, func(event *cadf.Event) error {
+		if count == 0 {
+			res.WriteHeader(http.StatusOK)
+		}
+		count++
+		err := writer.WriteEvent(event)
+		if err != nil {
+			return err
+		}
+		if count%exportFlushInterval == 0 {
+			return controller.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		logg.Error("api.ExportEvents: export aborted after %d events: %s", count, err.Error())
+		if count == 0 {
+			res.Header().Del("Content-Disposition")
+			respondWithStorageError(res, req, err)
+		} else if storage.ErrorTypeOf(req.Context(), err) != storage.ErrorCanceled {
+			storageErrorsCounter.Add(1)
+		}
+		return
+	}
+
+	err = writer.Close()
+	if err != nil {
+		logg.Error("api.ExportEvents: could not finish export: %s", err.Error())
+	}
+}
+
+// ndjsonWriter writes one JSON document per line.
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) eventWriter {
+	encoder := json.NewEncoder(w)
+	// Keep URLs readable, just like ReturnESJSON does
+	encoder.SetEscapeHTML(false)
+	return ndjsonWriter{encoder}
+}
+
+func (w ndjsonWriter) WriteEvent(event *cadf.Event) error {
+	return w.encoder.Encode(event)
+}
+
+func (w ndjsonWriter) Close() error {
+	return nil
+}
+
+// jsonArrayWriter writes all events as elements of a single JSON array.
+type jsonArrayWriter struct {
+	w       io.Writer
+	encoder *json.Encoder
+	started bool
+}
+
+func newJSONArrayWriter(w io.Writer) eventWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &jsonArrayWriter{w: w, encoder: encoder}
+}
+
+func (w *jsonArrayWriter) WriteEvent(event *cadf.Event) error {
+	separator := ","
+	if !w.started {
+		separator = "["
+		w.started = true
+	}
+	_, err := io.WriteString(w.w, separator)
+	if err != nil {
+		return err
+	}
+	return w.encoder.Encode(event)
+}
+
+func (w *jsonArrayWriter) Close() error {
+	if !w.started {
+		_, err := io.WriteString(w.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(w.w, "]\n")
+	return err
+}
+
+// csvColumns are the columns of the CSV export. Nested objects like
+// attachments are not representable in CSV and therefore omitted.
+var csvColumns = []string{
+	"id", "eventTime", "eventType", "action", "outcome", "requestPath",
+	"reason.reasonType", "reason.reasonCode",
+	"initiator.typeURI", "initiator.id", "initiator.name", "initiator.domain",
+	"initiator.project_id", "initiator.domain_id", "initiator.host.address", "initiator.host.agent",
+	"target.typeURI", "target.id", "target.name", "target.project_id", "target.domain_id",
+	"observer.typeURI", "observer.id", "observer.name",
+}
+
+// csvWriter writes a header line followed by one line per event.
+type csvWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func newCSVWriter(w io.Writer) eventWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+	return w.w.Write(csvColumns)
+}
+
+func (w *csvWriter) WriteEvent(e *cadf.Event) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	var address, agent string
+	if e.Initiator.Host != nil {
+		address = e.Initiator.Host.Address
+		agent = e.Initiator.Host.Agent
+	}
+	row := []string{
+		e.ID, e.EventTime, e.EventType, string(e.Action), string(e.Outcome), e.RequestPath,
+		e.Reason.ReasonType, e.Reason.ReasonCode,
+		e.Initiator.TypeURI, e.Initiator.ID, e.Initiator.Name, e.Initiator.Domain,
+		e.Initiator.ProjectID, e.Initiator.DomainID, address, agent,
+		e.Target.TypeURI, e.Target.ID, e.Target.Name, e.Target.ProjectID, e.Target.DomainID,
+		e.Observer.TypeURI, e.Observer.ID, e.Observer.Name,
+	}
+	for idx, value := range row {
+		row[idx] = csvCell(value)
+	}
+	err = w.w.Write(row)
+	if err != nil {
+		return err
+	}
+	// hand every line over to the ResponseWriter, which does its own buffering
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// csvCell prefixes values that spreadsheets would evaluate as formulas with a
+// single quote, since names and reasons of events are chosen by their senders.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func (w *csvWriter) Close() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/exportevents"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// maxExportConfigSize limits the size of the request body of UpdateExportConfig.
+const maxExportConfigSize = 64 << 10
+
+// bucketNameRx follows the S3 bucket naming rules, since the export worker
+// uploads through the S3 API.
+var bucketNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// ExportConfigRequest is the model for JSON accepted by the UpdateExportConfig
+// API call. The project ID is taken from the URL, the last run time is only
+// written by the export worker.
+type ExportConfigRequest struct {
+	Enabled       bool                  `json:"enabled"`
+	BucketName    string                `json:"bucket_name"`
+	RetentionDays int                   `json:"retention_days"`
+	Filters       storage.ExportFilters `json:"filters"`
+}
+
+// GetExportConfig handles GET /v1/projects/:project_id/export-events.
+func (p *v1Provider) GetExportConfig(res http.ResponseWriter, req *http.Request) {
+	_, ok := p.AuthHandler(res, req, "export:show")
+	if !ok {
+		return
+	}
+	store, ok := p.exportConfigStore(res)
+	if !ok {
+		return
+	}
+
+	projectID := exportProjectID(req)
+	config, err := store.GetExportConfig(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.GetExportConfig: error getting export configuration from Storage: %s", err.Error())
+		return
+	}
+	if config == nil {
+		respondWithError(res, fmt.Sprintf("no export configuration found for project %s", projectID), http.StatusNotFound)
+		return
+	}
+	ReturnESJSON(res, http.StatusOK, config)
+}
+
+// UpdateExportConfig handles POST /v1/projects/:project_id/export-events.
+func (p *v1Provider) UpdateExportConfig(res http.ResponseWriter, req *http.Request) {
+	_, ok := p.AuthHandler(res, req, "export:update")
+	if !ok {
+		return
+	}
+	store, ok := p.exportConfigStore(res)
+	if !ok {
+		return
+	}
+
+	var request ExportConfigRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxExportConfigSize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(res, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	projectID := exportProjectID(req)
+	err = request.validate(projectID)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := store.GetExportConfig(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.UpdateExportConfig: error getting export configuration from Storage: %s", err.Error())
+		return
+	}
+
+	config := storage.ExportConfig{
+		ProjectID:     projectID,
+		Enabled:       request.Enabled,
+		BucketName:    request.BucketName,
+		RetentionDays: request.RetentionDays,
+		Filters:       request.Filters,
+	}
+	err = store.SaveExportConfig(req.Context(), config)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.UpdateExportConfig: error saving export configuration to Storage: %s", err.Error())
+		return
+	}
+	logg.Info("export configuration of project %s updated: enabled=%t bucket=%q", projectID, config.Enabled, config.BucketName)
+
+	// the progress of the export worker is kept when the configuration is replaced
+	if existing != nil {
+		config.LastRunTime = existing.LastRunTime
+	}
+	ReturnESJSON(res, http.StatusOK, config)
+}
+
+// DeleteExportConfig handles DELETE /v1/projects/:project_id/export-events.
+func (p *v1Provider) DeleteExportConfig(res http.ResponseWriter, req *http.Request) {
+	_, ok := p.AuthHandler(res, req, "export:update")
+	if !ok {
+		return
+	}
+	store, ok := p.exportConfigStore(res)
+	if !ok {
+		return
+	}
+
+	projectID := exportProjectID(req)
+	err := store.DeleteExportConfig(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.DeleteExportConfig: error deleting export configuration from Storage: %s", err.Error())
+		return
+	}
+	logg.Info("export configuration of project %s deleted", projectID)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// exportConfigStore returns the storage as ExportConfigStore, or writes an
+// error if the configured storage driver cannot store export configurations.
+func (p *v1Provider) exportConfigStore(res http.ResponseWriter) (storage.ExportConfigStore, bool) {
+	store, ok := p.storage.(storage.ExportConfigStore)
+	if !ok {
+		respondWithError(res, "event export is not supported by this storage driver", http.StatusNotImplemented)
+	}
+	return store, ok
+}
+
+func exportProjectID(req *http.Request) string {
+	// Sanitize user input
+	projectID := mux.Vars(req)["project_id"]
+	projectID = strings.ReplaceAll(projectID, "\n", "")
+	return strings.ReplaceAll(projectID, "\r", "")
+}
+
+func (r ExportConfigRequest) validate(projectID string) error {
+	if r.BucketName == "" {
+		if r.Enabled {
+			return errors.New("bucket_name is required to enable the export")
+		}
+	} else if !bucketNameRx.MatchString(r.BucketName) {
+		return fmt.Errorf("invalid bucket_name %q: must be 3-63 lowercase letters, digits, dots or hyphens", r.BucketName)
+	} else if !exportevents.IsProjectBucket(projectID, r.BucketName) {
+		return fmt.Errorf("invalid bucket_name %q: must be the project ID, optionally followed by \"-\" and a suffix", r.BucketName)
+	}
+	if r.RetentionDays < 0 {
+		return errors.New("retention_days must not be negative")
+	}
+
+	lists := []struct {
+		name   string
+		values []string
+	}{
+		{"event_types", r.Filters.EventTypes},
+		{"resource_types", r.Filters.ResourceTypes},
+		{"exclude_event_types", r.Filters.ExcludeEventTypes},
+		{"exclude_resource_types", r.Filters.ExcludeResourceTypes},
+	}
+	for _, list := range lists {
+		for _, value := range list.values {
+			if strings.TrimSpace(value) == "" {
+				return fmt.Errorf("invalid filters.%s: must not contain empty values", list.name)
+			}
+		}
+	}
+	return nil
+}
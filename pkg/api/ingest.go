@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/integrity"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// maxEventSize limits the size of a single event (or line of an NDJSON batch).
+	maxEventSize = 1 << 20
+	// maxCreateEventsSize limits the size of the request body of CreateEvents.
+	maxCreateEventsSize = 16 << 20
+	// maxCreateEventsCount limits the number of events in an NDJSON batch.
+	maxCreateEventsCount = 1000
+)
+
+// CreateEventsResult is the model for JSON returned by the CreateEvents API call
+type CreateEventsResult struct {
+	Created int                `json:"created"`
+	Errors  []CreateEventError `json:"errors,omitempty"`
+}
+
+// CreateEventError describes why a single event of CreateEvents was not stored.
+type CreateEventError struct {
+	Line  int    `json:"line"` // starting at 1, also for single events
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// CreateEvents handles POST /v1/events.
+//
+// The body is a single CADF event, or a batch of events with one event per
+// line if the Content-Type is application/x-ndjson. Events are only written
+// if all of them are valid. Stored events are never replaced, so retrying a
+// request that failed partially only fails for events that differ from the
+// stored event with the same ID.
+func (p *v1Provider) CreateEvents(res http.ResponseWriter, req *http.Request) {
+	logg.Debug("* api.CreateEvents: Check token")
+	_, ok := p.AuthHandler(res, req, "event:create")
+	if !ok {
+		return
+	}
+	writer, ok := p.storage.(storage.EventWriter)
+	if !ok {
+		respondWithError(res, "writing events is not supported by this storage driver", http.StatusNotImplemented)
+		return
+	}
+	if p.sealer != nil {
+		writer = integrity.SealingWriter{Writer: writer, Sealer: p.sealer}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/json"
+	}
+	body := http.MaxBytesReader(res, req.Body, maxCreateEventsSize)
+	var lines [][]byte
+	switch mediaType {
+	case "application/json":
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(http.MaxBytesReader(res, body, maxEventSize))
+		lines = [][]byte{buf.Bytes()}
+	case "application/x-ndjson":
+		lines, err = readLines(body)
+	default:
+		respondWithError(res, fmt.Sprintf("unsupported Content-Type %q, must be application/json or application/x-ndjson", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if maxBytesErr := new(http.MaxBytesError); errors.As(err, &maxBytesErr) {
+		respondWithError(res, fmt.Sprintf("request too large: events must not exceed %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		respondWithError(res, "could not read request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lines) > maxCreateEventsCount {
+		respondWithError(res, fmt.Sprintf("request too large: at most %d events can be created at once", maxCreateEventsCount), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// validate all events before writing any of them
+	var result CreateEventsResult
+	events := make([]storage.TenantEvent, 0, len(lines))
+	lineNumbers := make([]int, 0, len(lines))
+	for idx, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		event, tags, err := parseNewEvent(line)
+		if err != nil {
+			result.Errors = append(result.Errors, CreateEventError{Line: idx + 1, ID: event.ID, Error: err.Error()})
+			continue
+		}
+		tenantID, err := hermes.EventTenantID(event)
+		if err != nil {
+			result.Errors = append(result.Errors, CreateEventError{Line: idx + 1, ID: event.ID, Error: err.Error()})
+			continue
+		}
+		events = append(events, storage.TenantEvent{TenantID: tenantID, Event: event, Tags: tags})
+		lineNumbers = append(lineNumbers, idx+1)
+	}
+	if len(result.Errors) > 0 {
+		ReturnESJSON(res, http.StatusBadRequest, result)
+		return
+	}
+	if len(events) == 0 {
+		respondWithError(res, "no events given", http.StatusBadRequest)
+		return
+	}
+
+	logg.Debug("api.CreateEvents: writing %d events", len(events))
+	writeErrors, err := writer.WriteEvents(req.Context(), events)
+	if err != nil {
+		logg.Error("api.CreateEvents: error writing events to Storage: %s", err.Error())
+		storageErrorsCounter.Add(1)
+		respondWithError(res, "could not write events: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	statusCode := http.StatusCreated
+	for idx, err := range writeErrors {
+		if err == nil {
+			result.Created++
+			continue
+		}
+		result.Errors = append(result.Errors, CreateEventError{Line: lineNumbers[idx], ID: events[idx].Event.ID, Error: err.Error()})
+		switch {
+		case !errors.Is(err, storage.ErrEventRejected):
+			// the storage might accept the event later
+			statusCode = http.StatusServiceUnavailable
+		case statusCode == http.StatusCreated:
+			statusCode = http.StatusBadRequest
+		}
+	}
+	if statusCode == http.StatusServiceUnavailable {
+		storageErrorsCounter.Add(1)
+	}
+	ReturnESJSON(res, statusCode, result)
+}
+
+// parseNewEvent decodes and validates a single event with its tags. The
+// returned event is never nil, so that its ID can be reported even if it is
+// invalid.
+func parseNewEvent(data []byte) (*cadf.Event, []string, error) {
+	event, tags, err := hermes.DecodeEvent(data)
+	if err != nil {
+		return event, nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return event, tags, hermes.ValidateEvent(event)
+}
+
+// readLines splits an NDJSON body into lines.
+func readLines(body io.Reader) ([][]byte, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxEventSize)
+	var lines [][]byte
+	for scanner.Scan() {
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+	}
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return nil, &http.MaxBytesError{Limit: maxEventSize}
+	}
+	return lines, err
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/integrity"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// GetEventProof handles GET /v1/events/:event_id/proof.
+func (p *v1Provider) GetEventProof(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "event:show")
+	if !ok {
+		return
+	}
+	anchors, ok := p.storage.(storage.IntegrityStore)
+	if !ok {
+		respondWithError(res, "proofs are not supported by this storage driver", http.StatusNotImplemented)
+		return
+	}
+
+	eventID := mux.Vars(req)["event_id"]
+	if _, err := uuid.Parse(eventID); err != nil {
+		respondWithError(res, "Invalid event ID format", http.StatusBadRequest)
+		return
+	}
+
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+	// events are sealed per project or domain
+	if indexID == "" || strings.Contains(indexID, ",") {
+		respondWithError(res, "proofs can only be requested for a single project or domain", http.StatusBadRequest)
+		return
+	}
+
+	event, err := hermes.GetEvent(req.Context(), eventID, indexID, p.storage)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("error getting event from Storage: %s", err)
+		return
+	}
+	if event == nil {
+		err := fmt.Errorf("event %s could not be found in project %s", eventID, indexID)
+		respondWithError(res, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// the signature of the anchor can only be checked with the key of the sealer
+	var key []byte
+	if p.sealer != nil {
+		key = p.sealer.Key
+	}
+	proof, err := integrity.NewProof(req.Context(), anchors, key, indexID, event)
+	switch {
+	case errors.Is(err, integrity.ErrNotSealed):
+		respondWithError(res, fmt.Sprintf("event %s is not sealed yet", eventID), http.StatusNotFound)
+		return
+	case errors.Is(err, integrity.ErrModified):
+		logg.Error("event %s of %s does not match its anchor", eventID, indexID)
+		respondWithError(res, fmt.Sprintf("event %s does not match its anchor", eventID), http.StatusConflict)
+		return
+	case respondWithStorageError(res, req, err):
+		logg.Error("error getting proof of event %s: %s", eventID, err)
+		return
+	}
+	ReturnESJSON(res, http.StatusOK, proof)
+}
@@ -4,11 +4,16 @@
 package api
 
 import (
+	"context"
 	"net/http"
+	"regexp"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
 )
 
 // Prometheus metrics counters
@@ -71,6 +76,68 @@ func InstrumentResponseSize(handlerName string) func(http.Handler) http.Handler
 	}
 }
 
+// queryTimeout returns the configured timeout for the storage queries of a
+// handler: API.query_timeouts.<handler> if set, or else API.query_timeout.
+func queryTimeout(handlerName string) time.Duration {
+	key := "API.query_timeouts." + handlerName
+	if viper.IsSet(key) {
+		return viper.GetDuration(key)
+	}
+	return viper.GetDuration("API.query_timeout")
+}
+
+// WithQueryTimeout wraps a handler with the configured query timeout of the
+// handler, see queryTimeout. The timeout applies to the request context, which
+// the handlers pass on to the storage. A timeout of zero disables it.
+func WithQueryTimeout(handlerName string) func(http.Handler) http.Handler {
+	timeout := queryTimeout(handlerName)
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// CancelOnShutdown wraps a handler so that the request context is canceled
+// when ctx is done. The HTTP server only stops accepting new requests when
+// shutting down, this also aborts the storage queries of running requests.
+func CancelOnShutdown(ctx context.Context) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqCtx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			stop := context.AfterFunc(ctx, cancel)
+			defer stop()
+			next.ServeHTTP(w, r.WithContext(reqCtx))
+		})
+	}
+}
+
+// requestIDHeader carries the ID of a request, which is also reported in
+// error responses so that clients can refer to it.
+const requestIDHeader = "X-Request-Id"
+
+// requestIDRx matches the request IDs that are taken over from clients.
+var requestIDRx = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// WithRequestID sets the X-Request-Id response header to the request ID
+// given by the client, or to a new one in the format of OpenStack.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDRx.MatchString(requestID) {
+			requestID = "req-" + uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
 // getOrCreateHandlerMetrics safely gets or creates metrics for a handler
 func getOrCreateHandlerMetrics(handlerName string) *handlerMetricSet {
 	handlerMetricsMux.RLock()
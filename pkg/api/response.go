@@ -9,7 +9,8 @@ import (
 	"net/http"
 
 	"github.com/sapcc/go-bits/logg"
-	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/hermes/pkg/storage"
 )
 
 // ReturnESJSON is a custom response helper that preserves Elasticsearch URL formatting.
@@ -26,7 +27,7 @@ import (
 func ReturnESJSON(w http.ResponseWriter, code int, data any) {
 	payload, err := json.MarshalIndent(&data, "", "  ")
 	if err != nil {
-		respondwith.ErrorText(w, err)
+		respondWithError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -43,6 +44,106 @@ func ReturnESJSON(w http.ResponseWriter, code int, data any) {
 	}
 }
 
+// ErrorResponse is the body of all error responses.
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+// ErrorDetails describes the error in an ErrorResponse.
+type ErrorDetails struct {
+	Type      storage.ErrorType `json:"type"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// errorStatusCodes maps the error types to the status codes of the responses.
+var errorStatusCodes = map[storage.ErrorType]int{
+	storage.ErrorBadData:      http.StatusBadRequest,
+	storage.ErrorUnauthorized: http.StatusUnauthorized,
+	storage.ErrorForbidden:    http.StatusForbidden,
+	storage.ErrorNotFound:     http.StatusNotFound,
+	storage.ErrorInternal:     http.StatusInternalServerError,
+	storage.ErrorNotSupported: http.StatusNotImplemented,
+	storage.ErrorExec:         http.StatusBadGateway,
+	storage.ErrorUnavailable:  http.StatusServiceUnavailable,
+	storage.ErrorCanceled:     http.StatusServiceUnavailable,
+	storage.ErrorTimeout:      http.StatusGatewayTimeout,
+}
+
+// respondWithError is like http.Error, but writes an ErrorResponse with the
+// error type that matches the status code.
+func respondWithError(w http.ResponseWriter, message string, code int) {
+	errorType := storage.ErrorInternal
+	switch code {
+	case http.StatusBadRequest, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		errorType = storage.ErrorBadData
+	case http.StatusUnauthorized:
+		errorType = storage.ErrorUnauthorized
+	case http.StatusForbidden:
+		errorType = storage.ErrorForbidden
+	case http.StatusNotFound:
+		errorType = storage.ErrorNotFound
+	case http.StatusNotImplemented:
+		errorType = storage.ErrorNotSupported
+	case http.StatusServiceUnavailable:
+		errorType = storage.ErrorUnavailable
+	case http.StatusGatewayTimeout:
+		errorType = storage.ErrorTimeout
+	}
+	writeError(w, code, errorType, message)
+}
+
+// writeError writes an ErrorResponse. The request ID is taken from the
+// response header set by WithRequestID.
+func writeError(w http.ResponseWriter, code int, errorType storage.ErrorType, message string) {
+	payload, err := json.Marshal(ErrorResponse{Error: ErrorDetails{
+		Type:      errorType,
+		Message:   message,
+		RequestID: w.Header().Get(requestIDHeader),
+	}})
+	if err != nil {
+		// cannot happen with strings only, but http.Error is better than nothing
+		http.Error(w, message, code)
+		return
+	}
+
+	// like http.Error, remove headers meant for the successful response
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_, err = w.Write(append(payload, '\n'))
+	if err != nil {
+		logg.Error("Issue with writing error response: %s", err.Error())
+	}
+}
+
+// respondWithStorageError writes the response for an error returned by the
+// storage and returns true, or returns false if there is no error. The status
+// code depends on the error type reported by storage.ErrorTypeOf, e.g. queries
+// that ran into the timeout of the request get a 504 response, and queries
+// that were canceled by a client disconnect or server shutdown a 503.
+func respondWithStorageError(w http.ResponseWriter, r *http.Request, err error) bool {
+	errorType := storage.ErrorTypeOf(r.Context(), err)
+	message := ""
+	switch errorType {
+	case storage.ErrorNone:
+		return false
+	case storage.ErrorTimeout:
+		message = "storage query timed out"
+	case storage.ErrorCanceled:
+		message = "storage query was canceled"
+	default:
+		message = err.Error()
+	}
+	// errors caused by the request itself are not storage errors
+	if errorType != storage.ErrorCanceled && errorType != storage.ErrorBadData && errorType != storage.ErrorNotFound {
+		storageErrorsCounter.Add(1)
+	}
+	writeError(w, errorStatusCodes[errorType], errorType, message)
+	return true
+}
+
 // getProtocol determines the protocol (http or https) for building URLs.
 func getProtocol(req *http.Request) string {
 	protocol := "http"
@@ -0,0 +1,393 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/sapcc/go-bits/gopherpolicy"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// maxSavedSearchSize limits the size of the request body of CreateSavedSearch and UpdateSavedSearch.
+	maxSavedSearchSize = 64 << 10
+	// maxSavedSearchesPerProject limits the number of saved searches of a
+	// project, including the private searches of its users.
+	maxSavedSearchesPerProject = 500
+	// maxSavedSearchNameLength and maxSavedSearchDescriptionLength limit the
+	// length of the name and the description of a saved search.
+	maxSavedSearchNameLength        = 256
+	maxSavedSearchDescriptionLength = 4096
+)
+
+// savedSearchParamNames are the parameters of ListEvents that can be stored
+// in a saved search, in addition to filterParamNames.
+var savedSearchParamNames = []string{"time", "sort"}
+
+// SavedSearchRequest is the model for JSON accepted by the CreateSavedSearch
+// and UpdateSavedSearch API calls. The filter has the filter, time and sort
+// parameters of ListEvents as keys. Searches that are not shared are only
+// visible to the user who saved them.
+type SavedSearchRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Shared      bool              `json:"shared"`
+	Filter      map[string]string `json:"filter"`
+}
+
+// SavedSearchList is the model for JSON returned by the ListSavedSearches API call
+type SavedSearchList struct {
+	SavedSearches []storage.SavedSearch `json:"saved_searches"`
+}
+
+// ListSavedSearches handles GET /v1/saved-searches.
+func (p *v1Provider) ListSavedSearches(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "saved_search:show")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return
+	}
+
+	searches, err := store.ListSavedSearches(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.ListSavedSearches: error listing saved searches from Storage: %s", err.Error())
+		return
+	}
+	userID := token.Context.Auth["user_id"]
+	result := SavedSearchList{SavedSearches: []storage.SavedSearch{}}
+	for _, search := range searches {
+		if isVisible(search, userID) {
+			result.SavedSearches = append(result.SavedSearches, search)
+		}
+	}
+	slices.SortStableFunc(result.SavedSearches, func(a, b storage.SavedSearch) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	ReturnESJSON(res, http.StatusOK, result)
+}
+
+// CreateSavedSearch handles POST /v1/saved-searches.
+func (p *v1Provider) CreateSavedSearch(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "saved_search:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return
+	}
+	request, filter, ok := parseSavedSearchRequest(res, req)
+	if !ok {
+		return
+	}
+	owner, ok := savedSearchOwner(res, token, request)
+	if !ok {
+		return
+	}
+
+	existing, err := store.ListSavedSearches(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.CreateSavedSearch: error listing saved searches from Storage: %s", err.Error())
+		return
+	}
+	if len(existing) >= maxSavedSearchesPerProject {
+		respondWithError(res, fmt.Sprintf("project %s already has the maximum of %d saved searches", projectID, maxSavedSearchesPerProject), http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	search := storage.SavedSearch{
+		ID:          uuid.NewString(),
+		ProjectID:   projectID,
+		Name:        strings.TrimSpace(request.Name),
+		Description: request.Description,
+		UserID:      owner,
+		CreatedBy:   token.Context.Auth["user_id"],
+		Filter:      filter,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = store.SaveSavedSearch(req.Context(), search)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.CreateSavedSearch: error saving saved search to Storage: %s", err.Error())
+		return
+	}
+	logg.Info("saved search %s of project %s created: name=%q shared=%t", search.ID, projectID, search.Name, owner == "")
+
+	res.Header().Set("Location", "/v1/saved-searches/"+search.ID)
+	ReturnESJSON(res, http.StatusCreated, search)
+}
+
+// GetSavedSearch handles GET /v1/saved-searches/:saved_search_id.
+func (p *v1Provider) GetSavedSearch(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "saved_search:show")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return
+	}
+
+	search, ok := getSavedSearch(res, req, store, token, projectID, savedSearchIDParam(req))
+	if !ok {
+		return
+	}
+	ReturnESJSON(res, http.StatusOK, search)
+}
+
+// UpdateSavedSearch handles PUT /v1/saved-searches/:saved_search_id.
+func (p *v1Provider) UpdateSavedSearch(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "saved_search:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return
+	}
+	request, filter, ok := parseSavedSearchRequest(res, req)
+	if !ok {
+		return
+	}
+	owner, ok := savedSearchOwner(res, token, request)
+	if !ok {
+		return
+	}
+	search, ok := getSavedSearch(res, req, store, token, projectID, savedSearchIDParam(req))
+	if !ok || !mayChangeSavedSearch(res, token, *search) {
+		return
+	}
+
+	if search.CreatedBy == "" {
+		// searches saved before their creator was recorded
+		search.CreatedBy = search.UserID
+	}
+	search.Name = strings.TrimSpace(request.Name)
+	search.Description = request.Description
+	search.UserID = owner
+	search.Filter = filter
+	search.UpdatedAt = time.Now().UTC()
+	err := store.SaveSavedSearch(req.Context(), *search)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.UpdateSavedSearch: error saving saved search to Storage: %s", err.Error())
+		return
+	}
+	logg.Info("saved search %s of project %s updated: name=%q shared=%t", search.ID, projectID, search.Name, owner == "")
+	ReturnESJSON(res, http.StatusOK, search)
+}
+
+// DeleteSavedSearch handles DELETE /v1/saved-searches/:saved_search_id.
+func (p *v1Provider) DeleteSavedSearch(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "saved_search:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return
+	}
+
+	// the private searches of other users must not be deleted
+	search, ok := getSavedSearch(res, req, store, token, projectID, savedSearchIDParam(req))
+	if !ok || !mayChangeSavedSearch(res, token, *search) {
+		return
+	}
+	err := store.DeleteSavedSearch(req.Context(), projectID, search.ID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.DeleteSavedSearch: error deleting saved search from Storage: %s", err.Error())
+		return
+	}
+	logg.Info("saved search %s of project %s deleted", search.ID, projectID)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// applySavedSearch adds the parameters of the saved search that is selected
+// by the saved_search parameter to the form of the request. Parameters that
+// are given in the request replace those of the saved search.
+func (p *v1Provider) applySavedSearch(res http.ResponseWriter, req *http.Request, token *gopherpolicy.Token) bool {
+	// Being able to list the events is enough to run any saved search that is
+	// visible to the user, since it only preselects parameters.
+	store, projectID, ok := p.savedSearchStore(res, token)
+	if !ok {
+		return false
+	}
+	searchID := strings.ReplaceAll(strings.ReplaceAll(req.FormValue("saved_search"), "\n", ""), "\r", "")
+	search, ok := getSavedSearch(res, req, store, token, projectID, searchID)
+	if !ok {
+		return false
+	}
+
+	params, err := savedSearchParams(search.Filter)
+	if err != nil {
+		logg.Error("api.ListEvents: cannot read the filter of saved search %s: %s", search.ID, err.Error())
+		respondWithError(res, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	for name, value := range params {
+		if !req.Form.Has(name) {
+			req.Form.Set(name, value)
+		}
+	}
+	return true
+}
+
+// savedSearchStore returns the storage as SavedSearchStore and the project of
+// the token, or writes an error if either is not available.
+func (p *v1Provider) savedSearchStore(res http.ResponseWriter, token *gopherpolicy.Token) (storage.SavedSearchStore, string, bool) {
+	store, ok := p.storage.(storage.SavedSearchStore)
+	if !ok {
+		respondWithError(res, "saved searches are not supported by this storage driver", http.StatusNotImplemented)
+		return nil, "", false
+	}
+	projectID := token.Context.Auth["project_id"]
+	if projectID == "" {
+		respondWithError(res, "saved searches require a project-scoped token", http.StatusBadRequest)
+		return nil, "", false
+	}
+	return store, projectID, true
+}
+
+// getSavedSearch returns the saved search with the given ID, or writes an
+// error if it does not exist in the project or is private to another user.
+func getSavedSearch(res http.ResponseWriter, req *http.Request, store storage.SavedSearchStore, token *gopherpolicy.Token, projectID, searchID string) (*storage.SavedSearch, bool) {
+	search, err := store.GetSavedSearch(req.Context(), projectID, searchID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.GetSavedSearch: error getting saved search from Storage: %s", err.Error())
+		return nil, false
+	}
+	if search == nil || !isVisible(*search, token.Context.Auth["user_id"]) {
+		respondWithError(res, fmt.Sprintf("saved search %s could not be found in project %s", searchID, projectID), http.StatusNotFound)
+		return nil, false
+	}
+	return search, true
+}
+
+// isVisible returns whether the saved search is shared with the project or
+// belongs to the user.
+func isVisible(search storage.SavedSearch, userID string) bool {
+	return search.UserID == "" || search.UserID == userID
+}
+
+// mayChangeSavedSearch returns whether the token may change or delete the
+// saved search, or writes an error otherwise. Shared searches may only be
+// changed by the user who created them, or with the
+// saved_search:update_shared rule, so that other users cannot replace,
+// delete or hide them.
+func mayChangeSavedSearch(res http.ResponseWriter, token *gopherpolicy.Token, search storage.SavedSearch) bool {
+	// getSavedSearch only returns private searches to their owner
+	if search.UserID != "" {
+		return true
+	}
+	userID := token.Context.Auth["user_id"]
+	if userID != "" && userID == search.CreatedBy {
+		return true
+	}
+	if !token.Enforcer.Enforce("saved_search:update_shared", token.Context) {
+		respondWithError(res, fmt.Sprintf("saved search %s can only be changed by the user who created it or by an admin of the project", search.ID), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// savedSearchOwner returns the owner of a saved search with the given
+// request, which is empty for shared searches.
+func savedSearchOwner(res http.ResponseWriter, token *gopherpolicy.Token, request SavedSearchRequest) (string, bool) {
+	if request.Shared {
+		return "", true
+	}
+	userID := token.Context.Auth["user_id"]
+	if userID == "" {
+		respondWithError(res, "private saved searches require the token of a user", http.StatusBadRequest)
+		return "", false
+	}
+	return userID, true
+}
+
+func savedSearchIDParam(req *http.Request) string {
+	// Sanitize user input
+	searchID := mux.Vars(req)["saved_search_id"]
+	searchID = strings.ReplaceAll(searchID, "\n", "")
+	return strings.ReplaceAll(searchID, "\r", "")
+}
+
+// savedSearchParams returns the parameters of ListEvents that the filter of
+// a saved search consists of. The fields of the filter are named after them.
+func savedSearchParams(filter storage.SavedSearchFilter) (map[string]string, error) {
+	buf, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var params map[string]string
+	err = json.Unmarshal(buf, &params)
+	return params, err
+}
+
+// parseSavedSearchRequest decodes and validates the request body, or writes
+// an error if it is invalid.
+func parseSavedSearchRequest(res http.ResponseWriter, req *http.Request) (SavedSearchRequest, storage.SavedSearchFilter, bool) {
+	var request SavedSearchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxSavedSearchSize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(res, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return request, storage.SavedSearchFilter{}, false
+	}
+	filter, err := request.validate()
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return request, storage.SavedSearchFilter{}, false
+	}
+	return request, filter, true
+}
+
+func (r SavedSearchRequest) validate() (storage.SavedSearchFilter, error) {
+	name := strings.TrimSpace(r.Name)
+	if name == "" {
+		return storage.SavedSearchFilter{}, errors.New("name is required")
+	}
+	if len(name) > maxSavedSearchNameLength {
+		return storage.SavedSearchFilter{}, fmt.Errorf("invalid name: must not be longer than %d characters", maxSavedSearchNameLength)
+	}
+	if len(r.Description) > maxSavedSearchDescriptionLength {
+		return storage.SavedSearchFilter{}, fmt.Errorf("invalid description: must not be longer than %d characters", maxSavedSearchDescriptionLength)
+	}
+
+	// the filter is validated like the parameters of ListEvents, and the
+	// time range is kept as given, so that relative times stay relative
+	form := make(url.Values, len(r.Filter))
+	for name, value := range r.Filter {
+		if !slices.Contains(filterParamNames, name) && !slices.Contains(savedSearchParamNames, name) {
+			return storage.SavedSearchFilter{}, fmt.Errorf("invalid filter: unknown parameter %s", name)
+		}
+		form.Set(name, strings.TrimSpace(value))
+	}
+	filter, err := parseSearchParams(form)
+	if err != nil {
+		return storage.SavedSearchFilter{}, fmt.Errorf("invalid filter: %w", err)
+	}
+	return storage.SavedSearchFilter{
+		SubscriptionFilter: hermes.NewSubscriptionFilter(filter),
+		Time:               form.Get("time"),
+		Sort:               form.Get("sort"),
+	}, nil
+}
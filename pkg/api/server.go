@@ -15,15 +15,18 @@ import (
 	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/logg"
 
+	"github.com/sapcc/hermes/pkg/alerts"
+	"github.com/sapcc/hermes/pkg/identity"
+	"github.com/sapcc/hermes/pkg/integrity"
 	"github.com/sapcc/hermes/pkg/storage"
 )
 
 // Server Set up and start the API server using httpapi patterns
-func Server(validator gopherpolicy.Validator, storageInterface storage.Storage) error {
+func Server(validator gopherpolicy.Validator, storageInterface storage.Storage, projects identity.ProjectLister, alertEngine *alerts.Engine, sealer *integrity.Sealer) error {
 	logg.Info("Starting Hermes API server")
 
 	// Create API compositions
-	v1API := NewV1API(validator, storageInterface)
+	v1API := NewV1API(validator, storageInterface, projects, alertEngine, sealer)
 	versionAPI := NewVersionAPI(v1API.VersionData())
 	metricsAPI := NewMetricsAPI()
 
@@ -32,22 +35,30 @@ func Server(validator gopherpolicy.Validator, storageInterface storage.Storage)
 		v1API,
 		versionAPI,
 		metricsAPI,
+		httpapi.WithGlobalMiddleware(WithRequestID),
 	)
 
 	// Apply middleware
+	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	handler = CancelOnShutdown(ctx)(handler)
+	if alertEngine != nil {
+		go alertEngine.Run(ctx)
+	}
 	handler = InstrumentInflight(handler)
 
 	// Enable CORS support
 	c := cors.New(cors.Options{
-		AllowedHeaders: []string{"X-Auth-Token", "Content-Type", "Accept"},
-		AllowedMethods: []string{"GET", "HEAD"},
+		AllowedHeaders: []string{"X-Auth-Token", "Content-Type", "Accept", "X-Request-Id", "Last-Event-ID"},
+		ExposedHeaders: []string{"X-Request-Id"},
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
 		MaxAge:         600,
 	})
 	handler = c.Handler(handler)
 
 	// Start HTTP server
 	listenAddress := viper.GetString("API.ListenAddress")
-
-	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
-	return httpext.ListenAndServeContext(ctx, listenAddress, handler)
+	err := httpext.ListenAndServeContext(ctx, listenAddress, handler)
+	// finish recording the accesses of the last requests
+	v1API.provider.accessWrites.Wait()
+	return err
 }
@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/query"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// maxStatsGroupBy limits the number of fields in the group_by parameter of GetStats.
+	maxStatsGroupBy = 4
+	// maxStatsLimit limits the number of buckets returned by GetStats.
+	maxStatsLimit = 1000
+	// maxHistogramBuckets limits the number of intervals in the time range of GetHistogram.
+	maxHistogramBuckets = 10000
+	// maxHistogramInterval limits the interval parameter of GetHistogram.
+	maxHistogramInterval = 365 * 24 * time.Hour
+	// maxHistogramSplitLimit limits the number of values per interval returned by GetHistogram.
+	maxHistogramSplitLimit = 100
+)
+
+// histogramIntervalRx matches the interval parameter of GetHistogram, e.g. "15m", "1h" or "7d".
+var histogramIntervalRx = regexp.MustCompile(`^([1-9][0-9]{0,5})([mhd])$`)
+
+// GetStats handles GET /v1/stats.
+func (p *v1Provider) GetStats(res http.ResponseWriter, req *http.Request) {
+	logg.Debug("* api.GetStats: Check token")
+	token, ok := p.AuthHandler(res, req, "event:list")
+	if !ok {
+		return
+	}
+	aggregator, ok := p.storage.(storage.EventAggregator)
+	if !ok {
+		respondWithError(res, "statistics are not supported by this storage driver", http.StatusNotImplemented)
+		return
+	}
+
+	groupBy, err := parseGroupBy(req.FormValue("group_by"))
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var limit uint = 10
+	if limitStr := req.FormValue("limit"); limitStr != "" {
+		parsedLimit, err := strconv.ParseUint(limitStr, 10, 32)
+		if err != nil || parsedLimit == 0 || parsedLimit > maxStatsLimit {
+			respondWithError(res, fmt.Sprintf("Invalid limit value: must be between 1 and %d", maxStatsLimit), http.StatusBadRequest)
+			return
+		}
+		limit = uint(parsedLimit)
+	}
+
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+	logg.Debug("api.GetStats: call hermes.GetStats()")
+	stats, err := hermes.GetStats(req.Context(), filter, indexID, groupBy, limit, aggregator)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.GetStats: error calling hermes.GetStats(): %s", err.Error())
+		return
+	}
+	ReturnESJSON(res, http.StatusOK, stats)
+}
+
+// parseGroupBy parses the comma-separated list of fields in the group_by parameter.
+func parseGroupBy(param string) ([]string, error) {
+	if strings.TrimSpace(param) == "" {
+		return nil, fmt.Errorf("missing group_by parameter, valid fields: %s", strings.Join(hermes.StatsFields, ", "))
+	}
+	var groupBy []string
+	for field := range strings.SplitSeq(param, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+			return nil, errors.New("invalid group_by parameter: field name cannot be empty")
+		case !slices.Contains(hermes.StatsFields, field):
+			return nil, fmt.Errorf("cannot group by %s, valid fields: %s", field, strings.Join(hermes.StatsFields, ", "))
+		case slices.Contains(groupBy, field):
+			return nil, fmt.Errorf("cannot group by %s more than once", field)
+		}
+		groupBy = append(groupBy, field)
+	}
+	if len(groupBy) > maxStatsGroupBy {
+		return nil, fmt.Errorf("cannot group by more than %d fields", maxStatsGroupBy)
+	}
+	return groupBy, nil
+}
+
+// GetHistogram handles GET /v1/events/histogram.
+func (p *v1Provider) GetHistogram(res http.ResponseWriter, req *http.Request) {
+	logg.Debug("* api.GetHistogram: Check token")
+	token, ok := p.AuthHandler(res, req, "event:list")
+	if !ok {
+		return
+	}
+	aggregator, ok := p.storage.(storage.EventAggregator)
+	if !ok {
+		respondWithError(res, "histograms are not supported by this storage driver", http.StatusNotImplemented)
+		return
+	}
+
+	interval := time.Hour
+	if intervalStr := req.FormValue("interval"); intervalStr != "" {
+		var err error
+		interval, err = parseHistogramInterval(intervalStr)
+		if err != nil {
+			respondWithError(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	splitBy := strings.TrimSpace(req.FormValue("split_by"))
+	if splitBy != "" && !slices.Contains(hermes.StatsFields, splitBy) {
+		respondWithError(res, fmt.Sprintf("cannot split by %s, valid fields: %s", splitBy, strings.Join(hermes.StatsFields, ", ")), http.StatusBadRequest)
+		return
+	}
+	var splitLimit uint = 5
+	if limitStr := req.FormValue("split_limit"); limitStr != "" {
+		parsedLimit, err := strconv.ParseUint(limitStr, 10, 32)
+		if err != nil || parsedLimit == 0 || parsedLimit > maxHistogramSplitLimit {
+			respondWithError(res, fmt.Sprintf("Invalid split_limit value: must be between 1 and %d", maxHistogramSplitLimit), http.StatusBadRequest)
+			return
+		}
+		splitLimit = uint(parsedLimit)
+	}
+
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = limitHistogramRange(filter, interval)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+	logg.Debug("api.GetHistogram: call hermes.GetHistogram()")
+	histogram, err := hermes.GetHistogram(req.Context(), filter, indexID, interval, splitBy, splitLimit, aggregator)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.GetHistogram: error calling hermes.GetHistogram(): %s", err.Error())
+		return
+	}
+	ReturnESJSON(res, http.StatusOK, histogram)
+}
+
+// parseHistogramInterval parses the interval parameter, a number followed by
+// one of the units m (minutes), h (hours) or d (days), of at most
+// maxHistogramInterval.
+func parseHistogramInterval(param string) (time.Duration, error) {
+	match := histogramIntervalRx.FindStringSubmatch(param)
+	if match == nil {
+		return 0, fmt.Errorf("invalid interval %q: must be a number followed by m, h or d, e.g. 1h", param)
+	}
+	value, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q: %w", param, err)
+	}
+	units := map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+	unit := units[match[2]]
+	// compared before multiplying, so that large values cannot overflow
+	if time.Duration(value) > maxHistogramInterval/unit {
+		return 0, fmt.Errorf("invalid interval %q: must not be longer than 365d", param)
+	}
+	return time.Duration(value) * unit, nil
+}
+
+// limitHistogramRange rejects histograms with too many intervals in the time
+// range of the filter. The time range ends now if it has no upper bound. If it
+// has no lower bound, it is restricted to the last maxHistogramBuckets
+// intervals, but not before 1970-01-01, since the storage fills in all
+// intervals up to the first event.
+func limitHistogramRange(filter *hermes.EventFilter, interval time.Duration) error {
+	now := time.Now()
+	var start, end time.Time
+	for operator, value := range filter.Time {
+		t, err := query.ParseTime(value, now)
+		if err != nil {
+			return err
+		}
+		switch operator {
+		case "gt", "gte":
+			start = t
+		case "lt", "lte":
+			end = t
+		}
+	}
+	if end.IsZero() {
+		end = now
+	}
+	if start.IsZero() {
+		if filter.Time == nil {
+			filter.Time = make(map[string]string)
+		}
+		start = time.Unix(0, 0)
+		// maxHistogramBuckets long intervals do not fit into a time.Duration
+		if interval <= math.MaxInt64/maxHistogramBuckets && end.Add(-maxHistogramBuckets*interval).After(start) {
+			start = end.Add(-maxHistogramBuckets * interval)
+		}
+		filter.Time["gte"] = start.UTC().Format(time.RFC3339)
+		return nil
+	}
+	if end.Sub(start)/interval > maxHistogramBuckets {
+		return fmt.Errorf("too many intervals: the time range must not contain more than %d intervals", maxHistogramBuckets)
+	}
+	return nil
+}
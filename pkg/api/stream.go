@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// streamHeartbeatInterval is the time without events after which a comment
+// is sent, so that proxies do not close the idle connection.
+const streamHeartbeatInterval = 15 * time.Second
+
+var (
+	activeStreams      atomic.Int64
+	activeStreamsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hermes_event_streams_active",
+		Help: "Number of open event streams",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(activeStreamsGauge)
+}
+
+// StreamEvents handles GET /v1/events/stream.
+//
+// The events matching the filter are sent as Server-Sent Events while they
+// are written to the storage. The ID of each event can be given as
+// Last-Event-ID header (or last_event_id parameter) to continue after it.
+// The token is checked again periodically, so that the stream ends once the
+// token expires, is revoked or loses its permissions.
+func (p *v1Provider) StreamEvents(res http.ResponseWriter, req *http.Request) {
+	logg.Debug("* api.StreamEvents: Check token")
+	token, ok := p.AuthHandler(res, req, "event:list")
+	if !ok {
+		return
+	}
+
+	for _, param := range []string{"time", "sort", "offset", "limit", "cursor"} {
+		if req.URL.Query().Has(param) {
+			respondWithError(res, fmt.Sprintf("the %s parameter is not supported by the event stream", param), http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := parseEventFilter(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Fields, err = parseFields(req)
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	indexID, err := p.getIndexID(token, req, res)
+	if err != nil {
+		return
+	}
+
+	resumeID := req.Header.Get("Last-Event-ID")
+	if resumeID == "" {
+		resumeID = req.FormValue("last_event_id")
+	}
+	tail, err := hermes.NewEventTail(filter, indexID, resumeID, viper.GetDuration("API.stream_lookback"), time.Now())
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxStreams := viper.GetInt64("API.max_streams")
+	if count := activeStreams.Add(1); maxStreams > 0 && count > maxStreams {
+		activeStreams.Add(-1)
+		respondWithError(res, fmt.Sprintf("too many open event streams, at most %d are allowed", maxStreams), http.StatusServiceUnavailable)
+		return
+	}
+	activeStreamsGauge.Inc()
+	defer func() {
+		activeStreams.Add(-1)
+		activeStreamsGauge.Dec()
+	}()
+
+	// The first poll happens before the response is started, so that its
+	// errors can be reported with the status code. Errors after that point
+	// are sent as error event and end the stream, after which clients
+	// reconnect with the ID of the last event.
+	events, more, err := pollEventTail(req.Context(), tail, p.storage)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.StreamEvents: error polling events: %s", err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// disable response buffering in nginx
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(res)
+
+	pollInterval := viper.GetDuration("API.stream_poll_interval")
+	tokenCheckInterval := viper.GetDuration("API.stream_token_check_interval")
+	lastWrite := time.Now()
+	lastTokenCheck := time.Now()
+	for {
+		var buf bytes.Buffer
+		for _, event := range events {
+			err = writeStreamEvent(&buf, event)
+			if err != nil {
+				logg.Error("api.StreamEvents: could not serialize event: %s", err.Error())
+				return
+			}
+		}
+		if buf.Len() == 0 && time.Since(lastWrite) >= streamHeartbeatInterval {
+			buf.WriteString(": heartbeat\n\n")
+		}
+		if buf.Len() > 0 {
+			_, err = res.Write(buf.Bytes())
+			if err == nil {
+				err = controller.Flush()
+			}
+			if err != nil {
+				logg.Debug("api.StreamEvents: client went away: %s", err.Error())
+				return
+			}
+			lastWrite = time.Now()
+		}
+
+		if !more {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+
+		if tokenCheckInterval > 0 && time.Since(lastTokenCheck) >= tokenCheckInterval {
+			errorType, err := p.recheckToken(req, "event:list")
+			if err != nil {
+				logg.Debug("api.StreamEvents: closing stream: %s", err.Error())
+				writeStreamError(res, errorType, err)
+				return
+			}
+			lastTokenCheck = time.Now()
+		}
+
+		events, more, err = pollEventTail(req.Context(), tail, p.storage)
+		if err != nil {
+			errorType := storage.ErrorTypeOf(req.Context(), err)
+			if errorType == storage.ErrorCanceled {
+				return
+			}
+			logg.Error("api.StreamEvents: error polling events: %s", err.Error())
+			storageErrorsCounter.Add(1)
+			writeStreamError(res, errorType, err)
+			return
+		}
+	}
+}
+
+// recheckToken checks whether the token of an open stream is still valid and
+// still permits the rule. The returned error is meant for the client.
+func (p *v1Provider) recheckToken(req *http.Request, rule string) (storage.ErrorType, error) {
+	token := p.checkToken(req)
+	if token.Err != nil {
+		if token.Context.Logger != nil {
+			token.Context.Logger(fmt.Sprintf("token of event stream is no longer valid: %s", token.Err.Error()))
+		}
+		return storage.ErrorUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized))
+	}
+	if !token.Enforcer.Enforce(rule, token.Context) {
+		return storage.ErrorForbidden, errors.New(http.StatusText(http.StatusForbidden))
+	}
+	return storage.ErrorNone, nil
+}
+
+// pollEventTail polls with the query timeout of the StreamEvents handler,
+// which applies to each poll instead of the whole request.
+func pollEventTail(ctx context.Context, tail *hermes.EventTail, eventStore storage.Storage) ([]hermes.TailEvent, bool, error) {
+	if timeout := queryTimeout("StreamEvents"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return tail.Poll(ctx, eventStore)
+}
+
+// writeStreamEvent writes an event in the format of Server-Sent Events.
+func writeStreamEvent(buf *bytes.Buffer, event hermes.TailEvent) error {
+	fmt.Fprintf(buf, "id: %s\ndata: ", event.ResumeID)
+	encoder := json.NewEncoder(buf)
+	// Keep URLs readable, just like ReturnESJSON does
+	encoder.SetEscapeHTML(false)
+	// the newline after the JSON ends the data field
+	err := encoder.Encode(event.Event)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	return nil
+}
+
+// writeStreamError writes an error event with an ErrorResponse as data.
+func writeStreamError(w http.ResponseWriter, errorType storage.ErrorType, err error) {
+	message := err.Error()
+	if errorType == storage.ErrorTimeout {
+		message = "storage query timed out"
+	}
+	payload, err := json.Marshal(ErrorResponse{Error: ErrorDetails{
+		Type:      errorType,
+		Message:   message,
+		RequestID: w.Header().Get(requestIDHeader),
+	}})
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "event: error\ndata: %s\n\n", payload)
+	if err == nil {
+		err = http.NewResponseController(w).Flush()
+	}
+	if err != nil {
+		logg.Debug("api.StreamEvents: could not write error event: %s", err.Error())
+	}
+}
@@ -0,0 +1,370 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+
+	"github.com/sapcc/go-bits/gopherpolicy"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+	"github.com/sapcc/hermes/pkg/webhooks"
+)
+
+const (
+	// maxSubscriptionSize limits the size of the request body of CreateSubscription and UpdateSubscription.
+	maxSubscriptionSize = 64 << 10
+	// maxSubscriptionsPerProject limits the number of subscriptions of a project.
+	maxSubscriptionsPerProject = 100
+	// maxSubscriptionURLLength limits the length of the URL of a subscription.
+	maxSubscriptionURLLength = 2048
+	// minSecretLength and maxSecretLength limit the length of a given secret.
+	minSecretLength = 16
+	maxSecretLength = 256
+)
+
+// SubscriptionRequest is the model for JSON accepted by the CreateSubscription
+// and UpdateSubscription API calls. The filter has the filter parameters of
+// ListEvents as keys.
+type SubscriptionRequest struct {
+	URL     string            `json:"url"`
+	Secret  string            `json:"secret"`
+	Enabled *bool             `json:"enabled"`
+	Filter  map[string]string `json:"filter"`
+}
+
+// SubscriptionList is the model for JSON returned by the ListSubscriptions API call
+type SubscriptionList struct {
+	Subscriptions []storage.Subscription `json:"subscriptions"`
+}
+
+// DeliveryList is the model for JSON returned by the ListDeliveries API call
+type DeliveryList struct {
+	Deliveries []storage.Delivery `json:"deliveries"`
+}
+
+// ListSubscriptions handles GET /v1/subscriptions.
+func (p *v1Provider) ListSubscriptions(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:show")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+
+	subscriptions, err := store.ListSubscriptions(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.ListSubscriptions: error listing subscriptions from Storage: %s", err.Error())
+		return
+	}
+	result := SubscriptionList{Subscriptions: make([]storage.Subscription, 0, len(subscriptions))}
+	for _, subscription := range subscriptions {
+		subscription.Secret = ""
+		result.Subscriptions = append(result.Subscriptions, subscription)
+	}
+	ReturnESJSON(res, http.StatusOK, result)
+}
+
+// CreateSubscription handles POST /v1/subscriptions.
+func (p *v1Provider) CreateSubscription(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+	request, filter, ok := parseSubscriptionRequest(res, req)
+	if !ok {
+		return
+	}
+
+	existing, err := store.ListSubscriptions(req.Context(), projectID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.CreateSubscription: error listing subscriptions from Storage: %s", err.Error())
+		return
+	}
+	if len(existing) >= maxSubscriptionsPerProject {
+		respondWithError(res, fmt.Sprintf("project %s already has the maximum of %d subscriptions", projectID, maxSubscriptionsPerProject), http.StatusConflict)
+		return
+	}
+
+	secret := request.Secret
+	if secret == "" {
+		secret = newSecret()
+	}
+	now := time.Now().UTC()
+	subscription := storage.Subscription{
+		ID:        uuid.NewString(),
+		ProjectID: projectID,
+		URL:       request.URL,
+		Secret:    secret,
+		Enabled:   request.Enabled == nil || *request.Enabled,
+		Filter:    filter,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = store.SaveSubscription(req.Context(), subscription)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.CreateSubscription: error saving subscription to Storage: %s", err.Error())
+		return
+	}
+	logg.Info("subscription %s of project %s created: url=%q", subscription.ID, projectID, subscription.URL)
+
+	// the secret is only returned once, so that Hermes can generate it
+	res.Header().Set("Location", "/v1/subscriptions/"+subscription.ID)
+	ReturnESJSON(res, http.StatusCreated, subscription)
+}
+
+// GetSubscription handles GET /v1/subscriptions/:subscription_id.
+func (p *v1Provider) GetSubscription(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:show")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+
+	subscription, ok := getSubscription(res, req, store, projectID)
+	if !ok {
+		return
+	}
+	subscription.Secret = ""
+	ReturnESJSON(res, http.StatusOK, subscription)
+}
+
+// UpdateSubscription handles PUT /v1/subscriptions/:subscription_id.
+func (p *v1Provider) UpdateSubscription(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+	request, filter, ok := parseSubscriptionRequest(res, req)
+	if !ok {
+		return
+	}
+	subscription, ok := getSubscription(res, req, store, projectID)
+	if !ok {
+		return
+	}
+
+	// the secret is kept if none is given
+	if request.Secret != "" {
+		subscription.Secret = request.Secret
+	}
+	subscription.URL = request.URL
+	subscription.Enabled = request.Enabled == nil || *request.Enabled
+	subscription.Filter = filter
+	subscription.UpdatedAt = time.Now().UTC()
+	err := store.UpdateSubscription(req.Context(), *subscription)
+	if errors.Is(err, storage.ErrSubscriptionNotFound) {
+		// deleted since it was read
+		respondWithError(res, fmt.Sprintf("subscription %s could not be found in project %s", subscription.ID, projectID), http.StatusNotFound)
+		return
+	}
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.UpdateSubscription: error saving subscription to Storage: %s", err.Error())
+		return
+	}
+	logg.Info("subscription %s of project %s updated: url=%q enabled=%t", subscription.ID, projectID, subscription.URL, subscription.Enabled)
+
+	subscription.Secret = ""
+	ReturnESJSON(res, http.StatusOK, subscription)
+}
+
+// DeleteSubscription handles DELETE /v1/subscriptions/:subscription_id.
+func (p *v1Provider) DeleteSubscription(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:update")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+
+	subscription, ok := getSubscription(res, req, store, projectID)
+	if !ok {
+		return
+	}
+	err := store.DeleteSubscription(req.Context(), projectID, subscription.ID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.DeleteSubscription: error deleting subscription from Storage: %s", err.Error())
+		return
+	}
+	logg.Info("subscription %s of project %s deleted", subscription.ID, projectID)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries handles GET /v1/subscriptions/:subscription_id/deliveries.
+func (p *v1Provider) ListDeliveries(res http.ResponseWriter, req *http.Request) {
+	token, ok := p.AuthHandler(res, req, "subscription:show")
+	if !ok {
+		return
+	}
+	store, projectID, ok := p.subscriptionStore(res, token)
+	if !ok {
+		return
+	}
+
+	limit := uint64(100)
+	if limitStr := req.FormValue("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.ParseUint(limitStr, 10, 32)
+		if err != nil || limit == 0 || limit > 1000 {
+			respondWithError(res, "invalid limit: must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the deliveries of other projects must not be listed
+	subscription, ok := getSubscription(res, req, store, projectID)
+	if !ok {
+		return
+	}
+	deliveries, err := store.ListDeliveries(req.Context(), subscription.ID, uint(limit))
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.ListDeliveries: error listing deliveries from Storage: %s", err.Error())
+		return
+	}
+	if deliveries == nil {
+		deliveries = []storage.Delivery{}
+	}
+	ReturnESJSON(res, http.StatusOK, DeliveryList{Deliveries: deliveries})
+}
+
+// subscriptionStore returns the storage as SubscriptionStore and the project
+// of the token, or writes an error if either is not available.
+func (p *v1Provider) subscriptionStore(res http.ResponseWriter, token *gopherpolicy.Token) (storage.SubscriptionStore, string, bool) {
+	store, ok := p.storage.(storage.SubscriptionStore)
+	if !ok {
+		respondWithError(res, "webhook subscriptions are not supported by this storage driver", http.StatusNotImplemented)
+		return nil, "", false
+	}
+	projectID := token.Context.Auth["project_id"]
+	if projectID == "" {
+		respondWithError(res, "webhook subscriptions require a project-scoped token", http.StatusBadRequest)
+		return nil, "", false
+	}
+	return store, projectID, true
+}
+
+// getSubscription returns the subscription from the URL, or writes an error
+// if it does not exist in the project.
+func getSubscription(res http.ResponseWriter, req *http.Request, store storage.SubscriptionStore, projectID string) (*storage.Subscription, bool) {
+	subscriptionID := subscriptionIDParam(req)
+	subscription, err := store.GetSubscription(req.Context(), projectID, subscriptionID)
+	if respondWithStorageError(res, req, err) {
+		logg.Error("api.GetSubscription: error getting subscription from Storage: %s", err.Error())
+		return nil, false
+	}
+	if subscription == nil {
+		respondWithError(res, fmt.Sprintf("subscription %s could not be found in project %s", subscriptionID, projectID), http.StatusNotFound)
+		return nil, false
+	}
+	return subscription, true
+}
+
+func subscriptionIDParam(req *http.Request) string {
+	// Sanitize user input
+	subscriptionID := mux.Vars(req)["subscription_id"]
+	subscriptionID = strings.ReplaceAll(subscriptionID, "\n", "")
+	return strings.ReplaceAll(subscriptionID, "\r", "")
+}
+
+// parseSubscriptionRequest decodes and validates the request body, or writes
+// an error if it is invalid.
+func parseSubscriptionRequest(res http.ResponseWriter, req *http.Request) (SubscriptionRequest, storage.SubscriptionFilter, bool) {
+	var request SubscriptionRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, maxSubscriptionSize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(res, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return request, storage.SubscriptionFilter{}, false
+	}
+	filter, err := request.validate()
+	if err != nil {
+		respondWithError(res, err.Error(), http.StatusBadRequest)
+		return request, storage.SubscriptionFilter{}, false
+	}
+	return request, filter, true
+}
+
+func (r SubscriptionRequest) validate() (storage.SubscriptionFilter, error) {
+	if r.URL == "" {
+		return storage.SubscriptionFilter{}, errors.New("url is required")
+	}
+	if len(r.URL) > maxSubscriptionURLLength {
+		return storage.SubscriptionFilter{}, fmt.Errorf("invalid url: must not be longer than %d characters", maxSubscriptionURLLength)
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return storage.SubscriptionFilter{}, fmt.Errorf("invalid url %q: must be an absolute https URL", r.URL)
+	}
+	// host names are checked by the dispatcher when it connects, since they
+	// can resolve to other addresses by then
+	host := u.Hostname()
+	addr, err := netip.ParseAddr(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (err == nil && !webhookAddressFilter().Allows(addr)) {
+		return storage.SubscriptionFilter{}, fmt.Errorf("invalid url %q: must not point to a loopback, private or link-local address", r.URL)
+	}
+	if r.Secret != "" && (len(r.Secret) < minSecretLength || len(r.Secret) > maxSecretLength) {
+		return storage.SubscriptionFilter{}, fmt.Errorf("invalid secret: must be %d to %d characters long", minSecretLength, maxSecretLength)
+	}
+
+	// the filter is validated like the parameters of ListEvents
+	form := make(url.Values, len(r.Filter))
+	for name, value := range r.Filter {
+		if !slices.Contains(filterParamNames, name) {
+			return storage.SubscriptionFilter{}, fmt.Errorf("invalid filter: unknown parameter %s", name)
+		}
+		form.Set(name, value)
+	}
+	filter, err := parseFilterParams(form)
+	if err != nil {
+		return storage.SubscriptionFilter{}, fmt.Errorf("invalid filter: %w", err)
+	}
+	return hermes.NewSubscriptionFilter(filter), nil
+}
+
+// webhookAddressFilter returns the filter that the webhook dispatcher applies
+// to the addresses of receivers.
+func webhookAddressFilter() webhooks.AddressFilter {
+	networks, err := webhooks.ParseNetworks(viper.GetStringSlice("webhooks.allowed_networks"))
+	if err != nil {
+		logg.Error("invalid webhooks.allowed_networks, only allowing public addresses: %s", err.Error())
+	}
+	return webhooks.AddressFilter{AllowedNetworks: networks}
+}
+
+// newSecret generates a secret for subscriptions that were created without one.
+func newSecret() string {
+	return rand.Text()
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package exportevents
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ObjectStore stores objects in the buckets of an object store.
+type ObjectStore interface {
+	PutObject(ctx context.Context, object Object) error
+	// ListObjects returns the keys of the objects in a bucket whose key starts
+	// with prefix, in lexicographic order and beginning after startAfter. Only
+	// the first page of keys is returned, more is true if there are more keys.
+	ListObjects(ctx context.Context, bucket, prefix, startAfter string) (keys []string, more bool, err error)
+	DeleteObject(ctx context.Context, bucket, key string) error
+}
+
+// Object is a single object to be uploaded by an ObjectStore. The body is
+// streamed, so its size and its SHA-256 hash (hex encoded) need to be known
+// beforehand.
+type Object struct {
+	Bucket          string
+	Key             string
+	Body            io.Reader
+	Size            int64
+	SHA256          string
+	ContentType     string
+	ContentEncoding string
+}
+
+// S3Client manages objects through the S3 API, which is also offered by
+// Swift through the s3api middleware. Requests are signed with AWS Signature
+// Version 4 and use path-style URLs.
+type S3Client struct {
+	Endpoint        string // e.g. "https://objectstore.example.com"
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	HTTPClient      *http.Client
+}
+
+// PutObject implements the ObjectStore interface.
+func (c S3Client) PutObject(ctx context.Context, object Object) error {
+	req, err := c.newRequest(ctx, http.MethodPut, object.Bucket, object.Key, nil, object.Body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = object.Size
+	req.Header.Set("Content-Type", object.ContentType)
+	if object.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", object.ContentEncoding)
+	}
+	c.sign(req, object.SHA256, time.Now())
+
+	_, err = c.do(req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("could not upload %s/%s: %w", object.Bucket, object.Key, err)
+	}
+	return nil
+}
+
+// listBucketResult is the part of the ListObjectsV2 response used by ListObjects.
+type listBucketResult struct {
+	IsTruncated bool `xml:"IsTruncated"`
+	Contents    []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// ListObjects implements the ObjectStore interface.
+func (c S3Client) ListObjects(ctx context.Context, bucket, prefix, startAfter string) (keys []string, more bool, err error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(1000)},
+	}
+	if startAfter != "" {
+		query.Set("start-after", startAfter)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, bucket, "", query, http.NoBody)
+	if err != nil {
+		return nil, false, err
+	}
+	c.sign(req, sha256Hex(nil), time.Now())
+
+	body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not list %s/%s: %w", bucket, prefix, err)
+	}
+	var result listBucketResult
+	err = xml.Unmarshal(body, &result)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not list %s/%s: %w", bucket, prefix, err)
+	}
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	return keys, result.IsTruncated, nil
+}
+
+// DeleteObject implements the ObjectStore interface.
+func (c S3Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, bucket, key, nil, http.NoBody)
+	if err != nil {
+		return err
+	}
+	c.sign(req, sha256Hex(nil), time.Now())
+
+	_, err = c.do(req, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("could not delete %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// newRequest builds the request for an object, or for the bucket itself if
+// key is empty. The query is encoded as required for the signature.
+func (c S3Client) newRequest(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	requestURL, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	requestURL.Path += "/" + bucket
+	if key != "" {
+		requestURL.Path += "/" + key
+	}
+	requestURL.RawPath = requestURL.EscapedPath()
+	// url.Values.Encode sorts by key, but encodes spaces as "+"
+	requestURL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	return http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+}
+
+// do sends the request and returns the response body, or an error if the
+// response does not have the expected status (or 200 OK).
+func (c S3Client) do(req *http.Request, expectedStatus int) ([]byte, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:errcheck // only used for the error message
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// sign adds the headers for AWS Signature Version 4 to the request.
+// Only the host and the x-amz-* headers are signed.
+func (c S3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
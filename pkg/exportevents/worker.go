@@ -0,0 +1,337 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package exportevents implements the export worker described in
+// docs/design/003-Export-Events.md. It periodically uploads the events of all
+// projects with an enabled export configuration to their object store bucket.
+package exportevents
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// timeFormat is used for the time range filters sent to the storage. Events
+// are stored with millisecond precision.
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Worker exports the events of all projects with an enabled export configuration.
+type Worker struct {
+	Storage storage.Storage
+	Configs storage.ExportConfigStore
+	Objects ObjectStore
+	// SettleDelay keeps the worker from exporting the most recently written
+	// events, which might not all be searchable yet. Events are only exported
+	// once they have been written longer ago.
+	SettleDelay time.Duration
+	// TimeNow can be replaced in tests, defaults to time.Now.
+	TimeNow func() time.Time
+}
+
+// ExportFile is the content of every uploaded object (before compression).
+// From and To are the range of the time at which the events were written.
+type ExportFile struct {
+	ProjectID string        `json:"project_id"`
+	From      time.Time     `json:"from"` // inclusive
+	To        time.Time     `json:"to"`   // exclusive
+	Events    []*cadf.Event `json:"events"`
+}
+
+// CronJob returns a job that runs the export every interval.
+func (w *Worker) CronJob(registerer prometheus.Registerer, interval time.Duration) jobloop.Job {
+	return (&jobloop.CronJob{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "export events",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "hermes_export_runs",
+				Help: "Counter for export runs of all enabled projects",
+			},
+		},
+		Interval:     interval,
+		InitialDelay: 5 * time.Second,
+		Task: func(ctx context.Context, _ prometheus.Labels) error {
+			return w.RunOnce(ctx)
+		},
+	}).Setup(registerer)
+}
+
+// RunOnce exports the new events of all enabled projects. A failing project
+// does not keep the other projects from being exported.
+func (w *Worker) RunOnce(ctx context.Context) error {
+	configs, err := w.Configs.ListExportConfigs(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list export configurations: %w", err)
+	}
+
+	var errs []error
+	for _, config := range configs {
+		if !config.Enabled {
+			continue
+		}
+		err := w.ExportProject(ctx, config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("project %s: %w", config.ProjectID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ExportProject uploads all events of the project that were written since its
+// last run. Events are selected by the time they were written instead of their
+// eventTime, so that events which arrive late (e.g. from a backlog of the
+// ingestion) are not skipped. They are split into one object per day, and the
+// progress is recorded after each uploaded object. When a run is missed or
+// fails halfway, the next run resumes exactly where the previous one stopped.
+func (w *Worker) ExportProject(ctx context.Context, config storage.ExportConfig) error {
+	if config.BucketName == "" {
+		return errors.New("no bucket configured")
+	}
+	// the configuration might have been stored before the bucket name was restricted
+	if !IsProjectBucket(config.ProjectID, config.BucketName) {
+		return fmt.Errorf("bucket %s does not belong to the project", config.BucketName)
+	}
+
+	now := time.Now
+	if w.TimeNow != nil {
+		now = w.TimeNow
+	}
+	err := w.exportEvents(ctx, config, now())
+	if err != nil {
+		return err
+	}
+	if config.RetentionDays > 0 {
+		return w.expireObjects(ctx, config, now())
+	}
+	return nil
+}
+
+// exportEvents uploads the events written since the last run, up to the settle delay before now.
+func (w *Worker) exportEvents(ctx context.Context, config storage.ExportConfig, now time.Time) error {
+	until := now.UTC().Add(-w.SettleDelay).Truncate(time.Millisecond)
+
+	var from time.Time
+	if config.LastRunTime != nil {
+		from = config.LastRunTime.UTC()
+	} else {
+		// a newly enabled export starts with the events of the current day
+		from = until.Truncate(24 * time.Hour)
+	}
+
+	for from.Before(until) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		to := from.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		if to.After(until) {
+			to = until
+		}
+
+		err := w.exportChunk(ctx, config, from, to)
+		if err != nil {
+			return err
+		}
+		err = w.Configs.UpdateExportLastRunTime(ctx, config.ProjectID, to)
+		if err != nil {
+			return fmt.Errorf("cannot record progress: %w", err)
+		}
+		from = to
+	}
+	return nil
+}
+
+// expireObjects deletes the exported objects of the days which are more than
+// RetentionDays before the current day. The keys start with the day, so the
+// listing starts with the oldest objects and stops at the first one to keep.
+// Objects that were not uploaded by the worker are kept.
+func (w *Worker) expireObjects(ctx context.Context, config storage.ExportConfig, now time.Time) error {
+	prefix := config.ProjectID + "/"
+	keepFrom := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -config.RetentionDays)
+
+	startAfter := ""
+	for {
+		keys, more, err := w.Objects.ListObjects(ctx, config.BucketName, prefix, startAfter)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			dayPath := strings.TrimPrefix(key, prefix)
+			if len(dayPath) < len("2006/01/02/") {
+				continue
+			}
+			day, err := time.Parse("2006/01/02/", dayPath[:len("2006/01/02/")])
+			if err != nil {
+				continue
+			}
+			if !day.Before(keepFrom) {
+				return nil
+			}
+			logg.Info("deleting expired export %s/%s", config.BucketName, key)
+			err = w.Objects.DeleteObject(ctx, config.BucketName, key)
+			if err != nil {
+				return err
+			}
+		}
+		if !more || len(keys) == 0 {
+			return nil
+		}
+		startAfter = keys[len(keys)-1]
+	}
+}
+
+// IsProjectBucket returns whether the bucket may hold the exports of a project.
+// All buckets belong to the account of the worker, so each project gets its
+// own names: the project ID, optionally followed by "-" and a suffix.
+func IsProjectBucket(projectID, bucket string) bool {
+	return projectID != "" && (bucket == projectID || strings.HasPrefix(bucket, projectID+"-"))
+}
+
+// exportChunk uploads the events written in the time range [from, to) as one
+// object. The object is compressed into a temporary file while the events are
+// read, so that large chunks do not need to fit into memory.
+func (w *Worker) exportChunk(ctx context.Context, config storage.ExportConfig, from, to time.Time) error {
+	filter := storage.EventFilter{
+		IngestTime: map[string]string{
+			"gte": from.Format(timeFormat),
+			"lt":  to.Format(timeFormat),
+		},
+		Sort: []storage.FieldOrder{{Fieldname: "time", Order: "asc"}},
+	}
+
+	tmpFile, err := os.CreateTemp("", "hermes-export-*.json.gz")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmpFile.Close()           //nolint:errcheck // only read from
+		os.Remove(tmpFile.Name()) //nolint:errcheck // in the temporary directory anyway
+	}()
+
+	chunk, err := newChunkWriter(tmpFile, ExportFile{ProjectID: config.ProjectID, From: from, To: to})
+	if err != nil {
+		return err
+	}
+	err = w.Storage.StreamEvents(ctx, &filter, config.ProjectID, func(event *cadf.Event) error {
+		if matchesFilters(event, config.Filters) {
+			return chunk.add(event)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read events: %w", err)
+	}
+	if chunk.count == 0 {
+		logg.Debug("no events to export for project %s between %s and %s", config.ProjectID, from, to)
+		return nil
+	}
+	err = chunk.close()
+	if err != nil {
+		return err
+	}
+	size, err := tmpFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// The key only depends on the start of the range, so that a chunk which is
+	// uploaded again (because recording the progress failed) overwrites the
+	// previous upload instead of duplicating its events.
+	key := fmt.Sprintf("%s/%s/%s.json.gz", config.ProjectID, from.Format("2006/01/02"), from.Format("20060102T150405.000Z"))
+	logg.Info("exporting %d events of project %s to %s/%s", chunk.count, config.ProjectID, config.BucketName, key)
+	return w.Objects.PutObject(ctx, Object{
+		Bucket:          config.BucketName,
+		Key:             key,
+		Body:            tmpFile,
+		Size:            size,
+		SHA256:          hex.EncodeToString(chunk.hash.Sum(nil)),
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+	})
+}
+
+// chunkWriter writes an ExportFile event by event as compressed JSON, and
+// computes the hash of the compressed data on the way.
+type chunkWriter struct {
+	gz    *gzip.Writer
+	hash  hash.Hash
+	count int
+}
+
+func newChunkWriter(out io.Writer, header ExportFile) (*chunkWriter, error) {
+	w := &chunkWriter{hash: sha256.New()}
+	w.gz = gzip.NewWriter(io.MultiWriter(out, w.hash))
+
+	// the events are written between the header and the end of the JSON
+	// object, i.e. buf ends with `"events":[]}`
+	header.Events = []*cadf.Event{}
+	buf, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.gz.Write(buf[:len(buf)-2])
+	return w, err
+}
+
+func (w *chunkWriter) add(event *cadf.Event) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if w.count > 0 {
+		buf = append([]byte{','}, buf...)
+	}
+	w.count++
+	_, err = w.gz.Write(buf)
+	return err
+}
+
+func (w *chunkWriter) close() error {
+	_, err := w.gz.Write([]byte("]}"))
+	if err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// matchesFilters applies the include and exclude lists of the export
+// configuration. Types are hierarchical, so "compute/server" also matches
+// "compute/server/volume-attachment".
+func matchesFilters(event *cadf.Event, filters storage.ExportFilters) bool {
+	action := string(event.Action)
+	resourceType := event.Target.TypeURI
+
+	if len(filters.EventTypes) > 0 && !matchesAny(action, filters.EventTypes) {
+		return false
+	}
+	if len(filters.ResourceTypes) > 0 && !matchesAny(resourceType, filters.ResourceTypes) {
+		return false
+	}
+	return !matchesAny(action, filters.ExcludeEventTypes) && !matchesAny(resourceType, filters.ExcludeResourceTypes)
+}
+
+func matchesAny(value string, patterns []string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return value == pattern || strings.HasPrefix(value, pattern+"/")
+	})
+}
@@ -0,0 +1,367 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package exportevents
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// fakeS3 is an in-process stand-in for an S3 object store.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	// failPut makes all uploads with a key containing this string fail
+	failPut string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, S3Client) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, S3Client{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+	case http.MethodGet:
+		f.listObjects(w, r)
+		return
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if f.failPut != "" && strings.Contains(r.URL.Path, f.failPut) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sha256Hex(body) != r.Header.Get("X-Amz-Content-Sha256") {
+		http.Error(w, "content hash mismatch", http.StatusBadRequest)
+		return
+	}
+	f.objects[r.URL.Path] = body
+}
+
+// listObjects answers ListObjectsV2 requests for the bucket in the path, with
+// at most two keys per page to exercise the paging.
+func (f *fakeS3) listObjects(w http.ResponseWriter, r *http.Request) {
+	bucket := "/" + strings.Trim(r.URL.Path, "/") + "/"
+	query := r.URL.Query()
+	var keys []string
+	for path := range f.objects {
+		key, found := strings.CutPrefix(path, bucket)
+		if found && strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("start-after") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := "<ListBucketResult>"
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result += "<IsTruncated>true</IsTruncated>"
+	}
+	for _, key := range keys {
+		result += "<Contents><Key>" + key + "</Key></Contents>"
+	}
+	fmt.Fprint(w, result+"</ListBucketResult>")
+}
+
+// exportedEventIDs decompresses all uploaded objects and returns the IDs of all
+// contained events, including duplicates.
+func (f *fakeS3) exportedEventIDs(t *testing.T) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var ids []string
+	for _, body := range f.objects {
+		gz, err := gzip.NewReader(strings.NewReader(string(body)))
+		require.Nil(t, err)
+		var file ExportFile
+		require.Nil(t, json.NewDecoder(gz).Decode(&file))
+		for _, event := range file.Events {
+			ids = append(ids, event.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fakeStorage honors the ingestion time filter of StreamEvents, which
+// storage.Mock does not. Events are written at their eventTime, unless
+// another time is given in ingestTimes.
+type fakeStorage struct {
+	storage.Mock
+	events      []*cadf.Event
+	ingestTimes map[string]string // by event ID
+}
+
+func (s fakeStorage) StreamEvents(_ context.Context, filter *storage.EventFilter, tenantID string, fn func(*cadf.Event) error) error {
+	from, err := time.Parse(timeFormat, filter.IngestTime["gte"])
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse(timeFormat, filter.IngestTime["lt"])
+	if err != nil {
+		return err
+	}
+	for _, event := range s.events {
+		ingestTime, ok := s.ingestTimes[event.ID]
+		if !ok {
+			ingestTime = event.EventTime
+		}
+		writtenAt, err := time.Parse(time.RFC3339, ingestTime)
+		if err != nil {
+			return err
+		}
+		if !writtenAt.Before(from) && writtenAt.Before(to) {
+			err := fn(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fakeConfigStore records the progress of the worker, which storage.Mock does not.
+type fakeConfigStore struct {
+	storage.Mock
+	configs []storage.ExportConfig
+}
+
+func (s *fakeConfigStore) ListExportConfigs(_ context.Context) ([]storage.ExportConfig, error) {
+	return s.configs, nil
+}
+
+func (s *fakeConfigStore) UpdateExportLastRunTime(_ context.Context, projectID string, lastRunTime time.Time) error {
+	for i := range s.configs {
+		if s.configs[i].ProjectID == projectID {
+			s.configs[i].LastRunTime = &lastRunTime
+			return nil
+		}
+	}
+	return errors.New("no such project")
+}
+
+func makeEvent(id, eventTime, action, targetType string) *cadf.Event {
+	return &cadf.Event{
+		ID:        id,
+		EventTime: eventTime,
+		Action:    cadf.Action(action),
+		Target:    cadf.Resource{TypeURI: targetType},
+	}
+}
+
+func TestExportResumesWithoutDuplicates(t *testing.T) {
+	s3, uploader := newFakeS3(t)
+	lastRun := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	configs := &fakeConfigStore{configs: []storage.ExportConfig{
+		{ProjectID: "project1", Enabled: true, BucketName: "project1-audit", LastRunTime: &lastRun},
+		{ProjectID: "project2", Enabled: false, BucketName: "project1-audit"},
+	}}
+	events := fakeStorage{events: []*cadf.Event{
+		makeEvent("1", "2024-03-01T11:59:59Z", "create", "compute/server"), // exported by the previous run
+		makeEvent("2", "2024-03-01T12:00:00Z", "create", "compute/server"),
+		makeEvent("3", "2024-03-01T23:59:59Z", "delete", "compute/server"),
+		makeEvent("4", "2024-03-02T00:00:00Z", "create", "network/port"),
+		makeEvent("5", "2024-03-03T08:00:00Z", "update", "compute/server"),
+		makeEvent("6", "2024-03-03T09:30:00Z", "update", "compute/server"), // not yet settled
+	}}
+	now := time.Date(2024, 3, 3, 9, 30, 0, 0, time.UTC)
+	worker := Worker{
+		Storage:     events,
+		Configs:     configs,
+		Objects:     uploader,
+		SettleDelay: 5 * time.Minute,
+		TimeNow:     func() time.Time { return now },
+	}
+
+	// the second day cannot be uploaded, so the first run stops after the first day
+	s3.failPut = "/2024/03/02/"
+	err := worker.RunOnce(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"2", "3"}, s3.exportedEventIDs(t))
+	assert.Equal(t, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), *configs.configs[0].LastRunTime)
+
+	// the next run resumes with the second day
+	s3.failPut = ""
+	err = worker.RunOnce(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2", "3", "4", "5"}, s3.exportedEventIDs(t))
+	assert.Equal(t, now.Add(-5*time.Minute), *configs.configs[0].LastRunTime)
+	assert.Nil(t, configs.configs[1].LastRunTime)
+
+	// a later run picks up the remaining event
+	now = now.Add(time.Hour)
+	err = worker.RunOnce(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2", "3", "4", "5", "6"}, s3.exportedEventIDs(t))
+	assert.Contains(t, s3.objects, "/project1-audit/project1/2024/03/01/20240301T120000.000Z.json.gz")
+}
+
+func TestExportIncludesLateEvents(t *testing.T) {
+	s3, uploader := newFakeS3(t)
+	lastRun := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	config := storage.ExportConfig{ProjectID: "project1", Enabled: true, BucketName: "project1-audit", LastRunTime: &lastRun}
+	configs := &fakeConfigStore{configs: []storage.ExportConfig{config}}
+	events := fakeStorage{
+		events: []*cadf.Event{
+			makeEvent("1", "2024-03-02T11:00:00Z", "create", "compute/server"), // exported by the previous run
+			makeEvent("2", "2024-03-02T13:00:00Z", "create", "compute/server"),
+			// written from a backlog after the previous run, with an older eventTime
+			makeEvent("3", "2024-03-01T08:00:00Z", "delete", "compute/server"),
+		},
+		ingestTimes: map[string]string{"3": "2024-03-02T14:00:00Z"},
+	}
+	worker := Worker{
+		Storage:     events,
+		Configs:     configs,
+		Objects:     uploader,
+		SettleDelay: 5 * time.Minute,
+		TimeNow:     func() time.Time { return time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC) },
+	}
+
+	require.Nil(t, worker.RunOnce(context.Background()))
+	assert.Equal(t, []string{"2", "3"}, s3.exportedEventIDs(t))
+	assert.Contains(t, s3.objects, "/project1-audit/project1/2024/03/02/20240302T120000.000Z.json.gz")
+}
+
+func TestExportOverwritesChunkOnRetry(t *testing.T) {
+	s3, uploader := newFakeS3(t)
+	lastRun := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	config := storage.ExportConfig{ProjectID: "project1", Enabled: true, BucketName: "project1-audit", LastRunTime: &lastRun}
+	events := fakeStorage{events: []*cadf.Event{
+		makeEvent("1", "2024-03-01T10:00:00Z", "create", "compute/server"),
+	}}
+	worker := Worker{
+		Storage: events,
+		Configs: &fakeConfigStore{}, // recording the progress always fails
+		Objects: uploader,
+		TimeNow: func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) },
+	}
+
+	assert.NotNil(t, worker.ExportProject(context.Background(), config))
+	worker.TimeNow = func() time.Time { return time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC) }
+	assert.NotNil(t, worker.ExportProject(context.Background(), config))
+	assert.Equal(t, []string{"1"}, s3.exportedEventIDs(t))
+}
+
+func TestExportRejectsForeignBucket(t *testing.T) {
+	s3, uploader := newFakeS3(t)
+	config := storage.ExportConfig{ProjectID: "project1", Enabled: true, BucketName: "project2-audit"}
+	worker := Worker{
+		Storage: fakeStorage{events: []*cadf.Event{
+			makeEvent("1", "2024-03-01T10:00:00Z", "create", "compute/server"),
+		}},
+		Configs: &fakeConfigStore{configs: []storage.ExportConfig{config}},
+		Objects: uploader,
+		TimeNow: func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) },
+	}
+
+	assert.ErrorContains(t, worker.ExportProject(context.Background(), config), "does not belong to the project")
+	assert.Empty(t, s3.objects)
+}
+
+func TestExportExpiresObjects(t *testing.T) {
+	s3, uploader := newFakeS3(t)
+	lastRun := time.Date(2024, 3, 10, 11, 0, 0, 0, time.UTC)
+	config := storage.ExportConfig{ProjectID: "project1", Enabled: true, BucketName: "project1", RetentionDays: 7, LastRunTime: &lastRun}
+	for _, key := range []string{
+		"project1/2024/03/01/20240301T000000.000Z.json.gz",
+		"project1/2024/03/02/20240302T000000.000Z.json.gz",
+		"project1/2024/03/02/20240302T120000.000Z.json.gz",
+		"project1/2024/03/03/20240303T000000.000Z.json.gz", // kept for 7 days
+		"project1/README.txt",                              // not uploaded by the worker
+		"project10/2024/03/01/20240301T000000.000Z.json.gz",
+	} {
+		s3.objects["/project1/"+key] = []byte("{}")
+	}
+	worker := Worker{
+		Storage: fakeStorage{events: []*cadf.Event{
+			makeEvent("1", "2024-03-10T11:30:00Z", "create", "compute/server"),
+		}},
+		Configs: &fakeConfigStore{configs: []storage.ExportConfig{config}},
+		Objects: uploader,
+		TimeNow: func() time.Time { return time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC) },
+	}
+
+	require.Nil(t, worker.RunOnce(context.Background()))
+	var keys []string
+	for path := range s3.objects {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{
+		"/project1/project1/2024/03/03/20240303T000000.000Z.json.gz",
+		"/project1/project1/2024/03/10/20240310T110000.000Z.json.gz",
+		"/project1/project1/README.txt",
+		"/project1/project10/2024/03/01/20240301T000000.000Z.json.gz",
+	}, keys)
+}
+
+func TestMatchesFilters(t *testing.T) {
+	event := makeEvent("1", "2024-03-01T10:00:00Z", "update/add/floatingip", "network/floatingip")
+
+	tests := []struct {
+		name     string
+		filters  storage.ExportFilters
+		expected bool
+	}{
+		{"No filters", storage.ExportFilters{}, true},
+		{"Event type", storage.ExportFilters{EventTypes: []string{"create", "update/add/floatingip"}}, true},
+		{"Event type hierarchy", storage.ExportFilters{EventTypes: []string{"update"}}, true},
+		{"Other event type", storage.ExportFilters{EventTypes: []string{"update/remove"}}, false},
+		{"Resource type", storage.ExportFilters{ResourceTypes: []string{"network"}}, true},
+		{"Other resource type", storage.ExportFilters{ResourceTypes: []string{"compute"}}, false},
+		{"Excluded event type", storage.ExportFilters{ExcludeEventTypes: []string{"update/add"}}, false},
+		{"Excluded resource type", storage.ExportFilters{ExcludeResourceTypes: []string{"network/floatingip"}}, false},
+		{"Prefix is not hierarchy", storage.ExportFilters{ResourceTypes: []string{"net"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, matchesFilters(event, tt.filters))
+		})
+	}
+}
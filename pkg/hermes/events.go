@@ -4,6 +4,8 @@
 package hermes
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/jinzhu/copier"
@@ -26,6 +28,12 @@ type ListEvent struct {
 	Target      ResourceRef       `json:"target"`
 	Observer    ResourceRef       `json:"observer"`
 	Attachments []cadf.Attachment `json:"attachments,omitempty"`
+	// only with full details
+	EventType string       `json:"eventType,omitempty"`
+	Reason    *cadf.Reason `json:"reason,omitempty"`
+	Tags      []string     `json:"tags,omitempty"`
+	// only when reading the events of several tenants
+	TenantID string `json:"tenant_id,omitempty"`
 }
 
 // ResourceRef is an embedded struct for ListEvents (eg. Initiator, Target, Observer)
@@ -33,25 +41,45 @@ type ResourceRef struct {
 	TypeURI string `json:"typeURI"`
 	ID      string `json:"id"`
 	Name    string `json:"name,omitempty"`
+	// only with full details
+	Domain    string     `json:"domain,omitempty"`
+	ProjectID string     `json:"project_id,omitempty"`
+	DomainID  string     `json:"domain_id,omitempty"`
+	Host      *cadf.Host `json:"host,omitempty"`
 }
 
 // EventFilter maps to the filtering/paging/sorting allowed by the API for Events
 type EventFilter struct {
-	ObserverType  string
-	TargetType    string
-	TargetID      string
-	InitiatorID   string
-	InitiatorType string
-	InitiatorName string
-	Action        string
-	Outcome       string
-	Search        string
-	RequestPath   string
-	Time          map[string]string
-	Offset        uint
-	Limit         uint
-	Sort          []FieldOrder
-	Details       bool // Additional Detail for eventsList func which includes attachments.
+	ObserverType     string
+	TargetType       string
+	TargetID         string
+	InitiatorID      string
+	InitiatorType    string
+	InitiatorName    string
+	Action           string
+	Outcome          string
+	Search           string
+	RequestPath      string
+	TargetName       string
+	InitiatorAddress string
+	Tag              string
+	Time             map[string]string
+	Offset           uint
+	Limit            uint
+	Sort             []FieldOrder
+	Details          bool // Additional Detail for eventsList func which includes attachments.
+	FullDetails      bool // Like Details, plus all other fields of the event that ListEvent has.
+	UseCursor        bool // Page with Cursor instead of Offset, an empty Cursor starts from the first page.
+	Cursor           string
+	Fields           []string // Selects the fields of the events in EventPage.Projections instead of EventPage.Events.
+}
+
+// EventPage is one page of events returned by GetEvents
+type EventPage struct {
+	Events      []*ListEvent
+	Projections []EventProjection // Only set if the filter selects Fields, instead of Events.
+	Total       int
+	NextCursor  string // Only set for cursor-based paging when more events might follow.
 }
 
 // FieldOrder is an embedded struct for Event Filtering
@@ -67,24 +95,44 @@ type AttributeFilter struct {
 	Limit     uint
 }
 
-// GetEvents returns a list of matching events (with filtering)
-func GetEvents(filter *EventFilter, tenantID string, eventStore storage.Storage) ([]*ListEvent, int, error) {
+// GetEvents returns a page of matching events (with filtering)
+func GetEvents(ctx context.Context, filter *EventFilter, tenantID string, eventStore storage.Storage) (*EventPage, error) {
 	storageFilter, err := storageFilter(filter, eventStore)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	logg.Debug("hermes.GetEvents: tenant id is %s", tenantID)
-	eventDetails, total, err := eventStore.GetEvents(storageFilter, tenantID)
+	page, err := eventStore.GetEvents(ctx, storageFilter, tenantID)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	events, err := eventsList(eventDetails, filter.Details)
-	if err != nil {
-		return nil, 0, err
+	if len(filter.Fields) > 0 {
+		projections := make([]EventProjection, 0, len(page.Events))
+		for _, event := range page.Events {
+			projection, err := ProjectEvent(event, filter.Fields)
+			if err != nil {
+				return nil, err
+			}
+			if page.TenantIDs != nil {
+				projection["tenant_id"] = page.TenantIDs[len(projections)]
+			}
+			projections = append(projections, projection)
+		}
+		return &EventPage{Projections: projections, Total: page.Total, NextCursor: page.NextCursor}, nil
 	}
-	return events, total, err
+
+	events := eventsList(page.Events, filter.Details || filter.FullDetails, filter.FullDetails)
+	for idx, tenantID := range page.TenantIDs {
+		events[idx].TenantID = tenantID
+	}
+	if filter.FullDetails {
+		for idx, tags := range page.Tags {
+			events[idx].Tags = tags
+		}
+	}
+	return &EventPage{Events: events, Total: page.Total, NextCursor: page.NextCursor}, nil
 }
 
 func storageFilter(filter *EventFilter, eventStore storage.Storage) (*storage.EventFilter, error) {
@@ -93,37 +141,63 @@ func storageFilter(filter *EventFilter, eventStore storage.Storage) (*storage.Ev
 		filter.Limit = 10
 	}
 
-	if filter.Offset+filter.Limit > eventStore.MaxLimit() {
+	if filter.UseCursor {
+		// The cursor is not bound to max_result_window, only the page size is.
+		if filter.Offset != 0 {
+			return nil, errors.New("offset cannot be combined with cursor")
+		}
+		if filter.Limit > eventStore.MaxLimit() {
+			return nil, fmt.Errorf("limit %d exceeds the maximum of %d", filter.Limit, eventStore.MaxLimit())
+		}
+	} else if filter.Offset+filter.Limit > eventStore.MaxLimit() {
 		return nil, fmt.Errorf("offset %d plus limit %d exceeds the maximum of %d",
 			filter.Offset, filter.Limit, eventStore.MaxLimit())
 	}
 
+	return newStorageFilter(filter), nil
+}
+
+// newStorageFilter converts the filter without any validation of the paging parameters.
+func newStorageFilter(filter *EventFilter) *storage.EventFilter {
 	var storageFieldOrder []storage.FieldOrder
 	err := copier.Copy(&storageFieldOrder, &filter.Sort)
 	if err != nil {
 		panic("Could not copy storage field order.")
 	}
 	storageFilter := storage.EventFilter{
-		ObserverType:  filter.ObserverType,
-		InitiatorID:   filter.InitiatorID,
-		InitiatorType: filter.InitiatorType,
-		InitiatorName: filter.InitiatorName,
-		TargetType:    filter.TargetType,
-		TargetID:      filter.TargetID,
-		Action:        filter.Action,
-		Outcome:       filter.Outcome,
-		Search:        filter.Search,
-		RequestPath:   filter.RequestPath,
-		Time:          filter.Time,
-		Offset:        filter.Offset,
-		Limit:         filter.Limit,
-		Sort:          storageFieldOrder,
+		ObserverType:     filter.ObserverType,
+		InitiatorID:      filter.InitiatorID,
+		InitiatorType:    filter.InitiatorType,
+		InitiatorName:    filter.InitiatorName,
+		TargetType:       filter.TargetType,
+		TargetID:         filter.TargetID,
+		Action:           filter.Action,
+		Outcome:          filter.Outcome,
+		Search:           filter.Search,
+		RequestPath:      filter.RequestPath,
+		TargetName:       filter.TargetName,
+		InitiatorAddress: filter.InitiatorAddress,
+		Tag:              filter.Tag,
+		Time:             filter.Time,
+		Offset:           filter.Offset,
+		Limit:            filter.Limit,
+		Sort:             storageFieldOrder,
+		UseCursor:        filter.UseCursor,
+		Cursor:           filter.Cursor,
+		Fields:           filter.Fields,
 	}
-	return &storageFilter, nil
+	return &storageFilter
+}
+
+// ExportEvents calls fn with the full CADF payload of every event matching the
+// filter. Paging parameters in the filter are ignored.
+func ExportEvents(ctx context.Context, filter *EventFilter, tenantID string, eventStore storage.Storage, fn func(*cadf.Event) error) error {
+	logg.Debug("hermes.ExportEvents: tenant id is %s", tenantID)
+	return eventStore.StreamEvents(ctx, newStorageFilter(filter), tenantID, fn)
 }
 
 // eventsList Construct ListEvents
-func eventsList(eventDetails []*cadf.Event, details bool) ([]*ListEvent, error) {
+func eventsList(eventDetails []*cadf.Event, details, fullDetails bool) []*ListEvent {
 	var events []*ListEvent
 	for _, storageEvent := range eventDetails {
 		event := ListEvent{
@@ -150,32 +224,50 @@ func eventsList(eventDetails []*cadf.Event, details bool) ([]*ListEvent, error)
 		if details {
 			event.Attachments = storageEvent.Attachments
 		}
-		copiedInitiator := storageEvent.Initiator              // Create a copy of the Initiator
-		err := copier.Copy(&event.Initiator, &copiedInitiator) // Use the copy as the source for the copy
-		if err != nil {
-			return nil, err
+		if fullDetails {
+			event.EventType = storageEvent.EventType
+			if storageEvent.Reason != (cadf.Reason{}) {
+				reason := storageEvent.Reason
+				event.Reason = &reason
+			}
+			event.Initiator = fullResourceRef(storageEvent.Initiator)
+			event.Target = fullResourceRef(storageEvent.Target)
+			event.Observer = fullResourceRef(storageEvent.Observer)
 		}
 
 		events = append(events, &event)
 	}
-	return events, nil
+	return events
+}
+
+// fullResourceRef contains all fields of the resource that ResourceRef has.
+func fullResourceRef(resource cadf.Resource) ResourceRef {
+	return ResourceRef{
+		TypeURI:   resource.TypeURI,
+		ID:        resource.ID,
+		Name:      resource.Name,
+		Domain:    resource.Domain,
+		ProjectID: resource.ProjectID,
+		DomainID:  resource.DomainID,
+		Host:      resource.Host,
+	}
 }
 
 // GetEvent returns the CADF detail for event with the specified ID
-func GetEvent(eventID, tenantID string, eventStore storage.Storage) (*cadf.Event, error) {
-	event, err := eventStore.GetEvent(eventID, tenantID)
+func GetEvent(ctx context.Context, eventID, tenantID string, eventStore storage.Storage) (*cadf.Event, error) {
+	event, err := eventStore.GetEvent(ctx, eventID, tenantID)
 
 	return event, err
 }
 
 // GetAttributes No Logic here, but handles mock implementation for eventStore
-func GetAttributes(filter *AttributeFilter, tenantID string, eventStore storage.Storage) ([]string, error) {
+func GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string, eventStore storage.Storage) ([]string, error) {
 	attributeFilter := storage.AttributeFilter{
 		QueryName: filter.QueryName,
 		MaxDepth:  filter.MaxDepth,
 		Limit:     filter.Limit,
 	}
-	attribute, err := eventStore.GetAttributes(&attributeFilter, tenantID)
+	attribute, err := eventStore.GetAttributes(ctx, &attributeFilter, tenantID)
 
 	return attribute, err
 }
@@ -4,8 +4,10 @@
 package hermes
 
 import (
+	"context"
 	"testing"
 
+	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -14,7 +16,7 @@ import (
 
 func Test_GetEvent(t *testing.T) {
 	eventID := "7be6c4ff-b761-5f1f-b234-f5d41616c2cd"
-	event, err := GetEvent(eventID, "", storage.Mock{})
+	event, err := GetEvent(context.Background(), eventID, "", storage.Mock{})
 	require.Nil(t, err)
 	require.NotNil(t, event)
 	assert.Equal(t, "7be6c4ff-b761-5f1f-b234-f5d41616c2cd", event.ID)
@@ -24,11 +26,12 @@ func Test_GetEvent(t *testing.T) {
 }
 
 func Test_GetEvents(t *testing.T) {
-	events, total, err := GetEvents(&EventFilter{}, "", storage.Mock{})
+	page, err := GetEvents(context.Background(), &EventFilter{}, "", storage.Mock{})
 	require.Nil(t, err)
-	require.NotNil(t, events)
+	require.NotNil(t, page)
+	events := page.Events
 	assert.Equal(t, len(events), 4)
-	assert.True(t, total >= len(events))
+	assert.True(t, page.Total >= len(events))
 	for _, event := range events {
 		assert.NotEmpty(t, event.ID)
 		assert.NotEmpty(t, event.Outcome)
@@ -41,8 +44,88 @@ func Test_GetEvents(t *testing.T) {
 	assert.NotEqual(t, events[0].ID, events[2].ID)
 }
 
+func Test_GetEvents_Cursor(t *testing.T) {
+	// the cursor is only limited by the page size, not by offset+limit
+	page, err := GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 100}, "", storage.Mock{})
+	require.Nil(t, err)
+	assert.Equal(t, len(page.Events), 4)
+	assert.Empty(t, page.NextCursor)
+
+	_, err = GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 101}, "", storage.Mock{})
+	assert.NotNil(t, err)
+	_, err = GetEvents(context.Background(), &EventFilter{UseCursor: true, Offset: 10}, "", storage.Mock{})
+	assert.NotNil(t, err)
+}
+
+func Test_GetEvents_Fields(t *testing.T) {
+	page, err := GetEvents(context.Background(), &EventFilter{Fields: []string{"id", "initiator", "initiator.name", "target.name", "reason.reasonCode"}}, "", storage.Mock{})
+	require.Nil(t, err)
+	assert.Nil(t, page.Events)
+	require.Equal(t, len(page.Projections), 4)
+	for _, projection := range page.Projections {
+		assert.NotEmpty(t, projection["id"])
+		initiator, ok := projection["initiator"].(map[string]any)
+		require.True(t, ok)
+		assert.NotEmpty(t, initiator["name"])
+		assert.NotEmpty(t, initiator["id"])
+		// fields missing in the event are left out
+		assert.NotContains(t, projection, "target")
+		assert.NotContains(t, projection, "reason")
+		assert.NotContains(t, projection, "action")
+	}
+}
+
+func Test_eventsList_FullDetails(t *testing.T) {
+	event, err := storage.Mock{}.GetEvent(context.Background(), "7be6c4ff-b761-5f1f-b234-f5d41616c2cd", "")
+	require.Nil(t, err)
+
+	basic := eventsList([]*cadf.Event{event}, true, false)[0]
+	assert.Empty(t, basic.Target.ProjectID)
+	assert.Nil(t, basic.Initiator.Host)
+	assert.Nil(t, basic.Reason)
+	assert.NotEmpty(t, basic.Attachments)
+
+	full := eventsList([]*cadf.Event{event}, true, true)[0]
+	assert.Equal(t, "activity", full.EventType)
+	assert.Equal(t, &cadf.Reason{ReasonType: "HTTP", ReasonCode: "409"}, full.Reason)
+	assert.Equal(t, "test_admin", full.Initiator.Name)
+	assert.Equal(t, "cc3test", full.Initiator.Domain)
+	require.NotNil(t, full.Initiator.Host)
+	assert.Equal(t, "127.0.0.1", full.Initiator.Host.Address)
+	assert.Equal(t, "a759dcc2a2384a76b0386bb985952373", full.Target.ProjectID)
+	assert.Equal(t, "neutron", full.Observer.Name)
+	assert.Equal(t, basic.Attachments, full.Attachments)
+}
+
+// taggedStorage returns the events of storage.Mock, the first one with tags.
+type taggedStorage struct {
+	storage.Mock
+}
+
+func (s taggedStorage) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	page, err := s.Mock.GetEvents(ctx, filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	page.Tags = make([][]string, len(page.Events))
+	page.Tags[0] = []string{"admin", "cli"}
+	return page, nil
+}
+
+func Test_GetEvents_Tags(t *testing.T) {
+	page, err := GetEvents(context.Background(), &EventFilter{FullDetails: true}, "", taggedStorage{})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"admin", "cli"}, page.Events[0].Tags)
+	assert.Nil(t, page.Events[1].Tags)
+
+	// tags are only returned with full details
+	page, err = GetEvents(context.Background(), &EventFilter{Details: true}, "", taggedStorage{})
+	require.Nil(t, err)
+	assert.Nil(t, page.Events[0].Tags)
+}
+
 func Test_GetAttributes(t *testing.T) {
-	attributes, err := GetAttributes(&AttributeFilter{}, "", storage.Mock{})
+	attributes, err := GetAttributes(context.Background(), &AttributeFilter{}, "", storage.Mock{})
 	require.Nil(t, err)
 	require.NotNil(t, attributes)
 	assert.Equal(t, len(attributes), 6)
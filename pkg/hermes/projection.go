@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+)
+
+// ProjectionFields are the fields of a CADF event that can be selected with
+// the fields parameter of the API. Nested fields are separated by dots.
+var ProjectionFields = func() []string {
+	fields := []string{
+		"typeURI", "id", "eventTime", "eventType", "action", "outcome", "requestPath", "attachments",
+		"reason", "reason.reasonType", "reason.reasonCode",
+	}
+	resourceFields := []string{
+		"typeURI", "name", "domain", "id", "addresses", "attachments", "project_id", "domain_id",
+		"project_name", "project_domain_name", "domain_name", "application_credential_id", "request_id", "global_request_id",
+		"host", "host.id", "host.address", "host.agent", "host.platform",
+	}
+	for _, resource := range []string{"initiator", "target", "observer"} {
+		fields = append(fields, resource)
+		for _, field := range resourceFields {
+			fields = append(fields, resource+"."+field)
+		}
+	}
+	return fields
+}()
+
+// EventProjection contains the selected fields of an event, nested like in
+// the CADF event.
+type EventProjection map[string]any
+
+// ProjectEvent selects the given fields of an event. Fields that the event
+// does not have are left out.
+func ProjectEvent(event *cadf.Event, fields []string) (EventProjection, error) {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var full map[string]any
+	err = json.Unmarshal(buf, &full)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(EventProjection)
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		value, found := lookupPath(full, path)
+		if found {
+			setPath(result, path, value)
+		}
+	}
+	return result, nil
+}
+
+func lookupPath(object map[string]any, path []string) (any, bool) {
+	value, found := object[path[0]]
+	if !found || len(path) == 1 {
+		return value, found
+	}
+	child, isObject := value.(map[string]any)
+	if !isObject {
+		return nil, false
+	}
+	return lookupPath(child, path[1:])
+}
+
+func setPath(object map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		object[path[0]] = value
+		return
+	}
+	child, isObject := object[path[0]].(map[string]any)
+	if !isObject {
+		child = make(map[string]any)
+		object[path[0]] = child
+	}
+	setPath(child, path[1:], value)
+}
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// StatsFields are the fields that events can be grouped by.
+var StatsFields = []string{
+	"action",
+	"initiator_address",
+	"initiator_id",
+	"initiator_name",
+	"initiator_type",
+	"observer_id",
+	"observer_type",
+	"outcome",
+	"request_path",
+	"tag",
+	"target_id",
+	"target_name",
+	"target_type",
+}
+
+// Stats contains the number of events per group of values
+//
+//	The JSON annotations here are for the JSON to be returned by the API
+type Stats struct {
+	GroupBy []string      `json:"group_by"`
+	Buckets []StatsBucket `json:"buckets"`
+	// Other is the number of matching events that are not counted in any
+	// bucket. It is approximate for fields with multiple values like tags.
+	Other int `json:"other"`
+	Total int `json:"total"`
+}
+
+// StatsBucket is the number of events with the values in Key.
+type StatsBucket struct {
+	Key   map[string]string `json:"key"`
+	Count int               `json:"count"`
+}
+
+// GetStats returns the number of matching events, grouped by the values of
+// the groupBy fields, for the limit largest groups.
+func GetStats(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint, aggregator storage.EventAggregator) (*Stats, error) {
+	logg.Debug("hermes.GetStats: tenant id is %s", tenantID)
+	counts, err := aggregator.CountEvents(ctx, newStorageFilter(filter), tenantID, groupBy, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := Stats{GroupBy: groupBy, Buckets: []StatsBucket{}, Total: counts.Total, Other: counts.Other}
+	counted := 0
+	for _, group := range counts.Groups {
+		key := make(map[string]string, len(groupBy))
+		for idx, field := range groupBy {
+			key[field] = group.Values[idx]
+		}
+		stats.Buckets = append(stats.Buckets, StatsBucket{Key: key, Count: group.Count})
+		counted += group.Count
+	}
+	// events with several values are counted in several buckets, so that the
+	// buckets can add up to more than the total
+	if !counts.HasOther {
+		stats.Other = max(counts.Total-counted, 0)
+	}
+	return &stats, nil
+}
+
+// Histogram contains the number of events per interval of time
+//
+//	The JSON annotations here are for the JSON to be returned by the API
+type Histogram struct {
+	Interval string            `json:"interval"`
+	SplitBy  string            `json:"split_by,omitempty"`
+	Buckets  []HistogramBucket `json:"buckets"`
+	Total    int               `json:"total"`
+}
+
+// HistogramBucket is the number of events in the interval starting at Time.
+type HistogramBucket struct {
+	Time  time.Time      `json:"time"`
+	Count int            `json:"count"`
+	Split map[string]int `json:"split,omitempty"`
+}
+
+// GetHistogram returns the number of matching events per interval of time,
+// optionally split by the values of another field.
+func GetHistogram(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint, aggregator storage.EventAggregator) (*Histogram, error) {
+	logg.Debug("hermes.GetHistogram: tenant id is %s", tenantID)
+	histogram, err := aggregator.HistogramEvents(ctx, newStorageFilter(filter), tenantID, interval, splitBy, splitLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := Histogram{
+		Interval: formatInterval(interval),
+		SplitBy:  splitBy,
+		Buckets:  make([]HistogramBucket, 0, len(histogram.Buckets)),
+		Total:    histogram.Total,
+	}
+	for _, bucket := range histogram.Buckets {
+		resultBucket := HistogramBucket{Time: bucket.Start, Count: bucket.Count}
+		if splitBy != "" {
+			resultBucket.Split = make(map[string]int, len(bucket.Groups))
+			for _, group := range bucket.Groups {
+				resultBucket.Split[group.Values[0]] = group.Count
+			}
+		}
+		result.Buckets = append(result.Buckets, resultBucket)
+	}
+	return &result, nil
+}
+
+// formatInterval formats an interval like the interval parameter of the API,
+// e.g. "1h" instead of "1h0m0s".
+func formatInterval(interval time.Duration) string {
+	switch {
+	case interval%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", interval/(24*time.Hour))
+	case interval%time.Hour == 0:
+		return fmt.Sprintf("%dh", interval/time.Hour)
+	case interval%time.Minute == 0:
+		return fmt.Sprintf("%dm", interval/time.Minute)
+	default:
+		return interval.String()
+	}
+}
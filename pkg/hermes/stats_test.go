@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// countingStorage returns fixed counts, like a storage with events that
+// have several tags.
+type countingStorage struct {
+	storage.Mock
+	counts storage.EventCounts
+}
+
+func (s countingStorage) CountEvents(ctx context.Context, filter *storage.EventFilter, tenantID string, groupBy []string, limit uint) (*storage.EventCounts, error) {
+	return &s.counts, nil
+}
+
+func Test_GetStats(t *testing.T) {
+	// 3 events with the tags admin and cli, 1 of them also with ops, and 1 event without tags
+	groups := []storage.EventGroup{
+		{Values: []string{"admin"}, Count: 3},
+		{Values: []string{"cli"}, Count: 3},
+	}
+	tt := []struct {
+		name   string
+		counts storage.EventCounts
+		other  int
+	}{
+		{"Estimated", storage.EventCounts{Total: 4, Groups: groups}, 0},
+		{"Known", storage.EventCounts{Total: 4, Groups: groups, Other: 1, HasOther: true}, 1},
+		{"SingleValues", storage.EventCounts{Total: 8, Groups: groups}, 2},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			stats, err := GetStats(context.Background(), &EventFilter{}, "", []string{"tag"}, 2, countingStorage{counts: tc.counts})
+			require.NoError(t, err)
+			assert.Equal(t, tc.counts.Total, stats.Total)
+			assert.Len(t, stats.Buckets, 2)
+			assert.Equal(t, map[string]string{"tag": "admin"}, stats.Buckets[0].Key)
+			assert.Equal(t, tc.other, stats.Other)
+		})
+	}
+}
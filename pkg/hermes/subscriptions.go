@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"github.com/jinzhu/copier"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// NewSubscriptionFilter converts the filter parameters of an EventFilter into
+// the filter of a subscription. Time ranges, paging and sorting are dropped.
+func NewSubscriptionFilter(filter *EventFilter) storage.SubscriptionFilter {
+	var result storage.SubscriptionFilter
+	err := copier.Copy(&result, filter)
+	if err != nil {
+		panic("Could not copy subscription filter.")
+	}
+	return result
+}
+
+// SubscriptionEventFilter converts the filter of a subscription into an EventFilter.
+func SubscriptionEventFilter(filter storage.SubscriptionFilter) *EventFilter {
+	var result EventFilter
+	err := copier.Copy(&result, &filter)
+	if err != nil {
+		panic("Could not copy subscription filter.")
+	}
+	return &result
+}
+
+// NewSubscriptionMatcher returns a matcher for the events of a subscription,
+// see storage.EventMatcher.
+func NewSubscriptionMatcher(filter storage.SubscriptionFilter) (*storage.EventMatcher, error) {
+	return storage.NewEventMatcher(newStorageFilter(SubscriptionEventFilter(filter)))
+}
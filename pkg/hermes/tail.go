@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// tailTimeFormat is used for the watermark in time filters and resume IDs.
+// Events are stored with millisecond precision.
+const tailTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// tailBatchSize is the maximum number of events read by a single poll.
+const tailBatchSize = 500
+
+// EventTail follows the events matching a filter as they are written to the
+// storage. Each poll reads the events at or after a watermark on their
+// eventTime, which is the latest eventTime returned so far.
+//
+// Events are usually written shortly after their eventTime, but not in order.
+// To find events that are written late, each poll also reads the events of
+// the lookback period before the watermark, and skips those that were
+// already returned. If the lookback period contains more events than a
+// single poll can read, the next poll continues at the watermark instead.
+type EventTail struct {
+	filter    EventFilter
+	tenantID  string
+	lookback  time.Duration
+	start     time.Time            // no events before this time are returned
+	watermark time.Time            // latest eventTime returned so far
+	seen      map[string]time.Time // returned events within the lookback period
+	catchUp   bool                 // whether the next poll skips the lookback period
+}
+
+// TailEvent is an event returned by EventTail.Poll.
+type TailEvent struct {
+	// ResumeID can be given to NewEventTail to continue after this event.
+	ResumeID string
+	// Event is a *ListEvent, or an EventProjection if the filter selects Fields.
+	Event any
+	// Payload is the event as read from the storage.
+	Payload *cadf.Event
+	// TenantID is only set when following the events of several tenants.
+	TenantID string
+	// Tags are the tags of the event.
+	Tags []string
+}
+
+// NewEventTail starts following the events matching the filter. Paging,
+// sorting and time ranges in the filter are ignored. If resumeID is empty,
+// the tail starts at the given time. Otherwise it continues after the event
+// which had this TailEvent.ResumeID, so that clients can reconnect without
+// missing events, except those written late before the resumed event.
+func NewEventTail(filter *EventFilter, tenantID, resumeID string, lookback time.Duration, now time.Time) (*EventTail, error) {
+	t := EventTail{
+		filter:   *filter,
+		tenantID: tenantID,
+		lookback: lookback,
+		start:    now.UTC().Truncate(time.Millisecond),
+		seen:     make(map[string]time.Time),
+	}
+	if resumeID != "" {
+		timeStr, eventID, ok := strings.Cut(resumeID, "/")
+		start, err := time.Parse(tailTimeFormat, timeStr)
+		if !ok || eventID == "" || err != nil {
+			return nil, fmt.Errorf("invalid event ID to resume after: %q", resumeID)
+		}
+		t.start = start.UTC()
+		t.seen[eventID] = t.start
+	}
+	t.watermark = t.start
+	return &t, nil
+}
+
+// SetTenantID changes the tenants whose events are followed, starting with
+// the next poll. Several tenants can be given as a comma-separated list, see
+// storage.Storage.
+func (t *EventTail) SetTenantID(tenantID string) {
+	t.tenantID = tenantID
+}
+
+// Poll returns the events that were written since the last poll, ordered by
+// their eventTime (except for events written late). If more is true, the
+// events did not fit into a single poll, and Poll should be called again
+// right away.
+func (t *EventTail) Poll(ctx context.Context, eventStore storage.Storage) (events []TailEvent, more bool, err error) {
+	from := t.watermark.Add(-t.lookback)
+	if t.catchUp {
+		from = t.watermark
+	}
+	if from.Before(t.start) {
+		from = t.start
+	}
+
+	filter := t.filter
+	filter.Time = map[string]string{"gte": from.Format(tailTimeFormat)}
+	filter.Sort = []FieldOrder{{Fieldname: "time", Order: "asc"}}
+	filter.Offset = 0
+	filter.Limit = min(tailBatchSize, eventStore.MaxLimit())
+	filter.UseCursor = false
+	filter.Cursor = ""
+	storageFilter := newStorageFilter(&filter)
+	if len(filter.Fields) > 0 {
+		// needed for the watermark, even if the client did not select them
+		storageFilter.Fields = slices.Concat(filter.Fields, []string{"id", "eventTime"})
+	}
+
+	logg.Debug("hermes.EventTail.Poll: tenant id is %s, reading events since %s", t.tenantID, from)
+	page, err := eventStore.GetEvents(ctx, storageFilter, t.tenantID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for idx, event := range page.Events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.EventTime)
+		if err != nil {
+			logg.Error("hermes.EventTail.Poll: skipping event %s with invalid eventTime %q", event.ID, event.EventTime)
+			continue
+		}
+		eventTime = eventTime.UTC().Truncate(time.Millisecond)
+		if _, exists := t.seen[event.ID]; exists || eventTime.Before(from) {
+			continue
+		}
+		t.seen[event.ID] = eventTime
+		if eventTime.After(t.watermark) {
+			t.watermark = eventTime
+		}
+
+		tenantID := ""
+		if page.TenantIDs != nil {
+			tenantID = page.TenantIDs[idx]
+		}
+		tailEvent, err := t.render(event, tenantID)
+		if err != nil {
+			return nil, false, err
+		}
+		tailEvent.ResumeID = eventTime.Format(tailTimeFormat) + "/" + event.ID
+		tailEvent.Payload = event
+		tailEvent.TenantID = tenantID
+		if page.Tags != nil {
+			tailEvent.Tags = page.Tags[idx]
+		}
+		events = append(events, tailEvent)
+	}
+
+	// forget the events which are too old to be read again
+	maps.DeleteFunc(t.seen, func(_ string, eventTime time.Time) bool {
+		return eventTime.Before(t.watermark.Add(-t.lookback))
+	})
+
+	more = uint(len(page.Events)) == filter.Limit
+	if more && len(events) == 0 && from.Equal(t.watermark) {
+		// a full page of events which were all returned before cannot move
+		// the watermark, so polling again right away would not help
+		return nil, false, errors.New("too many events with the same eventTime, cannot advance the event stream")
+	}
+	t.catchUp = more
+	return events, more, nil
+}
+
+// render converts an event from the storage into the format of the API.
+func (t *EventTail) render(event *cadf.Event, tenantID string) (TailEvent, error) {
+	if len(t.filter.Fields) > 0 {
+		projection, err := ProjectEvent(event, t.filter.Fields)
+		if err != nil {
+			return TailEvent{}, err
+		}
+		if tenantID != "" {
+			projection["tenant_id"] = tenantID
+		}
+		return TailEvent{Event: projection}, nil
+	}
+	listEvent := eventsList([]*cadf.Event{event}, t.filter.Details || t.filter.FullDetails, t.filter.FullDetails)[0]
+	listEvent.TenantID = tenantID
+	return TailEvent{Event: listEvent}, nil
+}
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// tailStorage returns its events like a real storage for the queries of
+// EventTail: since the time in the filter, in order of their eventTime.
+type tailStorage struct {
+	storage.Mock
+	events   []*cadf.Event
+	maxLimit uint
+}
+
+func (s *tailStorage) add(id, eventTime string) {
+	s.events = append(s.events, &cadf.Event{ID: id, EventTime: eventTime, Action: "create"})
+}
+
+func (s *tailStorage) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	from, err := time.Parse(time.RFC3339Nano, filter.Time["gte"])
+	if err != nil {
+		return nil, err
+	}
+	var events []*cadf.Event
+	for _, event := range s.events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.EventTime)
+		if err != nil {
+			return nil, err
+		}
+		if !eventTime.Before(from) {
+			events = append(events, event)
+		}
+	}
+	slices.SortStableFunc(events, func(a, b *cadf.Event) int {
+		return compareEventTimes(a.EventTime, b.EventTime)
+	})
+	events = events[:min(uint(len(events)), filter.Limit)]
+	return &storage.EventPage{Events: events, Total: len(events)}, nil
+}
+
+func (s *tailStorage) MaxLimit() uint {
+	if s.maxLimit == 0 {
+		return 100
+	}
+	return s.maxLimit
+}
+
+func compareEventTimes(a, b string) int {
+	timeA, _ := time.Parse(time.RFC3339Nano, a)
+	timeB, _ := time.Parse(time.RFC3339Nano, b)
+	return timeA.Compare(timeB)
+}
+
+func tailEventIDs(t *testing.T, events []TailEvent) []string {
+	t.Helper()
+	var ids []string
+	for _, event := range events {
+		listEvent, ok := event.Event.(*ListEvent)
+		require.True(t, ok)
+		ids = append(ids, listEvent.ID)
+	}
+	return ids
+}
+
+func Test_EventTail(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := &tailStorage{}
+	store.add("old", "2024-05-01T11:59:59.000+00:00")
+
+	tail, err := NewEventTail(&EventFilter{}, "", "", time.Minute, now)
+	require.Nil(t, err)
+	events, more, err := tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Empty(t, events, "events before the start are skipped")
+	assert.False(t, more)
+
+	store.add("first", "2024-05-01T12:00:01.5+00:00")
+	store.add("second", "2024-05-01T12:00:02.000+00:00")
+	events, _, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"first", "second"}, tailEventIDs(t, events))
+	assert.Equal(t, "2024-05-01T12:00:01.500Z/first", events[0].ResumeID)
+
+	events, _, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Empty(t, events, "events are only returned once")
+
+	// events written late are found within the lookback period
+	store.add("late", "2024-05-01T12:00:01.000+00:00")
+	store.add("third", "2024-05-01T12:03:00.000+00:00")
+	events, _, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"late", "third"}, tailEventIDs(t, events))
+	store.add("too-late", "2024-05-01T12:01:30.000+00:00")
+	events, _, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Empty(t, events, "events before the lookback period are skipped")
+}
+
+func Test_EventTail_Resume(t *testing.T) {
+	ctx := context.Background()
+	store := &tailStorage{}
+	store.add("first", "2024-05-01T12:00:01.000+00:00")
+	store.add("second", "2024-05-01T12:00:01.000+00:00")
+	store.add("third", "2024-05-01T12:00:02.000+00:00")
+
+	tail, err := NewEventTail(&EventFilter{}, "", "2024-05-01T12:00:01.000Z/first", time.Minute, time.Now())
+	require.Nil(t, err)
+	events, _, err := tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"second", "third"}, tailEventIDs(t, events))
+
+	for _, resumeID := range []string{"first", "2024-05-01T12:00:01.000Z/", "yesterday/first"} {
+		_, err = NewEventTail(&EventFilter{}, "", resumeID, time.Minute, time.Now())
+		assert.NotNil(t, err, resumeID)
+	}
+}
+
+func Test_EventTail_Batches(t *testing.T) {
+	ctx := context.Background()
+	store := &tailStorage{maxLimit: 2}
+	store.add("first", "2024-05-01T12:00:01.000+00:00")
+	store.add("second", "2024-05-01T12:00:02.000+00:00")
+	store.add("third", "2024-05-01T12:00:03.000+00:00")
+
+	tail, err := NewEventTail(&EventFilter{}, "", "2024-05-01T12:00:00.000Z/zero", time.Minute, time.Now())
+	require.Nil(t, err)
+	events, more, err := tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"first", "second"}, tailEventIDs(t, events))
+	assert.True(t, more)
+	events, more, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"third"}, tailEventIDs(t, events))
+	events, more, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.Empty(t, events)
+	assert.False(t, more)
+
+	// a full batch of events with the same eventTime cannot be advanced
+	store = &tailStorage{maxLimit: 2}
+	store.add("first", "2024-05-01T12:00:01.000+00:00")
+	store.add("second", "2024-05-01T12:00:01.000+00:00")
+	store.add("third", "2024-05-01T12:00:01.000+00:00")
+	tail, err = NewEventTail(&EventFilter{}, "", "2024-05-01T12:00:00.000Z/zero", time.Minute, time.Now())
+	require.Nil(t, err)
+	_, more, err = tail.Poll(ctx, store)
+	require.Nil(t, err)
+	assert.True(t, more)
+	_, _, err = tail.Poll(ctx, store)
+	assert.NotNil(t, err)
+}
+
+func Test_EventTail_Fields(t *testing.T) {
+	store := &tailStorage{}
+	store.add("first", "2024-05-01T12:00:01.000+00:00")
+	tail, err := NewEventTail(&EventFilter{Fields: []string{"action"}}, "", "2024-05-01T12:00:00.000Z/zero", time.Minute, time.Now())
+	require.Nil(t, err)
+	events, _, err := tail.Poll(context.Background(), store)
+	require.Nil(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, EventProjection{"action": "create"}, events[0].Event)
+	assert.Equal(t, "2024-05-01T12:00:01.000Z/first", events[0].ResumeID)
+}
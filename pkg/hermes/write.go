@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sapcc/go-api-declarations/cadf"
+)
+
+// tenantIDRx matches project and domain IDs which can be used in index names.
+var tenantIDRx = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// DecodeEvent decodes a CADF event together with its tags, which are part of
+// the CADF specification (and sent by the audit middleware), but not of
+// cadf.Event. The returned event is never nil.
+func DecodeEvent(data []byte) (*cadf.Event, []string, error) {
+	var doc struct {
+		cadf.Event
+		Tags []string `json:"tags"`
+	}
+	err := json.Unmarshal(data, &doc)
+	return &doc.Event, doc.Tags, err
+}
+
+// ValidateEvent checks that an event has all attributes which Hermes needs to
+// store, filter and display it.
+func ValidateEvent(event *cadf.Event) error {
+	// event details can only be retrieved for events with a UUID
+	if _, err := uuid.Parse(event.ID); err != nil {
+		return fmt.Errorf("invalid id %q: %w", event.ID, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, event.EventTime); err != nil {
+		return fmt.Errorf("invalid eventTime %q: %w", event.EventTime, err)
+	}
+
+	missing := []struct {
+		name  string
+		value string
+	}{
+		{"action", string(event.Action)},
+		{"outcome", string(event.Outcome)},
+		{"initiator.typeURI", event.Initiator.TypeURI},
+		{"target.typeURI", event.Target.TypeURI},
+		{"observer.typeURI", event.Observer.TypeURI},
+	}
+	for _, attr := range missing {
+		if attr.value == "" {
+			return fmt.Errorf("missing %s", attr.name)
+		}
+	}
+	return nil
+}
+
+// EventTenantID returns the ID of the project or domain which an event is
+// stored for. The project of the target is preferred, since the owner of a
+// resource needs to see what happens to it, then the project of the
+// initiator, then their domains.
+func EventTenantID(event *cadf.Event) (string, error) {
+	candidates := []string{
+		event.Target.ProjectID,
+		event.Initiator.ProjectID,
+		event.Target.DomainID,
+		event.Initiator.DomainID,
+	}
+	for _, tenantID := range candidates {
+		if tenantID == "" {
+			continue
+		}
+		tenantID = strings.ToLower(tenantID)
+		if !tenantIDRx.MatchString(tenantID) {
+			return "", fmt.Errorf("invalid project or domain ID %q", tenantID)
+		}
+		return tenantID, nil
+	}
+	return "", errors.New("missing project_id or domain_id in target and initiator")
+}
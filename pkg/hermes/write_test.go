@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package hermes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+func Test_ValidateEvent(t *testing.T) {
+	tt := []struct {
+		name   string
+		modify func(event *cadf.Event)
+		valid  bool
+	}{
+		{"Valid", func(event *cadf.Event) {}, true},
+		{"InvalidID", func(event *cadf.Event) { event.ID = "1234" }, false},
+		{"InvalidTime", func(event *cadf.Event) { event.EventTime = "2017-11-17 08:53" }, false},
+		{"MissingAction", func(event *cadf.Event) { event.Action = "" }, false},
+		{"MissingTargetType", func(event *cadf.Event) { event.Target.TypeURI = "" }, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := storage.Mock{}.GetEvent(context.Background(), "", "")
+			require.Nil(t, err)
+			tc.modify(event)
+			assert.Equal(t, tc.valid, ValidateEvent(event) == nil)
+		})
+	}
+}
+
+func Test_EventTenantID(t *testing.T) {
+	tt := []struct {
+		name      string
+		initiator cadf.Resource
+		target    cadf.Resource
+		expected  string
+	}{
+		{"TargetProject", cadf.Resource{ProjectID: "initiator"}, cadf.Resource{ProjectID: "target", DomainID: "domain"}, "target"},
+		{"InitiatorProject", cadf.Resource{ProjectID: "initiator"}, cadf.Resource{DomainID: "domain"}, "initiator"},
+		{"TargetDomain", cadf.Resource{DomainID: "domain1"}, cadf.Resource{DomainID: "domain2"}, "domain2"},
+		{"Lowercase", cadf.Resource{}, cadf.Resource{ProjectID: "B3B70C82"}, "b3b70c82"},
+		{"Invalid", cadf.Resource{}, cadf.Resource{ProjectID: "audit-*"}, ""},
+		{"Missing", cadf.Resource{}, cadf.Resource{}, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tenantID, err := EventTenantID(&cadf.Event{Initiator: tc.initiator, Target: tc.target})
+			assert.Equal(t, tc.expected, tenantID)
+			assert.Equal(t, tc.expected == "", err != nil)
+		})
+	}
+}
+
+func Test_DecodeEvent(t *testing.T) {
+	event, tags, err := DecodeEvent([]byte(`{"id":"7be6c4ff-b761-5f1f-b234-f5d41616c2cd","action":"create","tags":["admin","cli"]}`))
+	require.Nil(t, err)
+	assert.Equal(t, "7be6c4ff-b761-5f1f-b234-f5d41616c2cd", event.ID)
+	assert.Equal(t, cadf.Action("create"), event.Action)
+	assert.Equal(t, []string{"admin", "cli"}, tags)
+
+	_, _, err = DecodeEvent([]byte(`{"id":"7be6c4ff-b761-5f1f-b234-f5d41616c2cd","tags":"admin"}`))
+	assert.NotNil(t, err)
+}
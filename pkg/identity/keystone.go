@@ -17,18 +17,9 @@ import (
 // NewTokenValidator connects to Keystone using the provided OpenStack
 // credentials and constructs a gopherpolicy.TokenValidator instance.
 func NewTokenValidator(ctx context.Context) (*gopherpolicy.TokenValidator, error) {
-	opts := authOptions()
-	providerClient, err := openstack.AuthenticatedClient(ctx, opts)
-	if err != nil {
-		return nil, fmt.Errorf("cannot initialize OpenStack client: %w", err)
-	}
-
-	//TODO: crashes with RegionName != ""
-	identityV3, err := openstack.NewIdentityV3(providerClient,
-		gophercloud.EndpointOpts{Region: "", Availability: gophercloud.AvailabilityPublic},
-	)
+	identityV3, err := newIdentityClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("cannot initialize Keystone client: %w", err)
+		return nil, err
 	}
 
 	tv := gopherpolicy.TokenValidator{
@@ -43,6 +34,24 @@ func NewTokenValidator(ctx context.Context) (*gopherpolicy.TokenValidator, error
 	return &tv, nil
 }
 
+// newIdentityClient connects to Keystone using the provided OpenStack credentials.
+func newIdentityClient(ctx context.Context) (*gophercloud.ServiceClient, error) {
+	opts := authOptions()
+	providerClient, err := openstack.AuthenticatedClient(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize OpenStack client: %w", err)
+	}
+
+	//TODO: crashes with RegionName != ""
+	identityV3, err := openstack.NewIdentityV3(providerClient,
+		gophercloud.EndpointOpts{Region: "", Availability: gophercloud.AvailabilityPublic},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize Keystone client: %w", err)
+	}
+	return identityV3, nil
+}
+
 func authOptions() gophercloud.AuthOptions {
 	return gophercloud.AuthOptions{
 		IdentityEndpoint: viper.GetString("Keystone.auth_url"),
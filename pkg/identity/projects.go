@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package identity
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/projects"
+)
+
+// ProjectLister finds the projects of a domain, to query the events of a
+// whole domain.
+type ProjectLister interface {
+	// ListProjectIDs returns the IDs of all projects in the domain.
+	ListProjectIDs(ctx context.Context, domainID string) ([]string, error)
+}
+
+// NewProjectLister connects to Keystone using the provided OpenStack
+// credentials and constructs a ProjectLister that caches the projects of
+// each domain for the given duration.
+func NewProjectLister(ctx context.Context, cacheTime time.Duration) (ProjectLister, error) {
+	identityV3, err := newIdentityClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewCachedProjectLister(keystoneProjectLister{identityV3}, cacheTime), nil
+}
+
+// keystoneProjectLister lists the projects of a domain in Keystone.
+type keystoneProjectLister struct {
+	IdentityV3 *gophercloud.ServiceClient
+}
+
+// ListProjectIDs implements the ProjectLister interface.
+func (l keystoneProjectLister) ListProjectIDs(ctx context.Context, domainID string) ([]string, error) {
+	pages, err := projects.List(l.IdentityV3, projects.ListOpts{DomainID: domainID}).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list projects of domain %s: %w", domainID, err)
+	}
+	list, err := projects.ExtractProjects(pages)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list projects of domain %s: %w", domainID, err)
+	}
+	projectIDs := make([]string, len(list))
+	for idx, project := range list {
+		projectIDs[idx] = project.ID
+	}
+	return projectIDs, nil
+}
+
+// CachedProjectLister remembers the projects of a domain returned by another
+// ProjectLister, so that consecutive queries do not put load on Keystone.
+// Projects created in the meantime are found once the cache expires.
+type CachedProjectLister struct {
+	lister    ProjectLister
+	cacheTime time.Duration
+	timeNow   func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]cachedProjects
+}
+
+type cachedProjects struct {
+	projectIDs []string
+	expiresAt  time.Time
+}
+
+// NewCachedProjectLister constructs a CachedProjectLister that caches the
+// projects of each domain for the given duration.
+func NewCachedProjectLister(lister ProjectLister, cacheTime time.Duration) *CachedProjectLister {
+	return &CachedProjectLister{
+		lister:    lister,
+		cacheTime: cacheTime,
+		timeNow:   time.Now,
+		entries:   make(map[string]cachedProjects),
+	}
+}
+
+// ListProjectIDs implements the ProjectLister interface.
+func (l *CachedProjectLister) ListProjectIDs(ctx context.Context, domainID string) ([]string, error) {
+	l.mutex.Lock()
+	entry, exists := l.entries[domainID]
+	l.mutex.Unlock()
+	if exists && l.timeNow().Before(entry.expiresAt) {
+		return slices.Clone(entry.projectIDs), nil
+	}
+
+	projectIDs, err := l.lister.ListProjectIDs(ctx, domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// drop expired entries on the way, so that the cache does not grow with
+	// every domain that was ever queried
+	for id, entry := range l.entries {
+		if !l.timeNow().Before(entry.expiresAt) {
+			delete(l.entries, id)
+		}
+	}
+	l.entries[domainID] = cachedProjects{projectIDs, l.timeNow().Add(l.cacheTime)}
+	return slices.Clone(projectIDs), nil
+}
+
+// MockProjectLister is a ProjectLister with static projects per domain ID,
+// for use with the mock Keystone driver.
+type MockProjectLister map[string][]string
+
+// ListProjectIDs implements the ProjectLister interface.
+func (l MockProjectLister) ListProjectIDs(ctx context.Context, domainID string) ([]string, error) {
+	return slices.Clone(l[domainID]), nil
+}
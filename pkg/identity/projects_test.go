@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package identity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingProjectLister counts the calls, and fails for unknown domains.
+type countingProjectLister struct {
+	projects MockProjectLister
+	calls    int
+}
+
+func (l *countingProjectLister) ListProjectIDs(ctx context.Context, domainID string) ([]string, error) {
+	l.calls++
+	if _, exists := l.projects[domainID]; !exists {
+		return nil, errors.New("no such domain")
+	}
+	return l.projects.ListProjectIDs(ctx, domainID)
+}
+
+func TestCachedProjectLister(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingProjectLister{projects: MockProjectLister{
+		"domain-a": {"project-1", "project-2"},
+		"domain-b": {"project-3"},
+	}}
+	now := time.Date(2017, 11, 17, 9, 0, 0, 0, time.UTC)
+	lister := NewCachedProjectLister(backend, 5*time.Minute)
+	lister.timeNow = func() time.Time { return now }
+
+	projectIDs, err := lister.ListProjectIDs(ctx, "domain-a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"project-1", "project-2"}, projectIDs)
+	assert.Equal(t, 1, backend.calls)
+
+	// the result is cached per domain
+	now = now.Add(4 * time.Minute)
+	projectIDs, err = lister.ListProjectIDs(ctx, "domain-a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"project-1", "project-2"}, projectIDs)
+	assert.Equal(t, 1, backend.calls)
+
+	projectIDs, err = lister.ListProjectIDs(ctx, "domain-b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"project-3"}, projectIDs)
+	assert.Equal(t, 2, backend.calls)
+
+	// until it expires
+	now = now.Add(time.Minute)
+	backend.projects["domain-a"] = append(backend.projects["domain-a"], "project-4")
+	projectIDs, err = lister.ListProjectIDs(ctx, "domain-a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"project-1", "project-2", "project-4"}, projectIDs)
+	assert.Equal(t, 3, backend.calls)
+
+	// errors are not cached
+	_, err = lister.ListProjectIDs(ctx, "domain-c")
+	require.Error(t, err)
+	_, err = lister.ListProjectIDs(ctx, "domain-c")
+	require.Error(t, err)
+	assert.Equal(t, 5, backend.calls)
+}
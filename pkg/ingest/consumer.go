@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ingest implements `hermes ingest`, which consumes CADF events from
+// a RabbitMQ queue and writes them to the storage, replacing Logstash.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// maxRetryInterval limits the exponential backoff when writing to the storage fails.
+const maxRetryInterval = time.Minute
+
+var eventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "hermes_ingest_events_count",
+	Help: "Number of events consumed from RabbitMQ by result (indexed, dead_lettered or retried)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(eventsCounter)
+}
+
+// Channel is the subset of *amqp.Channel used by the Consumer, so that tests
+// can use an in-process stand-in for RabbitMQ.
+type Channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Consumer reads events from a queue and writes them to the storage in batches.
+//
+// Messages are only acknowledged after their event was written, so no event
+// is lost when Hermes or the storage goes down. While the storage does not
+// accept events, the Consumer keeps retrying the current batch and does not
+// take new messages, so that RabbitMQ holds them back (at most BatchSize
+// unacknowledged messages are delivered at any time).
+type Consumer struct {
+	Queue string
+	// DeadLetterQueue receives messages which do not contain a valid event,
+	// with the reason in the "x-hermes-error" header. If empty, those messages
+	// are rejected instead, which routes them to the dead letter exchange of
+	// the queue (if there is one).
+	DeadLetterQueue string
+	Writer          storage.EventWriter
+	BatchSize       int
+	// FlushInterval is the maximum time that a message waits for its batch to fill up.
+	FlushInterval time.Duration
+	// RetryInterval is the initial delay before writing a batch again, doubled after every failed attempt.
+	RetryInterval time.Duration
+}
+
+// pendingEvent is a valid event whose delivery is not yet acknowledged.
+type pendingEvent struct {
+	Delivery amqp.Delivery
+	Event    storage.TenantEvent
+}
+
+// Run consumes from the queue on the given channel until ctx is canceled
+// (which returns nil) or the channel is closed (which returns an error).
+func (c Consumer) Run(ctx context.Context, ch Channel) error {
+	err := ch.Qos(c.BatchSize, 0, false)
+	if err != nil {
+		return fmt.Errorf("cannot set prefetch count: %w", err)
+	}
+	deliveries, err := ch.Consume(c.Queue, "hermes-ingest", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("cannot consume from queue %s: %w", c.Queue, err)
+	}
+
+	var batch []amqp.Delivery
+	flushTimer := time.NewTimer(c.FlushInterval)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, d := range batch {
+				requeue(d)
+			}
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("delivery channel was closed")
+			}
+			batch = append(batch, d)
+			if len(batch) == 1 {
+				flushTimer.Reset(c.FlushInterval)
+			}
+			if len(batch) < c.BatchSize {
+				continue
+			}
+			flushTimer.Stop()
+		case <-flushTimer.C:
+		}
+
+		c.processBatch(ctx, ch, batch)
+		batch = nil
+	}
+}
+
+// processBatch writes the events of all deliveries, retrying until all of
+// them are either written or dead-lettered, or until ctx is canceled.
+func (c Consumer) processBatch(ctx context.Context, ch Channel, batch []amqp.Delivery) {
+	var pending []pendingEvent
+	for _, d := range batch {
+		event, err := parseMessage(d.Body)
+		if err != nil {
+			c.deadLetter(ctx, ch, d, err)
+			continue
+		}
+		pending = append(pending, pendingEvent{d, *event})
+	}
+
+	retryInterval := c.RetryInterval
+	for {
+		pending = c.writeEvents(ctx, ch, pending)
+		if len(pending) == 0 {
+			return
+		}
+		eventsCounter.WithLabelValues("retried").Add(float64(len(pending)))
+		logg.Info("ingest: retrying to write %d events in %s", len(pending), retryInterval)
+
+		select {
+		case <-ctx.Done():
+			for _, p := range pending {
+				requeue(p.Delivery)
+			}
+			return
+		case <-time.After(retryInterval):
+		}
+		retryInterval = min(2*retryInterval, maxRetryInterval)
+	}
+}
+
+// writeEvents writes the given events to the storage, and returns the ones
+// that need to be written again.
+func (c Consumer) writeEvents(ctx context.Context, ch Channel, pending []pendingEvent) []pendingEvent {
+	events := make([]storage.TenantEvent, len(pending))
+	for idx, p := range pending {
+		events[idx] = p.Event
+	}
+	results, err := c.Writer.WriteEvents(ctx, events)
+	if err != nil {
+		logg.Error("ingest: could not write %d events: %s", len(events), err.Error())
+		return pending
+	}
+
+	var retry []pendingEvent
+	for idx, err := range results {
+		switch {
+		case err == nil:
+			eventsCounter.WithLabelValues("indexed").Inc()
+			ack(pending[idx].Delivery)
+		case errors.Is(err, storage.ErrEventRejected):
+			c.deadLetter(ctx, ch, pending[idx].Delivery, err)
+		default:
+			logg.Error("ingest: could not write event %s: %s", pending[idx].Event.Event.ID, err.Error())
+			retry = append(retry, pending[idx])
+		}
+	}
+	return retry
+}
+
+// deadLetter moves a message that can never be written out of the queue.
+func (c Consumer) deadLetter(ctx context.Context, ch Channel, d amqp.Delivery, reason error) {
+	logg.Info("ingest: dead-lettering message %s: %s", d.MessageId, reason.Error())
+	eventsCounter.WithLabelValues("dead_lettered").Inc()
+
+	if c.DeadLetterQueue == "" {
+		err := d.Reject(false)
+		if err != nil {
+			logg.Error("ingest: could not reject message: %s", err.Error())
+		}
+		return
+	}
+
+	err := ch.PublishWithContext(ctx, "", c.DeadLetterQueue, false, false, amqp.Publishing{
+		Headers:      amqp.Table{"x-hermes-error": reason.Error()},
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Timestamp:    time.Now(),
+		Body:         d.Body,
+	})
+	if err != nil {
+		// keep the message in the queue, it is dead-lettered again after the redelivery
+		logg.Error("ingest: could not publish to dead letter queue %s: %s", c.DeadLetterQueue, err.Error())
+		requeue(d)
+		return
+	}
+	ack(d)
+}
+
+func ack(d amqp.Delivery) {
+	err := d.Ack(false)
+	if err != nil {
+		// the message will be redelivered, and its event is found to be stored already
+		logg.Error("ingest: could not acknowledge message: %s", err.Error())
+	}
+}
+
+func requeue(d amqp.Delivery) {
+	err := d.Nack(false, true)
+	if err != nil {
+		logg.Error("ingest: could not requeue message: %s", err.Error())
+	}
+}
@@ -0,0 +1,312 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// fakeBroker is an in-process stand-in for a RabbitMQ channel with a single queue.
+type fakeBroker struct {
+	mutex      sync.Mutex
+	deliveries chan amqp.Delivery
+	nextTag    uint64
+	prefetch   int
+	acked      []uint64
+	requeued   []uint64
+	rejected   []uint64
+	// published contains the messages sent to the dead letter queue
+	published []amqp.Publishing
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{deliveries: make(chan amqp.Delivery, 100)}
+}
+
+func (b *fakeBroker) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.prefetch = prefetchCount
+	return nil
+}
+
+func (b *fakeBroker) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if autoAck {
+		return nil, errors.New("messages must be acknowledged explicitly")
+	}
+	return b.deliveries, nil
+}
+
+func (b *fakeBroker) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if key != "dead-letters" {
+		return fmt.Errorf("unexpected routing key %q", key)
+	}
+	b.published = append(b.published, msg)
+	return nil
+}
+
+// Ack, Nack and Reject implement the amqp.Acknowledger interface.
+func (b *fakeBroker) Ack(tag uint64, multiple bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.acked = append(b.acked, tag)
+	return nil
+}
+
+func (b *fakeBroker) Nack(tag uint64, multiple, requeue bool) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if requeue {
+		b.requeued = append(b.requeued, tag)
+	} else {
+		b.rejected = append(b.rejected, tag)
+	}
+	return nil
+}
+
+func (b *fakeBroker) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+// send puts a message into the queue.
+func (b *fakeBroker) send(body string) {
+	b.mutex.Lock()
+	b.nextTag++
+	d := amqp.Delivery{Acknowledger: b, DeliveryTag: b.nextTag, MessageId: fmt.Sprintf("msg-%d", b.nextTag), Body: []byte(body)}
+	b.mutex.Unlock()
+	b.deliveries <- d
+}
+
+// settled returns the number of messages that were acknowledged, requeued or rejected.
+func (b *fakeBroker) settled() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.acked) + len(b.requeued) + len(b.rejected)
+}
+
+// fakeWriter records all written events. Its results can be chosen per call.
+type fakeWriter struct {
+	mutex  sync.Mutex
+	broker *fakeBroker
+	// results returns the result of WriteEvents for the n-th call (starting at 0)
+	results func(n int, events []storage.TenantEvent) ([]error, error)
+	calls   [][]string
+	// settledDuringWrite is the number of messages settled while events were written
+	settledDuringWrite int
+}
+
+func (w *fakeWriter) WriteEvents(ctx context.Context, events []storage.TenantEvent) ([]error, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.TenantID+"/"+e.Event.ID)
+	}
+	w.settledDuringWrite = w.broker.settled()
+	n := len(w.calls)
+	w.calls = append(w.calls, ids)
+	if w.results == nil {
+		return make([]error, len(events)), nil
+	}
+	return w.results(n, events)
+}
+
+func (w *fakeWriter) writtenEvents() [][]string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.calls
+}
+
+func makeEvent(id, projectID string) string {
+	return fmt.Sprintf(`{"typeURI":"http://schemas.dmtf.org/cloud/audit/1.0/event","id":%q,"eventTime":"2024-03-01T10:00:00.123456+00:00",`+
+		`"action":"create","outcome":"success","initiator":{"typeURI":"service/security/account/user","id":"user"},`+
+		`"target":{"typeURI":"compute/server","id":"server","project_id":%q},"observer":{"typeURI":"service/compute","id":"nova"}}`, id, projectID)
+}
+
+// makeNotification wraps an event like the audit middleware does.
+func makeNotification(event string) string {
+	message := fmt.Sprintf(`{"event_type":"audit.http.request","priority":"INFO","payload":%s}`, event)
+	envelope, err := json.Marshal(map[string]string{"oslo.version": "2.0", "oslo.message": message})
+	if err != nil {
+		panic(err)
+	}
+	return string(envelope)
+}
+
+const (
+	event1 = "c5b4e8a2-2c52-4a36-a9a1-3e0a6f9d5c01"
+	event2 = "c5b4e8a2-2c52-4a36-a9a1-3e0a6f9d5c02"
+	event3 = "c5b4e8a2-2c52-4a36-a9a1-3e0a6f9d5c03"
+)
+
+// startConsumer runs the consumer until the end of the test.
+func startConsumer(t *testing.T, consumer Consumer, broker *fakeBroker) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- consumer.Run(ctx, broker) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.Nil(t, <-done)
+	})
+	return cancel
+}
+
+func waitForSettled(t *testing.T, broker *fakeBroker, count int) {
+	require.Eventually(t, func() bool { return broker.settled() >= count }, 5*time.Second, time.Millisecond)
+}
+
+func TestConsumerAcknowledgesAfterWrite(t *testing.T) {
+	broker := newFakeBroker()
+	writer := &fakeWriter{broker: broker}
+	startConsumer(t, Consumer{Writer: writer, BatchSize: 3, FlushInterval: time.Hour}, broker)
+
+	broker.send(makeEvent(event1, "project1"))
+	broker.send(makeNotification(makeEvent(event2, "Project2")))
+	broker.send(`{"event_type":"audit.http.request","payload":` + makeEvent(event3, "project1") + `}`)
+	waitForSettled(t, broker, 3)
+
+	assert.Equal(t, [][]string{{"project1/" + event1, "project2/" + event2, "project1/" + event3}}, writer.writtenEvents())
+	assert.Equal(t, 0, writer.settledDuringWrite)
+	assert.Equal(t, []uint64{1, 2, 3}, broker.acked)
+	assert.Equal(t, 3, broker.prefetch)
+}
+
+func TestConsumerDeadLetters(t *testing.T) {
+	rejectEvent2 := func(n int, events []storage.TenantEvent) ([]error, error) {
+		results := make([]error, len(events))
+		for idx, e := range events {
+			if e.Event.ID == event2 {
+				results[idx] = fmt.Errorf("%w: mapper_parsing_exception", storage.ErrEventRejected)
+			}
+		}
+		return results, nil
+	}
+	sendMessages := func(broker *fakeBroker) {
+		broker.send("not json")
+		broker.send(`{"id": "` + event1 + `"}`)
+		broker.send(makeEvent(event2, "project1"))
+		broker.send(makeEvent(event3, ""))
+		broker.send(makeEvent(event1, "project1"))
+	}
+
+	t.Run("DeadLetterQueue", func(t *testing.T) {
+		broker := newFakeBroker()
+		writer := &fakeWriter{broker: broker, results: rejectEvent2}
+		consumer := Consumer{Writer: writer, DeadLetterQueue: "dead-letters", BatchSize: 10, FlushInterval: 100 * time.Millisecond}
+		startConsumer(t, consumer, broker)
+		sendMessages(broker)
+		waitForSettled(t, broker, 5)
+
+		assert.Equal(t, [][]string{{"project1/" + event2, "project1/" + event1}}, writer.writtenEvents())
+		assert.ElementsMatch(t, []uint64{1, 2, 3, 4, 5}, broker.acked)
+		require.Len(t, broker.published, 4)
+		assert.Equal(t, "not json", string(broker.published[0].Body))
+		assert.Contains(t, broker.published[0].Headers["x-hermes-error"], "invalid JSON")
+		assert.Contains(t, broker.published[1].Headers["x-hermes-error"], "invalid eventTime")
+		assert.Contains(t, broker.published[2].Headers["x-hermes-error"], "missing project_id")
+		assert.Contains(t, broker.published[3].Headers["x-hermes-error"], "mapper_parsing_exception")
+		assert.Equal(t, "msg-3", broker.published[3].MessageId)
+	})
+
+	t.Run("DeadLetterExchange", func(t *testing.T) {
+		broker := newFakeBroker()
+		writer := &fakeWriter{broker: broker, results: rejectEvent2}
+		startConsumer(t, Consumer{Writer: writer, BatchSize: 10, FlushInterval: 100 * time.Millisecond}, broker)
+		sendMessages(broker)
+		waitForSettled(t, broker, 5)
+
+		assert.Equal(t, []uint64{5}, broker.acked)
+		assert.ElementsMatch(t, []uint64{1, 2, 3, 4}, broker.rejected)
+		assert.Empty(t, broker.published)
+	})
+}
+
+func TestConsumerRetriesUntilWritten(t *testing.T) {
+	broker := newFakeBroker()
+	writer := &fakeWriter{broker: broker, results: func(n int, events []storage.TenantEvent) ([]error, error) {
+		results := make([]error, len(events))
+		switch n {
+		case 0:
+			return nil, errors.New("connection refused")
+		case 1:
+			results[0] = errors.New("es_rejected_execution_exception")
+		}
+		return results, nil
+	}}
+	startConsumer(t, Consumer{Writer: writer, BatchSize: 2, FlushInterval: time.Hour, RetryInterval: time.Millisecond}, broker)
+
+	broker.send(makeEvent(event1, "project1"))
+	broker.send(makeEvent(event2, "project1"))
+	waitForSettled(t, broker, 2)
+
+	assert.Equal(t, [][]string{
+		{"project1/" + event1, "project1/" + event2},
+		{"project1/" + event1, "project1/" + event2},
+		{"project1/" + event1},
+	}, writer.writtenEvents())
+	assert.Equal(t, []uint64{2, 1}, broker.acked)
+	assert.Empty(t, broker.rejected)
+}
+
+func TestConsumerRequeuesOnShutdown(t *testing.T) {
+	broker := newFakeBroker()
+	writer := &fakeWriter{broker: broker, results: func(n int, events []storage.TenantEvent) ([]error, error) {
+		return nil, errors.New("cluster_block_exception")
+	}}
+	cancel := startConsumer(t, Consumer{Writer: writer, BatchSize: 1, FlushInterval: time.Hour, RetryInterval: time.Millisecond}, broker)
+
+	broker.send(makeEvent(event1, "project1"))
+	require.Eventually(t, func() bool { return len(writer.writtenEvents()) >= 2 }, 5*time.Second, time.Millisecond)
+	cancel()
+	waitForSettled(t, broker, 1)
+
+	assert.Equal(t, []uint64{1}, broker.requeued)
+	assert.Empty(t, broker.acked)
+}
+
+func TestParseMessage(t *testing.T) {
+	tt := []struct {
+		name     string
+		body     string
+		tenantID string
+		tags     []string
+	}{
+		{"CADF", makeEvent(event1, "project1"), "project1", nil},
+		{"Notification", `{"event_type":"audit.http.request","payload":` + makeEvent(event1, "project1") + `}`, "project1", nil},
+		{"OsloEnvelope", makeNotification(makeEvent(event1, "project1")), "project1", nil},
+		{"Tags", strings.Replace(makeEvent(event1, "project1"), `{`, `{"tags":["admin","cli"],`, 1), "project1", []string{"admin", "cli"}},
+		{"InvalidJSON", `{"event_type":`, "", nil},
+		{"InvalidEnvelope", `{"oslo.version":"2.0","oslo.message":"{"}`, "", nil},
+		{"InvalidEvent", `{"event_type":"audit.http.request","payload":{"id":"1234"}}`, "", nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := parseMessage([]byte(tc.body))
+			if tc.tenantID == "" {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tc.tenantID, event.TenantID)
+			assert.Equal(t, event1, event.Event.ID)
+			assert.Equal(t, tc.tags, event.Tags)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// osloEnvelope wraps notifications sent with oslo.messaging (message format 2.0).
+type osloEnvelope struct {
+	Message string `json:"oslo.message"`
+}
+
+// notification is an oslo.messaging notification, e.g. from the audit middleware.
+type notification struct {
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// parseMessage extracts the event from a message body. The event can be sent
+// as an oslo.messaging notification (with or without envelope) or as a plain
+// CADF event, as sent by go-bits/audittools.
+func parseMessage(body []byte) (*storage.TenantEvent, error) {
+	var envelope osloEnvelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if envelope.Message != "" {
+		body = []byte(envelope.Message)
+	}
+
+	var n notification
+	err = json.Unmarshal(body, &n)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification: %w", err)
+	}
+	if len(n.Payload) > 0 {
+		body = n.Payload
+	}
+
+	event, tags, err := hermes.DecodeEvent(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CADF event: %w", err)
+	}
+	err = hermes.ValidateEvent(event)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CADF event: %w", err)
+	}
+	tenantID, err := hermes.EventTenantID(event)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CADF event %s: %w", event.ID, err)
+	}
+	return &storage.TenantEvent{TenantID: tenantID, Event: event, Tags: tags}, nil
+}
@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// reconnectInterval is the delay before connecting to RabbitMQ again after the connection was lost.
+const reconnectInterval = 10 * time.Second
+
+// Serve consumes from the RabbitMQ server at uri until ctx is canceled. Lost
+// connections are re-established.
+func (c Consumer) Serve(ctx context.Context, uri string) error {
+	parsedURI, err := amqp.ParseURI(uri)
+	if err != nil {
+		return fmt.Errorf("invalid RabbitMQ URL: %w", err)
+	}
+
+	for {
+		err := c.serveConnection(ctx, uri)
+		if ctx.Err() != nil {
+			return nil
+		}
+		logg.Error("ingest: lost connection to RabbitMQ at %s:%d: %s", parsedURI.Host, parsedURI.Port, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (c Consumer) serveConnection(ctx context.Context, uri string) error {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if c.DeadLetterQueue != "" {
+		_, err = ch.QueueDeclare(
+			c.DeadLetterQueue,
+			true,  // durable
+			false, // autoDelete
+			false, // exclusive
+			false, // noWait
+			nil,   // args
+		)
+		if err != nil {
+			return fmt.Errorf("cannot declare dead letter queue: %w", err)
+		}
+	}
+
+	logg.Info("ingest: consuming from queue %s", c.Queue)
+	return c.Run(ctx, ch)
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+const (
+	// KeyEnvVar is the environment variable with the key of the anchor signatures.
+	KeyEnvVar = "HERMES_INTEGRITY_KEY"
+	// maxTreeSize limits the number of events sealed by one anchor, which
+	// contains their digests.
+	maxTreeSize = 1000
+	// timeFormat is used for the time range filters sent to the storage. Events
+	// are stored with millisecond precision.
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// KeyFromEnv returns the key of the anchor signatures, or nil if it is not set.
+func KeyFromEnv() []byte {
+	key := os.Getenv(KeyEnvVar)
+	if key == "" {
+		return nil
+	}
+	return []byte(key)
+}
+
+// AnchorHash returns the hash of an anchor, which the next anchor of the
+// tenant refers to. It covers all fields except for the digests, which are
+// covered by the root hash, and the signature.
+func AnchorHash(anchor storage.Anchor) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d\n%d\n%s\n%s\n%s",
+		anchor.TenantID, anchor.Sequence, anchor.TreeSize, anchor.RootHash, anchor.PreviousHash, anchor.SealedAt.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:])
+}
+
+// AnchorSignature returns the signature of an anchor: HMAC-SHA256 over its
+// hash with the given key. Since the key is only known to Hermes, anchors
+// cannot be replaced by anyone else who can write to the storage.
+func AnchorSignature(anchor storage.Anchor, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(anchor.Hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkAnchor reports whether an anchor matches its hash and its signature.
+func checkAnchor(anchor storage.Anchor, key []byte) bool {
+	signature, err := hex.DecodeString(anchor.Signature)
+	if err != nil || AnchorHash(anchor) != anchor.Hash {
+		return false
+	}
+	expected, _ := hex.DecodeString(AnchorSignature(anchor, key)) //nolint:errcheck // always valid
+	return hmac.Equal(signature, expected)
+}
+
+// digestDocument returns the digest of the stored document of an event.
+func digestDocument(document json.RawMessage) (storage.EventDigest, error) {
+	var event struct {
+		ID        string `json:"id"`
+		EventTime string `json:"eventTime"`
+	}
+	err := json.Unmarshal(document, &event)
+	if err != nil {
+		return storage.EventDigest{}, err
+	}
+	hash, err := LeafHash(document)
+	if err != nil {
+		return storage.EventDigest{}, fmt.Errorf("cannot digest event %s: %w", event.ID, err)
+	}
+	return storage.EventDigest{EventID: event.ID, EventTime: event.EventTime, Hash: hex.EncodeToString(hash)}, nil
+}
+
+// treeLeaves sorts the digests into the order of the leaves of their tree,
+// which is by event ID, and returns the hashes of the leaves.
+func treeLeaves(digests []storage.EventDigest) ([][]byte, error) {
+	slices.SortFunc(digests, cmpDigests)
+	leaves := make([][]byte, 0, len(digests))
+	for _, digest := range digests {
+		leaf, err := hex.DecodeString(digest.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest of event %s: %w", digest.EventID, err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, nil
+}
+
+func cmpDigests(a, b storage.EventDigest) int {
+	if c := strings.Compare(a.EventID, b.EventID); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Hash, b.Hash)
+}
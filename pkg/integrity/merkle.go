@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package integrity makes the stored events tamper-evident. Right after events
+// have been written, the sealer computes the digests of their stored documents
+// and appends an anchor to the chain of their tenant: the root hash of a
+// Merkle tree over the digests, chained to the previous anchor of the tenant
+// and signed with a key that only Hermes knows. The verifier re-reads the
+// events and reports all differences, and proofs show that a single event is
+// part of the tree of its anchor.
+//
+// The Merkle trees follow RFC 6962, section 2.1, so that proofs can be checked
+// with any implementation of it.
+package integrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+)
+
+// Prefixes of the hashed data, which keep leaves and nodes from being mixed up.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// LeafHash returns the digest of the stored document of an event, which is
+// the hash of the leaf of the event in the Merkle tree: SHA-256 over 0x00 and
+// the canonical JSON encoding of the document. It covers all stored fields,
+// including those which are not part of cadf.Event (like tags), and does not
+// depend on the formatting and the order of the fields of the document.
+func LeafHash(document json.RawMessage) ([]byte, error) {
+	buf, err := canonicalJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	return leafHash(buf), nil
+}
+
+// canonicalJSON encodes a JSON document without whitespace, with the keys of
+// all objects in sorted order and numbers as they are.
+func canonicalJSON(document json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON document")
+	}
+	return json.Marshal(value)
+}
+
+func leafHash(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{leafPrefix})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{nodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// RootHash returns the root hash of the Merkle tree with the given leaf hashes.
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// AuditPath returns the hashes that are needed to compute the root hash from
+// the leaf at the given index, from the bottom of the tree to the top.
+func AuditPath(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(AuditPath(leaves[:k], index), RootHash(leaves[k:]))
+	}
+	return append(AuditPath(leaves[k:], index-k), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks that the leaf at the given index of a tree with
+// treeSize leaves leads to the root hash with the audit path. This is the
+// algorithm of RFC 9162, section 2.1.3.2.
+func VerifyInclusion(leaf []byte, index, treeSize int, path [][]byte, root []byte) bool {
+	if index < 0 || index >= treeSize {
+		return false
+	}
+	fn, sn := index, treeSize-1
+	result := leaf
+	for _, hash := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			result = nodeHash(hash, result)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			result = nodeHash(result, hash)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(result, root)
+}
+
+// splitPoint returns the largest power of two that is smaller than n > 1.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
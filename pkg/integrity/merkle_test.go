@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the test vectors of the Merkle tree implementation of Certificate Transparency
+var ctLeaves = []string{
+	"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f",
+}
+
+var ctRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func Test_RootHash(t *testing.T) {
+	var leaves [][]byte
+	for idx, data := range ctLeaves {
+		leaves = append(leaves, leafHash(must(hex.DecodeString(data))))
+		assert.Equal(t, ctRoots[idx], hex.EncodeToString(RootHash(leaves)), "tree size %d", idx+1)
+	}
+
+	// the hash of an empty tree is the hash of an empty string
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", hex.EncodeToString(RootHash(nil)))
+}
+
+func Test_VerifyInclusion(t *testing.T) {
+	var leaves [][]byte
+	for idx := range 33 {
+		leaves = append(leaves, leafHash(fmt.Appendf(nil, "event %d", idx)))
+		root := RootHash(leaves)
+		for index, leaf := range leaves {
+			path := AuditPath(leaves, index)
+			assert.True(t, VerifyInclusion(leaf, index, len(leaves), path, root), "leaf %d of %d", index, len(leaves))
+			assert.False(t, VerifyInclusion(leafHash([]byte("other")), index, len(leaves), path, root), "leaf %d of %d", index, len(leaves))
+			if len(leaves) > 1 {
+				other := (index + 1) % len(leaves)
+				assert.False(t, VerifyInclusion(leaf, other, len(leaves), path, root), "leaf %d of %d at %d", index, len(leaves), other)
+			}
+		}
+	}
+	assert.False(t, VerifyInclusion(leaves[0], 0, 0, nil, RootHash(nil)))
+}
+
+func Test_LeafHash(t *testing.T) {
+	document := `{"id": "1", "tags": ["b", "a"], "initiator": {"name": "Alice", "id": "u1"}, "size": 12345678901234567890}`
+	hash := must(LeafHash([]byte(document)))
+	assert.Equal(t, leafHash([]byte(`{"id":"1","initiator":{"id":"u1","name":"Alice"},"size":12345678901234567890,"tags":["b","a"]}`)), hash)
+
+	// fields outside of cadf.Event are covered as well
+	assert.NotEqual(t, hash, must(LeafHash([]byte(`{"id": "1", "tags": ["a", "b"], "initiator": {"name": "Alice", "id": "u1"}, "size": 12345678901234567890}`))))
+
+	_, err := LeafHash([]byte(`{"id": "1"} {}`))
+	assert.Error(t, err)
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
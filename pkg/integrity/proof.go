@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"slices"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+var (
+	// ErrNotSealed is returned by NewProof when the event has not been sealed yet.
+	ErrNotSealed = errors.New("event is not sealed")
+	// ErrModified is returned by NewProof when the event or its anchor do not
+	// match anymore.
+	ErrModified = errors.New("event does not match its anchor")
+)
+
+// Proof shows that an event is part of the Merkle tree of its anchor. The
+// root hash of the anchor is computed from the leaf hash and the audit path
+// as described in RFC 6962, section 2.1.1. The leaf hash is computed from the
+// stored document of the event with LeafHash.
+type Proof struct {
+	EventID   string   `json:"event_id"`
+	LeafHash  string   `json:"leaf_hash"`
+	LeafIndex int      `json:"leaf_index"`
+	AuditPath []string `json:"audit_path"`
+	// Anchor is the anchor of the event without its digests.
+	Anchor storage.Anchor `json:"anchor"`
+}
+
+// NewProof returns the proof that an event of a tenant is part of the tree of
+// its anchor. If key is not nil, the signature of the anchor is checked.
+func NewProof(ctx context.Context, store storage.IntegrityStore, key []byte, tenantID string, event *cadf.Event) (*Proof, error) {
+	anchors, err := store.FindAnchors(ctx, tenantID, []string{event.ID})
+	if err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, ErrNotSealed
+	}
+	// events are sealed once, unless they were sealed by several writers at the same time
+	anchor := anchors[0]
+	if AnchorHash(anchor) != anchor.Hash || (key != nil && !checkAnchor(anchor, key)) {
+		return nil, ErrModified
+	}
+
+	documents, err := store.GetEventDocuments(ctx, tenantID, []*cadf.Event{event})
+	if err != nil {
+		return nil, err
+	}
+	document, exists := documents[event.ID]
+	if !exists {
+		return nil, ErrModified
+	}
+	leaf, err := LeafHash(document)
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := treeLeaves(anchor.Digests)
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(anchor.Digests, func(digest storage.EventDigest) bool { return digest.EventID == event.ID })
+	path := AuditPath(leaves, index)
+	root, err := hex.DecodeString(anchor.RootHash)
+	if err != nil || !VerifyInclusion(leaf, index, anchor.TreeSize, path, root) {
+		return nil, ErrModified
+	}
+
+	anchor.Digests = nil
+	proof := Proof{
+		EventID:   event.ID,
+		LeafHash:  hex.EncodeToString(leaf),
+		LeafIndex: index,
+		AuditPath: make([]string, 0, len(path)),
+		Anchor:    anchor,
+	}
+	for _, hash := range path {
+		proof.AuditPath = append(proof.AuditPath, hex.EncodeToString(hash))
+	}
+	return &proof, nil
+}
@@ -0,0 +1,285 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+var sealedEventsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "hermes_integrity_sealed_events",
+	Help: "Number of events which were sealed",
+})
+
+func init() {
+	prometheus.MustRegister(sealedEventsCounter)
+}
+
+// Sealer appends the stored events of tenants to their chains of anchors.
+type Sealer struct {
+	Store storage.IntegrityStore
+	// Key signs the anchors. It must not be known to anyone who can write to
+	// the storage, otherwise they could replace the anchors as well.
+	Key []byte
+	// SettleDelay is how long after being written RunOnce seals the events
+	// that were not sealed while being written, so that it does not miss
+	// events which are not searchable yet.
+	SettleDelay time.Duration
+	// Lookback is how far back the first run of RunOnce looks for events
+	// that were not sealed, e.g. while the worker was not running.
+	Lookback time.Duration
+	// TimeNow can be replaced in tests, defaults to time.Now.
+	TimeNow func() time.Time
+
+	// sealedUntil is the time until which RunOnce has sealed the events of each tenant.
+	sealedUntil map[string]time.Time
+}
+
+// NewSealer returns a sealer for the events of a storage driver with the key
+// from KeyEnvVar, or nil if the key is not set.
+func NewSealer(storageDriver storage.Storage) (*Sealer, error) {
+	key := KeyFromEnv()
+	if key == nil {
+		return nil, nil
+	}
+	store, ok := storageDriver.(storage.IntegrityStore)
+	if !ok {
+		return nil, errors.New("the storage driver does not support sealing events")
+	}
+	return &Sealer{Store: store, Key: key}, nil
+}
+
+// CronJob returns a job that runs RunOnce every interval.
+func (s *Sealer) CronJob(registerer prometheus.Registerer, interval time.Duration) jobloop.Job {
+	return (&jobloop.CronJob{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "seal events",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "hermes_integrity_seal_runs",
+				Help: "Counter for runs of the sealing of events",
+			},
+		},
+		Interval:     interval,
+		InitialDelay: 5 * time.Second,
+		Task: func(ctx context.Context, _ prometheus.Labels) error {
+			return s.RunOnce(ctx)
+		},
+	}).Setup(registerer)
+}
+
+// SealEvents seals events of a tenant right after they have been written.
+// Events which are not stored or already sealed are skipped.
+func (s *Sealer) SealEvents(ctx context.Context, tenantID string, events []*cadf.Event) error {
+	for chunk := range slices.Chunk(events, maxTreeSize) {
+		documents, err := s.Store.GetEventDocuments(ctx, tenantID, chunk)
+		if err != nil {
+			return err
+		}
+		err = s.sealDocuments(ctx, tenantID, documents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunOnce seals the events which were written until SettleDelay ago, but not
+// sealed while being written, e.g. because they were written by Logstash.
+// Each run only reads the events written since the previous run, the first
+// one those written within Lookback.
+func (s *Sealer) RunOnce(ctx context.Context) error {
+	to := s.now().Add(-s.SettleDelay).Truncate(time.Millisecond)
+	tenants, err := s.Store.ListTenants(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot list tenants: %w", err)
+	}
+	if s.sealedUntil == nil {
+		s.sealedUntil = make(map[string]time.Time)
+	}
+
+	var errs []error
+	for _, tenantID := range tenants {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		from, exists := s.sealedUntil[tenantID]
+		if !exists {
+			from = to.Add(-s.Lookback)
+		}
+		err := s.sealWrittenEvents(ctx, tenantID, from, to)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot seal events of %s: %w", tenantID, err))
+			continue
+		}
+		s.sealedUntil[tenantID] = to
+	}
+	return errors.Join(errs...)
+}
+
+// sealWrittenEvents seals the events of a tenant which were written in [from, to).
+func (s *Sealer) sealWrittenEvents(ctx context.Context, tenantID string, from, to time.Time) error {
+	filter := storage.EventFilter{
+		IngestTime: map[string]string{
+			"gte": from.Format(timeFormat),
+			"lt":  to.Format(timeFormat),
+		},
+	}
+	documents := make(map[string]json.RawMessage)
+	err := s.Store.StreamEventDocuments(ctx, &filter, tenantID, func(eventID string, document json.RawMessage) error {
+		documents[eventID] = document
+		if len(documents) < maxTreeSize {
+			return nil
+		}
+		err := s.sealDocuments(ctx, tenantID, documents)
+		clear(documents)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.sealDocuments(ctx, tenantID, documents)
+}
+
+// sealDocuments appends an anchor for the stored documents of events by
+// event ID to the chain of the tenant, except for the events which are
+// already sealed.
+func (s *Sealer) sealDocuments(ctx context.Context, tenantID string, documents map[string]json.RawMessage) error {
+	if len(documents) == 0 {
+		return nil
+	}
+	anchors, err := s.Store.FindAnchors(ctx, tenantID, slices.Collect(maps.Keys(documents)))
+	if err != nil {
+		return err
+	}
+	sealed := make(map[string]bool)
+	for _, anchor := range anchors {
+		for _, digest := range anchor.Digests {
+			sealed[digest.EventID] = true
+		}
+	}
+
+	var digests []storage.EventDigest
+	for eventID, document := range documents {
+		if sealed[eventID] {
+			continue
+		}
+		digest, err := digestDocument(document)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, digest)
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	return s.appendAnchor(ctx, tenantID, digests)
+}
+
+// appendAnchor seals the given digests with a new anchor at the end of the
+// chain of the tenant. When another writer has extended the chain in the
+// meantime, the anchor is appended after the anchors of this writer.
+func (s *Sealer) appendAnchor(ctx context.Context, tenantID string, digests []storage.EventDigest) error {
+	leaves, err := treeLeaves(digests)
+	if err != nil {
+		return err
+	}
+	previous, err := s.Store.LastAnchor(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		anchor := storage.Anchor{
+			TenantID: tenantID,
+			Sequence: 1,
+			Digests:  digests,
+			TreeSize: len(leaves),
+			RootHash: hex.EncodeToString(RootHash(leaves)),
+			SealedAt: s.now(),
+		}
+		if previous != nil {
+			anchor.Sequence = previous.Sequence + 1
+			anchor.PreviousHash = previous.Hash
+		}
+		anchor.Hash = AnchorHash(anchor)
+		anchor.Signature = AnchorSignature(anchor, s.Key)
+
+		err := s.Store.CreateAnchor(ctx, anchor)
+		if err == nil {
+			sealedEventsCounter.Add(float64(anchor.TreeSize))
+			logg.Debug("sealed %d events of %s with anchor %d: root_hash=%s hash=%s", anchor.TreeSize, tenantID, anchor.Sequence, anchor.RootHash, anchor.Hash)
+			return nil
+		}
+		if !errors.Is(err, storage.ErrAnchorExists) {
+			return err
+		}
+		previous, err = s.Store.GetAnchor(ctx, tenantID, anchor.Sequence)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			return fmt.Errorf("anchor %d of %s was reported as existing, but cannot be found", anchor.Sequence, tenantID)
+		}
+	}
+}
+
+func (s *Sealer) now() time.Time {
+	if s.TimeNow != nil {
+		return s.TimeNow().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// SealingWriter is a storage.EventWriter which seals the events right after
+// they have been written with Writer.
+type SealingWriter struct {
+	Writer storage.EventWriter
+	Sealer *Sealer
+}
+
+// WriteEvents implements the storage.EventWriter interface. Events which were
+// stored, but could not be sealed, fail with an error that is not permanent.
+// Since writing them again succeeds without changing them, they are sealed
+// when they are written again.
+func (w SealingWriter) WriteEvents(ctx context.Context, events []storage.TenantEvent) ([]error, error) {
+	results, err := w.Writer.WriteEvents(ctx, events)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string][]int)
+	for idx, e := range events {
+		if results[idx] == nil {
+			stored[e.TenantID] = append(stored[e.TenantID], idx)
+		}
+	}
+	for _, tenantID := range slices.Sorted(maps.Keys(stored)) {
+		tenantEvents := make([]*cadf.Event, len(stored[tenantID]))
+		for i, idx := range stored[tenantID] {
+			tenantEvents[i] = events[idx].Event
+		}
+		err := w.Sealer.SealEvents(ctx, tenantID, tenantEvents)
+		if err != nil {
+			logg.Error("cannot seal %d events of %s: %s", len(tenantEvents), tenantID, err.Error())
+			for _, idx := range stored[tenantID] {
+				results[idx] = fmt.Errorf("event was stored, but could not be sealed: %w", err)
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,292 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+var testKey = []byte("secret")
+
+// fakeDocument is a stored event with the time at which it was written.
+type fakeDocument struct {
+	document   json.RawMessage
+	ingestTime time.Time
+}
+
+// fakeStore keeps events and anchors in memory and honors the tenants and
+// time filters, which storage.Mock does not.
+type fakeStore struct {
+	storage.Mock
+	documents map[string]map[string]fakeDocument // by tenant and event ID
+	anchors   []storage.Anchor
+	now       time.Time
+}
+
+func newFakeStore(now time.Time) *fakeStore {
+	return &fakeStore{documents: make(map[string]map[string]fakeDocument), now: now}
+}
+
+// WriteEvents stores the events with the current time of the store.
+func (s *fakeStore) WriteEvents(_ context.Context, events []storage.TenantEvent) ([]error, error) {
+	for _, e := range events {
+		document, err := json.Marshal(struct {
+			*cadf.Event
+			Tags []string `json:"tags,omitempty"`
+		}{e.Event, e.Tags})
+		if err != nil {
+			return nil, err
+		}
+		if s.documents[e.TenantID] == nil {
+			s.documents[e.TenantID] = make(map[string]fakeDocument)
+		}
+		s.documents[e.TenantID][e.Event.ID] = fakeDocument{document, s.now}
+	}
+	return make([]error, len(events)), nil
+}
+
+func (s *fakeStore) ListTenants(_ context.Context) ([]string, error) {
+	return slices.Sorted(maps.Keys(s.documents)), nil
+}
+
+func (s *fakeStore) StreamEventDocuments(_ context.Context, filter *storage.EventFilter, tenantID string, fn func(string, json.RawMessage) error) error {
+	from, err := time.Parse(timeFormat, filter.IngestTime["gte"])
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse(timeFormat, filter.IngestTime["lt"])
+	if err != nil {
+		return err
+	}
+	for _, eventID := range slices.Sorted(maps.Keys(s.documents[tenantID])) {
+		doc := s.documents[tenantID][eventID]
+		if !doc.ingestTime.Before(from) && doc.ingestTime.Before(to) {
+			err := fn(eventID, doc.document)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) GetEventDocuments(_ context.Context, tenantID string, events []*cadf.Event) (map[string]json.RawMessage, error) {
+	documents := make(map[string]json.RawMessage)
+	for _, event := range events {
+		if doc, exists := s.documents[tenantID][event.ID]; exists {
+			documents[event.ID] = doc.document
+		}
+	}
+	return documents, nil
+}
+
+func (s *fakeStore) ListAnchors(_ context.Context, tenantID string, from, to time.Time) ([]storage.Anchor, error) {
+	var anchors []storage.Anchor
+	for _, anchor := range s.anchors {
+		if (tenantID == "" || anchor.TenantID == tenantID) && !anchor.SealedAt.Before(from) && anchor.SealedAt.Before(to) {
+			anchors = append(anchors, anchor)
+		}
+	}
+	return anchors, nil
+}
+
+func (s *fakeStore) FindAnchors(_ context.Context, tenantID string, eventIDs []string) ([]storage.Anchor, error) {
+	var anchors []storage.Anchor
+	for _, anchor := range s.anchors {
+		if anchor.TenantID == tenantID && slices.ContainsFunc(anchor.Digests, func(digest storage.EventDigest) bool { return slices.Contains(eventIDs, digest.EventID) }) {
+			anchors = append(anchors, anchor)
+		}
+	}
+	return anchors, nil
+}
+
+func (s *fakeStore) LastAnchor(ctx context.Context, tenantID string) (*storage.Anchor, error) {
+	var last *storage.Anchor
+	for _, anchor := range s.anchors {
+		if anchor.TenantID == tenantID && (last == nil || anchor.Sequence > last.Sequence) {
+			last = &anchor
+		}
+	}
+	return last, nil
+}
+
+func (s *fakeStore) GetAnchor(_ context.Context, tenantID string, sequence int) (*storage.Anchor, error) {
+	for _, anchor := range s.anchors {
+		if anchor.TenantID == tenantID && anchor.Sequence == sequence {
+			return &anchor, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fakeStore) CreateAnchor(ctx context.Context, anchor storage.Anchor) error {
+	existing, err := s.GetAnchor(ctx, anchor.TenantID, anchor.Sequence)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return storage.ErrAnchorExists
+	}
+	anchor.Digests = slices.Clone(anchor.Digests)
+	s.anchors = append(s.anchors, anchor)
+	slices.SortStableFunc(s.anchors, func(a, b storage.Anchor) int { return a.SealedAt.Compare(b.SealedAt) })
+	return nil
+}
+
+// staleStore returns an outdated last anchor, like a search that does not
+// see the anchors which were just created by another writer.
+type staleStore struct {
+	*fakeStore
+}
+
+func (s staleStore) LastAnchor(ctx context.Context, tenantID string) (*storage.Anchor, error) {
+	return nil, nil
+}
+
+func makeEvent(id string) storage.TenantEvent {
+	return storage.TenantEvent{
+		TenantID: "project1",
+		Event:    &cadf.Event{ID: id, EventTime: "2024-03-01T08:00:00Z", Action: "create", Outcome: "success"},
+	}
+}
+
+func newSealer(store storage.IntegrityStore, now time.Time) *Sealer {
+	return &Sealer{
+		Store:       store,
+		Key:         testKey,
+		SettleDelay: time.Minute,
+		Lookback:    time.Hour,
+		TimeNow:     func() time.Time { return now },
+	}
+}
+
+// writeEvents writes events with the sealing writer at the given time.
+func writeEvents(t *testing.T, store *fakeStore, now time.Time, events ...storage.TenantEvent) {
+	t.Helper()
+	store.now = now
+	writer := SealingWriter{Writer: store, Sealer: newSealer(store, now)}
+	results, err := writer.WriteEvents(context.Background(), events)
+	require.NoError(t, err)
+	for _, err := range results {
+		require.NoError(t, err)
+	}
+}
+
+func TestSealingWriter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := newFakeStore(now)
+
+	event2 := makeEvent("2")
+	event2.Tags = []string{"cli"}
+	writeEvents(t, store, now, makeEvent("1"), event2)
+	writeEvents(t, store, now.Add(time.Second), makeEvent("3"))
+	// events which are written again are not sealed again
+	writeEvents(t, store, now.Add(2*time.Second), makeEvent("3"), makeEvent("4"))
+
+	require.Len(t, store.anchors, 3)
+	var sealed [][]string
+	for idx, anchor := range store.anchors {
+		assert.Equal(t, idx+1, anchor.Sequence)
+		assert.True(t, checkAnchor(anchor, testKey))
+		assert.False(t, checkAnchor(anchor, []byte("other")))
+		var eventIDs []string
+		for _, digest := range anchor.Digests {
+			eventIDs = append(eventIDs, digest.EventID)
+		}
+		sealed = append(sealed, eventIDs)
+	}
+	assert.Equal(t, [][]string{{"1", "2"}, {"3"}, {"4"}}, sealed)
+
+	// the anchors are chained
+	assert.Equal(t, "", store.anchors[0].PreviousHash)
+	assert.Equal(t, store.anchors[0].Hash, store.anchors[1].PreviousHash)
+	assert.Equal(t, store.anchors[1].Hash, store.anchors[2].PreviousHash)
+
+	// the digests cover the stored document, including the tags
+	hash, err := LeafHash(store.documents["project1"]["2"].document)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", hash), store.anchors[0].Digests[1].Hash)
+}
+
+func TestSealingWriterConcurrentAnchor(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := newFakeStore(now)
+	writeEvents(t, store, now, makeEvent("1"))
+	writeEvents(t, store, now, makeEvent("2"))
+
+	// the chain is extended after the anchors that the writer does not know about
+	_, err := store.WriteEvents(context.Background(), []storage.TenantEvent{makeEvent("3")})
+	require.NoError(t, err)
+	require.NoError(t, newSealer(staleStore{store}, now).SealEvents(context.Background(), "project1", []*cadf.Event{makeEvent("3").Event}))
+	require.Len(t, store.anchors, 3)
+	assert.Equal(t, 3, store.anchors[2].Sequence)
+	assert.Equal(t, store.anchors[1].Hash, store.anchors[2].PreviousHash)
+}
+
+func TestSealerSealsWrittenEvents(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := newFakeStore(now)
+	ctx := context.Background()
+
+	// events which were written without being sealed, e.g. by Logstash
+	for idx, offset := range []time.Duration{-2 * time.Hour, -30 * time.Minute, -10 * time.Second} {
+		store.now = now.Add(offset)
+		_, err := store.WriteEvents(ctx, []storage.TenantEvent{makeEvent(fmt.Sprintf("%d", idx+1))})
+		require.NoError(t, err)
+	}
+	writeEvents(t, store, now.Add(-20*time.Minute), makeEvent("4"))
+
+	// only the events within the lookback which have settled are sealed
+	sealer := newSealer(store, now)
+	require.NoError(t, sealer.RunOnce(ctx))
+	require.Len(t, store.anchors, 2)
+	require.Len(t, store.anchors[1].Digests, 1)
+	assert.Equal(t, "2", store.anchors[1].Digests[0].EventID)
+
+	// the next run only reads the events written in the meantime
+	sealer.TimeNow = func() time.Time { return now.Add(time.Minute) }
+	require.NoError(t, sealer.RunOnce(ctx))
+	require.Len(t, store.anchors, 3)
+	assert.Equal(t, "3", store.anchors[2].Digests[0].EventID)
+	assert.Equal(t, store.anchors[1].Hash, store.anchors[2].PreviousHash)
+}
+
+func TestProof(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	store := newFakeStore(now)
+	writeEvents(t, store, now, makeEvent("1"), makeEvent("2"), makeEvent("3"))
+	ctx := context.Background()
+
+	event := makeEvent("2").Event
+	proof, err := NewProof(ctx, store, testKey, "project1", event)
+	require.NoError(t, err)
+	assert.Equal(t, 1, proof.LeafIndex)
+	assert.Equal(t, 1, proof.Anchor.Sequence)
+	assert.Nil(t, proof.Anchor.Digests)
+	assert.Len(t, proof.AuditPath, 2)
+
+	_, err = NewProof(ctx, store, testKey, "project1", makeEvent("4").Event)
+	assert.ErrorIs(t, err, ErrNotSealed)
+
+	// anchors which were not signed with the key
+	_, err = NewProof(ctx, store, []byte("other"), "project1", event)
+	assert.ErrorIs(t, err, ErrModified)
+
+	// events which were changed after they had been sealed
+	store.documents["project1"]["2"] = fakeDocument{json.RawMessage(`{"id":"2","tags":["changed"]}`), now}
+	_, err = NewProof(ctx, store, testKey, "project1", event)
+	assert.ErrorIs(t, err, ErrModified)
+}
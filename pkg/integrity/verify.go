@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// Problem is a kind of difference between the stored events and their anchors.
+type Problem string
+
+// Problems found by the verifier.
+const (
+	// ProblemBrokenChain means that an anchor does not refer to the previous
+	// anchor of its tenant, i.e. an anchor was removed or replaced.
+	ProblemBrokenChain Problem = "broken chain"
+	// ProblemModifiedAnchor means that an anchor does not match its hash or
+	// its signature.
+	ProblemModifiedAnchor Problem = "modified anchor"
+	// ProblemModifiedDigests means that the digests of an anchor do not match
+	// its root hash.
+	ProblemModifiedDigests Problem = "modified digests"
+	// ProblemMissingEvent means that a sealed event is not stored anymore.
+	ProblemMissingEvent Problem = "missing event"
+	// ProblemModifiedEvent means that an event does not match its digest.
+	ProblemModifiedEvent Problem = "modified event"
+	// ProblemUnsealedEvent means that an event was written, but not sealed.
+	ProblemUnsealedEvent Problem = "unsealed event"
+)
+
+// Finding is a problem with an anchor of a tenant, or with a single event if
+// EventID is set. Sequence is the sequence number of the anchor, which is 0
+// for unsealed events.
+type Finding struct {
+	TenantID string
+	Sequence int
+	EventID  string
+	Problem  Problem
+}
+
+// String implements the fmt.Stringer interface.
+func (f Finding) String() string {
+	subject := f.TenantID
+	if f.Sequence > 0 {
+		subject = fmt.Sprintf("%s anchor %d", f.TenantID, f.Sequence)
+	}
+	if f.EventID != "" {
+		return fmt.Sprintf("%s: %s %s", subject, f.Problem, f.EventID)
+	}
+	return fmt.Sprintf("%s: %s", subject, f.Problem)
+}
+
+// Report is the result of Verifier.Verify.
+type Report struct {
+	Anchors  int // number of verified anchors
+	Events   int // number of verified events
+	Findings []Finding
+}
+
+// Verifier compares the stored events with their anchors.
+type Verifier struct {
+	Store storage.IntegrityStore
+	// Key is the key of the anchor signatures, see Sealer.Key.
+	Key []byte
+}
+
+// sealedDigest is the digest of an event together with the sequence number of its anchor.
+type sealedDigest struct {
+	storage.EventDigest
+	Sequence int
+}
+
+// Verify checks the anchors of a tenant, or of all tenants if tenantID is
+// empty, which were sealed in [from, to), and re-reads the events which were
+// written in this time range or are sealed by these anchors. The events which
+// were written just before the end of the time range may not be sealed yet,
+// so it should end at least the settle delay of the sealer ago.
+func (v *Verifier) Verify(ctx context.Context, tenantID string, from, to time.Time) (*Report, error) {
+	tenants := []string{tenantID}
+	if tenantID == "" {
+		var err error
+		tenants, err = v.Store.ListTenants(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list tenants: %w", err)
+		}
+		// tenants without events might have had them before
+		anchors, err := v.Store.ListAnchors(ctx, "", from, to)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list anchors: %w", err)
+		}
+		for _, anchor := range anchors {
+			tenants = append(tenants, anchor.TenantID)
+		}
+		tenants = slices.Compact(slices.Sorted(slices.Values(tenants)))
+	}
+
+	var report Report
+	for _, tenant := range tenants {
+		err := v.verifyTenant(ctx, &report, tenant, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("cannot verify %s: %w", tenant, err)
+		}
+	}
+	return &report, nil
+}
+
+func (v *Verifier) verifyTenant(ctx context.Context, report *Report, tenantID string, from, to time.Time) error {
+	finding := func(sequence int, eventID string, problem Problem) {
+		report.Findings = append(report.Findings, Finding{TenantID: tenantID, Sequence: sequence, EventID: eventID, Problem: problem})
+	}
+
+	// the anchors and their place in the chain
+	anchors, err := v.Store.ListAnchors(ctx, tenantID, from, to)
+	if err != nil {
+		return err
+	}
+	var previous *storage.Anchor
+	if len(anchors) > 0 && anchors[0].Sequence > 1 {
+		previous, err = v.Store.GetAnchor(ctx, tenantID, anchors[0].Sequence-1)
+		if err != nil {
+			return err
+		}
+	}
+	sealed := make(map[string][]sealedDigest)
+	for _, anchor := range anchors {
+		for _, problem := range v.verifyAnchor(anchor, previous) {
+			finding(anchor.Sequence, "", problem)
+		}
+		for _, digest := range anchor.Digests {
+			sealed[digest.EventID] = append(sealed[digest.EventID], sealedDigest{digest, anchor.Sequence})
+		}
+		previous = &anchor
+	}
+	report.Anchors += len(anchors)
+
+	// the events written in the time range
+	filter := storage.EventFilter{
+		IngestTime: map[string]string{
+			"gte": from.UTC().Format(timeFormat),
+			"lt":  to.UTC().Format(timeFormat),
+		},
+	}
+	current := make(map[string]string)
+	err = v.Store.StreamEventDocuments(ctx, &filter, tenantID, func(eventID string, document json.RawMessage) error {
+		hash, err := LeafHash(document)
+		if err != nil {
+			return fmt.Errorf("cannot digest event %s: %w", eventID, err)
+		}
+		current[eventID] = hex.EncodeToString(hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.Events += len(current)
+
+	// events written in the time range may be sealed by later anchors, and
+	// events sealed in the time range may have been written before it
+	var unknown []string
+	for eventID := range current {
+		if _, exists := sealed[eventID]; !exists {
+			unknown = append(unknown, eventID)
+		}
+	}
+	outside, err := v.findSealedDigests(ctx, tenantID, unknown, finding)
+	if err != nil {
+		return err
+	}
+	var notWritten []*cadf.Event
+	for eventID, digests := range sealed {
+		if _, exists := current[eventID]; !exists {
+			notWritten = append(notWritten, &cadf.Event{ID: eventID, EventTime: digests[0].EventTime})
+		}
+	}
+	for chunk := range slices.Chunk(notWritten, maxTreeSize) {
+		documents, err := v.Store.GetEventDocuments(ctx, tenantID, chunk)
+		if err != nil {
+			return err
+		}
+		for eventID, document := range documents {
+			hash, err := LeafHash(document)
+			if err != nil {
+				return fmt.Errorf("cannot digest event %s: %w", eventID, err)
+			}
+			current[eventID] = hex.EncodeToString(hash)
+		}
+		report.Events += len(documents)
+	}
+	maps.Copy(sealed, outside)
+
+	// the events compared to their digests
+	for _, eventID := range slices.Sorted(maps.Keys(sealed)) {
+		digests := sealed[eventID]
+		hash, exists := current[eventID]
+		switch {
+		case !exists:
+			finding(digests[0].Sequence, eventID, ProblemMissingEvent)
+		case !slices.ContainsFunc(digests, func(digest sealedDigest) bool { return digest.Hash == hash }):
+			finding(digests[0].Sequence, eventID, ProblemModifiedEvent)
+		}
+	}
+	for _, eventID := range slices.Sorted(maps.Keys(current)) {
+		if _, exists := sealed[eventID]; !exists {
+			finding(0, eventID, ProblemUnsealedEvent)
+		}
+	}
+	return nil
+}
+
+// verifyAnchor checks an anchor and whether it refers to the previous anchor,
+// which is nil if it is not stored.
+func (v *Verifier) verifyAnchor(anchor storage.Anchor, previous *storage.Anchor) []Problem {
+	var problems []Problem
+	if !checkAnchor(anchor, v.Key) {
+		problems = append(problems, ProblemModifiedAnchor)
+	}
+	switch {
+	case previous == nil:
+		if anchor.Sequence != 1 || anchor.PreviousHash != "" {
+			problems = append(problems, ProblemBrokenChain)
+		}
+	case anchor.Sequence != previous.Sequence+1 || anchor.PreviousHash != previous.Hash:
+		problems = append(problems, ProblemBrokenChain)
+	}
+	leaves, err := treeLeaves(anchor.Digests)
+	if err != nil || len(leaves) != anchor.TreeSize || hex.EncodeToString(RootHash(leaves)) != anchor.RootHash {
+		problems = append(problems, ProblemModifiedDigests)
+	}
+	return problems
+}
+
+// findSealedDigests returns the digests of the given events in the anchors
+// which seal them. Anchors which do not match their hash or signature are
+// reported and ignored.
+func (v *Verifier) findSealedDigests(ctx context.Context, tenantID string, eventIDs []string, finding func(int, string, Problem)) (map[string][]sealedDigest, error) {
+	result := make(map[string][]sealedDigest)
+	reported := make(map[int]bool)
+	for chunk := range slices.Chunk(eventIDs, maxTreeSize) {
+		anchors, err := v.Store.FindAnchors(ctx, tenantID, chunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, anchor := range anchors {
+			if !checkAnchor(anchor, v.Key) {
+				if !reported[anchor.Sequence] {
+					finding(anchor.Sequence, "", ProblemModifiedAnchor)
+					reported[anchor.Sequence] = true
+				}
+				continue
+			}
+			for _, digest := range anchor.Digests {
+				if slices.Contains(chunk, digest.EventID) {
+					result[digest.EventID] = append(result[digest.EventID], sealedDigest{digest, anchor.Sequence})
+				}
+			}
+		}
+	}
+	return result, nil
+}
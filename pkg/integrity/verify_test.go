@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package integrity
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+func TestVerifier(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		name     string
+		tenantID string
+		tamper   func(store *fakeStore)
+		findings []string
+	}{
+		{"Unchanged", "", func(store *fakeStore) {}, nil},
+		{"ModifiedEvent", "", func(store *fakeStore) {
+			store.documents["project1"]["1"] = fakeDocument{json.RawMessage(`{"id":"1","outcome":"failure"}`), from.Add(time.Hour)}
+		}, []string{"project1 anchor 1: modified event 1"}},
+		{"ModifiedTags", "", func(store *fakeStore) {
+			doc := store.documents["project1"]["2"]
+			var fields map[string]any
+			require.NoError(t, json.Unmarshal(doc.document, &fields))
+			fields["tags"] = []string{"changed"}
+			doc.document, _ = json.Marshal(fields) //nolint:errcheck // a map of JSON values
+			store.documents["project1"]["2"] = doc
+		}, []string{"project1 anchor 1: modified event 2"}},
+		{"MissingEvent", "", func(store *fakeStore) {
+			delete(store.documents["project2"], "5")
+		}, []string{"project2 anchor 1: missing event 5"}},
+		{"UnsealedEvent", "project1", func(store *fakeStore) {
+			store.now = from.Add(4 * time.Hour)
+			_, err := store.WriteEvents(context.Background(), []storage.TenantEvent{makeEvent("6")})
+			require.NoError(t, err)
+		}, []string{"project1: unsealed event 6"}},
+		{"ModifiedDigest", "", func(store *fakeStore) {
+			store.anchors[0].Digests[0].Hash = store.anchors[0].Digests[1].Hash
+		}, []string{"project1 anchor 1: modified digests", "project1 anchor 1: modified event 1"}},
+		{"ModifiedAnchor", "", func(store *fakeStore) {
+			store.anchors[2].TreeSize = 2
+		}, []string{"project2 anchor 1: modified anchor", "project2 anchor 1: modified digests"}},
+		{"ReplacedAnchor", "", func(store *fakeStore) {
+			// without the key, a replaced anchor cannot be signed
+			anchor := &store.anchors[0]
+			anchor.Digests = anchor.Digests[:1]
+			anchor.TreeSize = 1
+			leaves, err := treeLeaves(anchor.Digests)
+			require.NoError(t, err)
+			anchor.RootHash = hex.EncodeToString(RootHash(leaves))
+			anchor.Hash = AnchorHash(*anchor)
+			anchor.Signature = AnchorSignature(*anchor, []byte("guessed"))
+		}, []string{"project1 anchor 1: modified anchor", "project1 anchor 2: broken chain", "project1: unsealed event 2"}},
+		{"RemovedAnchor", "project1", func(store *fakeStore) {
+			store.anchors = store.anchors[1:]
+		}, []string{"project1 anchor 2: broken chain", "project1: unsealed event 1", "project1: unsealed event 2"}},
+		{"EventSealedLater", "project1", func(store *fakeStore) {
+			// written within the time range, but sealed after it
+			store.now = to.Add(-time.Second)
+			_, err := store.WriteEvents(context.Background(), []storage.TenantEvent{makeEvent("6")})
+			require.NoError(t, err)
+			require.NoError(t, newSealer(store, to.Add(time.Minute)).SealEvents(context.Background(), "project1", []*cadf.Event{makeEvent("6").Event}))
+		}, nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFakeStore(from)
+			writeEvents(t, store, from.Add(time.Hour), makeEvent("1"), makeEvent("2"))
+			writeEvents(t, store, from.Add(2*time.Hour), makeEvent("3"))
+			project2Event := makeEvent("5")
+			project2Event.TenantID = "project2"
+			writeEvents(t, store, from.Add(3*time.Hour), project2Event)
+			tc.tamper(store)
+
+			verifier := Verifier{Store: store, Key: testKey}
+			report, err := verifier.Verify(context.Background(), tc.tenantID, from, to)
+			require.NoError(t, err)
+			var findings []string
+			for _, finding := range report.Findings {
+				findings = append(findings, finding.String())
+			}
+			assert.Equal(t, tc.findings, findings)
+		})
+	}
+}
@@ -148,3 +148,61 @@ func TestPolicy(t *testing.T) {
 	//	t.Error("service_admin_or_owner should pass for non owning user")
 	//}
 }
+
+func Test_Policy_ExportUpdate(t *testing.T) {
+	enforcer := GetEnforcer()
+	tt := []struct {
+		name     string
+		role     string
+		project  string
+		expected bool
+	}{
+		{"ProjectAdmin", "admin", "7a09c05926ec452ca7992af4aa03c31d", true},
+		{"AdminOfOtherProject", "admin", "00000000000000000000000000000000", false},
+		{"AuditViewer", "audit_viewer", "7a09c05926ec452ca7992af4aa03c31d", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := policy.Context{
+				Roles: []string{tc.role},
+				Auth:  map[string]string{"project_id": "7a09c05926ec452ca7992af4aa03c31d"},
+				Request: map[string]string{
+					"project_id": tc.project,
+				},
+				Logger: logg.Debug,
+			}
+			assert.Equal(t, tc.expected, enforcer.Enforce("export:update", c))
+			// everyone who can view events or change the configuration can view it
+			assert.Equal(t, tc.project == c.Auth["project_id"], enforcer.Enforce("export:show", c))
+		})
+	}
+}
+
+func Test_Policy_SavedSearchUpdate(t *testing.T) {
+	enforcer := GetEnforcer()
+	tt := []struct {
+		name           string
+		role           string
+		expectedShared bool
+	}{
+		{"ProjectAdmin", "admin", true},
+		{"AuditViewer", "audit_viewer", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := policy.Context{
+				Roles: []string{tc.role},
+				Auth:  map[string]string{"project_id": "7a09c05926ec452ca7992af4aa03c31d"},
+				Request: map[string]string{
+					"project_id": "7a09c05926ec452ca7992af4aa03c31d",
+				},
+				Logger: logg.Debug,
+			}
+			// everyone can save searches, but only admins can change the shared searches of others
+			assert.True(t, enforcer.Enforce("saved_search:update", c))
+			assert.Equal(t, tc.expectedShared, enforcer.Enforce("saved_search:update_shared", c))
+		})
+	}
+}
@@ -0,0 +1,428 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package query implements the search language of the Hermes API.
+//
+// A query is a list of terms, which are combined with AND unless separated
+// by OR. Terms can be negated with NOT or a leading "-", and grouped with
+// parentheses:
+//
+//	action:delete AND NOT (outcome:success OR target_type:"service/storage/object")
+//
+// A term without a field searches the text of all fields for a word or a
+// quoted phrase. A term with a field matches the exact value of this field,
+// or all values starting with the given prefix if it ends with "*". The time
+// field only supports comparisons like time:>=2017-11-17T00:00:00Z or
+// time:>=now-24h (see ParseTime).
+package query
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxLength is the maximum length of a query in bytes.
+	MaxLength = 1024
+	// maxTerms limits the number of terms in a query.
+	maxTerms = 64
+	// maxDepth limits the nesting of parentheses and negations.
+	maxDepth = 16
+)
+
+// Fields are the fields that terms can refer to. These are the same names
+// that the API uses for filter parameters.
+var Fields = []string{
+	"action",
+	"initiator_address",
+	"initiator_id",
+	"initiator_name",
+	"initiator_type",
+	"observer_id",
+	"observer_type",
+	"outcome",
+	"request_path",
+	"tag",
+	"target_id",
+	"target_name",
+	"target_type",
+	"time",
+}
+
+// Expr is a parsed query, or a part of it. It is one of And, Or, Not, Match
+// or Range.
+type Expr interface {
+	isExpr()
+}
+
+// And matches events that match all of its operands.
+type And []Expr
+
+// Or matches events that match any of its operands.
+type Or []Expr
+
+// Not matches events that do not match Expr.
+type Not struct {
+	Expr Expr
+}
+
+// Match matches events with a value. If Field is empty, the value is searched
+// in the text of all fields.
+type Match struct {
+	Field  string
+	Value  string
+	Phrase bool // the value was quoted
+	Prefix bool // the value is a prefix of the field's value
+}
+
+// Range matches events whose time field compares to Value with Operator,
+// which is one of "lt", "lte", "gt" or "gte" (like the time filter of the API).
+type Range struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+func (And) isExpr()   {}
+func (Or) isExpr()    {}
+func (Not) isExpr()   {}
+func (Match) isExpr() {}
+func (Range) isExpr() {}
+
+// Error is returned by Parse for invalid queries.
+type Error struct {
+	Position int // of the offending token in bytes, starting at 1
+	Message  string
+}
+
+// Error implements the builtin/error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid search query at position %d: %s", e.Position, e.Message)
+}
+
+// Parse parses a query. An empty query matches all events and is returned as
+// a nil Expr.
+func Parse(input string) (Expr, error) {
+	if len(input) > MaxLength {
+		return nil, fmt.Errorf("invalid search query: must not be longer than %d bytes", MaxLength)
+	}
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := parser{tokens: tokens, end: len(input) + 1}
+	expr, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		return nil, &Error{tok.pos, fmt.Sprintf("unexpected %s", tok)}
+	}
+	return expr, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// lexer
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenPhrase
+	tokenFieldPhrase // field:"phrase"
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	pos   int
+	field string
+	value string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	case tokenPhrase, tokenFieldPhrase:
+		return "phrase"
+	default:
+		return fmt.Sprintf("%q", t.value)
+	}
+}
+
+// isSeparator reports whether c ends a word.
+func isSeparator(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' || c == ')' || c == '"'
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	for idx := 0; idx < len(input); {
+		c := input[idx]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			idx++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, pos: idx + 1, value: "("})
+			idx++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, pos: idx + 1, value: ")"})
+			idx++
+		case c == '"':
+			value, next, err := readPhrase(input, idx)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenPhrase, pos: idx + 1, value: value})
+			idx = next
+		case c == '-' && idx+1 < len(input) && input[idx+1] != ' ':
+			// "-term" is short for "NOT term"
+			tokens = append(tokens, token{kind: tokenNot, pos: idx + 1, value: "-"})
+			idx++
+		default:
+			start := idx
+			for idx < len(input) && !isSeparator(input[idx]) {
+				idx++
+			}
+			word := input[start:idx]
+			switch {
+			case word == "AND":
+				tokens = append(tokens, token{kind: tokenAnd, pos: start + 1, value: word})
+			case word == "OR":
+				tokens = append(tokens, token{kind: tokenOr, pos: start + 1, value: word})
+			case word == "NOT":
+				tokens = append(tokens, token{kind: tokenNot, pos: start + 1, value: word})
+			case strings.HasSuffix(word, ":") && idx < len(input) && input[idx] == '"':
+				value, next, err := readPhrase(input, idx)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{kind: tokenFieldPhrase, pos: start + 1, field: strings.TrimSuffix(word, ":"), value: value})
+				idx = next
+			default:
+				tokens = append(tokens, token{kind: tokenWord, pos: start + 1, value: word})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// readPhrase reads the quoted string starting at input[start]. Quotes and
+// backslashes in the phrase are escaped with a backslash.
+func readPhrase(input string, start int) (value string, next int, err error) {
+	var sb strings.Builder
+	for idx := start + 1; idx < len(input); idx++ {
+		switch input[idx] {
+		case '\\':
+			idx++
+			if idx < len(input) {
+				sb.WriteByte(input[idx])
+			}
+		case '"':
+			return sb.String(), idx + 1, nil
+		default:
+			sb.WriteByte(input[idx])
+		}
+	}
+	return "", 0, &Error{start + 1, "missing closing quote"}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// parser
+
+type parser struct {
+	tokens []token
+	pos    int
+	end    int // position reported for errors at the end of the input
+	terms  int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// parseOr parses: and ("OR" and)*
+func (p *parser) parseOr(depth int) (Expr, error) {
+	var operands Or
+	for {
+		expr, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, expr)
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokenOr {
+			break
+		}
+		p.pos++
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+// parseAnd parses: not (["AND"] not)*
+func (p *parser) parseAnd(depth int) (Expr, error) {
+	var operands And
+	for {
+		expr, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, expr)
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokenOr || tok.kind == tokenClose {
+			break
+		}
+		if tok.kind == tokenAnd {
+			p.pos++
+		}
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return operands, nil
+}
+
+// parseNot parses: ("NOT" | "-") not | "(" or ")" | term
+func (p *parser) parseNot(depth int) (Expr, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, &Error{p.end, "unexpected end of query"}
+	}
+	if depth >= maxDepth {
+		return nil, &Error{tok.pos, fmt.Sprintf("too deeply nested, at most %d levels are allowed", maxDepth)}
+	}
+
+	switch tok.kind {
+	case tokenNot:
+		p.pos++
+		expr, err := p.parseNot(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return Not{expr}, nil
+	case tokenOpen:
+		p.pos++
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok {
+			return nil, &Error{tok.pos, "missing closing parenthesis"}
+		}
+		if closing.kind != tokenClose {
+			return nil, &Error{closing.pos, fmt.Sprintf("unexpected %s", closing)}
+		}
+		p.pos++
+		return expr, nil
+	case tokenWord, tokenPhrase, tokenFieldPhrase:
+		p.pos++
+		p.terms++
+		if p.terms > maxTerms {
+			return nil, &Error{tok.pos, fmt.Sprintf("too many terms, at most %d are allowed", maxTerms)}
+		}
+		return parseTerm(tok)
+	default:
+		return nil, &Error{tok.pos, fmt.Sprintf("unexpected %s", tok)}
+	}
+}
+
+// parseTerm validates a single term.
+func parseTerm(tok token) (Expr, error) {
+	switch tok.kind {
+	case tokenPhrase:
+		return Match{Value: tok.value, Phrase: true}, nil
+	case tokenFieldPhrase:
+		err := checkField(tok.field, tok.pos)
+		if err != nil {
+			return nil, err
+		}
+		if tok.field == "time" {
+			return nil, &Error{tok.pos, "time only supports comparisons like time:>=2017-11-17T00:00:00Z"}
+		}
+		return Match{Field: tok.field, Value: tok.value, Phrase: true}, nil
+	}
+
+	field, value, hasField := strings.Cut(tok.value, ":")
+	if !hasField {
+		if strings.ContainsAny(tok.value, "*?") {
+			return nil, &Error{tok.pos, "wildcards are only supported in values of fields, e.g. action:update/*"}
+		}
+		return Match{Value: tok.value}, nil
+	}
+
+	err := checkField(field, tok.pos)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, &Error{tok.pos, fmt.Sprintf("missing value for field %s", field)}
+	}
+
+	operator, operand := parseComparison(value)
+	if field == "time" {
+		if operator == "" {
+			return nil, &Error{tok.pos, "time only supports comparisons like time:>=2017-11-17T00:00:00Z"}
+		}
+		_, err := ParseTime(operand, time.Now())
+		if err != nil {
+			return nil, &Error{tok.pos, err.Error()}
+		}
+		return Range{Field: field, Operator: operator, Value: operand}, nil
+	}
+	if operator != "" {
+		return nil, &Error{tok.pos, "comparisons are only supported for the time field"}
+	}
+
+	prefix := strings.HasSuffix(value, "*")
+	value = strings.TrimSuffix(value, "*")
+	if strings.ContainsAny(value, "*?") {
+		return nil, &Error{tok.pos, "wildcards are only supported at the end of a value"}
+	}
+	if value == "" {
+		return nil, &Error{tok.pos, fmt.Sprintf("missing value for field %s", field)}
+	}
+	return Match{Field: field, Value: value, Prefix: prefix}, nil
+}
+
+// parseComparison splits a leading comparison operator off the value.
+func parseComparison(value string) (operator, operand string) {
+	for _, op := range []struct{ symbol, name string }{
+		{">=", "gte"}, {"<=", "lte"}, {">", "gt"}, {"<", "lt"},
+	} {
+		if operand, found := strings.CutPrefix(value, op.symbol); found {
+			return op.name, operand
+		}
+	}
+	return "", value
+}
+
+func checkField(field string, pos int) error {
+	if field == "" {
+		return &Error{pos, "missing field name before colon"}
+	}
+	if !slices.Contains(Fields, field) {
+		return &Error{pos, fmt.Sprintf("unknown field %s, valid fields: %s", field, strings.Join(Fields, ", "))}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package query
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		input    string
+		expected Expr
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"floatingip", Match{Value: "floatingip"}},
+		{`"role assignment"`, Match{Value: "role assignment", Phrase: true}},
+		{"action:delete", Match{Field: "action", Value: "delete"}},
+		{"target_type:network/*", Match{Field: "target_type", Value: "network/", Prefix: true}},
+		{`initiator_name:"John \"JD\" Doe"`, Match{Field: "initiator_name", Value: `John "JD" Doe`, Phrase: true}},
+		{"time:>=2017-11-17T00:00:00Z", Range{Field: "time", Operator: "gte", Value: "2017-11-17T00:00:00Z"}},
+		{"time:<2017-11-17T00:00:00", Range{Field: "time", Operator: "lt", Value: "2017-11-17T00:00:00"}},
+		{"time:>now-24h", Range{Field: "time", Operator: "gt", Value: "now-24h"}},
+		{"time:<=2017-11-17", Range{Field: "time", Operator: "lte", Value: "2017-11-17"}},
+		{"action:create outcome:failure", And{
+			Match{Field: "action", Value: "create"},
+			Match{Field: "outcome", Value: "failure"},
+		}},
+		{"action:create AND outcome:failure OR action:delete", Or{
+			And{Match{Field: "action", Value: "create"}, Match{Field: "outcome", Value: "failure"}},
+			Match{Field: "action", Value: "delete"},
+		}},
+		{"action:create AND (outcome:failure OR outcome:unknown)", And{
+			Match{Field: "action", Value: "create"},
+			Or{Match{Field: "outcome", Value: "failure"}, Match{Field: "outcome", Value: "unknown"}},
+		}},
+		{"NOT outcome:success -action:read", And{
+			Not{Match{Field: "outcome", Value: "success"}},
+			Not{Match{Field: "action", Value: "read"}},
+		}},
+		{`-("role assignment")`, Not{Match{Value: "role assignment", Phrase: true}}},
+		// lowercase operators are words
+		{"create and delete", And{Match{Value: "create"}, Match{Value: "and"}, Match{Value: "delete"}}},
+		// hyphens within words are no negation
+		{"request_path:/v3/os-inherit", Match{Field: "request_path", Value: "/v3/os-inherit"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			expr, err := Parse(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, expr)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tt := []struct {
+		input    string
+		expected string
+	}{
+		{"password:secret", "at position 1: unknown field password"},
+		{":secret", "missing field name"},
+		{"action:", "missing value for field action"},
+		{"action:*", "missing value for field action"},
+		{"*:*", "unknown field *"},
+		{"action:*delete", "wildcards are only supported at the end of a value"},
+		{"action:de?ete", "wildcards are only supported at the end of a value"},
+		{"delete*", "wildcards are only supported in values of fields"},
+		{"time:2017-11-17T00:00:00Z", "time only supports comparisons"},
+		{`time:"2017-11-17T00:00:00Z"`, "time only supports comparisons"},
+		{"time:>=yesterday", "invalid time format: yesterday"},
+		{"action:>delete", "comparisons are only supported for the time field"},
+		{`"role assignment`, "at position 1: missing closing quote"},
+		{"(action:create", "at position 1: missing closing parenthesis"},
+		{"action:create)", `at position 14: unexpected ")"`},
+		{"action:create AND", "at position 18: unexpected end of query"},
+		{"OR action:create", `at position 1: unexpected "OR"`},
+		{"action:create OR OR outcome:success", `at position 18: unexpected "OR"`},
+		{"()", `at position 2: unexpected ")"`},
+		{strings.Repeat("(", 20) + "x" + strings.Repeat(")", 20), "too deeply nested"},
+		{strings.Repeat("x ", 65), "too many terms"},
+		{strings.Repeat("x", MaxLength+1), "must not be longer than"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := Parse(tc.input)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
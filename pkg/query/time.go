@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// timeFormats are the formats accepted for absolute times. Times without a
+// time zone are in UTC.
+var timeFormats = []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05", "2006-01-02"}
+
+var (
+	// relativeTimeRx matches relative times like "now-24h" or "now-1d/d". This
+	// is the subset of the date math of ElasticSearch that starts at "now".
+	relativeTimeRx = regexp.MustCompile(`^now((?:[+-][0-9]{1,6}[yMwdhHms]){0,4})(?:/([yMwdhHms]))?$`)
+	// timeOffsetRx matches a single offset of a relative time.
+	timeOffsetRx = regexp.MustCompile(`([+-][0-9]{1,6})([yMwdhHms])`)
+)
+
+// ParseTime parses a time as accepted by the time filter of the API and by
+// time comparisons in queries: either an absolute time like
+// "2017-11-17T09:00:00Z" or "2017-11-17", or a time relative to now like
+// "now-24h" (24 hours ago) or "now-1d/d" (the start of yesterday). Offsets
+// and rounding use the units y (years), M (months), w (weeks), d (days),
+// h or H (hours), m (minutes) and s (seconds). Rounding is done in UTC, and
+// weeks start on Monday.
+//
+// The string itself can be passed to ElasticSearch, which understands the
+// same syntax. ParseTime is only needed to validate it, or to find out which
+// time it refers to. Note that ElasticSearch rounds up when a rounded time is
+// used as an inclusive upper bound (or exclusive lower bound), whereas
+// ParseTime always rounds down.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	for _, format := range timeFormats {
+		t, err := time.Parse(format, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	match := relativeTimeRx.FindStringSubmatch(value)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("invalid time format: %s", value)
+	}
+	t := now.UTC()
+	for _, offset := range timeOffsetRx.FindAllStringSubmatch(match[1], -1) {
+		amount, err := strconv.Atoi(offset[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time format: %s", value)
+		}
+		switch offset[2] {
+		case "y":
+			t = t.AddDate(amount, 0, 0)
+		case "M":
+			t = t.AddDate(0, amount, 0)
+		case "w":
+			t = t.AddDate(0, 0, 7*amount)
+		case "d":
+			t = t.AddDate(0, 0, amount)
+		case "h", "H":
+			t = t.Add(time.Duration(amount) * time.Hour)
+		case "m":
+			t = t.Add(time.Duration(amount) * time.Minute)
+		case "s":
+			t = t.Add(time.Duration(amount) * time.Second)
+		}
+	}
+	return roundTime(t, match[2]), nil
+}
+
+// roundTime rounds t down to the start of the given unit.
+func roundTime(t time.Time, unit string) time.Time {
+	switch unit {
+	case "y":
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	case "M":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "w":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+	case "d":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "h", "H":
+		return t.Truncate(time.Hour)
+	case "m":
+		return t.Truncate(time.Minute)
+	case "s":
+		return t.Truncate(time.Second)
+	default:
+		return t
+	}
+}
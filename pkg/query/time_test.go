@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTime(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2017, 11, 15, 9, 30, 15, 500, time.UTC)
+
+	tt := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"2017-11-17T08:53:32Z", time.Date(2017, 11, 17, 8, 53, 32, 0, time.UTC)},
+		{"2017-11-17T08:53:32+01:00", time.Date(2017, 11, 17, 7, 53, 32, 0, time.UTC)},
+		{"2017-11-17T08:53:32+0100", time.Date(2017, 11, 17, 7, 53, 32, 0, time.UTC)},
+		{"2017-11-17T08:53:32", time.Date(2017, 11, 17, 8, 53, 32, 0, time.UTC)},
+		{"2017-11-17", time.Date(2017, 11, 17, 0, 0, 0, 0, time.UTC)},
+		{"now", now},
+		{"now-24h", time.Date(2017, 11, 14, 9, 30, 15, 500, time.UTC)},
+		{"now+90m", time.Date(2017, 11, 15, 11, 0, 15, 500, time.UTC)},
+		{"now-1M-2d", time.Date(2017, 10, 13, 9, 30, 15, 500, time.UTC)},
+		{"now-1y", time.Date(2016, 11, 15, 9, 30, 15, 500, time.UTC)},
+		{"now/d", time.Date(2017, 11, 15, 0, 0, 0, 0, time.UTC)},
+		{"now-1d/d", time.Date(2017, 11, 14, 0, 0, 0, 0, time.UTC)},
+		{"now/w", time.Date(2017, 11, 13, 0, 0, 0, 0, time.UTC)},
+		{"now/M", time.Date(2017, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"now/y", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"now-2H/h", time.Date(2017, 11, 15, 7, 0, 0, 0, time.UTC)},
+		{"now-30s/m", time.Date(2017, 11, 15, 9, 29, 0, 0, time.UTC)},
+	}
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			actual, err := ParseTime(tc.input, now)
+			require.NoError(t, err)
+			assert.True(t, tc.expected.Equal(actual), "expected %s, got %s", tc.expected, actual)
+		})
+	}
+
+	for _, input := range []string{"", "yesterday", "now-", "now-1", "now-1x", "now/", "now/d-1d", "now-1d-1d-1d-1d-1d", "now-1234567d", "2017-11-17T", "17.11.2017", "2017-11-17||+1d"} {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseTime(input, now)
+			assert.ErrorContains(t, err, "invalid time format")
+		})
+	}
+}
@@ -4,11 +4,14 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
+	"net/http"
 	"strings"
 
 	elastic "github.com/olivere/elastic/v7"
@@ -17,8 +20,16 @@ import (
 	"github.com/sapcc/go-bits/logg"
 
 	"github.com/spf13/viper"
+
+	hermesquery "github.com/sapcc/hermes/pkg/query"
 )
 
+func init() {
+	RegisterDriver("elasticsearch", func() (Storage, error) {
+		return ElasticSearch{}, nil
+	})
+}
+
 // ElasticSearch contains an elastic.Client we pass around after init.
 type ElasticSearch struct {
 	esClient *elastic.Client
@@ -82,37 +93,87 @@ func (es *ElasticSearch) init() {
 
 // New Schema that changes all pieces to keywords.
 var esFieldMapping = map[string]string{
-	"time":           "eventTime",
-	"action":         "action.keyword",
-	"outcome":        "outcome.keyword",
-	"request_path":   "requestPath.keyword",
-	"observer_id":    "observer.id.keyword",
-	"observer_type":  "observer.typeURI.keyword",
-	"target_id":      "target.id.keyword",
-	"target_type":    "target.typeURI.keyword",
-	"initiator_id":   "initiator.id.keyword",
-	"initiator_type": "initiator.typeURI.keyword",
-	"initiator_name": "initiator.name.keyword",
+	"time":              "eventTime",
+	"action":            "action.keyword",
+	"outcome":           "outcome.keyword",
+	"request_path":      "requestPath.keyword",
+	"observer_id":       "observer.id.keyword",
+	"observer_type":     "observer.typeURI.keyword",
+	"target_id":         "target.id.keyword",
+	"target_type":       "target.typeURI.keyword",
+	"initiator_id":      "initiator.id.keyword",
+	"initiator_type":    "initiator.typeURI.keyword",
+	"initiator_name":    "initiator.name.keyword",
+	"initiator_address": "initiator.host.address.keyword",
+	"target_name":       "target.name.keyword",
+	// tags are part of the CADF specification, but not of cadf.Event, see eventDocument
+	"tag": "tags.keyword",
+}
+
+// esIngestTimeField is the time at which an event was written. Logstash sets
+// it by default, and WriteEvents sets it as well.
+const esIngestTimeField = "@timestamp"
+
+// RecordsIngestTime implements the IngestTimeRecorder interface.
+func (es ElasticSearch) RecordsIngestTime() bool {
+	return true
 }
 
 // FilterQuery takes filter requests, and adds their filter to the ElasticSearch Query
 // Handle Filter, Negation of Filter !, and or values separated by ,
+// Events must have one of the values (if any), and none of the negated values.
+// Values ending with * match all values starting with the rest of the value.
 func FilterQuery(filter, filtername string, query *elastic.BoolQuery) *elastic.BoolQuery {
-	switch {
-	case strings.HasPrefix(filter, "!"):
-		filter = filter[1:]
-		query = query.MustNot(elastic.NewTermQuery(filtername, filter))
+	var values, negatedValues []string
+	for value := range strings.SplitSeq(filter, ",") {
+		value = strings.TrimSpace(value)
+		if negatedValue, isNegated := strings.CutPrefix(value, "!"); isNegated {
+			negatedValues = append(negatedValues, negatedValue)
+		} else {
+			values = append(values, value)
+		}
+	}
+
+	switch matches := valueQueries(filtername, values); len(matches) {
+	case 0:
+	case 1:
+		query = query.Filter(matches[0])
 	default:
-		query = query.Filter(elastic.NewTermQuery(filtername, filter))
+		query = query.Filter(elastic.NewBoolQuery().Should(matches...).MinimumNumberShouldMatch(1))
+	}
+	if matches := valueQueries(filtername, negatedValues); len(matches) > 0 {
+		query = query.MustNot(matches...)
 	}
 	return query
 }
 
-// GetEvents grabs events for a given tenantID with filtering.
-func (es ElasticSearch) GetEvents(filter *EventFilter, tenantID string) ([]*cadf.Event, int, error) {
-	index := indexName(tenantID)
-	logg.Debug("Looking for events in index %s", index)
+// valueQueries returns one query matching the exact values, and one prefix
+// query per value ending with *.
+func valueQueries(filtername string, values []string) []elastic.Query {
+	var (
+		exactValues []any
+		queries     []elastic.Query
+	)
+	for _, value := range values {
+		if prefix, isPrefix := strings.CutSuffix(value, "*"); isPrefix {
+			queries = append(queries, elastic.NewPrefixQuery(filtername, prefix))
+		} else {
+			exactValues = append(exactValues, value)
+		}
+	}
 
+	switch len(exactValues) {
+	case 0:
+		return queries
+	case 1:
+		return append([]elastic.Query{elastic.NewTermQuery(filtername, exactValues[0])}, queries...)
+	default:
+		return append([]elastic.Query{elastic.NewTermsQuery(filtername, exactValues...)}, queries...)
+	}
+}
+
+// eventQuery builds the ElasticSearch query for all filter criteria in the given EventFilter.
+func eventQuery(filter *EventFilter) (*elastic.BoolQuery, error) {
 	query := elastic.NewBoolQuery()
 
 	if filter.ObserverType != "" {
@@ -143,36 +204,59 @@ func (es ElasticSearch) GetEvents(filter *EventFilter, tenantID string) ([]*cadf
 	if filter.RequestPath != "" {
 		query = FilterQuery(filter.RequestPath, esFieldMapping["request_path"], query)
 	}
-
-	if len(filter.Time) > 0 {
-		for key, value := range filter.Time {
-			timeField := esFieldMapping["time"]
-			switch key {
-			case "lt":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Lt(value))
-			case "lte":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Lte(value))
-			case "gt":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Gt(value))
-			case "gte":
-				query = query.Filter(elastic.NewRangeQuery(timeField).Gte(value))
-			}
-		}
+	if filter.TargetName != "" {
+		query = FilterQuery(filter.TargetName, esFieldMapping["target_name"], query)
+	}
+	if filter.InitiatorAddress != "" {
+		query = FilterQuery(filter.InitiatorAddress, esFieldMapping["initiator_address"], query)
 	}
+	if filter.Tag != "" {
+		query = FilterQuery(filter.Tag, esFieldMapping["tag"], query)
+	}
+
+	query = timeRangeQuery(query, esFieldMapping["time"], filter.Time)
+	query = timeRangeQuery(query, esIngestTimeField, filter.IngestTime)
 
 	// Check if a search string is provided in EventFilter
 	if filter.Search != "" {
 		logg.Debug("Search Feature %s", filter.Search)
-		// Create a Query String Query for global text search
-		queryStringQuery := elastic.NewQueryStringQuery(filter.Search)
-		// Combine the Query String Query with the existing Bool Query
-		query = query.Must(queryStringQuery)
+		expr, err := hermesquery.Parse(filter.Search)
+		if err != nil {
+			return nil, err
+		}
+		if expr != nil {
+			searchQuery, err := searchQuery(expr)
+			if err != nil {
+				return nil, err
+			}
+			query = query.Must(searchQuery)
+		}
 	}
 
-	esSearch := es.client().Search().
-		Index(index).
-		Query(query)
+	return query, nil
+}
+
+// timeRangeQuery restricts the time field to the given range, with the
+// operators of EventFilter.Time as keys.
+func timeRangeQuery(query *elastic.BoolQuery, timeField string, timeRange map[string]string) *elastic.BoolQuery {
+	for key, value := range timeRange {
+		switch key {
+		case "lt":
+			query = query.Filter(elastic.NewRangeQuery(timeField).Lt(value))
+		case "lte":
+			query = query.Filter(elastic.NewRangeQuery(timeField).Lte(value))
+		case "gt":
+			query = query.Filter(elastic.NewRangeQuery(timeField).Gt(value))
+		case "gte":
+			query = query.Filter(elastic.NewRangeQuery(timeField).Gte(value))
+		}
+	}
+	return query
+}
 
+// sortEvents adds the requested sort order to the search, followed by eventTime
+// descending as the default order.
+func sortEvents(esSearch *elastic.SearchService, filter *EventFilter) *elastic.SearchService {
 	if filter.Sort != nil {
 		for _, fieldOrder := range filter.Sort {
 			switch fieldOrder.Order {
@@ -183,55 +267,336 @@ func (es ElasticSearch) GetEvents(filter *EventFilter, tenantID string) ([]*cadf
 			}
 		}
 	}
+	return esSearch.Sort(esFieldMapping["time"], false)
+}
+
+// selectFields restricts the source of the returned events to the fields
+// selected by the filter, if any.
+func selectFields(esSearch *elastic.SearchService, filter *EventFilter) *elastic.SearchService {
+	if len(filter.Fields) == 0 {
+		return esSearch
+	}
+	return esSearch.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(filter.Fields...))
+}
+
+// esCursor is the content of the opaque cursor handed out to API clients. It
+// refers to a point in time (PIT) snapshot of the tenant's indices and
+// contains the sort values of the last hit returned, which are used as
+// search_after on the next page.
+type esCursor struct {
+	TenantID    string `json:"t"`
+	PointInTime string `json:"p"`
+	SearchAfter []any  `json:"a"`
+}
+
+func (c esCursor) encode() (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeCursor(cursor, tenantID string) (esCursor, error) {
+	var c esCursor
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	// UseNumber keeps large sort values (e.g. _shard_doc) intact
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil || c.PointInTime == "" {
+		return c, ErrInvalidCursor
+	}
+	// a cursor must never be used to read another tenant's point in time
+	if c.TenantID != tenantID {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// cursorKeepAlive returns how long ElasticSearch keeps a point in time open
+// between two requests for consecutive pages.
+func cursorKeepAlive() string {
+	return viper.GetString("elasticsearch.cursor_keep_alive")
+}
+
+// logSearchError logs details about a failed ElasticSearch request.
+func logSearchError(err error) {
+	if elasticErr, ok := errext.As[*elastic.Error](err); ok {
+		errdetails, _ := json.Marshal(elasticErr.Details) //nolint:errcheck
+		log.Printf("Elastic failed with status %d and error %s.", elasticErr.Status, errdetails)
+	} else {
+		log.Printf("Unknown error occurred: %v", err)
+	}
+}
+
+// esErrorType classifies the errors of the ElasticSearch client, see ErrorTypeOf.
+func esErrorType(err error) (ErrorType, bool) {
+	if elasticErr, ok := errext.As[*elastic.Error](err); ok {
+		switch elasticErr.Status {
+		case http.StatusBadRequest:
+			return ErrorBadData, true
+		case http.StatusNotFound:
+			return ErrorNotFound, true
+		case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+			return ErrorTimeout, true
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return ErrorUnavailable, true
+		default:
+			return ErrorExec, true
+		}
+	}
+	if elastic.IsConnErr(err) {
+		return ErrorUnavailable, true
+	}
+	return ErrorNone, false
+}
+
+// GetEvents grabs events for a given tenantID with filtering.
+func (es ElasticSearch) GetEvents(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error) {
+	if filter.UseCursor {
+		return es.getEventsWithCursor(ctx, filter, tenantID)
+	}
+
+	filterQuery, err := eventQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	index, query := tenantSearch(tenantID, filterQuery)
+	logg.Debug("Looking for events in index %s", index)
+
+	esSearch := es.client().Search().
+		Index(index).
+		Query(query)
+	esSearch = sortEvents(esSearch, filter)
 
 	offset := int(math.Min(float64(filter.Offset), float64(math.MaxInt32)))
 	limit := int(math.Min(float64(filter.Limit), float64(math.MaxInt32)))
 
-	esSearch = esSearch.
-		Sort(esFieldMapping["time"], false).
-		From(offset).Size(limit)
+	esSearch = selectFields(esSearch, filter).From(offset).Size(limit)
 
-	searchResult, err := esSearch.Do(context.Background()) // execute
+	searchResult, err := esSearch.Do(ctx) // execute
 	if err != nil {
-		if elasticErr, ok := errext.As[*elastic.Error](err); ok {
-			errdetails, _ := json.Marshal(elasticErr.Details) //nolint:errcheck
-			log.Printf("Elastic failed with status %d and error %s.", elasticErr.Status, errdetails)
-		} else {
-			log.Printf("Unknown error occurred: %v", err)
+		logSearchError(err)
+		return nil, err
+	}
+
+	events, tags, err := eventsFromHits(searchResult)
+	if err != nil {
+		return nil, err
+	}
+	return &EventPage{Events: events, Total: int(searchResult.TotalHits()), TenantIDs: tenantsFromHits(searchResult, tenantID), Tags: tags}, nil
+}
+
+// getEventsWithCursor pages through the results using search_after on a point
+// in time, which is not limited by max_result_window.
+func (es ElasticSearch) getEventsWithCursor(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error) {
+	searchResult, nextCursor, err := es.searchWithCursor(ctx, filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	events, tags, err := eventsFromHits(searchResult)
+	if err != nil {
+		return nil, err
+	}
+	return &EventPage{
+		Events:     events,
+		Total:      int(searchResult.TotalHits()),
+		NextCursor: nextCursor,
+		TenantIDs:  tenantsFromHits(searchResult, tenantID),
+		Tags:       tags,
+	}, nil
+}
+
+// searchWithCursor returns the page of search results selected by the cursor
+// of the filter, and the cursor of the next page, which is empty on the last page.
+func (es ElasticSearch) searchWithCursor(ctx context.Context, filter *EventFilter, tenantID string) (*elastic.SearchResult, string, error) {
+	filterQuery, err := eventQuery(filter)
+	if err != nil {
+		return nil, "", err
+	}
+	index, query := tenantSearch(tenantID, filterQuery)
+
+	var cursor esCursor
+	if filter.Cursor == "" {
+		logg.Debug("Opening point in time for events in index %s", index)
+		pit, err := es.client().OpenPointInTime(index).KeepAlive(cursorKeepAlive()).Do(ctx)
+		if err != nil {
+			logSearchError(err)
+			return nil, "", err
+		}
+		cursor = esCursor{TenantID: tenantID, PointInTime: pit.Id}
+	} else {
+		cursor, err = decodeCursor(filter.Cursor, tenantID)
+		if err != nil {
+			return nil, "", err
 		}
-		return nil, 0, err
 	}
 
+	limit := int(math.Min(float64(filter.Limit), float64(math.MaxInt32)))
+
+	// a search on a point in time must not specify an index, and ElasticSearch
+	// adds the _shard_doc tiebreaker to the sort order on its own
+	esSearch := es.client().Search().
+		PointInTime(elastic.NewPointInTimeWithKeepAlive(cursor.PointInTime, cursorKeepAlive())).
+		Query(query).
+		TrackTotalHits(true)
+	esSearch = selectFields(sortEvents(esSearch, filter), filter).Size(limit)
+	if len(cursor.SearchAfter) > 0 {
+		esSearch = esSearch.SearchAfter(cursor.SearchAfter...)
+	}
+
+	searchResult, err := esSearch.Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, "", err
+	}
+
+	hits := searchResult.Hits.Hits
+	if len(hits) < limit || limit == 0 {
+		// last page reached, release the point in time right away instead of waiting for it to expire
+		_, err := es.client().ClosePointInTime(cursor.PointInTime).Do(ctx)
+		if err != nil {
+			logg.Error("Could not close point in time: %s", err.Error())
+		}
+		return searchResult, "", nil
+	}
+
+	// the point in time ID may change between requests, so always use the latest one
+	if searchResult.PitId != "" {
+		cursor.PointInTime = searchResult.PitId
+	}
+	cursor.SearchAfter = hits[len(hits)-1].Sort
+	nextCursor, err := cursor.encode()
+	if err != nil {
+		return nil, "", err
+	}
+	return searchResult, nextCursor, nil
+}
+
+// exportBatchSize is the number of events fetched per request by StreamEvents.
+const exportBatchSize = 1000
+
+// StreamEvents walks through all matching events using a point in time, so
+// that it is neither limited by max_result_window nor affected by events
+// that are indexed in the meantime.
+func (es ElasticSearch) StreamEvents(ctx context.Context, filter *EventFilter, tenantID string, fn func(*cadf.Event) error) error {
+	return es.streamHits(ctx, filter, tenantID, func(hit *elastic.SearchHit) error {
+		doc, err := decodeEventDocument(hit.Source)
+		if err != nil {
+			return err
+		}
+		return fn(doc.Event)
+	})
+}
+
+// streamHits calls fn for the search hits of all matching events, like StreamEvents.
+func (es ElasticSearch) streamHits(ctx context.Context, filter *EventFilter, tenantID string, fn func(*elastic.SearchHit) error) error {
+	pageFilter := *filter
+	pageFilter.Offset = 0
+	pageFilter.Limit = exportBatchSize
+	pageFilter.UseCursor = true
+	pageFilter.Cursor = ""
+
+	for {
+		searchResult, nextCursor, err := es.searchWithCursor(ctx, &pageFilter, tenantID)
+		if err != nil {
+			return err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			err := fn(hit)
+			if err != nil {
+				es.closeCursor(ctx, nextCursor, tenantID)
+				return err
+			}
+		}
+		if nextCursor == "" {
+			return nil
+		}
+		pageFilter.Cursor = nextCursor
+	}
+}
+
+// closeCursor releases the point in time of a cursor that will not be used
+// any further. This is also done when the context has been canceled.
+func (es ElasticSearch) closeCursor(ctx context.Context, cursor, tenantID string) {
+	if cursor == "" {
+		return
+	}
+	c, err := decodeCursor(cursor, tenantID)
+	if err != nil {
+		return
+	}
+	_, err = es.client().ClosePointInTime(c.PointInTime).Do(context.WithoutCancel(ctx))
+	if err != nil {
+		logg.Error("Could not close point in time: %s", err.Error())
+	}
+}
+
+// eventsFromHits constructs the EventDetail array from search results, with
+// the tags of each event.
+func eventsFromHits(searchResult *elastic.SearchResult) ([]*cadf.Event, [][]string, error) {
 	logg.Debug("Got %d hits", searchResult.TotalHits())
 
-	// Construct EventDetail array from search results
 	var events []*cadf.Event
+	var tags [][]string
 	for _, hit := range searchResult.Hits.Hits {
-		var de cadf.Event
-		err := json.Unmarshal(hit.Source, &de)
+		doc, err := decodeEventDocument(hit.Source)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, err
 		}
-		events = append(events, &de)
+		events = append(events, doc.Event)
+		tags = append(tags, doc.Tags)
 	}
-	total := searchResult.TotalHits()
+	return events, tags, nil
+}
+
+// tenantsFromHits returns the tenant of each hit when several tenants were
+// searched, and nil otherwise.
+func tenantsFromHits(searchResult *elastic.SearchResult, tenantID string) []string {
+	if tenantID != "" && !strings.Contains(tenantID, ",") {
+		return nil
+	}
+	tenantIDs := strings.Split(tenantID, ",")
+	result := make([]string, len(searchResult.Hits.Hits))
+	for idx, hit := range searchResult.Hits.Hits {
+		result[idx] = tenantOfIndex(hit.Index, tenantIDs)
+	}
+	return result
+}
 
-	return events, int(total), nil
+// tenantOfIndex returns the tenant which an index belongs to. If it is one of
+// the given tenants (the longest one, if several match), this one is
+// returned, since tenant IDs in general might contain dashes. Otherwise, the
+// tenant ID is assumed to end at the first dash, as in the index names of
+// writeIndexName.
+func tenantOfIndex(index string, tenantIDs []string) string {
+	name := strings.TrimPrefix(index, "audit-")
+	var result string
+	for _, tenantID := range tenantIDs {
+		if len(tenantID) > len(result) && (name == tenantID || strings.HasPrefix(name, tenantID+"-")) {
+			result = tenantID
+		}
+	}
+	if result == "" {
+		result, _, _ = strings.Cut(name, "-")
+	}
+	return result
 }
 
 // GetEvent Returns EventDetail for a single event.
-func (es ElasticSearch) GetEvent(eventID, tenantID string) (*cadf.Event, error) {
-	index := indexName(tenantID)
+func (es ElasticSearch) GetEvent(ctx context.Context, eventID, tenantID string) (*cadf.Event, error) {
+	index, query := tenantSearch(tenantID, elastic.NewTermQuery("id", eventID))
 	logg.Debug("Looking for event %s in index %s", eventID, index)
-
-	query := elastic.NewTermQuery("id", eventID)
 	logg.Debug("Query: %v", query)
 
 	esSearch := es.client().Search().
 		Index(index).
 		Query(query)
 
-	searchResult, err := esSearch.Do(context.Background())
+	searchResult, err := esSearch.Do(ctx)
 	if err != nil {
 		logg.Debug("Query failed: %s", err.Error())
 		return nil, err
@@ -250,8 +615,8 @@ func (es ElasticSearch) GetEvent(eventID, tenantID string) (*cadf.Event, error)
 
 // GetAttributes Return all unique attributes available for filtering
 // Possible queries, event_type, dns, identity, etc..
-func (es ElasticSearch) GetAttributes(filter *AttributeFilter, tenantID string) ([]string, error) {
-	index := indexName(tenantID)
+func (es ElasticSearch) GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string) ([]string, error) {
+	index, query := tenantSearch(tenantID, nil)
 
 	logg.Debug("Looking for unique attributes for %s in index %s", filter.QueryName, index)
 
@@ -268,15 +633,13 @@ func (es ElasticSearch) GetAttributes(filter *AttributeFilter, tenantID string)
 	queryAgg := elastic.NewTermsAggregation().Size(limit).Field(esName)
 
 	esSearch := es.client().Search().Index(index).Size(limit).Aggregation("attributes", queryAgg)
-	searchResult, err := esSearch.Do(context.Background())
+	if query != nil {
+		esSearch = esSearch.Query(query)
+	}
+	searchResult, err := esSearch.Do(ctx)
 
 	if err != nil {
-		if elasticErr, ok := errext.As[*elastic.Error](err); ok {
-			errdetails, _ := json.Marshal(elasticErr.Details) //nolint:errcheck
-			log.Printf("Elastic failed with status %d and error %s.", elasticErr.Status, errdetails)
-		} else {
-			log.Printf("Unknown error occurred: %v", err)
-		}
+		logSearchError(err)
 		return nil, err
 	}
 
@@ -345,3 +708,28 @@ func indexName(tenantID string) string {
 	}
 	return index
 }
+
+// tenantSearch returns the index pattern and the query to search for events
+// of a tenant. Several tenants can be given as a comma-separated list of IDs.
+// Since the length of the request line of ElasticSearch is limited, their
+// indices are not listed one by one in this case. Instead, all indices are
+// searched, and the query is restricted to the ones of these tenants. The
+// given query may be nil.
+func tenantSearch(tenantID string, query elastic.Query) (string, elastic.Query) {
+	if !strings.Contains(tenantID, ",") {
+		return indexName(tenantID), query
+	}
+
+	var indices []elastic.Query
+	for id := range strings.SplitSeq(tenantID, ",") {
+		// an empty ID would select the indices of all tenants
+		if id != "" {
+			indices = append(indices, elastic.NewPrefixQuery("_index", "audit-"+id))
+		}
+	}
+	tenantQuery := elastic.NewBoolQuery().Should(indices...).MinimumNumberShouldMatch(1)
+	if query == nil {
+		return indexName(""), elastic.NewBoolQuery().Filter(tenantQuery)
+	}
+	return indexName(""), elastic.NewBoolQuery().Must(query).Filter(tenantQuery)
+}
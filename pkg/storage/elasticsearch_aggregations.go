@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	// compositePageSize is the number of buckets requested per page of a composite aggregation.
+	compositePageSize = 1000
+	// maxCompositeBuckets limits the number of groups considered when counting
+	// by multiple fields, since all of them have to be read to find the largest ones.
+	maxCompositeBuckets = 10000
+)
+
+// CountEvents implements the EventAggregator interface. Counting by a single
+// field uses a terms aggregation. For multiple fields, a composite
+// aggregation is read page by page, since it can not be ordered by count.
+func (es ElasticSearch) CountEvents(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint) (*EventCounts, error) {
+	logg.Debug("Counting events by %v of tenant %s", groupBy, tenantID)
+
+	if len(groupBy) == 0 {
+		return nil, errors.New("no fields to group by")
+	}
+	fields := make([]string, len(groupBy))
+	for idx, name := range groupBy {
+		field, ok := esFieldMapping[name]
+		if !ok || name == "time" {
+			return nil, fmt.Errorf("cannot group by %s", name)
+		}
+		fields[idx] = field
+	}
+	size := int(math.Min(float64(limit), float64(math.MaxInt32)))
+	query, err := eventQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 1 {
+		agg := elastic.NewTermsAggregation().Field(fields[0]).Size(size)
+		searchResult, err := es.countSearch(tenantID, query).Aggregation("groups", agg).Do(ctx)
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		result := EventCounts{Total: int(searchResult.TotalHits())}
+		terms, found := searchResult.Aggregations.Terms("groups")
+		if !found {
+			return &result, nil
+		}
+		for _, bucket := range terms.Buckets {
+			result.Groups = append(result.Groups, EventGroup{
+				Values: []string{fmt.Sprint(bucket.Key)},
+				Count:  int(bucket.DocCount),
+			})
+		}
+		result.Other = int(terms.SumOfOtherDocCount)
+		result.HasOther = true
+		return &result, nil
+	}
+
+	sources := make([]elastic.CompositeAggregationValuesSource, len(fields))
+	for idx, field := range fields {
+		sources[idx] = elastic.NewCompositeAggregationTermsValuesSource(groupBy[idx]).Field(field)
+	}
+	var (
+		result   EventCounts
+		afterKey map[string]any
+	)
+	for len(result.Groups) < maxCompositeBuckets {
+		agg := elastic.NewCompositeAggregation().Sources(sources...).Size(compositePageSize)
+		if afterKey != nil {
+			agg = agg.AggregateAfter(afterKey)
+		}
+		searchResult, err := es.countSearch(tenantID, query).Aggregation("groups", agg).Do(ctx)
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		result.Total = int(searchResult.TotalHits())
+		composite, found := searchResult.Aggregations.Composite("groups")
+		if !found {
+			break
+		}
+		for _, bucket := range composite.Buckets {
+			values := make([]string, len(groupBy))
+			for idx, name := range groupBy {
+				values[idx] = fmt.Sprint(bucket.Key[name])
+			}
+			result.Groups = append(result.Groups, EventGroup{Values: values, Count: int(bucket.DocCount)})
+		}
+		if len(composite.Buckets) < compositePageSize || composite.AfterKey == nil {
+			break
+		}
+		afterKey = composite.AfterKey
+	}
+	if len(result.Groups) >= maxCompositeBuckets {
+		logg.Info("Counting events by %v of tenant %s: only the first %d groups were considered", groupBy, tenantID, maxCompositeBuckets)
+	}
+
+	sort.SliceStable(result.Groups, func(i, j int) bool {
+		return result.Groups[i].Count > result.Groups[j].Count
+	})
+	if len(result.Groups) > size {
+		result.Groups = result.Groups[:size]
+	}
+	return &result, nil
+}
+
+// HistogramEvents implements the EventAggregator interface with a
+// date_histogram aggregation.
+func (es ElasticSearch) HistogramEvents(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*EventHistogram, error) {
+	logg.Debug("Building histogram of events with interval %s of tenant %s", interval, tenantID)
+
+	if interval < time.Second {
+		return nil, fmt.Errorf("invalid histogram interval %s", interval)
+	}
+	agg := elastic.NewDateHistogramAggregation().
+		Field(esFieldMapping["time"]).
+		FixedInterval(esInterval(interval)).
+		MinDocCount(0)
+	// report empty intervals at the start and end of the time range, too
+	for key, value := range filter.Time {
+		switch key {
+		case "gt", "gte":
+			agg = agg.ExtendedBoundsMin(value)
+		case "lt", "lte":
+			agg = agg.ExtendedBoundsMax(value)
+		}
+	}
+	if splitBy != "" {
+		field, ok := esFieldMapping[splitBy]
+		if !ok || splitBy == "time" {
+			return nil, fmt.Errorf("cannot split by %s", splitBy)
+		}
+		size := int(math.Min(float64(splitLimit), float64(math.MaxInt32)))
+		agg = agg.SubAggregation("split", elastic.NewTermsAggregation().Field(field).Size(size))
+	}
+
+	query, err := eventQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	searchResult, err := es.countSearch(tenantID, query).Aggregation("histogram", agg).Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	result := EventHistogram{Total: int(searchResult.TotalHits())}
+	histogram, found := searchResult.Aggregations.DateHistogram("histogram")
+	if !found {
+		return &result, nil
+	}
+	for _, item := range histogram.Buckets {
+		bucket := HistogramBucket{
+			Start: time.UnixMilli(int64(item.Key)).UTC(),
+			Count: int(item.DocCount),
+		}
+		if terms, found := item.Terms("split"); found {
+			for _, term := range terms.Buckets {
+				bucket.Groups = append(bucket.Groups, EventGroup{
+					Values: []string{fmt.Sprint(term.Key)},
+					Count:  int(term.DocCount),
+				})
+			}
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	return &result, nil
+}
+
+// esInterval formats a duration as a fixed interval for a date_histogram, in
+// the largest unit that represents it exactly.
+func esInterval(interval time.Duration) string {
+	units := []struct {
+		suffix   string
+		duration time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, unit := range units {
+		if interval%unit.duration == 0 {
+			return fmt.Sprintf("%d%s", interval/unit.duration, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", interval.Milliseconds())
+}
+
+// countSearch prepares a search that only returns aggregations over the
+// matching events of the tenant.
+func (es ElasticSearch) countSearch(tenantID string, query elastic.Query) *elastic.SearchService {
+	index, query := tenantSearch(tenantID, query)
+	return es.client().Search().
+		Index(index).
+		Query(query).
+		Size(0).
+		TrackTotalHits(true)
+}
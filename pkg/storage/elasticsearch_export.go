@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// exportConfigIndex holds one document per project, with the project ID as document ID.
+const exportConfigIndex = "export_events"
+
+// ListExportConfigs implements the ExportConfigStore interface.
+func (es ElasticSearch) ListExportConfigs(ctx context.Context) ([]ExportConfig, error) {
+	logg.Debug("Looking for export configurations in index %s", exportConfigIndex)
+
+	var configs []ExportConfig
+	scroll := es.client().Scroll(exportConfigIndex).Size(1000)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if elastic.IsNotFound(err) {
+			// the index is created with the first configuration
+			return nil, nil
+		}
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var config ExportConfig
+			err := json.Unmarshal(hit.Source, &config)
+			if err != nil {
+				return nil, err
+			}
+			configs = append(configs, config)
+		}
+	}
+
+	err := scroll.Clear(ctx)
+	if err != nil {
+		logg.Error("Could not clear scroll: %s", err.Error())
+	}
+	return configs, nil
+}
+
+// GetExportConfig implements the ExportConfigStore interface.
+func (es ElasticSearch) GetExportConfig(ctx context.Context, projectID string) (*ExportConfig, error) {
+	result, err := es.client().Get().
+		Index(exportConfigIndex).
+		Id(projectID).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		// also returned when the index does not exist yet
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	var config ExportConfig
+	err = json.Unmarshal(result.Source, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// SaveExportConfig implements the ExportConfigStore interface.
+func (es ElasticSearch) SaveExportConfig(ctx context.Context, config ExportConfig) error {
+	// A partial update keeps the last_run_time written by the export worker.
+	// Nested objects are merged by partial updates, so all filter lists are set
+	// explicitly to replace the previous ones.
+	doc := map[string]any{
+		"project_id":     config.ProjectID,
+		"enabled":        config.Enabled,
+		"bucket_name":    config.BucketName,
+		"retention_days": config.RetentionDays,
+		"filters": map[string][]string{
+			"event_types":            nonNil(config.Filters.EventTypes),
+			"resource_types":         nonNil(config.Filters.ResourceTypes),
+			"exclude_event_types":    nonNil(config.Filters.ExcludeEventTypes),
+			"exclude_resource_types": nonNil(config.Filters.ExcludeResourceTypes),
+		},
+	}
+	_, err := es.client().Update().
+		Index(exportConfigIndex).
+		Id(config.ProjectID).
+		Doc(doc).
+		DocAsUpsert(true).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// DeleteExportConfig implements the ExportConfigStore interface.
+func (es ElasticSearch) DeleteExportConfig(ctx context.Context, projectID string) error {
+	_, err := es.client().Delete().
+		Index(exportConfigIndex).
+		Id(projectID).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// nonNil makes sure that an empty list is serialized as [] instead of null.
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// UpdateExportLastRunTime implements the ExportConfigStore interface.
+func (es ElasticSearch) UpdateExportLastRunTime(ctx context.Context, projectID string, lastRunTime time.Time) error {
+	_, err := es.client().Update().
+		Index(exportConfigIndex).
+		Id(projectID).
+		Doc(map[string]any{"last_run_time": lastRunTime.UTC()}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// anchorIndex holds one document per anchor, with "<tenant_id>_<sequence>" as
+// document ID, so that each sequence number can only be used once.
+const anchorIndex = "event_anchors"
+
+func anchorDocumentID(tenantID string, sequence int) string {
+	return tenantID + "_" + strconv.Itoa(sequence)
+}
+
+// ListTenants implements the IntegrityStore interface.
+func (es ElasticSearch) ListTenants(ctx context.Context) ([]string, error) {
+	rows, err := es.client().CatIndices().
+		Index(indexName("")).
+		Columns("index").
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if tenantID := tenantOfIndex(row.Index, nil); tenantID != "" {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	slices.Sort(tenants)
+	return slices.Compact(tenants), nil
+}
+
+// StreamEventDocuments implements the IntegrityStore interface.
+func (es ElasticSearch) StreamEventDocuments(ctx context.Context, filter *EventFilter, tenantID string, fn func(eventID string, document json.RawMessage) error) error {
+	return es.streamHits(ctx, filter, tenantID, func(hit *elastic.SearchHit) error {
+		eventID, err := eventIDOfDocument(hit.Source)
+		if err != nil {
+			return err
+		}
+		return fn(eventID, hit.Source)
+	})
+}
+
+// GetEventDocuments implements the IntegrityStore interface. The documents
+// written by WriteEvents are read in real time from the daily indices given
+// by the eventTime of the events, which is not possible with a search. The
+// documents written by others, e.g. Logstash, may have other document IDs,
+// so the remaining events are searched for by their ID afterwards.
+func (es ElasticSearch) GetEventDocuments(ctx context.Context, tenantID string, events []*cadf.Event) (map[string]json.RawMessage, error) {
+	documents := make(map[string]json.RawMessage, len(events))
+	var items []*elastic.MultiGetItem
+	for _, event := range events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.EventTime)
+		if err == nil {
+			items = append(items, elastic.NewMultiGetItem().Index(writeIndexName(tenantID, eventTime)).Id(event.ID))
+		}
+	}
+	if len(items) > 0 {
+		response, err := es.client().MultiGet().Realtime(true).Add(items...).Do(ctx)
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		for _, doc := range response.Docs {
+			// the index does not exist either if the event was not written
+			if doc.Found {
+				documents[doc.Id] = doc.Source
+			}
+		}
+	}
+
+	var missing []any
+	for _, event := range events {
+		if _, found := documents[event.ID]; !found {
+			missing = append(missing, event.ID)
+		}
+	}
+	if len(missing) == 0 {
+		return documents, nil
+	}
+	searchResult, err := es.client().Search().
+		Index(indexName(tenantID)).
+		Query(elastic.NewTermsQuery("id", missing...)).
+		Size(len(missing)).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return documents, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		eventID, err := eventIDOfDocument(hit.Source)
+		if err != nil {
+			return nil, err
+		}
+		documents[eventID] = hit.Source
+	}
+	return documents, nil
+}
+
+// eventIDOfDocument returns the ID of the event stored in a document, which
+// is not necessarily the ID of the document.
+func eventIDOfDocument(document json.RawMessage) (string, error) {
+	var id struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(document, &id)
+	return id.ID, err
+}
+
+// ListAnchors implements the IntegrityStore interface.
+func (es ElasticSearch) ListAnchors(ctx context.Context, tenantID string, from, to time.Time) ([]Anchor, error) {
+	query := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("sealed_at").Gte(from.UTC()).Lt(to.UTC()))
+	if tenantID != "" {
+		// tenant_id is mapped dynamically, as text with a .keyword subfield
+		query = query.Filter(elastic.NewTermQuery("tenant_id.keyword", tenantID))
+	}
+	return es.searchAnchors(ctx, query)
+}
+
+// FindAnchors implements the IntegrityStore interface.
+func (es ElasticSearch) FindAnchors(ctx context.Context, tenantID string, eventIDs []string) ([]Anchor, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	ids := make([]any, len(eventIDs))
+	for idx, eventID := range eventIDs {
+		ids[idx] = eventID
+	}
+	return es.searchAnchors(ctx, elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("tenant_id.keyword", tenantID)).
+		Filter(elastic.NewTermsQuery("digests.event_id.keyword", ids...)))
+}
+
+// searchAnchors returns all anchors matching the query, ordered by tenant and sequence number.
+func (es ElasticSearch) searchAnchors(ctx context.Context, query elastic.Query) ([]Anchor, error) {
+	var anchors []Anchor
+	scroll := es.client().Scroll(anchorIndex).
+		Query(query).
+		SortBy(elastic.NewFieldSort("tenant_id.keyword"), elastic.NewFieldSort("sequence")).
+		Size(100)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if elastic.IsNotFound(err) {
+			// the index is created with the first anchor
+			return nil, nil
+		}
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var anchor Anchor
+			err := json.Unmarshal(hit.Source, &anchor)
+			if err != nil {
+				return nil, err
+			}
+			anchors = append(anchors, anchor)
+		}
+	}
+
+	err := scroll.Clear(ctx)
+	if err != nil {
+		logg.Error("Could not clear scroll: %s", err.Error())
+	}
+	return anchors, nil
+}
+
+// LastAnchor implements the IntegrityStore interface.
+func (es ElasticSearch) LastAnchor(ctx context.Context, tenantID string) (*Anchor, error) {
+	searchResult, err := es.client().Search(anchorIndex).
+		Query(elastic.NewTermQuery("tenant_id.keyword", tenantID)).
+		Sort("sequence", false).
+		Size(1).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	if len(searchResult.Hits.Hits) == 0 {
+		return nil, nil
+	}
+
+	var anchor Anchor
+	err = json.Unmarshal(searchResult.Hits.Hits[0].Source, &anchor)
+	if err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// GetAnchor implements the IntegrityStore interface.
+func (es ElasticSearch) GetAnchor(ctx context.Context, tenantID string, sequence int) (*Anchor, error) {
+	result, err := es.client().Get().
+		Index(anchorIndex).
+		Id(anchorDocumentID(tenantID, sequence)).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	var anchor Anchor
+	err = json.Unmarshal(result.Source, &anchor)
+	if err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// CreateAnchor implements the IntegrityStore interface. The anchor is visible
+// to searches when CreateAnchor returns, so that its events are not sealed
+// again.
+func (es ElasticSearch) CreateAnchor(ctx context.Context, anchor Anchor) error {
+	_, err := es.client().Index().
+		Index(anchorIndex).
+		OpType("create").
+		Id(anchorDocumentID(anchor.TenantID, anchor.Sequence)).
+		BodyJson(anchor).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsConflict(err) {
+		return fmt.Errorf("%w: %d of %s", ErrAnchorExists, anchor.Sequence, anchor.TenantID)
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
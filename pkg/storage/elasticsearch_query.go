@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	elastic "github.com/olivere/elastic/v7"
+
+	"github.com/sapcc/hermes/pkg/query"
+)
+
+// esTextFields are the analyzed fields searched by query terms without a
+// field. These are the text fields behind the keyword fields in
+// esFieldMapping, and the content of attachments.
+var esTextFields = func() []string {
+	var fields []string
+	for name, field := range esFieldMapping {
+		if name != "time" {
+			fields = append(fields, strings.TrimSuffix(field, ".keyword"))
+		}
+	}
+	slices.Sort(fields)
+	return append(fields, "attachments.content")
+}()
+
+// searchQuery compiles a query of the search language into an ElasticSearch query.
+func searchQuery(expr query.Expr) (elastic.Query, error) {
+	switch expr := expr.(type) {
+	case query.And:
+		result := elastic.NewBoolQuery()
+		for _, operand := range expr {
+			q, err := searchQuery(operand)
+			if err != nil {
+				return nil, err
+			}
+			result = result.Must(q)
+		}
+		return result, nil
+	case query.Or:
+		result := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+		for _, operand := range expr {
+			q, err := searchQuery(operand)
+			if err != nil {
+				return nil, err
+			}
+			result = result.Should(q)
+		}
+		return result, nil
+	case query.Not:
+		q, err := searchQuery(expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return elastic.NewBoolQuery().MustNot(q), nil
+	case query.Match:
+		if expr.Field == "" {
+			q := elastic.NewMultiMatchQuery(expr.Value, esTextFields...).Lenient(true)
+			if expr.Phrase {
+				q = q.Type("phrase")
+			}
+			return q, nil
+		}
+		field, ok := esFieldMapping[expr.Field]
+		if !ok {
+			return nil, fmt.Errorf("cannot search field %s", expr.Field)
+		}
+		if expr.Prefix {
+			return elastic.NewPrefixQuery(field, expr.Value), nil
+		}
+		return elastic.NewTermQuery(field, expr.Value), nil
+	case query.Range:
+		field, ok := esFieldMapping[expr.Field]
+		if !ok {
+			return nil, fmt.Errorf("cannot search field %s", expr.Field)
+		}
+		q := elastic.NewRangeQuery(field)
+		switch expr.Operator {
+		case "lt":
+			return q.Lt(expr.Value), nil
+		case "lte":
+			return q.Lte(expr.Value), nil
+		case "gt":
+			return q.Gt(expr.Value), nil
+		case "gte":
+			return q.Gte(expr.Value), nil
+		}
+		return nil, fmt.Errorf("invalid comparison operator %s", expr.Operator)
+	default:
+		return nil, fmt.Errorf("unexpected search expression %T", expr)
+	}
+}
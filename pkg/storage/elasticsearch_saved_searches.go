@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// savedSearchIndex holds one document per saved search, with the search ID as document ID.
+const savedSearchIndex = "saved_searches"
+
+// ListSavedSearches implements the SavedSearchStore interface.
+func (es ElasticSearch) ListSavedSearches(ctx context.Context, projectID string) ([]SavedSearch, error) {
+	logg.Debug("Looking for saved searches in index %s", savedSearchIndex)
+
+	// like subscriptions, saved searches are filtered here instead of
+	// depending on the mapping of the index
+	var searches []SavedSearch
+	scroll := es.client().Scroll(savedSearchIndex).Size(1000)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if elastic.IsNotFound(err) {
+			// the index is created with the first saved search
+			return nil, nil
+		}
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var search SavedSearch
+			err := json.Unmarshal(hit.Source, &search)
+			if err != nil {
+				return nil, err
+			}
+			if search.ProjectID == projectID {
+				searches = append(searches, search)
+			}
+		}
+	}
+
+	err := scroll.Clear(ctx)
+	if err != nil {
+		logg.Error("Could not clear scroll: %s", err.Error())
+	}
+	return searches, nil
+}
+
+// GetSavedSearch implements the SavedSearchStore interface.
+func (es ElasticSearch) GetSavedSearch(ctx context.Context, projectID, searchID string) (*SavedSearch, error) {
+	result, err := es.client().Get().
+		Index(savedSearchIndex).
+		Id(searchID).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		// also returned when the index does not exist yet
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	var search SavedSearch
+	err = json.Unmarshal(result.Source, &search)
+	if err != nil {
+		return nil, err
+	}
+	if search.ProjectID != projectID {
+		return nil, nil
+	}
+	return &search, nil
+}
+
+// SaveSavedSearch implements the SavedSearchStore interface.
+func (es ElasticSearch) SaveSavedSearch(ctx context.Context, search SavedSearch) error {
+	search.CreatedAt = search.CreatedAt.UTC()
+	search.UpdatedAt = search.UpdatedAt.UTC()
+	_, err := es.client().Index().
+		Index(savedSearchIndex).
+		Id(search.ID).
+		BodyJson(search).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// DeleteSavedSearch implements the SavedSearchStore interface.
+func (es ElasticSearch) DeleteSavedSearch(ctx context.Context, projectID, searchID string) error {
+	// saved searches of other projects must not be deleted
+	search, err := es.GetSavedSearch(ctx, projectID, searchID)
+	if search == nil || err != nil {
+		return err
+	}
+
+	_, err = es.client().Delete().
+		Index(savedSearchIndex).
+		Id(searchID).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		logSearchError(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	// subscriptionIndex holds one document per subscription, with the subscription ID as document ID.
+	subscriptionIndex = "webhook_subscriptions"
+	// deliveryIndex holds one document per delivery, with the delivery ID as document ID.
+	deliveryIndex = "webhook_deliveries"
+)
+
+// ListSubscriptions implements the SubscriptionStore interface.
+func (es ElasticSearch) ListSubscriptions(ctx context.Context, projectID string) ([]Subscription, error) {
+	logg.Debug("Looking for subscriptions in index %s", subscriptionIndex)
+
+	// there are few subscriptions per project, so they are filtered here
+	// instead of depending on the mapping of the index
+	var subscriptions []Subscription
+	scroll := es.client().Scroll(subscriptionIndex).Size(1000)
+	for {
+		searchResult, err := scroll.Do(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if elastic.IsNotFound(err) {
+			// the index is created with the first subscription
+			return nil, nil
+		}
+		if err != nil {
+			logSearchError(err)
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var subscription Subscription
+			err := json.Unmarshal(hit.Source, &subscription)
+			if err != nil {
+				return nil, err
+			}
+			if projectID == "" || subscription.ProjectID == projectID {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+
+	err := scroll.Clear(ctx)
+	if err != nil {
+		logg.Error("Could not clear scroll: %s", err.Error())
+	}
+	return subscriptions, nil
+}
+
+// GetSubscription implements the SubscriptionStore interface.
+func (es ElasticSearch) GetSubscription(ctx context.Context, projectID, subscriptionID string) (*Subscription, error) {
+	result, err := es.client().Get().
+		Index(subscriptionIndex).
+		Id(subscriptionID).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		// also returned when the index does not exist yet
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	var subscription Subscription
+	err = json.Unmarshal(result.Source, &subscription)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.ProjectID != projectID {
+		return nil, nil
+	}
+	return &subscription, nil
+}
+
+// SaveSubscription implements the SubscriptionStore interface.
+func (es ElasticSearch) SaveSubscription(ctx context.Context, subscription Subscription) error {
+	_, err := es.client().Update().
+		Index(subscriptionIndex).
+		Id(subscription.ID).
+		Doc(subscriptionDocument(subscription)).
+		DocAsUpsert(true).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// UpdateSubscription implements the SubscriptionStore interface.
+func (es ElasticSearch) UpdateSubscription(ctx context.Context, subscription Subscription) error {
+	// without an upsert, a subscription that was deleted in the meantime is not created again
+	_, err := es.client().Update().
+		Index(subscriptionIndex).
+		Id(subscription.ID).
+		Doc(subscriptionDocument(subscription)).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrSubscriptionNotFound
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// subscriptionDocument returns the partial update of the document of a
+// subscription. A partial update keeps the last_event_id written by the
+// dispatcher. Nested objects are merged by partial updates, so all filter
+// fields are set explicitly to replace the previous ones.
+func subscriptionDocument(subscription Subscription) map[string]any {
+	f := subscription.Filter
+	return map[string]any{
+		"id":         subscription.ID,
+		"project_id": subscription.ProjectID,
+		"url":        subscription.URL,
+		"secret":     subscription.Secret,
+		"enabled":    subscription.Enabled,
+		"created_at": subscription.CreatedAt.UTC(),
+		"updated_at": subscription.UpdatedAt.UTC(),
+		"filter": map[string]string{
+			"observer_type":     f.ObserverType,
+			"target_type":       f.TargetType,
+			"target_id":         f.TargetID,
+			"initiator_id":      f.InitiatorID,
+			"initiator_type":    f.InitiatorType,
+			"initiator_name":    f.InitiatorName,
+			"action":            f.Action,
+			"outcome":           f.Outcome,
+			"search":            f.Search,
+			"request_path":      f.RequestPath,
+			"target_name":       f.TargetName,
+			"initiator_address": f.InitiatorAddress,
+			"tag":               f.Tag,
+		},
+	}
+}
+
+// DeleteSubscription implements the SubscriptionStore interface.
+func (es ElasticSearch) DeleteSubscription(ctx context.Context, projectID, subscriptionID string) error {
+	// subscriptions of other projects must not be deleted
+	subscription, err := es.GetSubscription(ctx, projectID, subscriptionID)
+	if subscription == nil || err != nil {
+		return err
+	}
+
+	_, err = es.client().Delete().
+		Index(subscriptionIndex).
+		Id(subscriptionID).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		logSearchError(err)
+		return err
+	}
+
+	_, err = es.client().DeleteByQuery(deliveryIndex).
+		Query(elastic.NewTermQuery("subscription_id.keyword", subscriptionID)).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// UpdateSubscriptionProgress implements the SubscriptionStore interface.
+func (es ElasticSearch) UpdateSubscriptionProgress(ctx context.Context, subscriptionID, lastEventID string) error {
+	_, err := es.client().Update().
+		Index(subscriptionIndex).
+		Id(subscriptionID).
+		Doc(map[string]any{"last_event_id": lastEventID}).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		// the subscription was deleted in the meantime
+		return nil
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// SaveDelivery implements the SubscriptionStore interface.
+func (es ElasticSearch) SaveDelivery(ctx context.Context, delivery Delivery) error {
+	_, err := es.client().Index().
+		Index(deliveryIndex).
+		Id(delivery.ID).
+		BodyJson(delivery).
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
+
+// ListDeliveries implements the SubscriptionStore interface.
+func (es ElasticSearch) ListDeliveries(ctx context.Context, subscriptionID string, limit uint) ([]Delivery, error) {
+	// subscription_id is mapped dynamically, as text with a .keyword subfield
+	searchResult, err := es.client().Search(deliveryIndex).
+		Query(elastic.NewTermQuery("subscription_id.keyword", subscriptionID)).
+		Sort("time", false).
+		Size(int(math.Min(float64(limit), float64(math.MaxInt32)))).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		// the index is created with the first delivery
+		return nil, nil
+	}
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var delivery Delivery
+		err := json.Unmarshal(hit.Source, &delivery)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// PruneDeliveries implements the SubscriptionStore interface.
+func (es ElasticSearch) PruneDeliveries(ctx context.Context, before time.Time) error {
+	_, err := es.client().DeleteByQuery(deliveryIndex).
+		Query(elastic.NewRangeQuery("time").Lt(before.UTC())).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logSearchError(err)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := esCursor{
+		TenantID:    "b3b70c8271a845709f9a03030e705da7",
+		PointInTime: "46ToAwMDaWR5BXV1aWQy",
+		SearchAfter: []any{"create/role_assignment", json.Number("1510908812667"), json.Number("9007199254740993")},
+	}
+	encoded, err := cursor.encode()
+	require.Nil(t, err)
+
+	decoded, err := decodeCursor(encoded, "b3b70c8271a845709f9a03030e705da7")
+	require.Nil(t, err)
+	assert.Equal(t, cursor, decoded)
+}
+
+func TestCursorInvalid(t *testing.T) {
+	encoded, err := esCursor{TenantID: "tenant-a", PointInTime: "pit"}.encode()
+	require.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		cursor   string
+		tenantID string
+	}{
+		{"Other tenant", encoded, "tenant-b"},
+		{"Not base64", "!!!", "tenant-a"},
+		{"Not JSON", "bm90IGpzb24", "tenant-a"},
+		{"No point in time", "e30", "tenant-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeCursor(tt.cursor, tt.tenantID)
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
+
+func TestWriteIndexName(t *testing.T) {
+	eventTime := time.Date(2017, 11, 17, 23, 53, 32, 0, time.FixedZone("", -2*60*60))
+	index := writeIndexName("b3b70c8271a845709f9a03030e705da7", eventTime)
+	assert.Equal(t, "audit-b3b70c8271a845709f9a03030e705da7-2017.11.18", index)
+
+	// written events must be found by the index pattern used for reading
+	matched, err := path.Match(indexName("b3b70c8271a845709f9a03030e705da7"), index)
+	require.Nil(t, err)
+	assert.True(t, matched)
+}
+
+func TestTenantSearch(t *testing.T) {
+	query := elastic.NewTermQuery("id", "7be6c4ff-b761-5f1f-b234-f5d41616c2cd")
+
+	index, actual := tenantSearch("b3b70c8271a845709f9a03030e705da7", query)
+	assert.Equal(t, "audit-b3b70c8271a845709f9a03030e705da7*", index)
+	assert.Equal(t, query, actual)
+
+	index, actual = tenantSearch("domain1,project1,project2", query)
+	assert.Equal(t, "audit-*", index)
+	source, err := actual.Source()
+	require.NoError(t, err)
+	buf, err := json.Marshal(source)
+	require.NoError(t, err)
+	expected := `{"bool":{"filter":{"bool":{"minimum_should_match":"1","should":[` +
+		`{"prefix":{"_index":"audit-domain1"}},{"prefix":{"_index":"audit-project1"}},{"prefix":{"_index":"audit-project2"}}]}},` +
+		`"must":{"term":{"id":"7be6c4ff-b761-5f1f-b234-f5d41616c2cd"}}}}`
+	assert.JSONEq(t, expected, string(buf))
+
+	// without a query, only the tenants are selected
+	_, actual = tenantSearch("project1,,project2", nil)
+	source, err = actual.Source()
+	require.NoError(t, err)
+	buf, err = json.Marshal(source)
+	require.NoError(t, err)
+	expected = `{"bool":{"filter":{"bool":{"minimum_should_match":"1","should":[` +
+		`{"prefix":{"_index":"audit-project1"}},{"prefix":{"_index":"audit-project2"}}]}}}}`
+	assert.JSONEq(t, expected, string(buf))
+}
+
+func TestTenantOfIndex(t *testing.T) {
+	tenantIDs := []string{"abc", "abc-def"}
+	tt := []struct {
+		index    string
+		expected string
+	}{
+		{"audit-abc-2017.11.17", "abc"},
+		{"audit-abc-def-2017.11.17", "abc-def"},
+		{"audit-abc", "abc"},
+		{"audit-abcd-2017.11.17", "abcd"},
+		{"audit-b3b70c8271a845709f9a03030e705da7-2017.11.17", "b3b70c8271a845709f9a03030e705da7"},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, tenantOfIndex(tc.index, tenantIDs), tc.index)
+	}
+}
+
+func TestESInterval(t *testing.T) {
+	tt := []struct {
+		interval time.Duration
+		expected string
+	}{
+		{30 * time.Second, "30s"},
+		{15 * time.Minute, "15m"},
+		{90 * time.Minute, "90m"},
+		{time.Hour, "1h"},
+		{36 * time.Hour, "36h"},
+		{7 * 24 * time.Hour, "7d"},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, esInterval(tc.interval))
+	}
+}
+
+func TestEventQuerySearch(t *testing.T) {
+	filter := EventFilter{Search: `action:update/* AND NOT (outcome:success OR time:<2017-11-17T00:00:00Z) "floating ip"`}
+	query, err := eventQuery(&filter)
+	require.Nil(t, err)
+	source, err := query.Source()
+	require.Nil(t, err)
+	actual, err := json.Marshal(source)
+	require.Nil(t, err)
+
+	expected := `{"bool":{"must":{"bool":{"must":[` +
+		`{"prefix":{"action.keyword":"update/"}},` +
+		`{"bool":{"must_not":{"bool":{"minimum_should_match":"1","should":[` +
+		`{"term":{"outcome.keyword":"success"}},` +
+		`{"range":{"eventTime":{"from":null,"include_lower":true,"include_upper":false,"to":"2017-11-17T00:00:00Z"}}}]}}}},` +
+		`{"multi_match":{"fields":["action","initiator.host.address","initiator.id","initiator.name","initiator.typeURI","observer.id","observer.typeURI",` +
+		`"outcome","requestPath","tags","target.id","target.name","target.typeURI","attachments.content"],` +
+		`"lenient":true,"query":"floating ip","type":"phrase"}}]}}}}`
+	assert.JSONEq(t, expected, string(actual))
+
+	_, err = eventQuery(&EventFilter{Search: "password:secret"})
+	assert.ErrorContains(t, err, "unknown field password")
+}
+
+func TestFilterQuery(t *testing.T) {
+	tt := []struct {
+		name     string
+		filter   string
+		expected string
+	}{
+		{"Single", "create", `{"bool":{"filter":{"term":{"action.keyword":"create"}}}}`},
+		{"Negated", "!create", `{"bool":{"must_not":{"term":{"action.keyword":"create"}}}}`},
+		{"List", "create,delete", `{"bool":{"filter":{"terms":{"action.keyword":["create","delete"]}}}}`},
+		{"NegatedList", "!create,!delete", `{"bool":{"must_not":{"terms":{"action.keyword":["create","delete"]}}}}`},
+		{"Mixed", "create, delete,!read", `{"bool":{` +
+			`"filter":{"terms":{"action.keyword":["create","delete"]}},` +
+			`"must_not":{"term":{"action.keyword":"read"}}}}`},
+		{"Prefix", "update/*", `{"bool":{"filter":{"prefix":{"action.keyword":"update/"}}}}`},
+		{"PrefixList", "create,update/*,delete/*", `{"bool":{"filter":{"bool":{"minimum_should_match":"1","should":[` +
+			`{"term":{"action.keyword":"create"}},` +
+			`{"prefix":{"action.keyword":"update/"}},` +
+			`{"prefix":{"action.keyword":"delete/"}}]}}}}`},
+		{"NegatedPrefix", "update/*,!update/add/*,!update/set", `{"bool":{` +
+			`"filter":{"prefix":{"action.keyword":"update/"}},` +
+			`"must_not":[{"term":{"action.keyword":"update/set"}},{"prefix":{"action.keyword":"update/add/"}}]}}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			query := FilterQuery(tc.filter, esFieldMapping["action"], elastic.NewBoolQuery())
+			source, err := query.Source()
+			require.Nil(t, err)
+			actual, err := json.Marshal(source)
+			require.Nil(t, err)
+			assert.JSONEq(t, tc.expected, string(actual))
+		})
+	}
+}
+
+func TestCompareStoredEvent(t *testing.T) {
+	event := TenantEvent{
+		TenantID: "tenant-a",
+		Event:    &cadf.Event{ID: "e1", EventTime: "2024-05-01T10:00:00.000+00:00", Action: "create", Outcome: "success"},
+		Tags:     []string{"cli"},
+	}
+	tt := []struct {
+		name     string
+		source   string
+		expected error
+	}{
+		{"Equal", `{"id":"e1","eventTime":"2024-05-01T10:00:00.000+00:00","action":"create","outcome":"success",` +
+			`"tags":["cli"],"@timestamp":"2024-05-01T10:00:01.000Z"}`, nil},
+		{"Reordered", `{"tags":["cli"],"outcome":"success","action":"create","eventTime":"2024-05-01T10:00:00.000+00:00","id":"e1",` +
+			`"initiator":{"typeURI":"","id":""}}`, nil},
+		{"Different", `{"id":"e1","eventTime":"2024-05-01T10:00:00.000+00:00","action":"delete","outcome":"success","tags":["cli"]}`, ErrEventConflict},
+		{"AdditionalField", `{"id":"e1","eventTime":"2024-05-01T10:00:00.000+00:00","action":"create","outcome":"success",` +
+			`"tags":["cli"],"requestPath":"/v3/users"}`, ErrEventConflict},
+		{"DifferentTags", `{"id":"e1","eventTime":"2024-05-01T10:00:00.000+00:00","action":"create","outcome":"success"}`, ErrEventConflict},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, compareStoredEvent(json.RawMessage(tc.source), event))
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// esEventDocument is the document stored for an event.
+type esEventDocument struct {
+	eventDocument
+	// IngestTime is stored as @timestamp, see esIngestTimeField.
+	IngestTime time.Time `json:"@timestamp"`
+}
+
+// WriteEvents implements the EventWriter interface. All events are written
+// with a single bulk request. Events are only created, never replaced. Since
+// the daily index of an event depends on its eventTime, events with the same
+// ID are looked up in all indices of their tenant beforehand. Events created
+// in the meantime are found through the conflicts of the bulk request.
+func (es ElasticSearch) WriteEvents(ctx context.Context, events []TenantEvent) ([]error, error) {
+	results := make([]error, len(events))
+
+	var valid []int
+	for idx, e := range events {
+		_, err := time.Parse(time.RFC3339Nano, e.Event.EventTime)
+		if err != nil {
+			results[idx] = fmt.Errorf("%w: invalid eventTime: %w", ErrEventRejected, err)
+			continue
+		}
+		valid = append(valid, idx)
+	}
+	stored, err := es.storedEvents(ctx, events, valid)
+	if err != nil {
+		return nil, err
+	}
+
+	// bulkIndex maps the items of the bulk request to the events
+	bulkIndex := make([]int, 0, len(valid))
+	ingestTime := time.Now().UTC().Truncate(time.Millisecond)
+	bulk := es.client().Bulk()
+	for _, idx := range valid {
+		e := events[idx]
+		if source, exists := stored[e.TenantID+"/"+e.Event.ID]; exists {
+			results[idx] = compareStoredEvent(source, e)
+			continue
+		}
+		eventTime, _ := time.Parse(time.RFC3339Nano, e.Event.EventTime) //nolint:errcheck // checked above
+		bulk.Add(elastic.NewBulkIndexRequest().
+			OpType("create").
+			Index(writeIndexName(e.TenantID, eventTime)).
+			Id(e.Event.ID).
+			Doc(esEventDocument{eventDocument: eventDocument{Event: e.Event, Tags: e.Tags}, IngestTime: ingestTime}))
+		bulkIndex = append(bulkIndex, idx)
+	}
+	if bulk.NumberOfActions() == 0 {
+		return results, nil
+	}
+
+	response, err := bulk.Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	if len(response.Items) != len(bulkIndex) {
+		return nil, fmt.Errorf("expected %d results from bulk request, got %d", len(bulkIndex), len(response.Items))
+	}
+	// events which were created in the meantime, e.g. twice in the same request
+	var conflicts []int
+	for itemIdx, item := range response.Items {
+		for _, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			if result.Status == http.StatusConflict {
+				conflicts = append(conflicts, bulkIndex[itemIdx])
+				continue
+			}
+			err := fmt.Errorf("%s: %s", result.Error.Type, result.Error.Reason)
+			// 429 means that Elasticsearch is overloaded, 5xx are server errors:
+			// both might go away when the event is written again
+			if result.Status != http.StatusTooManyRequests && result.Status < 500 {
+				err = fmt.Errorf("%w: %w", ErrEventRejected, err)
+			}
+			results[bulkIndex[itemIdx]] = err
+		}
+	}
+	if len(conflicts) == 0 {
+		return results, nil
+	}
+
+	// the index of these events is known, so they are read in real time
+	mget := es.client().MultiGet()
+	for _, idx := range conflicts {
+		e := events[idx]
+		eventTime, _ := time.Parse(time.RFC3339Nano, e.Event.EventTime) //nolint:errcheck // checked above
+		mget.Add(elastic.NewMultiGetItem().Index(writeIndexName(e.TenantID, eventTime)).Id(e.Event.ID))
+	}
+	mgetResponse, err := mget.Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	if len(mgetResponse.Docs) != len(conflicts) {
+		return nil, fmt.Errorf("expected %d results from multi-get request, got %d", len(conflicts), len(mgetResponse.Docs))
+	}
+	for docIdx, doc := range mgetResponse.Docs {
+		e := events[conflicts[docIdx]]
+		if !doc.Found {
+			results[conflicts[docIdx]] = fmt.Errorf("event %s of %s was reported as existing, but cannot be found", e.Event.ID, e.TenantID)
+			continue
+		}
+		results[conflicts[docIdx]] = compareStoredEvent(doc.Source, e)
+	}
+	return results, nil
+}
+
+// storedEvents returns the stored documents of the selected events by
+// "<tenant>/<ID>", if they exist in any index of their tenant.
+func (es ElasticSearch) storedEvents(ctx context.Context, events []TenantEvent, selected []int) (map[string]json.RawMessage, error) {
+	if len(selected) == 0 {
+		return nil, nil
+	}
+	eventIDs := make(map[string][]any)
+	for _, idx := range selected {
+		e := events[idx]
+		eventIDs[e.TenantID] = append(eventIDs[e.TenantID], e.Event.ID)
+	}
+	tenantIDs := slices.Sorted(maps.Keys(eventIDs))
+	queries := make([]elastic.Query, 0, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		queries = append(queries, elastic.NewBoolQuery().Filter(
+			elastic.NewPrefixQuery("_index", "audit-"+tenantID+"-"),
+			elastic.NewTermsQuery("id", eventIDs[tenantID]...),
+		))
+	}
+
+	searchResult, err := es.client().Search().
+		Index(indexName("")).
+		Query(elastic.NewBoolQuery().Should(queries...).MinimumNumberShouldMatch(1)).
+		Size(len(selected)).
+		Do(ctx)
+	if err != nil {
+		logSearchError(err)
+		return nil, err
+	}
+	stored := make(map[string]json.RawMessage, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var id struct {
+			ID string `json:"id"`
+		}
+		err := json.Unmarshal(hit.Source, &id)
+		if err != nil {
+			return nil, err
+		}
+		stored[tenantOfIndex(hit.Index, tenantIDs)+"/"+id.ID] = hit.Source
+	}
+	return stored, nil
+}
+
+// compareStoredEvent returns nil if the stored document contains the event,
+// or ErrEventConflict otherwise. Both are compared as encoded by WriteEvents,
+// so that fields added by the writer of the document (like @timestamp) and
+// the encoding of empty fields do not matter.
+func compareStoredEvent(source json.RawMessage, event TenantEvent) error {
+	stored, err := decodeEventDocument(source)
+	if err != nil {
+		return err
+	}
+	storedJSON, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	eventJSON, err := json.Marshal(eventDocument{Event: event.Event, Tags: event.Tags})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(storedJSON, eventJSON) {
+		return ErrEventConflict
+	}
+	return nil
+}
+
+// writeIndexName generates the name of the daily index for new events of a
+// given tenant, which is matched by indexName(tenantID) when reading events.
+func writeIndexName(tenantID string, eventTime time.Time) string {
+	return fmt.Sprintf("audit-%s-%s", tenantID, eventTime.UTC().Format("2006.01.02"))
+}
@@ -4,7 +4,15 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/errext"
 )
 
 // Status contains Prometheus status strings
@@ -25,15 +33,25 @@ const (
 	// ErrorNone means no error
 	ErrorNone ErrorType = ""
 	// ErrorTimeout means that a timeout occurred while processing the request
-	ErrorTimeout = "timeout"
+	ErrorTimeout ErrorType = "timeout"
 	// ErrorCanceled means that the query was cancelled (to protect the service from malicious requests)
-	ErrorCanceled = "canceled"
+	ErrorCanceled ErrorType = "canceled"
 	// ErrorExec means unspecified error happened during query execution
-	ErrorExec = "execution"
+	ErrorExec ErrorType = "execution"
 	// ErrorBadData means the API parameters where invalid
-	ErrorBadData = "bad_data"
+	ErrorBadData ErrorType = "bad_data"
 	// ErrorInternal means some unspecified internal error happened
-	ErrorInternal = "internal"
+	ErrorInternal ErrorType = "internal"
+	// ErrorNotFound means that the requested object or index does not exist
+	ErrorNotFound ErrorType = "not_found"
+	// ErrorUnavailable means that the storage cannot be reached or is overloaded
+	ErrorUnavailable ErrorType = "unavailable"
+	// ErrorUnauthorized means that the request has no valid token
+	ErrorUnauthorized ErrorType = "unauthorized"
+	// ErrorForbidden means that the token does not permit the request
+	ErrorForbidden ErrorType = "forbidden"
+	// ErrorNotSupported means that the storage driver does not support the request
+	ErrorNotSupported ErrorType = "not_supported"
 )
 
 // Response encapsulates a generic response of a Prometheus API
@@ -44,16 +62,362 @@ type Response struct {
 	Error     string    `json:"error,omitempty"`
 }
 
+// ErrorTypeOf classifies an error returned by a method that was called with
+// the given context. Drivers do not always wrap the error of the context
+// (e.g. Postgres reports a canceled statement instead), so the context is
+// checked as well. Errors that cannot be classified are ErrorInternal.
+func ErrorTypeOf(ctx context.Context, err error) ErrorType {
+	switch {
+	case err == nil:
+		return ErrorNone
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.Is(err, context.Canceled), ctx.Err() != nil:
+		return ErrorCanceled
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrEventRejected):
+		return ErrorBadData
+	}
+	for _, classify := range driverErrorTypes {
+		if errorType, ok := classify(err); ok {
+			return errorType
+		}
+	}
+	if _, ok := errext.As[*net.OpError](err); ok {
+		return ErrorUnavailable
+	}
+	return ErrorInternal
+}
+
+// driverErrorTypes classify the errors of the clients of the storage drivers.
+var driverErrorTypes = []func(error) (ErrorType, bool){esErrorType, pgErrorType}
+
 // Storage is an interface that wraps the underlying event storage mechanism.
 // Because it is an interface, the real implementation can be mocked away in unit tests.
+//
+// The tenantID arguments of all methods, including those of the optional
+// interfaces for reading events, are a project or domain ID, or a
+// comma-separated list of them to read the events of all these tenants.
+//
+// All methods with a context stop when the context is done, and then return
+// an error for which ErrorTypeOf reports ErrorTimeout or ErrorCanceled.
 type Storage interface {
 	/********** requests to ElasticSearch **********/
-	GetEvents(filter *EventFilter, tenantID string) ([]*cadf.Event, int, error)
-	GetEvent(eventID, tenantID string) (*cadf.Event, error)
-	GetAttributes(filter *AttributeFilter, tenantID string) ([]string, error)
+	GetEvents(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error)
+	// StreamEvents calls fn for every event matching the filter, ignoring Offset,
+	// Limit and Cursor. Iteration stops at the first error returned by fn.
+	StreamEvents(ctx context.Context, filter *EventFilter, tenantID string, fn func(*cadf.Event) error) error
+	GetEvent(ctx context.Context, eventID, tenantID string) (*cadf.Event, error)
+	GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string) ([]string, error)
 	MaxLimit() uint
 }
 
+// EventAggregator is implemented by storage drivers that can count events
+// without retrieving them.
+type EventAggregator interface {
+	// CountEvents counts the events matching the filter, grouped by their
+	// values of the groupBy fields (with the names used in the API, e.g.
+	// "initiator_name"). Only the limit largest groups are returned, ordered
+	// by their count. Paging and sorting in the filter are ignored.
+	CountEvents(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint) (*EventCounts, error)
+
+	// HistogramEvents counts the events matching the filter per interval of
+	// time. Intervals start at multiples of interval since the Unix epoch.
+	// Empty intervals are included, within the time range of the filter if
+	// it has one. If splitBy is not empty, the events of each interval are
+	// also counted per value of this field, for the splitLimit most frequent
+	// values in this interval. Paging and sorting in the filter are ignored.
+	HistogramEvents(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*EventHistogram, error)
+}
+
+// EventCounts is the result of EventAggregator.CountEvents.
+type EventCounts struct {
+	Total  int // number of all matching events, including those outside of Groups
+	Groups []EventGroup
+	// Other is the number of events in the groups that were not returned, if
+	// HasOther is set. Otherwise, it can only be estimated from Total, which
+	// is not exact for fields with multiple values like tags.
+	Other    int
+	HasOther bool
+}
+
+// EventGroup is the number of events with the same values of the groupBy fields.
+type EventGroup struct {
+	Values []string // in the order of the groupBy fields
+	Count  int
+}
+
+// EventHistogram is the result of EventAggregator.HistogramEvents.
+type EventHistogram struct {
+	Total   int // number of all matching events
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket is the number of events in the interval starting at Start.
+type HistogramBucket struct {
+	Start  time.Time
+	Count  int
+	Groups []EventGroup // only if split by a field, with a single value each
+}
+
+// EventWriter is implemented by storage drivers that can store new events.
+type EventWriter interface {
+	// WriteEvents stores the given events. The result has one entry per event,
+	// which is nil if the event was stored, or the reason why it was not.
+	// Reasons wrapping ErrEventRejected are permanent, the other ones might go
+	// away when writing the event again. The error is set if the write failed
+	// as a whole. Stored events are never replaced: writing an event with the
+	// ID of a stored event of the same tenant succeeds without writing it if
+	// both are equal, and fails with ErrEventConflict if they are not.
+	WriteEvents(ctx context.Context, events []TenantEvent) ([]error, error)
+}
+
+// TenantEvent is an event together with the project or domain ID it belongs to.
+type TenantEvent struct {
+	TenantID string
+	Event    *cadf.Event
+	// Tags are part of the CADF specification, but not of cadf.Event, so
+	// they are stored next to it.
+	Tags []string
+}
+
+// ErrEventRejected is wrapped by the errors of events that the storage will
+// never accept, e.g. because they do not match the mapping of the index.
+var ErrEventRejected = errors.New("event rejected by storage")
+
+// ErrEventConflict is the error of an event whose ID is already used by a
+// different stored event of the same tenant. It wraps ErrEventRejected.
+var ErrEventConflict = fmt.Errorf("%w: a different event with this ID is already stored", ErrEventRejected)
+
+// ExportConfigStore is implemented by storage drivers that can persist the
+// per-project configuration of the event export (see docs/design/003-Export-Events.md).
+type ExportConfigStore interface {
+	// ListExportConfigs returns the export configuration of all projects.
+	ListExportConfigs(ctx context.Context) ([]ExportConfig, error)
+	// GetExportConfig returns the export configuration of a project, or nil if there is none.
+	GetExportConfig(ctx context.Context, projectID string) (*ExportConfig, error)
+	// SaveExportConfig creates or replaces the export configuration of config.ProjectID.
+	// LastRunTime is not changed, it is only written by UpdateExportLastRunTime.
+	SaveExportConfig(ctx context.Context, config ExportConfig) error
+	// DeleteExportConfig removes the export configuration of a project. Deleting a
+	// configuration that does not exist is not an error.
+	DeleteExportConfig(ctx context.Context, projectID string) error
+	// UpdateExportLastRunTime records that all events before lastRunTime have been exported for the project.
+	UpdateExportLastRunTime(ctx context.Context, projectID string, lastRunTime time.Time) error
+}
+
+// ExportConfig is the configuration of the event export for a single project.
+type ExportConfig struct {
+	ProjectID  string `json:"project_id"`
+	Enabled    bool   `json:"enabled"`
+	BucketName string `json:"bucket_name"`
+	// RetentionDays is the number of days the exported objects are to be kept, 0 keeps them forever.
+	RetentionDays int `json:"retention_days,omitempty"`
+	// LastRunTime is the exclusive upper bound of the events exported so far, nil before the first run.
+	LastRunTime *time.Time    `json:"last_run_time,omitempty"`
+	Filters     ExportFilters `json:"filters"`
+}
+
+// ExportFilters selects the events to export. Event types are matched against
+// the action, resource types against the target type URI of an event.
+type ExportFilters struct {
+	EventTypes           []string `json:"event_types,omitempty"`
+	ResourceTypes        []string `json:"resource_types,omitempty"`
+	ExcludeEventTypes    []string `json:"exclude_event_types,omitempty"`
+	ExcludeResourceTypes []string `json:"exclude_resource_types,omitempty"`
+}
+
+// SubscriptionStore is implemented by storage drivers that can persist the
+// webhook subscriptions of projects and the log of their deliveries.
+type SubscriptionStore interface {
+	// ListSubscriptions returns the subscriptions of a project, or of all
+	// projects if projectID is empty.
+	ListSubscriptions(ctx context.Context, projectID string) ([]Subscription, error)
+	// GetSubscription returns a subscription of a project, or nil if there is none.
+	GetSubscription(ctx context.Context, projectID, subscriptionID string) (*Subscription, error)
+	// SaveSubscription creates the subscription with subscription.ID.
+	// LastEventID is not changed, it is only written by UpdateSubscriptionProgress.
+	SaveSubscription(ctx context.Context, subscription Subscription) error
+	// UpdateSubscription replaces the subscription with subscription.ID, or
+	// returns ErrSubscriptionNotFound if it does not exist (anymore), so that
+	// deleted subscriptions are not brought back. LastEventID is not changed.
+	UpdateSubscription(ctx context.Context, subscription Subscription) error
+	// DeleteSubscription removes a subscription of a project together with its
+	// deliveries. Deleting a subscription that does not exist is not an error.
+	DeleteSubscription(ctx context.Context, projectID, subscriptionID string) error
+	// UpdateSubscriptionProgress records that all events up to lastEventID
+	// have been delivered for the subscription.
+	UpdateSubscriptionProgress(ctx context.Context, subscriptionID, lastEventID string) error
+	// SaveDelivery adds a delivery to the delivery log.
+	SaveDelivery(ctx context.Context, delivery Delivery) error
+	// ListDeliveries returns the latest deliveries of a subscription, newest first.
+	ListDeliveries(ctx context.Context, subscriptionID string, limit uint) ([]Delivery, error)
+	// PruneDeliveries removes the deliveries before the given time from the delivery log.
+	PruneDeliveries(ctx context.Context, before time.Time) error
+}
+
+// ErrSubscriptionNotFound is returned by SubscriptionStore.UpdateSubscription
+// when the subscription does not exist.
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// Subscription is a webhook that receives the matching events of a project.
+type Subscription struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id"`
+	URL       string `json:"url"`
+	// Secret is the key of the HMAC signature of all deliveries.
+	Secret    string             `json:"secret,omitempty"`
+	Enabled   bool               `json:"enabled"`
+	Filter    SubscriptionFilter `json:"filter"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	// LastEventID is the ID of the last delivered event in the format of the
+	// event stream, empty before the first delivery.
+	LastEventID string `json:"last_event_id,omitempty"`
+}
+
+// SubscriptionFilter selects the events of a subscription. The fields have the
+// names and the format of the filter parameters of the API, and of the
+// corresponding fields of EventFilter.
+type SubscriptionFilter struct {
+	ObserverType     string `json:"observer_type,omitempty"`
+	TargetType       string `json:"target_type,omitempty"`
+	TargetID         string `json:"target_id,omitempty"`
+	InitiatorID      string `json:"initiator_id,omitempty"`
+	InitiatorType    string `json:"initiator_type,omitempty"`
+	InitiatorName    string `json:"initiator_name,omitempty"`
+	Action           string `json:"action,omitempty"`
+	Outcome          string `json:"outcome,omitempty"`
+	Search           string `json:"search,omitempty"`
+	RequestPath      string `json:"request_path,omitempty"`
+	TargetName       string `json:"target_name,omitempty"`
+	InitiatorAddress string `json:"initiator_address,omitempty"`
+	Tag              string `json:"tag,omitempty"`
+}
+
+// Delivery records the delivery of an event to a subscription, including all
+// of its attempts.
+type Delivery struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	EventID        string `json:"event_id"`
+	// Time is the time of the last attempt.
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Success  bool      `json:"success"`
+	// StatusCode is the status code of the last response, 0 if there was none.
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SavedSearchStore is implemented by storage drivers that can persist the
+// saved searches of projects.
+type SavedSearchStore interface {
+	// ListSavedSearches returns all saved searches of a project, including
+	// the private searches of all of its users.
+	ListSavedSearches(ctx context.Context, projectID string) ([]SavedSearch, error)
+	// GetSavedSearch returns a saved search of a project, or nil if there is none.
+	GetSavedSearch(ctx context.Context, projectID, searchID string) (*SavedSearch, error)
+	// SaveSavedSearch creates or replaces the saved search with search.ID.
+	SaveSavedSearch(ctx context.Context, search SavedSearch) error
+	// DeleteSavedSearch removes a saved search of a project. Deleting a saved
+	// search that does not exist is not an error.
+	DeleteSavedSearch(ctx context.Context, projectID, searchID string) error
+}
+
+// SavedSearch is a named filter for the events of a project, which can be run
+// with the saved_search parameter of ListEvents.
+type SavedSearch struct {
+	ID          string `json:"id"`
+	ProjectID   string `json:"project_id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// UserID is the owner of a private search. Searches without an owner are
+	// shared with all users of the project.
+	UserID string `json:"user_id,omitempty"`
+	// CreatedBy is the user who created the search. Only this user and
+	// project admins can change or delete it while it is shared.
+	CreatedBy string            `json:"created_by,omitempty"`
+	Filter    SavedSearchFilter `json:"filter"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// SavedSearchFilter is the filter of a saved search. Like SubscriptionFilter,
+// the fields have the names and the format of the parameters of the API, so
+// that relative times like "now-7d" are kept as they are.
+type SavedSearchFilter struct {
+	SubscriptionFilter
+	// Time is the time range, e.g. "gte:now-7d".
+	Time string `json:"time,omitempty"`
+	// Sort is the sort order, e.g. "time:desc".
+	Sort string `json:"sort,omitempty"`
+}
+
+// IntegrityStore is implemented by storage drivers that can persist the
+// anchors which make the stored events tamper-evident, and read the stored
+// documents of events as they are, including fields unknown to cadf.Event.
+type IntegrityStore interface {
+	// ListTenants returns the projects and domains that have events.
+	ListTenants(ctx context.Context) ([]string, error)
+	// StreamEventDocuments calls fn with the ID and the stored document of every
+	// event matching the filter, like StreamEvents.
+	StreamEventDocuments(ctx context.Context, filter *EventFilter, tenantID string, fn func(eventID string, document json.RawMessage) error) error
+	// GetEventDocuments returns the stored documents of events of a tenant by
+	// event ID, including events that were written just before. Only the ID
+	// and eventTime of the given events are used. Events that are not stored
+	// are left out.
+	GetEventDocuments(ctx context.Context, tenantID string, events []*cadf.Event) (map[string]json.RawMessage, error)
+	// ListAnchors returns the anchors of a tenant, or of all tenants if
+	// tenantID is empty, that were sealed in [from, to), ordered by tenant and
+	// sequence number.
+	ListAnchors(ctx context.Context, tenantID string, from, to time.Time) ([]Anchor, error)
+	// FindAnchors returns the anchors of a tenant that seal any of the given
+	// events, ordered by sequence number.
+	FindAnchors(ctx context.Context, tenantID string, eventIDs []string) ([]Anchor, error)
+	// LastAnchor returns the anchor of a tenant with the highest sequence
+	// number, or nil if there is none. It may miss the anchors that were
+	// created just before, GetAnchor does not.
+	LastAnchor(ctx context.Context, tenantID string) (*Anchor, error)
+	// GetAnchor returns the anchor of a tenant with the given sequence number,
+	// or nil if there is none.
+	GetAnchor(ctx context.Context, tenantID string, sequence int) (*Anchor, error)
+	// CreateAnchor stores a new anchor. Anchors are never replaced: if the
+	// tenant already has an anchor with the same sequence number, it fails
+	// with ErrAnchorExists.
+	CreateAnchor(ctx context.Context, anchor Anchor) error
+}
+
+// ErrAnchorExists is returned by IntegrityStore.CreateAnchor when the sequence
+// number of the anchor is already used, e.g. by a concurrent writer.
+var ErrAnchorExists = errors.New("an anchor with this sequence number already exists")
+
+// Anchor seals a batch of events of a tenant with the root hash of a Merkle
+// tree over their digests. The anchors of a tenant form a hash chain, since
+// each one contains the hash of the previous one, and are signed with a key
+// that only Hermes knows.
+type Anchor struct {
+	TenantID string `json:"tenant_id"`
+	// Sequence numbers the anchors of a tenant, starting at 1.
+	Sequence int `json:"sequence"`
+	// Digests are the leaves of the Merkle tree, in order.
+	Digests  []EventDigest `json:"digests,omitempty"`
+	TreeSize int           `json:"tree_size"`
+	RootHash string        `json:"root_hash"`
+	// PreviousHash is the Hash of the previous anchor of the tenant, empty for the first one.
+	PreviousHash string    `json:"previous_hash,omitempty"`
+	Hash         string    `json:"hash"`
+	Signature    string    `json:"signature"`
+	SealedAt     time.Time `json:"sealed_at"`
+}
+
+// EventDigest is the hash of a sealed event, i.e. a leaf of the Merkle tree of its anchor.
+type EventDigest struct {
+	EventID string `json:"event_id"`
+	// EventTime is the eventTime of the event, which is needed to find its document.
+	EventTime string `json:"event_time"`
+	Hash      string `json:"hash"`
+}
+
 // FieldOrder maps the sort Fieldname and Order
 type FieldOrder struct {
 	Fieldname string
@@ -62,22 +426,67 @@ type FieldOrder struct {
 
 // EventFilter is similar to hermes.EventFilter, but using IDs instead of names
 type EventFilter struct {
-	ObserverType  string
-	TargetType    string
-	TargetID      string
-	InitiatorID   string
-	InitiatorType string
-	InitiatorName string
-	Action        string
-	Outcome       string
-	Search        string
-	RequestPath   string
-	Time          map[string]string
-	Offset        uint
-	Limit         uint
-	Sort          []FieldOrder
+	ObserverType     string
+	TargetType       string
+	TargetID         string
+	InitiatorID      string
+	InitiatorType    string
+	InitiatorName    string
+	Action           string
+	Outcome          string
+	Search           string
+	RequestPath      string
+	TargetName       string
+	InitiatorAddress string
+	Tag              string
+	Time             map[string]string
+	// IngestTime restricts the events to those written in a time range, with
+	// the same keys as Time and absolute times only. It is only supported by
+	// ElasticSearch, where it is the @timestamp set by Logstash and by
+	// WriteEvents, and used by the export to select the new events.
+	IngestTime map[string]string
+	Offset     uint
+	Limit      uint
+	Sort       []FieldOrder
+	// UseCursor requests cursor-based paging instead of Offset. Cursor is the
+	// opaque token returned in EventPage.NextCursor of the previous page, or
+	// empty to start a new cursor.
+	UseCursor bool
+	Cursor    string
+	// Fields optionally restricts the fields of the events returned by
+	// GetEvents, e.g. "initiator.name". The other fields may be empty.
+	Fields []string
 }
 
+// EventPage is one page of results returned by GetEvents.
+type EventPage struct {
+	Events []*cadf.Event
+	Total  int
+	// NextCursor is only set when the filter requested cursor-based paging
+	// and there might be more results after this page.
+	NextCursor string
+	// TenantIDs is only set when reading the events of several tenants, and
+	// contains the tenant of each event in Events.
+	TenantIDs []string
+	// Tags contains the tags of each event in Events (see TenantEvent.Tags).
+	// It may be nil if none of the events have tags.
+	Tags [][]string
+}
+
+// ErrIngestTimeNotSupported is returned by drivers which do not record the
+// ingestion time of events when EventFilter.IngestTime is set.
+var ErrIngestTimeNotSupported = errors.New("filtering by ingestion time is not supported by this storage driver")
+
+// IngestTimeRecorder is implemented by storage drivers which record the
+// ingestion time of events, so that they support EventFilter.IngestTime.
+type IngestTimeRecorder interface {
+	RecordsIngestTime() bool
+}
+
+// ErrInvalidCursor is returned by GetEvents when EventFilter.Cursor cannot be
+// decoded or does not belong to the requested tenant.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 // AttributeFilter contains parameters for filtering by attributes
 type AttributeFilter struct {
 	QueryName string
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/lib/pq"
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorTypeOf(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expiredCtx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		expected ErrorType
+	}{
+		{"no error", context.Background(), nil, ErrorNone},
+		{"no error after timeout", expiredCtx, nil, ErrorNone},
+		{"other error", context.Background(), errors.New("boom"), ErrorInternal},
+		{"invalid cursor", context.Background(), fmt.Errorf("%w: wrong tenant", ErrInvalidCursor), ErrorBadData},
+		{"elastic bad request", context.Background(), &elastic.Error{Status: http.StatusBadRequest}, ErrorBadData},
+		{"elastic missing index", context.Background(), &elastic.Error{Status: http.StatusNotFound}, ErrorNotFound},
+		{"elastic overloaded", context.Background(), &elastic.Error{Status: http.StatusTooManyRequests}, ErrorUnavailable},
+		{"elastic failure", context.Background(), fmt.Errorf("search: %w", &elastic.Error{Status: http.StatusInternalServerError}), ErrorExec},
+		{"elastic unreachable", context.Background(), elastic.ErrNoClient, ErrorUnavailable},
+		{"postgres statement timeout", context.Background(), &pq.Error{Code: "57014"}, ErrorTimeout},
+		{"postgres shutdown", context.Background(), &pq.Error{Code: "57P01"}, ErrorUnavailable},
+		{"postgres invalid value", context.Background(), &pq.Error{Code: "22P02"}, ErrorBadData},
+		{"postgres failure", context.Background(), &pq.Error{Code: "XX000"}, ErrorExec},
+		{"connection refused", context.Background(), &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorUnavailable},
+		{"wrapped deadline", context.Background(), fmt.Errorf("search: %w", context.DeadlineExceeded), ErrorTimeout},
+		{"wrapped cancellation", context.Background(), fmt.Errorf("search: %w", context.Canceled), ErrorCanceled},
+		{"driver error after timeout", expiredCtx, errors.New("pq: canceling statement due to user request"), ErrorTimeout},
+		{"driver error after cancellation", canceledCtx, errors.New("pq: canceling statement due to user request"), ErrorCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ErrorTypeOf(tt.ctx, tt.err))
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+
+	"github.com/sapcc/hermes/pkg/query"
+)
+
+// EventMatcher checks events against the criteria of an EventFilter in
+// memory, e.g. for matching the events read by a single query against many
+// filters. It compares values like the SQL drivers do: exactly, or as prefix
+// if the value ends with *, and query terms without a field match any part
+// of the searched fields, ignoring case. The time range of the filter is
+// ignored, only the time comparisons of the search query are checked.
+type EventMatcher struct {
+	conditions []matchCondition
+	search     query.Expr
+}
+
+// matchCondition is the condition of a filter with comma-separated values,
+// see sqliteFilterCondition.
+type matchCondition struct {
+	field         sqliteField
+	values        []string
+	negatedValues []string
+}
+
+// MatchEvent is an event prepared for EventMatcher.Match, so that it is only
+// decoded once for all matchers.
+type MatchEvent struct {
+	object     map[string]any
+	eventTime  time.Time
+	searchText string
+}
+
+// NewEventMatcher returns a matcher for the criteria of the filter. It fails
+// if the search query of the filter is invalid.
+func NewEventMatcher(filter *EventFilter) (*EventMatcher, error) {
+	var m EventMatcher
+	filters := []struct {
+		value string
+		name  string
+	}{
+		{filter.ObserverType, "observer_type"},
+		{filter.TargetType, "target_type"},
+		{filter.TargetID, "target_id"},
+		{filter.InitiatorType, "initiator_type"},
+		{filter.InitiatorID, "initiator_id"},
+		{filter.InitiatorName, "initiator_name"},
+		{filter.Action, "action"},
+		{filter.Outcome, "outcome"},
+		{filter.RequestPath, "request_path"},
+		{filter.TargetName, "target_name"},
+		{filter.InitiatorAddress, "initiator_address"},
+		{filter.Tag, "tag"},
+	}
+	for _, f := range filters {
+		if f.value == "" {
+			continue
+		}
+		condition := matchCondition{field: sqliteFieldMapping[f.name]}
+		for value := range strings.SplitSeq(f.value, ",") {
+			value = strings.TrimSpace(value)
+			if negatedValue, isNegated := strings.CutPrefix(value, "!"); isNegated {
+				condition.negatedValues = append(condition.negatedValues, negatedValue)
+			} else {
+				condition.values = append(condition.values, value)
+			}
+		}
+		m.conditions = append(m.conditions, condition)
+	}
+
+	if filter.Search != "" {
+		expr, err := query.Parse(filter.Search)
+		if err != nil {
+			return nil, err
+		}
+		err = checkSearchFields(expr)
+		if err != nil {
+			return nil, err
+		}
+		m.search = expr
+	}
+	return &m, nil
+}
+
+// checkSearchFields rejects the terms of a search query that cannot be
+// matched, like sqliteSearchCondition does.
+func checkSearchFields(expr query.Expr) error {
+	switch expr := expr.(type) {
+	case query.And:
+		return checkAllSearchFields(expr)
+	case query.Or:
+		return checkAllSearchFields(expr)
+	case query.Not:
+		return checkSearchFields(expr.Expr)
+	case query.Match:
+		if _, ok := sqliteFieldMapping[expr.Field]; expr.Field != "" && !ok {
+			return fmt.Errorf("cannot search field %s", expr.Field)
+		}
+		return nil
+	case query.Range:
+		if expr.Field != "time" {
+			return fmt.Errorf("cannot compare field %s", expr.Field)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected search expression %T", expr)
+	}
+}
+
+func checkAllSearchFields(operands []query.Expr) error {
+	for _, operand := range operands {
+		err := checkSearchFields(operand)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMatchEvent prepares an event with its tags for EventMatcher.Match.
+func NewMatchEvent(event *cadf.Event, tags []string) (MatchEvent, error) {
+	payload, err := json.Marshal(eventDocument{Event: event, Tags: tags})
+	if err != nil {
+		return MatchEvent{}, err
+	}
+	var result MatchEvent
+	err = json.Unmarshal(payload, &result.object)
+	if err != nil {
+		return MatchEvent{}, err
+	}
+	result.searchText, err = eventSearchText(payload)
+	if err != nil {
+		return MatchEvent{}, err
+	}
+	result.eventTime, err = time.Parse(time.RFC3339Nano, event.EventTime)
+	if err != nil {
+		return MatchEvent{}, fmt.Errorf("invalid eventTime %q: %w", event.EventTime, err)
+	}
+	return result, nil
+}
+
+// Match reports whether the event matches all criteria.
+func (m *EventMatcher) Match(event MatchEvent) bool {
+	for _, condition := range m.conditions {
+		if len(condition.values) > 0 && !event.matchesAny(condition.field, condition.values) {
+			return false
+		}
+		if len(condition.negatedValues) > 0 && event.matchesAny(condition.field, condition.negatedValues) {
+			return false
+		}
+	}
+	return m.search == nil || event.matchesSearch(m.search, time.Now())
+}
+
+// matchesAny reports whether a value of the field is one of the given values.
+// Missing values are empty, like in sqliteField.valueExpr.
+func (e MatchEvent) matchesAny(field sqliteField, values []string) bool {
+	fieldValue, found := lookupJSONPath(e.object, strings.Split(strings.TrimPrefix(field.jsonPath, "$."), "."))
+	var fieldValues []string
+	switch {
+	case field.multiValued:
+		elements, _ := fieldValue.([]any)
+		for _, element := range elements {
+			if text, isText := element.(string); isText {
+				fieldValues = append(fieldValues, text)
+			}
+		}
+	case found:
+		text, _ := fieldValue.(string)
+		fieldValues = []string{text}
+	default:
+		fieldValues = []string{""}
+	}
+
+	for _, fieldValue := range fieldValues {
+		for _, value := range values {
+			if prefix, isPrefix := strings.CutSuffix(value, "*"); isPrefix {
+				if strings.HasPrefix(fieldValue, prefix) {
+					return true
+				}
+			} else if fieldValue == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesSearch evaluates a query of the search language.
+func (e MatchEvent) matchesSearch(expr query.Expr, now time.Time) bool {
+	switch expr := expr.(type) {
+	case query.And:
+		for _, operand := range expr {
+			if !e.matchesSearch(operand, now) {
+				return false
+			}
+		}
+		return true
+	case query.Or:
+		for _, operand := range expr {
+			if e.matchesSearch(operand, now) {
+				return true
+			}
+		}
+		return false
+	case query.Not:
+		return !e.matchesSearch(expr.Expr, now)
+	case query.Match:
+		if expr.Field == "" {
+			return strings.Contains(e.searchText, strings.ToLower(expr.Value))
+		}
+		value := expr.Value
+		if expr.Prefix {
+			value += "*"
+		}
+		return e.matchesAny(sqliteFieldMapping[expr.Field], []string{value})
+	case query.Range:
+		t, err := query.ParseTime(expr.Value, now)
+		if err != nil {
+			return false
+		}
+		switch expr.Operator {
+		case "lt":
+			return e.eventTime.Before(t)
+		case "lte":
+			return !e.eventTime.After(t)
+		case "gt":
+			return e.eventTime.After(t)
+		case "gte":
+			return !e.eventTime.Before(t)
+		}
+		return false
+	default:
+		return false
+	}
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventMatcher(t *testing.T) {
+	event := &cadf.Event{
+		ID:        "e1",
+		EventTime: "2017-11-17T08:53:32.667973+00:00",
+		Action:    "delete",
+		Outcome:   "success",
+		Initiator: cadf.Resource{TypeURI: "service/security/account/user", ID: "u1", Name: "Alice"},
+		Target:    cadf.Resource{TypeURI: "compute/server", ID: "s1", Name: "web-01"},
+	}
+	matchEvent, err := NewMatchEvent(event, []string{"admin", "cli"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		filter EventFilter
+		match  bool
+	}{
+		{"NoCriteria", EventFilter{}, true},
+		{"Value", EventFilter{Action: "delete"}, true},
+		{"OtherValue", EventFilter{Action: "update"}, false},
+		{"AnyValue", EventFilter{Action: "update,delete"}, true},
+		{"NegatedValue", EventFilter{Action: "!delete"}, false},
+		{"OtherNegatedValue", EventFilter{Action: "!update"}, true},
+		{"Prefix", EventFilter{TargetType: "compute/*"}, true},
+		{"CaseSensitive", EventFilter{InitiatorName: "alice"}, false},
+		{"AllCriteria", EventFilter{Action: "delete", Outcome: "failure"}, false},
+		{"MissingValue", EventFilter{InitiatorAddress: "!10.0.0.1"}, true},
+		{"Tag", EventFilter{Tag: "cli"}, true},
+		{"OtherTag", EventFilter{Tag: "!admin"}, false},
+		{"SearchWord", EventFilter{Search: "alice"}, true},
+		{"SearchPartOfWord", EventFilter{Search: "web"}, true},
+		{"SearchOtherWord", EventFilter{Search: "bob"}, false},
+		{"SearchField", EventFilter{Search: "target_id:s1 AND NOT outcome:failure"}, true},
+		{"SearchOr", EventFilter{Search: "action:update OR tag:adm*"}, true},
+		{"SearchTime", EventFilter{Search: "time:>=2017-11-17T00:00:00Z"}, true},
+		{"SearchOtherTime", EventFilter{Search: "time:<2017-11-17T00:00:00Z"}, false},
+		{"TimeIgnored", EventFilter{Time: map[string]string{"lt": "2017-01-01T00:00:00Z"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := NewEventMatcher(&tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.match, matcher.Match(matchEvent))
+		})
+	}
+
+	_, err = NewEventMatcher(&EventFilter{Search: "action:"})
+	assert.Error(t, err)
+}
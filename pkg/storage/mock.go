@@ -4,20 +4,31 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/sapcc/go-api-declarations/cadf"
 )
 
+func init() {
+	RegisterDriver("mock", func() (Storage, error) {
+		return Mock{}, nil
+	})
+}
+
 // Mock elasticsearch driver with static data
 type Mock struct{}
 
 // GetEvents mock with static data
-func (m Mock) GetEvents(filter *EventFilter, tenantID string) ([]*cadf.Event, int, error) {
+func (m Mock) GetEvents(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error) {
 	var detailedEvents eventListWithTotal
 	err := json.Unmarshal(mockEvents, &detailedEvents)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	var events []*cadf.Event
@@ -26,11 +37,39 @@ func (m Mock) GetEvents(filter *EventFilter, tenantID string) ([]*cadf.Event, in
 		events = append(events, &detailedEvents.Events[i])
 	}
 
-	return events, detailedEvents.Total, nil
+	page := EventPage{Events: events, Total: detailedEvents.Total}
+	// the events of several tenants are spread evenly over them
+	if strings.Contains(tenantID, ",") {
+		tenantIDs := strings.Split(tenantID, ",")
+		for idx := range events {
+			page.TenantIDs = append(page.TenantIDs, tenantIDs[idx%len(tenantIDs)])
+		}
+	}
+	return &page, nil
+}
+
+// RecordsIngestTime implements the IngestTimeRecorder interface.
+func (m Mock) RecordsIngestTime() bool {
+	return true
+}
+
+// StreamEvents mock with static data
+func (m Mock) StreamEvents(ctx context.Context, filter *EventFilter, tenantID string, fn func(*cadf.Event) error) error {
+	page, err := m.GetEvents(ctx, filter, tenantID)
+	if err != nil {
+		return err
+	}
+	for _, event := range page.Events {
+		err := fn(event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetEvent Mock with static data
-func (m Mock) GetEvent(eventID, tenantID string) (*cadf.Event, error) {
+func (m Mock) GetEvent(ctx context.Context, eventID, tenantID string) (*cadf.Event, error) {
 	var parsedEvent cadf.Event
 	err := json.Unmarshal(mockEvent, &parsedEvent)
 	return &parsedEvent, err
@@ -42,12 +81,381 @@ func (m Mock) MaxLimit() uint {
 }
 
 // GetAttributes Mock
-func (m Mock) GetAttributes(filter *AttributeFilter, tenantID string) ([]string, error) {
+func (m Mock) GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string) ([]string, error) {
 	var parsedAttribute []string
 	err := json.Unmarshal(mockAttributes, &parsedAttribute)
 	return parsedAttribute, err
 }
 
+// CountEvents Mock, groups the static events
+func (m Mock) CountEvents(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint) (*EventCounts, error) {
+	page, err := m.GetEvents(ctx, filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := EventCounts{Total: len(page.Events)}
+	groupIndex := make(map[string]int)
+	for _, event := range page.Events {
+		values := make([]string, len(groupBy))
+		for idx, field := range groupBy {
+			values[idx] = mockFieldValue(event, field)
+		}
+		key := strings.Join(values, "\x00")
+		if idx, exists := groupIndex[key]; exists {
+			result.Groups[idx].Count++
+			continue
+		}
+		groupIndex[key] = len(result.Groups)
+		result.Groups = append(result.Groups, EventGroup{Values: values, Count: 1})
+	}
+
+	sort.SliceStable(result.Groups, func(i, j int) bool {
+		return result.Groups[i].Count > result.Groups[j].Count
+	})
+	if uint(len(result.Groups)) > limit {
+		result.Groups = result.Groups[:limit]
+	}
+	return &result, nil
+}
+
+// HistogramEvents mock with static data
+func (m Mock) HistogramEvents(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*EventHistogram, error) {
+	page, err := m.GetEvents(ctx, filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := EventHistogram{Total: len(page.Events)}
+	counts := make(map[time.Time]*EventCounts)
+	var first, last time.Time
+	for _, event := range page.Events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.EventTime)
+		if err != nil {
+			return nil, err
+		}
+		start := eventTime.UTC().Truncate(interval)
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+		if counts[start] == nil {
+			counts[start] = &EventCounts{}
+		}
+		counts[start].Total++
+		if splitBy != "" {
+			value := mockFieldValue(event, splitBy)
+			found := false
+			for idx, group := range counts[start].Groups {
+				if group.Values[0] == value {
+					counts[start].Groups[idx].Count++
+					found = true
+				}
+			}
+			if !found {
+				counts[start].Groups = append(counts[start].Groups, EventGroup{Values: []string{value}, Count: 1})
+			}
+		}
+	}
+	if first.IsZero() {
+		return &result, nil
+	}
+
+	for start := first; !start.After(last); start = start.Add(interval) {
+		bucket := HistogramBucket{Start: start}
+		if count, exists := counts[start]; exists {
+			bucket.Count = count.Total
+			bucket.Groups = count.Groups
+			sort.SliceStable(bucket.Groups, func(i, j int) bool {
+				return bucket.Groups[i].Count > bucket.Groups[j].Count
+			})
+			if uint(len(bucket.Groups)) > splitLimit {
+				bucket.Groups = bucket.Groups[:splitLimit]
+			}
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	return &result, nil
+}
+
+// mockFieldValue returns the value of an event for a field name used in the API.
+func mockFieldValue(event *cadf.Event, field string) string {
+	switch field {
+	case "action":
+		return string(event.Action)
+	case "outcome":
+		return string(event.Outcome)
+	case "request_path":
+		return event.RequestPath
+	case "observer_id":
+		return event.Observer.ID
+	case "observer_type":
+		return event.Observer.TypeURI
+	case "target_id":
+		return event.Target.ID
+	case "target_type":
+		return event.Target.TypeURI
+	case "initiator_id":
+		return event.Initiator.ID
+	case "initiator_type":
+		return event.Initiator.TypeURI
+	case "initiator_name":
+		return event.Initiator.Name
+	case "initiator_address":
+		if event.Initiator.Host == nil {
+			return ""
+		}
+		return event.Initiator.Host.Address
+	case "target_name":
+		return event.Target.Name
+	default:
+		return ""
+	}
+}
+
+// WriteEvents Mock, accepts all events without storing them
+func (m Mock) WriteEvents(ctx context.Context, events []TenantEvent) ([]error, error) {
+	return make([]error, len(events)), nil
+}
+
+// ListExportConfigs Mock with static data
+func (m Mock) ListExportConfigs(ctx context.Context) ([]ExportConfig, error) {
+	var config ExportConfig
+	err := json.Unmarshal(mockExportConfig, &config)
+	return []ExportConfig{config}, err
+}
+
+// GetExportConfig Mock with static data, returned for any project
+func (m Mock) GetExportConfig(ctx context.Context, projectID string) (*ExportConfig, error) {
+	var config ExportConfig
+	err := json.Unmarshal(mockExportConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+	config.ProjectID = projectID
+	return &config, nil
+}
+
+// SaveExportConfig Mock, does not persist anything
+func (m Mock) SaveExportConfig(ctx context.Context, config ExportConfig) error {
+	return nil
+}
+
+// DeleteExportConfig Mock, does not persist anything
+func (m Mock) DeleteExportConfig(ctx context.Context, projectID string) error {
+	return nil
+}
+
+// UpdateExportLastRunTime Mock, does not persist anything
+func (m Mock) UpdateExportLastRunTime(ctx context.Context, projectID string, lastRunTime time.Time) error {
+	return nil
+}
+
+// ListSubscriptions Mock with static data, returned for any project
+func (m Mock) ListSubscriptions(ctx context.Context, projectID string) ([]Subscription, error) {
+	subscription, err := m.GetSubscription(ctx, projectID, mockSubscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return []Subscription{*subscription}, nil
+}
+
+// GetSubscription Mock with static data, returned for any project
+func (m Mock) GetSubscription(ctx context.Context, projectID, subscriptionID string) (*Subscription, error) {
+	if subscriptionID != mockSubscriptionID {
+		return nil, nil
+	}
+	var subscription Subscription
+	err := json.Unmarshal(mockSubscription, &subscription)
+	if err != nil {
+		return nil, err
+	}
+	if projectID != "" {
+		subscription.ProjectID = projectID
+	}
+	return &subscription, nil
+}
+
+// SaveSubscription Mock, does not persist anything
+func (m Mock) SaveSubscription(ctx context.Context, subscription Subscription) error {
+	return nil
+}
+
+// UpdateSubscription Mock, does not persist anything
+func (m Mock) UpdateSubscription(ctx context.Context, subscription Subscription) error {
+	if subscription.ID != mockSubscriptionID {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// DeleteSubscription Mock, does not persist anything
+func (m Mock) DeleteSubscription(ctx context.Context, projectID, subscriptionID string) error {
+	return nil
+}
+
+// UpdateSubscriptionProgress Mock, does not persist anything
+func (m Mock) UpdateSubscriptionProgress(ctx context.Context, subscriptionID, lastEventID string) error {
+	return nil
+}
+
+// SaveDelivery Mock, does not persist anything
+func (m Mock) SaveDelivery(ctx context.Context, delivery Delivery) error {
+	return nil
+}
+
+// ListDeliveries Mock with static data
+func (m Mock) ListDeliveries(ctx context.Context, subscriptionID string, limit uint) ([]Delivery, error) {
+	var deliveries []Delivery
+	err := json.Unmarshal(mockDeliveries, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries[:min(uint(len(deliveries)), limit)], nil
+}
+
+// PruneDeliveries Mock, does not persist anything
+func (m Mock) PruneDeliveries(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// ListSavedSearches Mock with static data, returned for any project
+func (m Mock) ListSavedSearches(ctx context.Context, projectID string) ([]SavedSearch, error) {
+	var searches []SavedSearch
+	err := json.Unmarshal(mockSavedSearches, &searches)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range searches {
+		searches[idx].ProjectID = projectID
+	}
+	return searches, nil
+}
+
+// GetSavedSearch Mock with static data, returned for any project
+func (m Mock) GetSavedSearch(ctx context.Context, projectID, searchID string) (*SavedSearch, error) {
+	searches, err := m.ListSavedSearches(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, search := range searches {
+		if search.ID == searchID {
+			return &search, nil
+		}
+	}
+	return nil, nil
+}
+
+// SaveSavedSearch Mock, does not persist anything
+func (m Mock) SaveSavedSearch(ctx context.Context, search SavedSearch) error {
+	return nil
+}
+
+// DeleteSavedSearch Mock, does not persist anything
+func (m Mock) DeleteSavedSearch(ctx context.Context, projectID, searchID string) error {
+	return nil
+}
+
+// ListTenants Mock with static data
+func (m Mock) ListTenants(ctx context.Context) ([]string, error) {
+	anchors, err := m.ListAnchors(ctx, "", time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var tenantIDs []string
+	for _, anchor := range anchors {
+		tenantIDs = append(tenantIDs, anchor.TenantID)
+	}
+	return slices.Compact(tenantIDs), nil
+}
+
+// StreamEventDocuments Mock with the static events of StreamEvents
+func (m Mock) StreamEventDocuments(ctx context.Context, filter *EventFilter, tenantID string, fn func(eventID string, document json.RawMessage) error) error {
+	return m.StreamEvents(ctx, filter, tenantID, func(event *cadf.Event) error {
+		document, err := json.Marshal(eventDocument{Event: event})
+		if err != nil {
+			return err
+		}
+		return fn(event.ID, document)
+	})
+}
+
+// GetEventDocuments Mock with the static event of GetEvent, returned for any tenant
+func (m Mock) GetEventDocuments(ctx context.Context, tenantID string, events []*cadf.Event) (map[string]json.RawMessage, error) {
+	event, err := m.GetEvent(ctx, "", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	documents := make(map[string]json.RawMessage)
+	for _, e := range events {
+		if e.ID == event.ID {
+			documents[e.ID] = mockEvent
+		}
+	}
+	return documents, nil
+}
+
+// ListAnchors Mock with static data
+func (m Mock) ListAnchors(ctx context.Context, tenantID string, from, to time.Time) ([]Anchor, error) {
+	var anchors []Anchor
+	err := json.Unmarshal(mockAnchors, &anchors)
+	if err != nil {
+		return nil, err
+	}
+	var result []Anchor
+	for _, anchor := range anchors {
+		if (tenantID == "" || anchor.TenantID == tenantID) && !anchor.SealedAt.Before(from) && anchor.SealedAt.Before(to) {
+			result = append(result, anchor)
+		}
+	}
+	return result, nil
+}
+
+// FindAnchors Mock with static data
+func (m Mock) FindAnchors(ctx context.Context, tenantID string, eventIDs []string) ([]Anchor, error) {
+	anchors, err := m.ListAnchors(ctx, tenantID, time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var result []Anchor
+	for _, anchor := range anchors {
+		if slices.ContainsFunc(anchor.Digests, func(digest EventDigest) bool { return slices.Contains(eventIDs, digest.EventID) }) {
+			result = append(result, anchor)
+		}
+	}
+	return result, nil
+}
+
+// LastAnchor Mock with static data
+func (m Mock) LastAnchor(ctx context.Context, tenantID string) (*Anchor, error) {
+	anchors, err := m.ListAnchors(ctx, tenantID, time.Time{}, time.Now())
+	if err != nil || len(anchors) == 0 {
+		return nil, err
+	}
+	return &anchors[len(anchors)-1], nil
+}
+
+// GetAnchor Mock with static data
+func (m Mock) GetAnchor(ctx context.Context, tenantID string, sequence int) (*Anchor, error) {
+	anchors, err := m.ListAnchors(ctx, tenantID, time.Time{}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, anchor := range anchors {
+		if anchor.Sequence == sequence {
+			return &anchor, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateAnchor Mock, does not persist anything
+func (m Mock) CreateAnchor(ctx context.Context, anchor Anchor) error {
+	return nil
+}
+
 var mockEvent = []byte(`
 {
 
@@ -194,3 +602,131 @@ var mockAttributes = []byte(`
   "compute/keypairs"
 ]
 `)
+
+var mockExportConfig = []byte(`
+{
+  "project_id": "b3b70c8271a845709f9a03030e705da7",
+  "enabled": true,
+  "bucket_name": "b3b70c8271a845709f9a03030e705da7-audit",
+  "retention_days": 365,
+  "last_run_time": "2017-11-17T09:00:00Z",
+  "filters": {
+    "resource_types": ["identity", "network/floatingip"],
+    "exclude_event_types": ["read"]
+  }
+}
+`)
+
+const mockSubscriptionID = "5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21"
+
+var mockSubscription = []byte(`
+{
+  "id": "5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21",
+  "project_id": "b3b70c8271a845709f9a03030e705da7",
+  "url": "https://hooks.example.com/audit",
+  "secret": "mock-secret",
+  "enabled": true,
+  "filter": {
+    "action": "delete",
+    "target_type": "service/security/account/user"
+  },
+  "created_at": "2017-11-17T09:00:00Z",
+  "updated_at": "2017-11-17T09:00:00Z",
+  "last_event_id": "2017-11-17T08:53:32.667Z/7be6c4ff-b761-5f1f-b234-f5d41616c2cd"
+}
+`)
+
+var mockDeliveries = []byte(`
+[
+  {
+    "id": "0d8a9b53-3f0e-4b5c-8d2c-6a3e9f1b2c47",
+    "subscription_id": "5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21",
+    "event_id": "7be6c4ff-b761-5f1f-b234-f5d41616c2cd",
+    "time": "2017-11-17T08:53:35Z",
+    "attempts": 1,
+    "success": true,
+    "status_code": 200
+  },
+  {
+    "id": "8f2c1e4d-9a7b-4c3e-b5d6-1e2f3a4b5c6d",
+    "subscription_id": "5b4e8fd1-6f5c-4f7e-9f37-2a1d3c0b7e21",
+    "event_id": "f6f0ebf3-bf59-553a-9e38-788f714ccc46",
+    "time": "2017-11-07T11:51:19Z",
+    "attempts": 6,
+    "success": false,
+    "status_code": 503,
+    "error": "503 Service Unavailable"
+  }
+]
+`)
+
+var mockSavedSearches = []byte(`
+[
+  {
+    "id": "0b6d3f5e-2c1a-4e8b-9f7d-3a5c1e9b7d24",
+    "project_id": "b3b70c8271a845709f9a03030e705da7",
+    "name": "Deleted users",
+    "description": "Users deleted in the last week",
+    "created_by": "e9141fb24eee4b3e9f25ae69cda31132",
+    "filter": {
+      "action": "delete",
+      "target_type": "service/security/account/user",
+      "time": "gte:now-7d",
+      "sort": "time:desc"
+    },
+    "created_at": "2017-11-17T09:00:00Z",
+    "updated_at": "2017-11-17T09:00:00Z"
+  },
+  {
+    "id": "7e1c9a4b-5d3f-4b2e-8c6a-1f9e7d5b3a68",
+    "project_id": "b3b70c8271a845709f9a03030e705da7",
+    "name": "My failed requests",
+    "user_id": "e9141fb24eee4b3e9f25ae69cda31132",
+    "created_by": "e9141fb24eee4b3e9f25ae69cda31132",
+    "filter": {
+      "initiator_id": "e9141fb24eee4b3e9f25ae69cda31132",
+      "outcome": "failure",
+      "time": "gte:now-1d"
+    },
+    "created_at": "2017-11-18T10:30:00Z",
+    "updated_at": "2017-11-18T10:30:00Z"
+  }
+]
+`)
+
+var mockAnchors = []byte(`
+[
+  {
+    "tenant_id": "b3b70c8271a845709f9a03030e705da7",
+    "sequence": 2,
+    "digests": [
+      {
+        "event_id": "49e2084a-b81c-51f1-9822-78cdd31d0944",
+        "event_time": "2017-11-06T10:11:21.605421+00:00",
+        "hash": "421d1b56152cf76d415d4c8272ce0242623b80c3b65212baaa55a7fff471f3af"
+      },
+      {
+        "event_id": "7be6c4ff-b761-5f1f-b234-f5d41616c2cd",
+        "event_time": "2017-11-17T08:53:32.667973+00:00",
+        "hash": "13e7b9bb86d4b21c85446f89a0f696c1e9e7d910017c46a7c1d46e4043d10d7a"
+      },
+      {
+        "event_id": "eae03aad-86ab-574e-b428-f9dd58e5a715",
+        "event_time": "2017-11-06T10:15:56.984390+00:00",
+        "hash": "a93afb60b8e4a5711c7970e8d87248722094d730dc969c176b99f4add39c060f"
+      },
+      {
+        "event_id": "f6f0ebf3-bf59-553a-9e38-788f714ccc46",
+        "event_time": "2017-11-07T11:46:19.448565+00:00",
+        "hash": "98c53c07d053f1ee5881194c75fa1111f8ed6bd3d512009240060113b0148258"
+      }
+    ],
+    "tree_size": 4,
+    "root_hash": "ce9b9848c83177745e6cc61f83508a3981e61d0115262e438458bffb478e81fd",
+    "previous_hash": "33c75255d49c006e16262cef536c878a8da6e4f6f15121903443037b06c25aa1",
+    "hash": "45e32117977a45f93e89dd21e5726dd57e5b33c8d845540dc584d4661cd8c1d0",
+    "signature": "a2075743c5c13f9de44dbcc2058c242164f9513404d018d2ae9884fddfd59947",
+    "sealed_at": "2017-11-17T08:53:33Z"
+  }
+]
+`)
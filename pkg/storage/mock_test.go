@@ -4,6 +4,7 @@
 package storage
 
 import (
+	"context"
 	"testing"
 
 	"github.com/sapcc/go-api-declarations/cadf"
@@ -12,7 +13,7 @@ import (
 
 func Test_MockStorage_EventDetail(t *testing.T) {
 	// both params are ignored
-	eventDetail, err := Mock{}.GetEvent("d5eed458-6666-58ec-ad06-8d3cf6bafca1", "b3b70c8271a845709f9a03030e705da7")
+	eventDetail, err := Mock{}.GetEvent(context.Background(), "d5eed458-6666-58ec-ad06-8d3cf6bafca1", "b3b70c8271a845709f9a03030e705da7")
 	assert.Nil(t, err)
 	tt := []struct {
 		name     string
@@ -39,18 +40,31 @@ func Test_MockStorage_EventDetail(t *testing.T) {
 }
 
 func Test_MockStorage_Events(t *testing.T) {
-	eventsList, total, err := Mock{}.GetEvents(&EventFilter{}, "b3b70c8271a845709f9a03030e705da7")
+	page, err := Mock{}.GetEvents(context.Background(), &EventFilter{}, "b3b70c8271a845709f9a03030e705da7")
 
 	assert.Nil(t, err)
-	assert.Equal(t, total, 4)
+	eventsList := page.Events
+	assert.Equal(t, page.Total, 4)
 	assert.Equal(t, len(eventsList), 4)
 	assert.Equal(t, cadf.SuccessOutcome, eventsList[0].Outcome)
 	assert.Equal(t, "f6f0ebf3-bf59-553a-9e38-788f714ccc46", eventsList[1].ID)
 	assert.Equal(t, "2017-11-06T10:15:56.984390+00:00", eventsList[2].EventTime)
 }
 
+func Test_MockStorage_StreamEvents(t *testing.T) {
+	var ids []string
+	err := Mock{}.StreamEvents(context.Background(), &EventFilter{}, "b3b70c8271a845709f9a03030e705da7", func(event *cadf.Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, "f6f0ebf3-bf59-553a-9e38-788f714ccc46", ids[1])
+}
+
 func Test_MockStorage__Attributes(t *testing.T) {
-	attributesList, err := Mock{}.GetAttributes(&AttributeFilter{}, "b3b70c8271a845709f9a03030e705da7")
+	attributesList, err := Mock{}.GetAttributes(context.Background(), &AttributeFilter{}, "b3b70c8271a845709f9a03030e705da7")
 
 	assert.Nil(t, err)
 	assert.Equal(t, len(attributesList), 6)
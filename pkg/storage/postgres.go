@@ -0,0 +1,319 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	RegisterDriver("postgres", func() (Storage, error) {
+		return NewPostgres(viper.GetString("postgres.url"))
+	})
+}
+
+// Postgres stores events in a PostgreSQL database. The events are stored as
+// JSONB in a table which is partitioned by the hash of the tenant ID, so that
+// the events of a tenant are kept together like in the per-tenant indexes of
+// ElasticSearch.
+//
+// Unlike ElasticSearch, search terms without a field match substrings of the
+// searched fields, ignoring case, instead of words.
+type Postgres struct {
+	db *sql.DB
+}
+
+// postgresPartitions is the number of partitions of the events table. It
+// cannot be changed without a migration that moves all events.
+const postgresPartitions = 16
+
+// postgresMigrations is the database schema in the format expected by
+// easypg. The schema is applied with "hermes migrate" (see MigratePostgres).
+var postgresMigrations = map[string]string{
+	"001_initial.up.sql": fmt.Sprintf(`
+		CREATE TABLE events (
+			tenant_id   TEXT        NOT NULL,
+			id          TEXT        NOT NULL,
+			seq         BIGSERIAL   NOT NULL,
+			event_time  TIMESTAMPTZ NOT NULL,
+			payload     JSONB       NOT NULL,
+			search_text TEXT        NOT NULL,
+			PRIMARY KEY (tenant_id, id)
+		) PARTITION BY HASH (tenant_id);
+		DO $$
+		BEGIN
+			FOR i IN 0..%[1]d LOOP
+				EXECUTE format('CREATE TABLE events_%%s PARTITION OF events FOR VALUES WITH (MODULUS %[2]d, REMAINDER %%s)', i, i);
+			END LOOP;
+		END $$;
+		CREATE INDEX events_tenant_time ON events (tenant_id, event_time);
+		CREATE INDEX events_payload ON events USING GIN (payload jsonb_path_ops);
+	`, postgresPartitions-1, postgresPartitions),
+	"001_initial.down.sql": `
+		DROP TABLE events;
+	`,
+}
+
+// postgresSchemaVersion is the number of the last migration.
+const postgresSchemaVersion = 1
+
+// MigratePostgres creates or updates the schema of the Postgres database at
+// the given URL, and creates the database if it does not exist yet.
+func MigratePostgres(dbURL string) error {
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		return fmt.Errorf("malformed Postgres URL: %w", err)
+	}
+	db, err := easypg.Connect(*parsedURL, easypg.Configuration{Migrations: postgresMigrations})
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// NewPostgres connects to the Postgres database at the given URL. The schema
+// must be up to date, see MigratePostgres.
+func NewPostgres(dbURL string) (*Postgres, error) {
+	if dbURL == "" {
+		return nil, errors.New("missing URL of the Postgres database")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		version int
+		dirty   bool
+	)
+	err = db.QueryRow(`SELECT version, dirty FROM schema_migrations`).Scan(&version, &dirty)
+	if err == nil && (dirty || version != postgresSchemaVersion) {
+		err = fmt.Errorf("found schema version %d, expected %d", version, postgresSchemaVersion)
+	}
+	if err != nil {
+		db.Close() //nolint:errcheck // the schema error is more useful
+		return nil, fmt.Errorf(`database schema is not up to date, run "hermes migrate": %w`, err)
+	}
+	return &Postgres{db: db}, nil
+}
+
+// pgErrorType classifies the errors reported by Postgres, see ErrorTypeOf.
+func pgErrorType(err error) (ErrorType, bool) {
+	pqErr, ok := errext.As[*pq.Error](err)
+	if !ok {
+		return ErrorNone, false
+	}
+	switch {
+	case pqErr.Code == "57014": // query_canceled, e.g. by statement_timeout
+		return ErrorTimeout, true
+	case pqErr.Code.Class() == "08", pqErr.Code.Class() == "53", pqErr.Code.Class() == "57":
+		// connection exception, insufficient resources, operator intervention
+		return ErrorUnavailable, true
+	case pqErr.Code.Class() == "22": // data exception
+		return ErrorBadData, true
+	default:
+		return ErrorExec, true
+	}
+}
+
+// Close closes the database connections.
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// GetEvents implements the Storage interface.
+func (p *Postgres) GetEvents(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error) {
+	var q pgQuery
+	where, err := q.eventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := pgOrderBy(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := filter.Offset
+	var cursor sqlCursor
+	if filter.UseCursor {
+		if filter.Cursor == "" {
+			cursor.TenantID = tenantID
+			err := p.db.QueryRowContext(ctx, `SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM events_seq_seq`).Scan(&cursor.MaxRowID)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			cursor, err = decodeSQLCursor(filter.Cursor, tenantID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		where += " AND events.seq <= " + q.arg(cursor.MaxRowID)
+		offset = cursor.Offset
+	}
+
+	var page EventPage
+	err = p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE `+where, q.args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT tenant_id, payload FROM events WHERE ` + where + ` ORDER BY ` + orderBy
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + q.arg(filter.Limit)
+	}
+	query += ` OFFSET ` + q.arg(offset)
+	rows, err := p.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	withTenants := tenantID == "" || strings.Contains(tenantID, ",")
+	for rows.Next() {
+		doc, eventTenantID, err := scanPostgresEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Events = append(page.Events, doc.Event)
+		page.Tags = append(page.Tags, doc.Tags)
+		if withTenants {
+			page.TenantIDs = append(page.TenantIDs, eventTenantID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter.UseCursor && filter.Limit > 0 && uint(len(page.Events)) == filter.Limit {
+		cursor.Offset = offset + filter.Limit
+		page.NextCursor, err = cursor.encode()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &page, nil
+}
+
+// scanPostgresEvent reads the tenant ID and the payload of an event.
+func scanPostgresEvent(rows *sql.Rows) (eventDocument, string, error) {
+	var (
+		tenantID string
+		payload  []byte
+	)
+	err := rows.Scan(&tenantID, &payload)
+	if err != nil {
+		return eventDocument{}, "", err
+	}
+	doc, err := decodeEventDocument(payload)
+	return doc, tenantID, err
+}
+
+// StreamEvents implements the Storage interface with a single query.
+func (p *Postgres) StreamEvents(ctx context.Context, filter *EventFilter, tenantID string, fn func(*cadf.Event) error) error {
+	var q pgQuery
+	where, err := q.eventConditions(filter, tenantID)
+	if err != nil {
+		return err
+	}
+	orderBy, err := pgOrderBy(filter)
+	if err != nil {
+		return err
+	}
+
+	rows, err := p.db.QueryContext(ctx, `SELECT tenant_id, payload FROM events WHERE `+where+` ORDER BY `+orderBy, q.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		doc, _, err := scanPostgresEvent(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(doc.Event)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetEvent implements the Storage interface.
+func (p *Postgres) GetEvent(ctx context.Context, eventID, tenantID string) (*cadf.Event, error) {
+	var q pgQuery
+	where := q.and(q.tenantCondition(tenantID), "events.id = "+q.arg(eventID))
+
+	rows, err := p.db.QueryContext(ctx, `SELECT tenant_id, payload FROM events WHERE `+where+` LIMIT 1`, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	doc, _, err := scanPostgresEvent(rows)
+	return doc.Event, err
+}
+
+// GetAttributes implements the Storage interface. The values are ordered by
+// the number of events having them, like in ElasticSearch.
+func (p *Postgres) GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string) ([]string, error) {
+	field, ok := pgFieldMapping[filter.QueryName]
+	if !ok {
+		logg.Debug("Attribute %s is not supported by Postgres", filter.QueryName)
+		return nil, nil
+	}
+
+	var q pgQuery
+	where := q.and(q.tenantCondition(tenantID), field.valueExpr()+" != ''")
+	query := `SELECT ` + field.valueExpr() + ` FROM ` + field.from() + ` WHERE ` + where +
+		` GROUP BY 1 ORDER BY COUNT(*) DESC, 1 LIMIT ` + q.arg(filter.Limit)
+	rows, err := p.db.QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unique []string
+	for rows.Next() {
+		var attribute string
+		err := rows.Scan(&attribute)
+		if err != nil {
+			return nil, err
+		}
+		// Hierarchical Depth Handling
+		if filter.MaxDepth != 0 {
+			parts := strings.Split(attribute, "/")
+			if uint(len(parts)) > filter.MaxDepth {
+				attribute = strings.Join(parts[:filter.MaxDepth], "/")
+			}
+		}
+		unique = append(unique, attribute)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return RemoveDuplicates(unique), nil
+}
+
+// MaxLimit implements the Storage interface.
+func (p *Postgres) MaxLimit() uint {
+	maxLimit := viper.GetInt("postgres.max_result_window")
+	if maxLimit < 0 {
+		return 0
+	}
+	return uint(maxLimit)
+}
@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgGroupFields returns the fields to group by, the FROM clause which they
+// need, and the conditions that skip events without a value, like in
+// ElasticSearch.
+func pgGroupFields(names []string) (fields []pgField, from, where string, err error) {
+	from = "events"
+	conditions := make([]string, len(names))
+	for idx, name := range names {
+		field, ok := pgFieldMapping[name]
+		if !ok {
+			return nil, "", "", fmt.Errorf("cannot group by %s", name)
+		}
+		if field.multiValued {
+			if from != "events" {
+				return nil, "", "", fmt.Errorf("cannot group by %s together with other multi-valued fields", name)
+			}
+			from = field.from()
+		}
+		conditions[idx] = field.valueExpr() + " != ''"
+		fields = append(fields, field)
+	}
+	return fields, from, strings.Join(conditions, " AND "), nil
+}
+
+// positions returns "1, 2, ..., count" for GROUP BY and ORDER BY clauses.
+func positions(count int) string {
+	list := make([]string, count)
+	for idx := range list {
+		list[idx] = strconv.Itoa(idx + 1)
+	}
+	return strings.Join(list, ", ")
+}
+
+// CountEvents implements the EventAggregator interface.
+func (p *Postgres) CountEvents(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint) (*EventCounts, error) {
+	if len(groupBy) == 0 {
+		return nil, errors.New("no fields to group by")
+	}
+	fields, from, hasValues, err := pgGroupFields(groupBy)
+	if err != nil {
+		return nil, err
+	}
+	var q pgQuery
+	where, err := q.eventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result EventCounts
+	err = p.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE `+where, q.args...).Scan(&result.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(fields))
+	for idx, field := range fields {
+		columns[idx] = field.valueExpr()
+	}
+	groupColumns := positions(len(fields))
+	rows, err := p.db.QueryContext(ctx, `SELECT `+strings.Join(columns, ", ")+`, COUNT(*) FROM `+from+
+		` WHERE `+where+` AND `+hasValues+` GROUP BY `+groupColumns+
+		` ORDER BY COUNT(*) DESC, `+groupColumns+` LIMIT `+q.arg(limit), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		group := EventGroup{Values: make([]string, len(fields))}
+		targets := make([]any, 0, len(fields)+1)
+		for idx := range group.Values {
+			targets = append(targets, &group.Values[idx])
+		}
+		err := rows.Scan(append(targets, &group.Count)...)
+		if err != nil {
+			return nil, err
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	return &result, rows.Err()
+}
+
+// HistogramEvents implements the EventAggregator interface.
+func (p *Postgres) HistogramEvents(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*EventHistogram, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("invalid histogram interval %s", interval)
+	}
+	seconds := int64(interval / time.Second)
+	var q pgQuery
+	where, err := q.eventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	bucketExpr := fmt.Sprintf("(floor(extract(epoch FROM events.event_time) / %d) * %d)::bigint", seconds, seconds)
+
+	counts := make(map[int64]*HistogramBucket)
+	rows, err := p.db.QueryContext(ctx, `SELECT `+bucketExpr+`, COUNT(*) FROM events WHERE `+where+` GROUP BY 1`, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result EventHistogram
+	for rows.Next() {
+		var (
+			start int64
+			count int
+		)
+		err := rows.Scan(&start, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[start] = &HistogramBucket{Start: time.Unix(start, 0).UTC(), Count: count}
+		result.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if splitBy != "" {
+		err := p.splitHistogram(ctx, counts, q, where, bucketExpr, splitBy, splitLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Buckets, err = fillHistogram(counts, filter, seconds)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// splitHistogram counts the events of each bucket by the values of a field,
+// and keeps the splitLimit most frequent values per bucket.
+func (p *Postgres) splitHistogram(ctx context.Context, counts map[int64]*HistogramBucket, q pgQuery, where, bucketExpr, splitBy string, splitLimit uint) error {
+	fields, from, hasValues, err := pgGroupFields([]string{splitBy})
+	if err != nil {
+		return fmt.Errorf("cannot split by %s", splitBy)
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT `+bucketExpr+`, `+fields[0].valueExpr()+`, COUNT(*) FROM `+from+
+		` WHERE `+where+` AND `+hasValues+` GROUP BY 1, 2 ORDER BY 1, 3 DESC, 2`, q.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			start int64
+			group = EventGroup{Values: make([]string, 1)}
+		)
+		err := rows.Scan(&start, &group.Values[0], &group.Count)
+		if err != nil {
+			return err
+		}
+		bucket := counts[start]
+		if bucket != nil && uint(len(bucket.Groups)) < splitLimit {
+			bucket.Groups = append(bucket.Groups, group)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,328 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/sapcc/hermes/pkg/query"
+)
+
+// pgField is a field of the events that can be filtered, sorted or counted by.
+// The event time is not a pgField, since it has its own column.
+type pgField struct {
+	path        []string // in the JSON payload
+	multiValued bool     // for JSON arrays like tags, which match if any element matches
+}
+
+// pathLiteral returns the path as a Postgres text array literal.
+func (f pgField) pathLiteral() string {
+	return "'{" + strings.Join(f.path, ",") + "}'"
+}
+
+// valueExpr returns the SQL expression for the value of the field. Missing
+// values are empty, like in SQLite. Multi-valued fields need the FROM clause
+// returned by from().
+func (f pgField) valueExpr() string {
+	if f.multiValued {
+		return "elem.value"
+	}
+	return "COALESCE(events.payload #>> " + f.pathLiteral() + ", '')"
+}
+
+// from returns the FROM clause for selecting valueExpr().
+func (f pgField) from() string {
+	if f.multiValued {
+		return "events, jsonb_array_elements_text(events.payload #> " + f.pathLiteral() + ") AS elem(value)"
+	}
+	return "events"
+}
+
+// containment returns a JSON document for the @> operator, which matches
+// events with the given value. Unlike comparing valueExpr(), this can use the
+// GIN index on the payload.
+func (f pgField) containment(value string) (string, error) {
+	var doc any = value
+	if f.multiValued {
+		doc = []string{value}
+	}
+	for idx := len(f.path) - 1; idx >= 0; idx-- {
+		doc = map[string]any{f.path[idx]: doc}
+	}
+	buf, err := json.Marshal(doc)
+	return string(buf), err
+}
+
+// pgFieldMapping maps the field names of the API to the fields of the stored
+// events, like esFieldMapping does for ElasticSearch.
+var pgFieldMapping = map[string]pgField{
+	"action":            {path: []string{"action"}},
+	"outcome":           {path: []string{"outcome"}},
+	"request_path":      {path: []string{"requestPath"}},
+	"observer_id":       {path: []string{"observer", "id"}},
+	"observer_type":     {path: []string{"observer", "typeURI"}},
+	"target_id":         {path: []string{"target", "id"}},
+	"target_type":       {path: []string{"target", "typeURI"}},
+	"initiator_id":      {path: []string{"initiator", "id"}},
+	"initiator_type":    {path: []string{"initiator", "typeURI"}},
+	"initiator_name":    {path: []string{"initiator", "name"}},
+	"initiator_address": {path: []string{"initiator", "host", "address"}},
+	"target_name":       {path: []string{"target", "name"}},
+	"tag":               {path: []string{"tags"}, multiValued: true},
+}
+
+// pgQuery collects the arguments of a query. Placeholders are numbered in
+// Postgres, so all conditions of a query must be built with the same pgQuery.
+type pgQuery struct {
+	args []any
+}
+
+// arg adds an argument and returns its placeholder.
+func (q *pgQuery) arg(value any) string {
+	q.args = append(q.args, value)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// and joins the non-empty conditions with AND.
+func (q *pgQuery) and(conditions ...string) string {
+	var nonEmpty []string
+	for _, condition := range conditions {
+		if condition != "" {
+			nonEmpty = append(nonEmpty, condition)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(nonEmpty, " AND ")
+}
+
+// tenantCondition restricts the events to the given tenants (all of them if
+// the tenant ID is empty), see the Storage interface. Comparing with a single
+// tenant ID lets Postgres read only the partition of that tenant.
+func (q *pgQuery) tenantCondition(tenantID string) string {
+	switch {
+	case tenantID == "":
+		return ""
+	case strings.Contains(tenantID, ","):
+		return "events.tenant_id = ANY(" + q.arg(pq.Array(strings.Split(tenantID, ","))) + ")"
+	default:
+		return "events.tenant_id = " + q.arg(tenantID)
+	}
+}
+
+// eventConditions builds the conditions for all filter criteria in the given
+// EventFilter, like eventQuery does for ElasticSearch.
+func (q *pgQuery) eventConditions(filter *EventFilter, tenantID string) (string, error) {
+	if len(filter.IngestTime) > 0 {
+		return "", ErrIngestTimeNotSupported
+	}
+	conditions := []string{q.tenantCondition(tenantID)}
+
+	filters := []struct {
+		value string
+		name  string
+	}{
+		{filter.ObserverType, "observer_type"},
+		{filter.TargetType, "target_type"},
+		{filter.TargetID, "target_id"},
+		{filter.InitiatorType, "initiator_type"},
+		{filter.InitiatorID, "initiator_id"},
+		{filter.InitiatorName, "initiator_name"},
+		{filter.Action, "action"},
+		{filter.Outcome, "outcome"},
+		{filter.RequestPath, "request_path"},
+		{filter.TargetName, "target_name"},
+		{filter.InitiatorAddress, "initiator_address"},
+		{filter.Tag, "tag"},
+	}
+	for _, f := range filters {
+		if f.value != "" {
+			condition, err := q.filterCondition(f.value, pgFieldMapping[f.name])
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+
+	// sorted, so that the placeholders are always numbered the same way
+	for _, operator := range slices.Sorted(maps.Keys(filter.Time)) {
+		condition, err := q.timeCondition(operator, filter.Time[operator])
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if filter.Search != "" {
+		expr, err := query.Parse(filter.Search)
+		if err != nil {
+			return "", err
+		}
+		if expr != nil {
+			condition, err := q.searchCondition(expr)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return q.and(conditions...), nil
+}
+
+// filterCondition returns the condition for a filter with comma-separated
+// values like FilterQuery does: events must have one of the values (if any),
+// and none of the negated values. Values ending with * are prefixes.
+func (q *pgQuery) filterCondition(filter string, field pgField) (string, error) {
+	var values, negatedValues []string
+	for value := range strings.SplitSeq(filter, ",") {
+		value = strings.TrimSpace(value)
+		if negatedValue, isNegated := strings.CutPrefix(value, "!"); isNegated {
+			negatedValues = append(negatedValues, negatedValue)
+		} else {
+			values = append(values, value)
+		}
+	}
+
+	var conditions []string
+	if len(values) > 0 {
+		condition, err := q.matchCondition(field, values)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(negatedValues) > 0 {
+		condition, err := q.matchCondition(field, negatedValues)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, "NOT "+condition)
+	}
+	return q.and(conditions...), nil
+}
+
+// matchCondition returns a condition that matches any of the values.
+func (q *pgQuery) matchCondition(field pgField, values []string) (string, error) {
+	clauses := make([]string, len(values))
+	for idx, value := range values {
+		prefix, isPrefix := strings.CutSuffix(value, "*")
+		switch {
+		case isPrefix && field.multiValued:
+			clauses[idx] = "EXISTS (SELECT 1 FROM jsonb_array_elements_text(events.payload #> " + field.pathLiteral() +
+				") AS elem(value) WHERE starts_with(elem.value, " + q.arg(prefix) + "))"
+		case isPrefix:
+			clauses[idx] = "starts_with(" + field.valueExpr() + ", " + q.arg(prefix) + ")"
+		default:
+			doc, err := field.containment(value)
+			if err != nil {
+				return "", err
+			}
+			clauses[idx] = "events.payload @> " + q.arg(doc) + "::jsonb"
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", nil
+}
+
+// timeCondition compares the event time with an absolute or relative time.
+func (q *pgQuery) timeCondition(operator, value string) (string, error) {
+	t, err := query.ParseTime(value, time.Now())
+	if err != nil {
+		return "", err
+	}
+	operators := map[string]string{"lt": "<", "lte": "<=", "gt": ">", "gte": ">="}
+	sqlOperator, ok := operators[operator]
+	if !ok {
+		return "", fmt.Errorf("invalid comparison operator %s", operator)
+	}
+	return "events.event_time " + sqlOperator + " " + q.arg(t.UTC()), nil
+}
+
+// searchCondition compiles a query of the search language into a condition,
+// like searchQuery does for ElasticSearch.
+func (q *pgQuery) searchCondition(expr query.Expr) (string, error) {
+	switch expr := expr.(type) {
+	case query.And:
+		return q.joinSearchConditions(expr, " AND ")
+	case query.Or:
+		return q.joinSearchConditions(expr, " OR ")
+	case query.Not:
+		inner, err := q.searchCondition(expr.Expr)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + inner + ")", nil
+	case query.Match:
+		if expr.Field == "" {
+			return "strpos(events.search_text, " + q.arg(strings.ToLower(expr.Value)) + ") > 0", nil
+		}
+		field, ok := pgFieldMapping[expr.Field]
+		if !ok {
+			return "", fmt.Errorf("cannot search field %s", expr.Field)
+		}
+		value := expr.Value
+		if expr.Prefix {
+			value += "*"
+		}
+		return q.matchCondition(field, []string{value})
+	case query.Range:
+		if expr.Field != "time" {
+			return "", fmt.Errorf("cannot compare field %s", expr.Field)
+		}
+		return q.timeCondition(expr.Operator, expr.Value)
+	default:
+		return "", fmt.Errorf("unexpected search expression %T", expr)
+	}
+}
+
+// joinSearchConditions returns the conditions of all operands, joined with
+// the given operator.
+func (q *pgQuery) joinSearchConditions(operands []query.Expr, operator string) (string, error) {
+	conditions := make([]string, len(operands))
+	for idx, operand := range operands {
+		condition, err := q.searchCondition(operand)
+		if err != nil {
+			return "", err
+		}
+		conditions[idx] = condition
+	}
+	return "(" + strings.Join(conditions, operator) + ")", nil
+}
+
+// pgOrderBy returns the ORDER BY clause for the requested sort order,
+// followed by the event time descending as the default order.
+func pgOrderBy(filter *EventFilter) (string, error) {
+	var terms []string
+	for _, fieldOrder := range filter.Sort {
+		name := fieldOrder.Fieldname
+		if alias, exists := sortFieldAliases[name]; exists {
+			name = alias
+		}
+		expr := "events.event_time"
+		if name != "time" {
+			field, ok := pgFieldMapping[name]
+			if !ok || field.multiValued {
+				return "", fmt.Errorf("cannot sort by %s", fieldOrder.Fieldname)
+			}
+			expr = field.valueExpr()
+		}
+		switch fieldOrder.Order {
+		case "asc":
+			terms = append(terms, expr+" ASC")
+		case "desc":
+			terms = append(terms, expr+" DESC")
+		}
+	}
+	// the sequence number makes the order unique, so that pages do not overlap
+	return strings.Join(append(terms, "events.event_time DESC", "events.seq DESC"), ", "), nil
+}
@@ -0,0 +1,310 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/easypg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withTestDB is set when a local PostgreSQL installation is available for the
+// tests of the Postgres driver. Without one, these tests are skipped.
+var withTestDB bool
+
+func TestMain(m *testing.M) {
+	if _, err := exec.LookPath("pg_ctl"); err != nil {
+		os.Exit(m.Run())
+	}
+	os.Exit(easypg.WithTestDB(m, func() int {
+		withTestDB = true
+		return m.Run()
+	}))
+}
+
+// newTestPostgres returns a Postgres storage with the testEvents.
+func newTestPostgres(t *testing.T) *Postgres {
+	t.Helper()
+	if !withTestDB {
+		t.Skip("needs a local PostgreSQL installation")
+	}
+	db := easypg.ConnectForTest(t, easypg.Configuration{Migrations: postgresMigrations}, easypg.ClearTables("events"))
+	p := &Postgres{db: db}
+	t.Cleanup(func() { p.Close() })
+
+	results, err := p.WriteEvents(context.Background(), testEvents())
+	require.Nil(t, err)
+	for _, err := range results {
+		require.Nil(t, err)
+	}
+	return p
+}
+
+func TestPostgresEventConditions(t *testing.T) {
+	tenPM := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		filter       EventFilter
+		tenantID     string
+		expectedSQL  string
+		expectedArgs []any
+	}{
+		{
+			"All tenants", EventFilter{}, "",
+			"TRUE", nil,
+		},
+		{
+			"Tenant list", EventFilter{}, "tenant-a,tenant-b",
+			"events.tenant_id = ANY($1)", []any{pq.Array([]string{"tenant-a", "tenant-b"})},
+		},
+		{
+			"Filters", EventFilter{Action: "create,update", TargetType: "!network/*"}, "tenant-a",
+			"events.tenant_id = $1 AND NOT (starts_with(COALESCE(events.payload #>> '{target,typeURI}', ''), $2)) AND " +
+				"(events.payload @> $3::jsonb OR events.payload @> $4::jsonb)",
+			[]any{"tenant-a", "network/", `{"action":"create"}`, `{"action":"update"}`},
+		},
+		{
+			"Tags", EventFilter{Tag: "admin,c*"}, "",
+			"(events.payload @> $1::jsonb OR EXISTS (SELECT 1 FROM jsonb_array_elements_text(events.payload #> '{tags}') AS elem(value) " +
+				"WHERE starts_with(elem.value, $2)))",
+			[]any{`{"tags":["admin"]}`, "c"},
+		},
+		{
+			"Time", EventFilter{Time: map[string]string{"lt": "2024-05-01T22:00:00Z", "gte": "2024-05-01T20:00:00+02:00"}}, "",
+			"events.event_time >= $1 AND events.event_time < $2",
+			[]any{tenPM.Add(-4 * time.Hour), tenPM},
+		},
+		{
+			"Search", EventFilter{Search: "ALI OR NOT initiator_name:carol"}, "",
+			"(strpos(events.search_text, $1) > 0 OR NOT ((events.payload @> $2::jsonb)))",
+			[]any{"ali", `{"initiator":{"name":"carol"}}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q pgQuery
+			where, err := q.eventConditions(&tt.filter, tt.tenantID)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expectedSQL, where)
+			assert.Equal(t, tt.expectedArgs, q.args)
+		})
+	}
+}
+
+func TestPostgresEventConditionsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter EventFilter
+	}{
+		{"Invalid time", EventFilter{Time: map[string]string{"gte": "yesterday-ish"}}},
+		{"Invalid operator", EventFilter{Time: map[string]string{"eq": "2024-05-01T22:00:00Z"}}},
+		{"Invalid search", EventFilter{Search: "action:"}},
+		{"Unknown search field", EventFilter{Search: "color:red"}},
+		{"Compare other field", EventFilter{Search: "action:>create"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q pgQuery
+			_, err := q.eventConditions(&tt.filter, "tenant-a")
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestPostgresOrderBy(t *testing.T) {
+	orderBy, err := pgOrderBy(&EventFilter{Sort: []FieldOrder{{"event_type", "asc"}, {"time", "desc"}}})
+	require.Nil(t, err)
+	assert.Equal(t, "COALESCE(events.payload #>> '{action}', '') ASC, events.event_time DESC, events.event_time DESC, events.seq DESC", orderBy)
+
+	_, err = pgOrderBy(&EventFilter{Sort: []FieldOrder{{"tag", "asc"}}})
+	assert.NotNil(t, err)
+	_, err = pgOrderBy(&EventFilter{Sort: []FieldOrder{{"color", "asc"}}})
+	assert.NotNil(t, err)
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	// the migrations must create all partitions, and the schema version must match them
+	assert.Contains(t, postgresMigrations["001_initial.up.sql"], "FOR i IN 0..15 LOOP")
+	assert.Contains(t, postgresMigrations["001_initial.up.sql"], "PARTITION OF events FOR VALUES WITH (MODULUS 16, REMAINDER %s)")
+	assert.Contains(t, postgresMigrations, fmt.Sprintf("%03d_initial.up.sql", postgresSchemaVersion))
+}
+
+func TestPostgresGetEvents(t *testing.T) {
+	p := newTestPostgres(t)
+
+	tests := []struct {
+		name     string
+		filter   EventFilter
+		tenantID string
+		expected []string
+	}{
+		{"All events of a tenant", EventFilter{}, "tenant-a", []string{"e3", "e2", "e1"}},
+		{"All tenants", EventFilter{}, "", []string{"e3", "e4", "e2", "e1"}},
+		{"Tenant list", EventFilter{}, "tenant-a,tenant-b", []string{"e3", "e4", "e2", "e1"}},
+		{"Other tenant", EventFilter{}, "tenant-c", []string{}},
+		{"Exact value", EventFilter{Action: "create"}, "", []string{"e4", "e1"}},
+		{"Several values", EventFilter{InitiatorName: "bob,carol"}, "", []string{"e4", "e2"}},
+		{"Negated value", EventFilter{Action: "!create"}, "tenant-a", []string{"e3", "e2"}},
+		{"Prefix", EventFilter{TargetType: "network/*"}, "", []string{"e3"}},
+		{"Negated prefix", EventFilter{TargetType: "!compute/*"}, "", []string{"e3"}},
+		{"Missing field", EventFilter{InitiatorAddress: "!10.0.0.1"}, "tenant-b", []string{"e4"}},
+		{"Time range", EventFilter{Time: map[string]string{"gte": "2024-05-01T10:30:00Z", "lt": "2024-05-01T12:00:00Z"}}, "", []string{"e4", "e2"}},
+		{"Search without field", EventFilter{Search: "ALI"}, "", []string{"e3", "e1"}},
+		{"Search with fields", EventFilter{Search: "outcome:success AND NOT initiator_name:carol"}, "", []string{"e3", "e1"}},
+		{"Sort ascending", EventFilter{Sort: []FieldOrder{{"time", "asc"}}}, "tenant-a", []string{"e1", "e2", "e3"}},
+		{"Sort by alias", EventFilter{Sort: []FieldOrder{{"event_type", "asc"}}}, "", []string{"e4", "e1", "e2", "e3"}},
+		{"Offset and limit", EventFilter{Offset: 1, Limit: 2}, "", []string{"e4", "e2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := p.GetEvents(context.Background(), &tt.filter, tt.tenantID)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, eventIDs(page))
+			if tt.filter.Limit == 0 {
+				assert.Equal(t, len(tt.expected), page.Total)
+			}
+		})
+	}
+
+	page, err := p.GetEvents(context.Background(), &EventFilter{}, "tenant-a,tenant-b")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"tenant-a", "tenant-b", "tenant-a", "tenant-a"}, page.TenantIDs)
+}
+
+func TestPostgresTags(t *testing.T) {
+	p := newTestPostgres(t)
+	// events written by the audit middleware may have tags, which are not part of cadf.Event
+	page, err := p.GetEvents(context.Background(), &EventFilter{Tag: "admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+
+	page, err = p.GetEvents(context.Background(), &EventFilter{Tag: "!admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e2"}, eventIDs(page))
+
+	page, err = p.GetEvents(context.Background(), &EventFilter{Search: "tag:c*"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e2", "e1"}, eventIDs(page))
+
+	tags, err := p.GetAttributes(context.Background(), &AttributeFilter{QueryName: "tag", Limit: 10}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"cli", "admin"}, tags)
+
+	// the tags are returned next to the events, and found by searches without field
+	page, err = p.GetEvents(context.Background(), &EventFilter{Search: "admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+	assert.Equal(t, [][]string{{"admin", "cli"}}, page.Tags)
+}
+
+func TestPostgresCursor(t *testing.T) {
+	p := newTestPostgres(t)
+
+	page, err := p.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e2"}, eventIDs(page))
+	require.NotEqual(t, "", page.NextCursor)
+
+	// events written in the meantime do not shift the following pages
+	_, err = p.WriteEvents(context.Background(), []TenantEvent{
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e5", EventTime: "2024-05-01T13:00:00Z"}},
+	})
+	require.Nil(t, err)
+
+	page, err = p.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2, Cursor: page.NextCursor}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+	assert.Equal(t, "", page.NextCursor)
+}
+
+func TestPostgresWriteEvents(t *testing.T) {
+	p := newTestPostgres(t)
+
+	results, err := p.WriteEvents(context.Background(), []TenantEvent{
+		testEvents()[0],
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e2", EventTime: "2024-05-01T09:00:00Z", Action: "read"}},
+		{TenantID: "tenant-b", Event: &cadf.Event{ID: "e2", EventTime: "2024-05-01T09:00:00Z", Action: "read"}},
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e6", EventTime: "not a time"}},
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e7", EventTime: "2024-05-01T09:00:00Z", RequestPath: "/v3/\x00"}},
+	})
+	require.Nil(t, err)
+	// writing an event again is harmless, but a different event cannot replace it
+	assert.Nil(t, results[0])
+	assert.ErrorIs(t, results[1], ErrEventConflict)
+	assert.Nil(t, results[2])
+	assert.ErrorIs(t, results[3], ErrEventRejected)
+	assert.ErrorIs(t, results[4], ErrEventRejected)
+
+	event, err := p.GetEvent(context.Background(), "e2", "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, cadf.Action("delete"), event.Action)
+
+	event, err = p.GetEvent(context.Background(), "e1", "tenant-b")
+	require.Nil(t, err)
+	assert.Nil(t, event)
+
+	var ids []string
+	err = p.StreamEvents(context.Background(), &EventFilter{Outcome: "success"}, "", func(event *cadf.Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e4", "e1"}, ids)
+}
+
+func TestPostgresGetAttributes(t *testing.T) {
+	p := newTestPostgres(t)
+
+	tests := []struct {
+		filter   AttributeFilter
+		tenantID string
+		expected []string
+	}{
+		{AttributeFilter{QueryName: "initiator_name", Limit: 10}, "tenant-a", []string{"alice", "bob"}},
+		{AttributeFilter{QueryName: "initiator_name", Limit: 1}, "", []string{"alice"}},
+		{AttributeFilter{QueryName: "target_type", MaxDepth: 1, Limit: 10}, "", []string{"compute", "network"}},
+		{AttributeFilter{QueryName: "initiator_address", Limit: 10}, "", nil},
+		{AttributeFilter{QueryName: "color", Limit: 10}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter.QueryName, func(t *testing.T) {
+			attributes, err := p.GetAttributes(context.Background(), &tt.filter, tt.tenantID)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, attributes)
+		})
+	}
+}
+
+func TestPostgresAggregations(t *testing.T) {
+	p := newTestPostgres(t)
+
+	counts, err := p.CountEvents(context.Background(), &EventFilter{}, "", []string{"action", "outcome"}, 2)
+	require.Nil(t, err)
+	assert.Equal(t, 4, counts.Total)
+	assert.Equal(t, []EventGroup{
+		{Values: []string{"create", "success"}, Count: 2},
+		{Values: []string{"delete", "failure"}, Count: 1},
+	}, counts.Groups)
+
+	hour := func(h int) time.Time { return time.Date(2024, 5, 1, h, 0, 0, 0, time.UTC) }
+	filter := EventFilter{Time: map[string]string{"gte": "2024-05-01T09:00:00Z", "lt": "2024-05-01T13:00:00Z"}}
+	histogram, err := p.HistogramEvents(context.Background(), &filter, "", time.Hour, "outcome", 1)
+	require.Nil(t, err)
+	assert.Equal(t, 4, histogram.Total)
+	assert.Equal(t, []HistogramBucket{
+		{Start: hour(9)},
+		{Start: hour(10), Count: 2, Groups: []EventGroup{{Values: []string{"failure"}, Count: 1}}},
+		{Start: hour(11), Count: 1, Groups: []EventGroup{{Values: []string{"success"}, Count: 1}}},
+		{Start: hour(12), Count: 1, Groups: []EventGroup{{Values: []string{"success"}, Count: 1}}},
+	}, histogram.Buckets)
+}
@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DriverFactory constructs a storage driver from the configuration.
+type DriverFactory func() (Storage, error)
+
+var (
+	driversMutex sync.Mutex
+	drivers      = make(map[string]DriverFactory)
+)
+
+// RegisterDriver makes a storage driver available under the given name,
+// which is selected with the hermes.storage_driver option. Drivers register
+// themselves in an init function. Registering the same name twice panics.
+func RegisterDriver(name string, factory DriverFactory) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	if _, exists := drivers[name]; exists {
+		panic(fmt.Sprintf("storage driver %q is registered twice", name))
+	}
+	drivers[name] = factory
+}
+
+// DriverNames returns the names of all registered storage drivers in
+// alphabetical order.
+func DriverNames() []string {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// NewDriver constructs the storage driver registered under the given name.
+func NewDriver(name string) (Storage, error) {
+	driversMutex.Lock()
+	factory, exists := drivers[name]
+	driversMutex.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown storage driver %q, must be one of: %s", name, strings.Join(DriverNames(), ", "))
+	}
+	driver, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize storage driver %q: %w", name, err)
+	}
+	return driver, nil
+}
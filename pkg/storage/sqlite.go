@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/spf13/viper"
+
+	// registers the pure Go "sqlite" driver for database/sql
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	RegisterDriver("sqlite", func() (Storage, error) {
+		return NewSQLite(viper.GetString("sqlite.path"))
+	})
+}
+
+// SQLite stores events in an embedded SQLite database. It needs no separate
+// database server, which makes it suitable for small regions and for
+// development, but it does not scale like ElasticSearch does.
+//
+// Events are stored as JSON, and filters are evaluated on the JSON fields.
+// Unlike ElasticSearch, search terms without a field match substrings of the
+// searched fields, ignoring case, instead of words.
+type SQLite struct {
+	db *sql.DB
+}
+
+// sqliteSchema creates the database on first use.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	tenant_id   TEXT NOT NULL,
+	id          TEXT NOT NULL,
+	event_time  TEXT NOT NULL,
+	payload     TEXT NOT NULL,
+	search_text TEXT NOT NULL,
+	PRIMARY KEY (tenant_id, id)
+);
+CREATE INDEX IF NOT EXISTS events_tenant_time ON events (tenant_id, event_time);
+CREATE INDEX IF NOT EXISTS events_time ON events (event_time);
+`
+
+// NewSQLite opens the SQLite database at the given path, and creates it if
+// it does not exist yet.
+func NewSQLite(path string) (*SQLite, error) {
+	if path == "" {
+		return nil, errors.New("missing path of the SQLite database")
+	}
+	// WAL allows reading while events are written, and the busy timeout lets
+	// concurrent writers wait for each other instead of failing
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close() //nolint:errcheck // the initialization error is more useful
+		return nil, fmt.Errorf("cannot initialize SQLite database %s: %w", path, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// GetEvents implements the Storage interface.
+func (s *SQLite) GetEvents(ctx context.Context, filter *EventFilter, tenantID string) (*EventPage, error) {
+	where, err := sqliteEventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := sqliteOrderBy(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := filter.Offset
+	var cursor sqlCursor
+	if filter.UseCursor {
+		if filter.Cursor == "" {
+			cursor.TenantID = tenantID
+			err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(rowid), 0) FROM events`).Scan(&cursor.MaxRowID)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			cursor, err = decodeSQLCursor(filter.Cursor, tenantID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		where.add("rowid <= ?", cursor.MaxRowID)
+		offset = cursor.Offset
+	}
+
+	var page EventPage
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE `+where.sql(), where.args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	// a negative LIMIT means no limit in SQLite
+	limit := int64(filter.Limit)
+	if limit == 0 {
+		limit = -1
+	}
+	query := `SELECT tenant_id, payload FROM events WHERE ` + where.sql() + ` ORDER BY ` + orderBy + ` LIMIT ? OFFSET ?`
+	rows, err := s.db.QueryContext(ctx, query, append(where.args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	withTenants := tenantID == "" || strings.Contains(tenantID, ",")
+	for rows.Next() {
+		doc, eventTenantID, err := scanSQLiteEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Events = append(page.Events, doc.Event)
+		page.Tags = append(page.Tags, doc.Tags)
+		if withTenants {
+			page.TenantIDs = append(page.TenantIDs, eventTenantID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if filter.UseCursor && filter.Limit > 0 && uint(len(page.Events)) == filter.Limit {
+		cursor.Offset = offset + filter.Limit
+		page.NextCursor, err = cursor.encode()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &page, nil
+}
+
+// scanSQLiteEvent reads the tenant ID and the payload of an event.
+func scanSQLiteEvent(rows *sql.Rows) (eventDocument, string, error) {
+	var (
+		tenantID string
+		payload  string
+	)
+	err := rows.Scan(&tenantID, &payload)
+	if err != nil {
+		return eventDocument{}, "", err
+	}
+	doc, err := decodeEventDocument([]byte(payload))
+	return doc, tenantID, err
+}
+
+// StreamEvents implements the Storage interface with a single query.
+func (s *SQLite) StreamEvents(ctx context.Context, filter *EventFilter, tenantID string, fn func(*cadf.Event) error) error {
+	where, err := sqliteEventConditions(filter, tenantID)
+	if err != nil {
+		return err
+	}
+	orderBy, err := sqliteOrderBy(filter)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT tenant_id, payload FROM events WHERE `+where.sql()+` ORDER BY `+orderBy, where.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		doc, _, err := scanSQLiteEvent(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(doc.Event)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetEvent implements the Storage interface.
+func (s *SQLite) GetEvent(ctx context.Context, eventID, tenantID string) (*cadf.Event, error) {
+	var where sqliteConditions
+	where.addTenants(tenantID)
+	where.add("id = ?", eventID)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT tenant_id, payload FROM events WHERE `+where.sql()+` LIMIT 1`, where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	doc, _, err := scanSQLiteEvent(rows)
+	return doc.Event, err
+}
+
+// GetAttributes implements the Storage interface. The values are ordered by
+// the number of events having them, like in ElasticSearch.
+func (s *SQLite) GetAttributes(ctx context.Context, filter *AttributeFilter, tenantID string) ([]string, error) {
+	field, ok := sqliteFieldMapping[filter.QueryName]
+	if !ok || filter.QueryName == "time" {
+		logg.Debug("Attribute %s is not supported by SQLite", filter.QueryName)
+		return nil, nil
+	}
+
+	var where sqliteConditions
+	where.addTenants(tenantID)
+	from := `events`
+	if field.multiValued {
+		from = `events, json_each(events.payload, '` + field.jsonPath + `')`
+	}
+	query := `SELECT ` + field.valueExpr() + ` AS value FROM ` + from + ` WHERE ` + where.sql() +
+		` GROUP BY value HAVING value != '' ORDER BY COUNT(*) DESC, value LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, append(where.args, filter.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unique []string
+	for rows.Next() {
+		var attribute string
+		err := rows.Scan(&attribute)
+		if err != nil {
+			return nil, err
+		}
+		// Hierarchical Depth Handling
+		if filter.MaxDepth != 0 {
+			parts := strings.Split(attribute, "/")
+			if uint(len(parts)) > filter.MaxDepth {
+				attribute = strings.Join(parts[:filter.MaxDepth], "/")
+			}
+		}
+		unique = append(unique, attribute)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return RemoveDuplicates(unique), nil
+}
+
+// MaxLimit implements the Storage interface.
+func (s *SQLite) MaxLimit() uint {
+	maxLimit := viper.GetInt("sqlite.max_result_window")
+	if maxLimit < 0 {
+		return 0
+	}
+	return uint(maxLimit)
+}
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteGroupFields returns the fields to group by, and the FROM clause which
+// they need. Like in ElasticSearch, events without a value are not counted.
+func sqliteGroupFields(names []string, where *sqliteConditions) ([]sqliteField, string, error) {
+	from := "events"
+	fields := make([]sqliteField, len(names))
+	for idx, name := range names {
+		field, ok := sqliteFieldMapping[name]
+		if !ok || name == "time" {
+			return nil, "", fmt.Errorf("cannot group by %s", name)
+		}
+		if field.multiValued {
+			if from != "events" {
+				return nil, "", fmt.Errorf("cannot group by %s together with other multi-valued fields", name)
+			}
+			from = "events, json_each(events.payload, '" + field.jsonPath + "')"
+		}
+		where.add(field.valueExpr() + " != ''")
+		fields[idx] = field
+	}
+	return fields, from, nil
+}
+
+// CountEvents implements the EventAggregator interface.
+func (s *SQLite) CountEvents(ctx context.Context, filter *EventFilter, tenantID string, groupBy []string, limit uint) (*EventCounts, error) {
+	if len(groupBy) == 0 {
+		return nil, errors.New("no fields to group by")
+	}
+	where, err := sqliteEventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var result EventCounts
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE `+where.sql(), where.args...).Scan(&result.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, from, err := sqliteGroupFields(groupBy, &where)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, len(fields))
+	for idx, field := range fields {
+		columns[idx] = field.valueExpr()
+	}
+	groupColumns := strings.Join(columns, ", ")
+	rows, err := s.db.QueryContext(ctx, `SELECT `+groupColumns+`, COUNT(*) FROM `+from+` WHERE `+where.sql()+
+		` GROUP BY `+groupColumns+` ORDER BY COUNT(*) DESC, `+groupColumns+` LIMIT ?`, append(where.args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		group := EventGroup{Values: make([]string, len(fields))}
+		targets := make([]any, 0, len(fields)+1)
+		for idx := range group.Values {
+			targets = append(targets, &group.Values[idx])
+		}
+		err := rows.Scan(append(targets, &group.Count)...)
+		if err != nil {
+			return nil, err
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	return &result, rows.Err()
+}
+
+// HistogramEvents implements the EventAggregator interface.
+func (s *SQLite) HistogramEvents(ctx context.Context, filter *EventFilter, tenantID string, interval time.Duration, splitBy string, splitLimit uint) (*EventHistogram, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("invalid histogram interval %s", interval)
+	}
+	seconds := int64(interval / time.Second)
+	where, err := sqliteEventConditions(filter, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	bucketExpr := fmt.Sprintf("(unixepoch(events.event_time) / %d) * %d", seconds, seconds)
+
+	counts := make(map[int64]*HistogramBucket)
+	rows, err := s.db.QueryContext(ctx, `SELECT `+bucketExpr+` AS bucket, COUNT(*) FROM events WHERE `+where.sql()+` GROUP BY bucket`, where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result EventHistogram
+	for rows.Next() {
+		var (
+			start int64
+			count int
+		)
+		err := rows.Scan(&start, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[start] = &HistogramBucket{Start: time.Unix(start, 0).UTC(), Count: count}
+		result.Total += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if splitBy != "" {
+		err := s.splitHistogram(ctx, counts, where, bucketExpr, splitBy, splitLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Buckets, err = fillHistogram(counts, filter, seconds)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// splitHistogram counts the events of each bucket by the values of a field,
+// and keeps the splitLimit most frequent values per bucket.
+func (s *SQLite) splitHistogram(ctx context.Context, counts map[int64]*HistogramBucket, where sqliteConditions, bucketExpr, splitBy string, splitLimit uint) error {
+	fields, from, err := sqliteGroupFields([]string{splitBy}, &where)
+	if err != nil {
+		return fmt.Errorf("cannot split by %s", splitBy)
+	}
+	valueExpr := fields[0].valueExpr()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+bucketExpr+` AS bucket, `+valueExpr+` AS value, COUNT(*) AS count FROM `+from+
+		` WHERE `+where.sql()+` GROUP BY bucket, value ORDER BY bucket, count DESC, value`, where.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			start int64
+			group = EventGroup{Values: make([]string, 1)}
+		)
+		err := rows.Scan(&start, &group.Values[0], &group.Count)
+		if err != nil {
+			return err
+		}
+		bucket := counts[start]
+		if bucket != nil && uint(len(bucket.Groups)) < splitLimit {
+			bucket.Groups = append(bucket.Groups, group)
+		}
+	}
+	return rows.Err()
+}
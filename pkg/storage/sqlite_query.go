@@ -0,0 +1,301 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/query"
+)
+
+// sqliteTimeFormat is used for the event_time column. Since all times are in
+// UTC with the same number of digits, they can be compared as strings.
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// sqliteField is a field of the events that can be filtered, sorted or
+// counted by.
+type sqliteField struct {
+	column      string // set instead of jsonPath for fields with their own column
+	jsonPath    string
+	multiValued bool // for JSON arrays like tags, which match if any element matches
+}
+
+// valueExpr returns the SQL expression for the value of the field. Missing
+// values are empty, so that negated filters match events without the field.
+// Multi-valued fields need json_each(events.payload, jsonPath) in FROM.
+func (f sqliteField) valueExpr() string {
+	switch {
+	case f.column != "":
+		return "events." + f.column
+	case f.multiValued:
+		return "COALESCE(json_each.value, '')"
+	default:
+		return "COALESCE(json_extract(events.payload, '" + f.jsonPath + "'), '')"
+	}
+}
+
+// sqliteFieldMapping maps the field names of the API to the fields of the
+// stored events, like esFieldMapping does for ElasticSearch.
+var sqliteFieldMapping = map[string]sqliteField{
+	"time":              {column: "event_time"},
+	"action":            {jsonPath: "$.action"},
+	"outcome":           {jsonPath: "$.outcome"},
+	"request_path":      {jsonPath: "$.requestPath"},
+	"observer_id":       {jsonPath: "$.observer.id"},
+	"observer_type":     {jsonPath: "$.observer.typeURI"},
+	"target_id":         {jsonPath: "$.target.id"},
+	"target_type":       {jsonPath: "$.target.typeURI"},
+	"initiator_id":      {jsonPath: "$.initiator.id"},
+	"initiator_type":    {jsonPath: "$.initiator.typeURI"},
+	"initiator_name":    {jsonPath: "$.initiator.name"},
+	"initiator_address": {jsonPath: "$.initiator.host.address"},
+	"target_name":       {jsonPath: "$.target.name"},
+	"tag":               {jsonPath: "$.tags", multiValued: true},
+}
+
+// sqliteConditions collects the conditions of a WHERE clause with their arguments.
+type sqliteConditions struct {
+	clauses []string
+	args    []any
+}
+
+func (c *sqliteConditions) add(clause string, args ...any) {
+	c.clauses = append(c.clauses, clause)
+	c.args = append(c.args, args...)
+}
+
+// addTenants restricts the events to the given tenants (all of them if the
+// tenant ID is empty), see the Storage interface.
+func (c *sqliteConditions) addTenants(tenantID string) {
+	if tenantID == "" {
+		return
+	}
+	tenantIDs := strings.Split(tenantID, ",")
+	args := make([]any, len(tenantIDs))
+	for idx, id := range tenantIDs {
+		args[idx] = id
+	}
+	c.add("events.tenant_id IN ("+placeholders(len(args))+")", args...)
+}
+
+// sql returns the conditions joined with AND.
+func (c *sqliteConditions) sql() string {
+	if len(c.clauses) == 0 {
+		return "1"
+	}
+	return strings.Join(c.clauses, " AND ")
+}
+
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
+
+// sqliteEventConditions builds the conditions for all filter criteria in the
+// given EventFilter, like eventQuery does for ElasticSearch.
+func sqliteEventConditions(filter *EventFilter, tenantID string) (sqliteConditions, error) {
+	var where sqliteConditions
+	if len(filter.IngestTime) > 0 {
+		return where, ErrIngestTimeNotSupported
+	}
+	where.addTenants(tenantID)
+
+	filters := []struct {
+		value string
+		name  string
+	}{
+		{filter.ObserverType, "observer_type"},
+		{filter.TargetType, "target_type"},
+		{filter.TargetID, "target_id"},
+		{filter.InitiatorType, "initiator_type"},
+		{filter.InitiatorID, "initiator_id"},
+		{filter.InitiatorName, "initiator_name"},
+		{filter.Action, "action"},
+		{filter.Outcome, "outcome"},
+		{filter.RequestPath, "request_path"},
+		{filter.TargetName, "target_name"},
+		{filter.InitiatorAddress, "initiator_address"},
+		{filter.Tag, "tag"},
+	}
+	for _, f := range filters {
+		if f.value != "" {
+			sqliteFilterCondition(&where, f.value, sqliteFieldMapping[f.name])
+		}
+	}
+
+	for operator, value := range filter.Time {
+		clause, arg, err := sqliteTimeCondition(operator, value)
+		if err != nil {
+			return where, err
+		}
+		where.add(clause, arg)
+	}
+
+	if filter.Search != "" {
+		expr, err := query.Parse(filter.Search)
+		if err != nil {
+			return where, err
+		}
+		if expr != nil {
+			var search sqliteConditions
+			err := sqliteSearchCondition(&search, expr)
+			if err != nil {
+				return where, err
+			}
+			where.add(search.sql(), search.args...)
+		}
+	}
+	return where, nil
+}
+
+// sqliteFilterCondition adds the condition for a filter with comma-separated
+// values like FilterQuery does: events must have one of the values (if any),
+// and none of the negated values. Values ending with * are prefixes.
+func sqliteFilterCondition(where *sqliteConditions, filter string, field sqliteField) {
+	var values, negatedValues []string
+	for value := range strings.SplitSeq(filter, ",") {
+		value = strings.TrimSpace(value)
+		if negatedValue, isNegated := strings.CutPrefix(value, "!"); isNegated {
+			negatedValues = append(negatedValues, negatedValue)
+		} else {
+			values = append(values, value)
+		}
+	}
+	if len(values) > 0 {
+		clause, args := sqliteMatchCondition(field, values)
+		where.add(clause, args...)
+	}
+	if len(negatedValues) > 0 {
+		clause, args := sqliteMatchCondition(field, negatedValues)
+		where.add("NOT "+clause, args...)
+	}
+}
+
+// sqliteMatchCondition returns a condition that matches any of the values.
+func sqliteMatchCondition(field sqliteField, values []string) (string, []any) {
+	var (
+		exactValues []any
+		clauses     []string
+		args        []any
+	)
+	for _, value := range values {
+		if prefix, isPrefix := strings.CutSuffix(value, "*"); isPrefix {
+			// unlike LIKE, this is case-sensitive like the other comparisons
+			clauses = append(clauses, "instr("+field.valueExpr()+", ?) = 1")
+			args = append(args, prefix)
+		} else {
+			exactValues = append(exactValues, value)
+		}
+	}
+	if len(exactValues) > 0 {
+		clauses = append([]string{field.valueExpr() + " IN (" + placeholders(len(exactValues)) + ")"}, clauses...)
+		args = append(exactValues, args...)
+	}
+
+	clause := "(" + strings.Join(clauses, " OR ") + ")"
+	if field.multiValued {
+		clause = "EXISTS (SELECT 1 FROM json_each(events.payload, '" + field.jsonPath + "') WHERE " + clause + ")"
+	}
+	return clause, args
+}
+
+// sqliteTimeCondition compares the event time with an absolute or relative time.
+func sqliteTimeCondition(operator, value string) (string, string, error) {
+	t, err := query.ParseTime(value, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	operators := map[string]string{"lt": "<", "lte": "<=", "gt": ">", "gte": ">="}
+	sqlOperator, ok := operators[operator]
+	if !ok {
+		return "", "", fmt.Errorf("invalid comparison operator %s", operator)
+	}
+	return "events.event_time " + sqlOperator + " ?", t.UTC().Format(sqliteTimeFormat), nil
+}
+
+// sqliteSearchCondition compiles a query of the search language into a
+// condition, like searchQuery does for ElasticSearch.
+func sqliteSearchCondition(where *sqliteConditions, expr query.Expr) error {
+	switch expr := expr.(type) {
+	case query.And:
+		return sqliteJoinSearchConditions(where, expr, " AND ")
+	case query.Or:
+		return sqliteJoinSearchConditions(where, expr, " OR ")
+	case query.Not:
+		var inner sqliteConditions
+		err := sqliteSearchCondition(&inner, expr.Expr)
+		if err != nil {
+			return err
+		}
+		where.add("NOT ("+inner.sql()+")", inner.args...)
+		return nil
+	case query.Match:
+		if expr.Field == "" {
+			where.add("instr(events.search_text, ?) > 0", strings.ToLower(expr.Value))
+			return nil
+		}
+		field, ok := sqliteFieldMapping[expr.Field]
+		if !ok {
+			return fmt.Errorf("cannot search field %s", expr.Field)
+		}
+		value := expr.Value
+		if expr.Prefix {
+			value += "*"
+		}
+		clause, args := sqliteMatchCondition(field, []string{value})
+		where.add(clause, args...)
+		return nil
+	case query.Range:
+		if expr.Field != "time" {
+			return fmt.Errorf("cannot compare field %s", expr.Field)
+		}
+		clause, arg, err := sqliteTimeCondition(expr.Operator, expr.Value)
+		if err != nil {
+			return err
+		}
+		where.add(clause, arg)
+		return nil
+	default:
+		return fmt.Errorf("unexpected search expression %T", expr)
+	}
+}
+
+// sqliteJoinSearchConditions adds the conditions of all operands, joined with
+// the given operator.
+func sqliteJoinSearchConditions(where *sqliteConditions, operands []query.Expr, operator string) error {
+	var inner sqliteConditions
+	for _, operand := range operands {
+		err := sqliteSearchCondition(&inner, operand)
+		if err != nil {
+			return err
+		}
+	}
+	where.add("("+strings.Join(inner.clauses, operator)+")", inner.args...)
+	return nil
+}
+
+// sqliteOrderBy returns the ORDER BY clause for the requested sort order,
+// followed by the event time descending as the default order.
+func sqliteOrderBy(filter *EventFilter) (string, error) {
+	var terms []string
+	for _, fieldOrder := range filter.Sort {
+		name := fieldOrder.Fieldname
+		if alias, exists := sortFieldAliases[name]; exists {
+			name = alias
+		}
+		field, ok := sqliteFieldMapping[name]
+		if !ok || field.multiValued {
+			return "", fmt.Errorf("cannot sort by %s", fieldOrder.Fieldname)
+		}
+		switch fieldOrder.Order {
+		case "asc":
+			terms = append(terms, field.valueExpr()+" ASC")
+		case "desc":
+			terms = append(terms, field.valueExpr()+" DESC")
+		}
+	}
+	// the rowid makes the order unique, so that pages do not overlap
+	return strings.Join(append(terms, "events.event_time DESC", "events.rowid DESC"), ", "), nil
+}
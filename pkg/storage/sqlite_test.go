@@ -0,0 +1,333 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testEvents are written into the storage for the tests of the SQL drivers:
+//
+//	id  tenant    time   action  outcome  initiator  target          tags
+//	e1  tenant-a  10:00  create  success  alice      compute/server  admin, cli
+//	e2  tenant-a  10:30  delete  failure  bob        compute/server  cli
+//	e3  tenant-a  12:00  update  success  alice      network/port
+//	e4  tenant-b  11:00  create  success  carol      compute/server
+func testEvents() []TenantEvent {
+	event := func(id, eventTime string, action cadf.Action, outcome cadf.Outcome, initiator, targetType string) *cadf.Event {
+		return &cadf.Event{
+			ID:        id,
+			EventTime: "2024-05-01T" + eventTime + ":00.000000+00:00",
+			Action:    action,
+			Outcome:   outcome,
+			Initiator: cadf.Resource{TypeURI: "service/security/account/user", Name: initiator, ID: initiator + "-id"},
+			Target:    cadf.Resource{TypeURI: targetType, ID: id + "-target"},
+			Observer:  cadf.Resource{TypeURI: "service/" + targetType, ID: "observer"},
+		}
+	}
+	return []TenantEvent{
+		{"tenant-a", event("e1", "10:00", "create", cadf.SuccessOutcome, "alice", "compute/server"), []string{"admin", "cli"}},
+		{"tenant-a", event("e2", "10:30", "delete", cadf.FailureOutcome, "bob", "compute/server"), []string{"cli"}},
+		{"tenant-a", event("e3", "12:00", "update", cadf.SuccessOutcome, "alice", "network/port"), nil},
+		{"tenant-b", event("e4", "11:00", "create", cadf.SuccessOutcome, "carol", "compute/server"), nil},
+	}
+}
+
+// newTestSQLite returns an SQLite storage with the testEvents.
+func newTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+	s, err := NewSQLite(filepath.Join(t.TempDir(), "hermes.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	results, err := s.WriteEvents(context.Background(), testEvents())
+	require.Nil(t, err)
+	for _, err := range results {
+		require.Nil(t, err)
+	}
+	return s
+}
+
+func eventIDs(page *EventPage) []string {
+	ids := make([]string, len(page.Events))
+	for idx, event := range page.Events {
+		ids[idx] = event.ID
+	}
+	return ids
+}
+
+func TestSQLiteGetEvents(t *testing.T) {
+	s := newTestSQLite(t)
+
+	tests := []struct {
+		name     string
+		filter   EventFilter
+		tenantID string
+		expected []string
+	}{
+		{"All events of a tenant", EventFilter{}, "tenant-a", []string{"e3", "e2", "e1"}},
+		{"All tenants", EventFilter{}, "", []string{"e3", "e4", "e2", "e1"}},
+		{"Tenant list", EventFilter{}, "tenant-a,tenant-b", []string{"e3", "e4", "e2", "e1"}},
+		{"Other tenant", EventFilter{}, "tenant-c", []string{}},
+		{"Exact value", EventFilter{Action: "create"}, "", []string{"e4", "e1"}},
+		{"Several values", EventFilter{InitiatorName: "bob,carol"}, "", []string{"e4", "e2"}},
+		{"Negated value", EventFilter{Action: "!create"}, "tenant-a", []string{"e3", "e2"}},
+		{"Prefix", EventFilter{TargetType: "network/*"}, "", []string{"e3"}},
+		{"Prefix is case-sensitive", EventFilter{TargetType: "Network/*"}, "", []string{}},
+		{"Negated prefix", EventFilter{TargetType: "!compute/*"}, "", []string{"e3"}},
+		{"Missing field", EventFilter{InitiatorAddress: "!10.0.0.1"}, "tenant-b", []string{"e4"}},
+		{"Time range", EventFilter{Time: map[string]string{"gte": "2024-05-01T10:30:00Z", "lt": "2024-05-01T12:00:00Z"}}, "", []string{"e4", "e2"}},
+		{"Search without field", EventFilter{Search: "ALI"}, "", []string{"e3", "e1"}},
+		{"Search with fields", EventFilter{Search: "outcome:success AND NOT initiator_name:carol"}, "", []string{"e3", "e1"}},
+		{"Search with prefix", EventFilter{Search: "target_type:network/* OR action:delete"}, "", []string{"e3", "e2"}},
+		{"Search time range", EventFilter{Search: "time:>=2024-05-01T11:00:00Z"}, "", []string{"e3", "e4"}},
+		{"Sort ascending", EventFilter{Sort: []FieldOrder{{"time", "asc"}}}, "tenant-a", []string{"e1", "e2", "e3"}},
+		{"Sort by alias", EventFilter{Sort: []FieldOrder{{"event_type", "asc"}}}, "", []string{"e4", "e1", "e2", "e3"}},
+		{"Offset and limit", EventFilter{Offset: 1, Limit: 2}, "", []string{"e4", "e2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := s.GetEvents(context.Background(), &tt.filter, tt.tenantID)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, eventIDs(page))
+			if tt.filter.Limit == 0 {
+				assert.Equal(t, len(tt.expected), page.Total)
+			}
+		})
+	}
+}
+
+func TestSQLiteGetEventsErrors(t *testing.T) {
+	s := newTestSQLite(t)
+
+	tests := []struct {
+		name   string
+		filter EventFilter
+	}{
+		{"Invalid time", EventFilter{Time: map[string]string{"gte": "yesterday-ish"}}},
+		{"Invalid search", EventFilter{Search: "action:"}},
+		{"Unknown search field", EventFilter{Search: "color:red"}},
+		{"Unknown sort field", EventFilter{Sort: []FieldOrder{{"color", "asc"}}}},
+		{"Sort by tags", EventFilter{Sort: []FieldOrder{{"tag", "asc"}}}},
+		{"Ingestion time", EventFilter{IngestTime: map[string]string{"gte": "2024-03-01T00:00:00Z"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.GetEvents(context.Background(), &tt.filter, "tenant-a")
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestSQLiteTenantIDs(t *testing.T) {
+	s := newTestSQLite(t)
+
+	page, err := s.GetEvents(context.Background(), &EventFilter{}, "tenant-a,tenant-b")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"tenant-a", "tenant-b", "tenant-a", "tenant-a"}, page.TenantIDs)
+
+	page, err = s.GetEvents(context.Background(), &EventFilter{}, "tenant-a")
+	require.Nil(t, err)
+	assert.Nil(t, page.TenantIDs)
+}
+
+func TestSQLiteTags(t *testing.T) {
+	s := newTestSQLite(t)
+	// events written by the audit middleware may have tags, which are not part of cadf.Event
+	page, err := s.GetEvents(context.Background(), &EventFilter{Tag: "admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+
+	page, err = s.GetEvents(context.Background(), &EventFilter{Tag: "!admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e2"}, eventIDs(page))
+
+	page, err = s.GetEvents(context.Background(), &EventFilter{Search: "tag:c*"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e2", "e1"}, eventIDs(page))
+
+	tags, err := s.GetAttributes(context.Background(), &AttributeFilter{QueryName: "tag", Limit: 10}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"cli", "admin"}, tags)
+
+	// the tags are returned next to the events, and found by searches without field
+	page, err = s.GetEvents(context.Background(), &EventFilter{Search: "admin"}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+	assert.Equal(t, [][]string{{"admin", "cli"}}, page.Tags)
+}
+
+func TestSQLiteCursor(t *testing.T) {
+	s := newTestSQLite(t)
+
+	page, err := s.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e2"}, eventIDs(page))
+	require.NotEqual(t, "", page.NextCursor)
+
+	// events written in the meantime do not shift the following pages
+	_, err = s.WriteEvents(context.Background(), []TenantEvent{
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e5", EventTime: "2024-05-01T13:00:00Z"}},
+	})
+	require.Nil(t, err)
+
+	page, err = s.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2, Cursor: page.NextCursor}, "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e1"}, eventIDs(page))
+	assert.Equal(t, "", page.NextCursor)
+
+	_, err = s.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2, Cursor: "e30"}, "tenant-a")
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	cursor, err := sqlCursor{TenantID: "tenant-a", MaxRowID: 4}.encode()
+	require.Nil(t, err)
+	_, err = s.GetEvents(context.Background(), &EventFilter{UseCursor: true, Limit: 2, Cursor: cursor}, "tenant-b")
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestSQLiteWriteEvents(t *testing.T) {
+	s := newTestSQLite(t)
+
+	results, err := s.WriteEvents(context.Background(), []TenantEvent{
+		testEvents()[0],
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e2", EventTime: "2024-05-01T09:00:00Z", Action: "read"}},
+		{TenantID: "tenant-b", Event: &cadf.Event{ID: "e2", EventTime: "2024-05-01T09:00:00Z", Action: "read"}},
+		{TenantID: "tenant-a", Event: &cadf.Event{ID: "e6", EventTime: "not a time"}},
+	})
+	require.Nil(t, err)
+	// writing an event again is harmless, but a different event cannot replace it
+	assert.Nil(t, results[0])
+	assert.ErrorIs(t, results[1], ErrEventConflict)
+	assert.ErrorIs(t, results[1], ErrEventRejected)
+	assert.Nil(t, results[2])
+	assert.ErrorIs(t, results[3], ErrEventRejected)
+
+	event, err := s.GetEvent(context.Background(), "e2", "tenant-a")
+	require.Nil(t, err)
+	assert.Equal(t, cadf.Action("delete"), event.Action)
+
+	event, err = s.GetEvent(context.Background(), "e1", "tenant-b")
+	require.Nil(t, err)
+	assert.Nil(t, event)
+
+	event, err = s.GetEvent(context.Background(), "e4", "tenant-a,tenant-b")
+	require.Nil(t, err)
+	assert.Equal(t, "carol", event.Initiator.Name)
+}
+
+func TestSQLiteStreamEvents(t *testing.T) {
+	s := newTestSQLite(t)
+
+	var ids []string
+	err := s.StreamEvents(context.Background(), &EventFilter{Outcome: "success"}, "", func(event *cadf.Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"e3", "e4", "e1"}, ids)
+}
+
+func TestSQLiteCanceledContext(t *testing.T) {
+	s := newTestSQLite(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.GetEvents(ctx, &EventFilter{}, "tenant-a")
+	assert.Equal(t, ErrorCanceled, ErrorTypeOf(ctx, err))
+	_, err = s.CountEvents(ctx, &EventFilter{}, "tenant-a", []string{"action"}, 10)
+	assert.Equal(t, ErrorCanceled, ErrorTypeOf(ctx, err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = s.GetEvent(ctx, "e1", "tenant-a")
+	assert.Equal(t, ErrorTimeout, ErrorTypeOf(ctx, err))
+}
+
+func TestSQLiteGetAttributes(t *testing.T) {
+	s := newTestSQLite(t)
+
+	tests := []struct {
+		filter   AttributeFilter
+		tenantID string
+		expected []string
+	}{
+		{AttributeFilter{QueryName: "initiator_name", Limit: 10}, "tenant-a", []string{"alice", "bob"}},
+		{AttributeFilter{QueryName: "initiator_name", Limit: 1}, "", []string{"alice"}},
+		{AttributeFilter{QueryName: "target_type", Limit: 10}, "", []string{"compute/server", "network/port"}},
+		{AttributeFilter{QueryName: "target_type", MaxDepth: 1, Limit: 10}, "", []string{"compute", "network"}},
+		{AttributeFilter{QueryName: "initiator_address", Limit: 10}, "", nil},
+		{AttributeFilter{QueryName: "color", Limit: 10}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter.QueryName, func(t *testing.T) {
+			attributes, err := s.GetAttributes(context.Background(), &tt.filter, tt.tenantID)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, attributes)
+		})
+	}
+}
+
+func TestSQLiteCountEvents(t *testing.T) {
+	s := newTestSQLite(t)
+
+	counts, err := s.CountEvents(context.Background(), &EventFilter{}, "", []string{"action", "outcome"}, 2)
+	require.Nil(t, err)
+	assert.Equal(t, 4, counts.Total)
+	assert.Equal(t, []EventGroup{
+		{Values: []string{"create", "success"}, Count: 2},
+		{Values: []string{"delete", "failure"}, Count: 1},
+	}, counts.Groups)
+
+	counts, err = s.CountEvents(context.Background(), &EventFilter{Action: "create"}, "tenant-a", []string{"initiator_name"}, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, counts.Total)
+	assert.Equal(t, []EventGroup{{Values: []string{"alice"}, Count: 1}}, counts.Groups)
+
+	_, err = s.CountEvents(context.Background(), &EventFilter{}, "", []string{"time"}, 10)
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteHistogramEvents(t *testing.T) {
+	s := newTestSQLite(t)
+	hour := func(h int) time.Time { return time.Date(2024, 5, 1, h, 0, 0, 0, time.UTC) }
+
+	filter := EventFilter{Time: map[string]string{"gte": "2024-05-01T09:00:00Z", "lt": "2024-05-01T13:00:00Z"}}
+	histogram, err := s.HistogramEvents(context.Background(), &filter, "", time.Hour, "outcome", 1)
+	require.Nil(t, err)
+	assert.Equal(t, 4, histogram.Total)
+	assert.Equal(t, []HistogramBucket{
+		{Start: hour(9)},
+		{Start: hour(10), Count: 2, Groups: []EventGroup{{Values: []string{"failure"}, Count: 1}}},
+		{Start: hour(11), Count: 1, Groups: []EventGroup{{Values: []string{"success"}, Count: 1}}},
+		{Start: hour(12), Count: 1, Groups: []EventGroup{{Values: []string{"success"}, Count: 1}}},
+	}, histogram.Buckets)
+
+	histogram, err = s.HistogramEvents(context.Background(), &EventFilter{}, "tenant-c", time.Hour, "", 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, histogram.Total)
+	assert.Nil(t, histogram.Buckets)
+
+	_, err = s.HistogramEvents(context.Background(), &EventFilter{}, "", time.Millisecond, "", 0)
+	assert.NotNil(t, err)
+}
+
+func TestRegistry(t *testing.T) {
+	assert.Subset(t, DriverNames(), []string{"elasticsearch", "mock", "sqlite"})
+
+	driver, err := NewDriver("mock")
+	require.Nil(t, err)
+	assert.Equal(t, Mock{}, driver)
+
+	_, err = NewDriver("cassandra")
+	assert.ErrorContains(t, err, `unknown storage driver "cassandra"`)
+	assert.Panics(t, func() {
+		RegisterDriver("mock", func() (Storage, error) { return Mock{}, nil })
+	})
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// WriteEvents implements the EventWriter interface. All events are written
+// in a single transaction.
+func (s *SQLite) WriteEvents(ctx context.Context, events []TenantEvent) ([]error, error) {
+	results := make([]error, len(events))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck // no-op after Commit
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO events (tenant_id, id, event_time, payload, search_text)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant_id, id) DO NOTHING`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	// stored events are kept, but only equal ones count as written
+	sameStmt, err := tx.PrepareContext(ctx, `SELECT payload = ? FROM events WHERE tenant_id = ? AND id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer sameStmt.Close()
+
+	for idx, e := range events {
+		eventTime, err := time.Parse(time.RFC3339Nano, e.Event.EventTime)
+		if err != nil {
+			results[idx] = fmt.Errorf("%w: invalid eventTime: %w", ErrEventRejected, err)
+			continue
+		}
+		payload, err := json.Marshal(eventDocument{Event: e.Event, Tags: e.Tags})
+		if err != nil {
+			results[idx] = fmt.Errorf("%w: %w", ErrEventRejected, err)
+			continue
+		}
+		searchText, err := eventSearchText(payload)
+		if err != nil {
+			results[idx] = fmt.Errorf("%w: %w", ErrEventRejected, err)
+			continue
+		}
+		result, err := stmt.ExecContext(ctx, e.TenantID, e.Event.ID, eventTime.UTC().Format(sqliteTimeFormat), string(payload), searchText)
+		if err != nil {
+			return nil, err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if inserted == 0 {
+			var same bool
+			err = sameStmt.QueryRowContext(ctx, string(payload), e.TenantID, e.Event.ID).Scan(&same)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				results[idx] = ErrEventConflict
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
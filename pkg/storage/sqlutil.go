@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sapcc/hermes/pkg/query"
+)
+
+// This file contains the parts of the SQLite and Postgres storage drivers
+// which do not depend on the SQL dialect.
+
+// sortFieldAliases are the deprecated names of sort fields.
+var sortFieldAliases = map[string]string{
+	"source":        "observer_type",
+	"resource_type": "target_type",
+	"resource_name": "target_name",
+	"event_type":    "action",
+}
+
+// sqlCursor is the content of the opaque cursor handed out to API clients.
+// Events written after the first page have a larger rowid (or sequence
+// number) and are ignored, so that they do not shift the following pages.
+type sqlCursor struct {
+	TenantID string `json:"t"`
+	MaxRowID int64  `json:"r"`
+	Offset   uint   `json:"o"`
+}
+
+func (c sqlCursor) encode() (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeSQLCursor(cursor, tenantID string) (sqlCursor, error) {
+	var c sqlCursor
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(buf, &c); err != nil || c.MaxRowID == 0 {
+		return c, ErrInvalidCursor
+	}
+	// a cursor must never be used to read another tenant's events
+	if c.TenantID != tenantID {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// fillHistogram returns the buckets of a histogram in order, given the
+// buckets with events by their start in Unix time. Empty intervals in between
+// and up to the bounds of the time filter are reported, too.
+func fillHistogram(counts map[int64]*HistogramBucket, filter *EventFilter, seconds int64) ([]HistogramBucket, error) {
+	var first, last int64
+	isFirst := true
+	extend := func(start int64) {
+		if isFirst || start < first {
+			first = start
+		}
+		if isFirst || start > last {
+			last = start
+		}
+		isFirst = false
+	}
+	for start := range counts {
+		extend(start)
+	}
+	now := time.Now()
+	for operator, value := range filter.Time {
+		bound, err := query.ParseTime(value, now)
+		if err != nil {
+			return nil, err
+		}
+		if operator == "lt" {
+			bound = bound.Add(-time.Nanosecond)
+		}
+		unix := bound.Unix()
+		extend(unix - ((unix%seconds)+seconds)%seconds)
+	}
+	if isFirst {
+		return nil, nil
+	}
+
+	var buckets []HistogramBucket
+	for start := first; start <= last; start += seconds {
+		bucket := HistogramBucket{Start: time.Unix(start, 0).UTC()}
+		if counted, exists := counts[start]; exists {
+			bucket = *counted
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// searchTextPaths are the fields searched by query terms without a field,
+// like esTextFields for ElasticSearch.
+var searchTextPaths = []string{
+	"action", "outcome", "requestPath",
+	"initiator.id", "initiator.typeURI", "initiator.name", "initiator.host.address",
+	"target.id", "target.typeURI", "target.name",
+	"observer.id", "observer.typeURI",
+}
+
+// eventSearchText collects the values of the searched fields of an event in
+// lowercase, one per line, for query terms without a field. It is stored next
+// to the event.
+func eventSearchText(payload []byte) (string, error) {
+	var event map[string]any
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return "", err
+	}
+
+	var values []string
+	for _, path := range searchTextPaths {
+		value, found := lookupJSONPath(event, strings.Split(path, "."))
+		if text, isText := value.(string); found && isText && text != "" {
+			values = append(values, text)
+		}
+	}
+	tags, _ := event["tags"].([]any)
+	for _, tag := range tags {
+		if text, isText := tag.(string); isText && text != "" {
+			values = append(values, text)
+		}
+	}
+	attachments, _ := event["attachments"].([]any)
+	for _, attachment := range attachments {
+		attachment, _ := attachment.(map[string]any)
+		if content, isText := attachment["content"].(string); isText && content != "" {
+			values = append(values, content)
+		}
+	}
+	return strings.ToLower(strings.Join(values, "\n")), nil
+}
+
+// lookupJSONPath returns the value at the given path of a decoded JSON object.
+func lookupJSONPath(object map[string]any, path []string) (any, bool) {
+	value, found := object[path[0]]
+	if !found || len(path) == 1 {
+		return value, found
+	}
+	child, isObject := value.(map[string]any)
+	if !isObject {
+		return nil, false
+	}
+	return lookupJSONPath(child, path[1:])
+}
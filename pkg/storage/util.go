@@ -3,6 +3,26 @@
 
 package storage
 
+import (
+	"encoding/json"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+)
+
+// eventDocument is the stored form of a TenantEvent: the CADF event with its
+// tags, as sent by the audit middleware.
+type eventDocument struct {
+	*cadf.Event
+	Tags []string `json:"tags,omitempty"`
+}
+
+// decodeEventDocument decodes a stored event together with its tags.
+func decodeEventDocument(data []byte) (eventDocument, error) {
+	doc := eventDocument{Event: &cadf.Event{}}
+	err := json.Unmarshal(data, &doc)
+	return doc, err
+}
+
 // RemoveDuplicates removes duplicates from a slice of strings while preserving the order.
 func RemoveDuplicates(s []string) []string {
 	seen := make(map[string]struct{}, len(s))
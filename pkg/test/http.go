@@ -13,18 +13,22 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"testing"
 )
 
 // APIRequest contains all metadata about a test request.
 type APIRequest struct {
-	Method           string
-	Path             string
-	RequestJSON      any // if non-nil, will be encoded as JSON
-	ExpectStatusCode int
-	ExpectBody       *string // raw content (not a file path)
-	ExpectJSON       string  // path to JSON file
-	ExpectFile       string  // path to arbitrary file
+	Method             string
+	Path               string
+	RequestJSON        any     // if non-nil, will be encoded as JSON
+	RequestBody        *string // raw content with RequestContentType (instead of RequestJSON)
+	RequestContentType string
+	RequestHeaders     map[string]string
+	ExpectStatusCode   int
+	ExpectBody         *string // raw content (not a file path)
+	ExpectJSON         string  // path to JSON file
+	ExpectFile         string  // path to arbitrary file
 }
 
 // Check performs the HTTP request described by this APIRequest against the
@@ -39,8 +43,17 @@ func (r APIRequest) Check(t *testing.T, handler http.Handler) {
 		}
 		requestBody = bytes.NewReader(body)
 	}
+	if r.RequestBody != nil {
+		requestBody = strings.NewReader(*r.RequestBody)
+	}
 	request := httptest.NewRequest(r.Method, r.Path, requestBody)
 	request.Header.Set("X-Auth-Token", "something")
+	if r.RequestContentType != "" {
+		request.Header.Set("Content-Type", r.RequestContentType)
+	}
+	for key, value := range r.RequestHeaders {
+		request.Header.Set(key, value)
+	}
 
 	recorder := httptest.NewRecorder()
 	handler.ServeHTTP(recorder, request)
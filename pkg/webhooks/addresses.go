@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// ErrAddressNotAllowed is returned when a delivery would connect to an
+// address that is not public, e.g. of a service in the internal network.
+var ErrAddressNotAllowed = errors.New("address is not allowed")
+
+// nonPublicNetworks are not routed on the internet, in addition to the
+// loopback, private, link-local and multicast addresses.
+var nonPublicNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network" (RFC 791)
+	netip.MustParsePrefix("100.64.0.0/10"), // shared address space of carrier-grade NAT (RFC 6598)
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments (RFC 6890)
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking (RFC 2544)
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved (RFC 1112)
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can reach any IPv4 address (RFC 6052)
+}
+
+// IsPublicAddress reports whether an address is routed on the internet.
+// Loopback, private (RFC 1918, RFC 4193), link-local (including the metadata
+// service at 169.254.169.254) and other special-purpose addresses are not.
+func IsPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddressFilter decides which addresses deliveries may connect to: public
+// addresses, and those in AllowedNetworks, with which operators can permit
+// receivers in their internal network.
+type AddressFilter struct {
+	AllowedNetworks []netip.Prefix
+}
+
+// Allows reports whether deliveries may connect to an address.
+func (f AddressFilter) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range f.AllowedNetworks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return IsPublicAddress(addr)
+}
+
+// control is used as Control function of the dialer of deliveries. It checks
+// the address after the host name was resolved, so that host names cannot
+// point to other addresses than those checked.
+func (f AddressFilter) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("cannot parse address %q: %w", address, err)
+	}
+	if !f.Allows(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, addrPort.Addr())
+	}
+	return nil
+}
+
+// ParseNetworks parses networks in CIDR notation, e.g. "10.0.0.0/8".
+func ParseNetworks(values []string) ([]netip.Prefix, error) {
+	networks := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		network, err := netip.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		networks = append(networks, network.Masked())
+	}
+	return networks, nil
+}
@@ -0,0 +1,555 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package webhooks implements the dispatcher of webhook subscriptions. It
+// follows the new events of the projects with enabled subscriptions, and
+// delivers those matching a subscription to its URL, signed with its secret.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/hermes/pkg/hermes"
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// Headers of all deliveries.
+const (
+	DeliveryHeader  = "X-Hermes-Delivery"
+	EventHeader     = "X-Hermes-Event"
+	SignatureHeader = "X-Hermes-Signature-256"
+)
+
+// pruneInterval is how often the delivery log is pruned.
+const pruneInterval = time.Hour
+
+// defaultQueueSize is the number of events that can be queued for delivery to
+// each subscription.
+const defaultQueueSize = 1000
+
+// maxFollowedTenants limits the number of projects whose events are read by
+// listing them in the query. With more projects, the events of all projects
+// are read instead.
+const maxFollowedTenants = 500
+
+var deliveriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "hermes_webhook_deliveries",
+	Help: "Number of events delivered to webhook subscriptions, by whether the delivery succeeded",
+}, []string{"success"})
+
+func init() {
+	prometheus.MustRegister(deliveriesCounter)
+}
+
+// Payload is the body of all deliveries.
+type Payload struct {
+	SubscriptionID string      `json:"subscription_id"`
+	ProjectID      string      `json:"project_id"`
+	Event          *cadf.Event `json:"event"`
+}
+
+// Dispatcher delivers the events of all enabled subscriptions.
+type Dispatcher struct {
+	Storage       storage.Storage
+	Subscriptions storage.SubscriptionStore
+	Client        *http.Client
+	// SyncInterval is how often the subscriptions are read from the storage,
+	// and therefore how long it takes until changes are picked up.
+	SyncInterval time.Duration
+	// PollInterval and Lookback are used for following the events of all
+	// subscriptions, like in the event stream of the API.
+	PollInterval time.Duration
+	Lookback     time.Duration
+	// MaxAttempts limits the attempts of each delivery. RetryInterval is the
+	// time before the second attempt, it is doubled for every further attempt
+	// up to MaxRetryInterval.
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// DeliveryLogRetention is how long deliveries are kept in the delivery log,
+	// 0 keeps them forever.
+	DeliveryLogRetention time.Duration
+	// TimeNow can be replaced in tests, defaults to time.Now.
+	TimeNow func() time.Time
+
+	// tail follows the events of the projects in tenantID for all followers.
+	tail      *hermes.EventTail
+	tenantID  string
+	followers map[string]*follower
+	lastPrune time.Time
+	// queueSize can be replaced in tests, defaults to defaultQueueSize.
+	queueSize int
+}
+
+// follower delivers the events of one subscription in its own goroutine.
+// The events are queued by Poll, which reads them once for all followers.
+// Followers that are behind, e.g. because they were just started or because
+// their queue was full, read their events with their own tail instead, until
+// they have caught up.
+type follower struct {
+	subscription storage.Subscription
+	matcher      *storage.EventMatcher
+	queue        chan hermes.TailEvent
+	cancel       context.CancelFunc
+	done         chan struct{}
+	// catchUp is the tail of a follower that is behind, or nil
+	catchUp *hermes.EventTail
+	// lastQueuedID is the ResumeID of the last queued event
+	lastQueuedID string
+	// lastEventID may only be read after done is closed
+	lastEventID string
+}
+
+// NewClient returns an HTTP client for deliveries. Redirects are not followed,
+// so that deliveries only go to the URLs that subscriptions were created with,
+// and connections are only made to the addresses that the filter allows.
+func NewClient(timeout time.Duration, filter AddressFilter) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   filter.control,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the receivers instead of the dialer
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Run syncs the subscriptions every SyncInterval and polls their events every
+// PollInterval until ctx is done, and then waits for all deliveries to stop.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var lastSync time.Time
+	for {
+		if time.Since(lastSync) >= d.SyncInterval {
+			err := d.Sync(ctx)
+			if err != nil {
+				logg.Error("could not sync webhook subscriptions: %s", err.Error())
+			}
+			lastSync = time.Now()
+		}
+		d.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			for id, f := range d.followers {
+				f.stop()
+				delete(d.followers, id)
+			}
+			return
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+// Sync starts following the events of new or changed subscriptions, and stops
+// following those of deleted or disabled ones.
+func (d *Dispatcher) Sync(ctx context.Context) error {
+	subscriptions, err := d.Subscriptions.ListSubscriptions(ctx, "")
+	if err != nil {
+		return fmt.Errorf("cannot list subscriptions: %w", err)
+	}
+	wanted := make(map[string]storage.Subscription, len(subscriptions))
+	for _, subscription := range subscriptions {
+		if subscription.Enabled {
+			wanted[subscription.ID] = subscription
+		}
+	}
+
+	if d.followers == nil {
+		d.followers = make(map[string]*follower)
+	}
+	resumeIDs := make(map[string]string)
+	for id, f := range d.followers {
+		subscription, exists := wanted[id]
+		if exists && subscription.UpdatedAt.Equal(f.subscription.UpdatedAt) {
+			continue
+		}
+		f.stop()
+		delete(d.followers, id)
+		// the progress in the storage might not be up to date yet
+		resumeIDs[id] = f.lastEventID
+	}
+	for id, subscription := range wanted {
+		if _, exists := d.followers[id]; exists {
+			continue
+		}
+		resumeID := subscription.LastEventID
+		if resumeIDs[id] != "" {
+			resumeID = resumeIDs[id]
+		}
+		matcher, err := hermes.NewSubscriptionMatcher(subscription.Filter)
+		if err != nil {
+			logg.Error("subscription %s: cannot follow events with invalid filter: %s", id, err.Error())
+			continue
+		}
+		logg.Info("following the events of subscription %s of project %s", id, subscription.ProjectID)
+		d.followers[id] = d.startFollower(ctx, subscription, matcher, resumeID)
+	}
+	d.followTenants()
+
+	now := d.now()
+	if d.DeliveryLogRetention > 0 && now.Sub(d.lastPrune) >= pruneInterval {
+		err := d.Subscriptions.PruneDeliveries(ctx, now.Add(-d.DeliveryLogRetention))
+		if err != nil {
+			return fmt.Errorf("cannot prune delivery log: %w", err)
+		}
+		d.lastPrune = now
+	}
+	return nil
+}
+
+// followTenants sets the tail to the projects of all followers. Followers in
+// projects that were not followed before are behind anyway, so they do not
+// miss the earlier events of their project.
+func (d *Dispatcher) followTenants() {
+	var tenantIDs []string
+	for _, f := range d.followers {
+		tenantIDs = append(tenantIDs, f.subscription.ProjectID)
+	}
+	slices.Sort(tenantIDs)
+	tenantIDs = slices.Compact(tenantIDs)
+	d.tenantID = strings.Join(tenantIDs, ",")
+	if len(tenantIDs) > maxFollowedTenants {
+		d.tenantID = ""
+	}
+
+	switch {
+	case len(tenantIDs) == 0:
+		d.tail = nil
+	case d.tail == nil:
+		// the followers read the earlier events with their own tails
+		tail, err := hermes.NewEventTail(&hermes.EventFilter{}, d.tenantID, "", d.Lookback, d.now())
+		if err != nil {
+			logg.Error("cannot follow events: %s", err.Error())
+			return
+		}
+		d.tail = tail
+	default:
+		d.tail.SetTenantID(d.tenantID)
+	}
+}
+
+func (d *Dispatcher) startFollower(ctx context.Context, subscription storage.Subscription, matcher *storage.EventMatcher, resumeID string) *follower {
+	ctx, cancel := context.WithCancel(ctx)
+	queueSize := d.queueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	f := &follower{
+		subscription: subscription,
+		matcher:      matcher,
+		queue:        make(chan hermes.TailEvent, queueSize),
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		lastQueuedID: resumeID,
+		lastEventID:  resumeID,
+	}
+	f.catchUp = d.newFollowerTail(subscription, resumeID)
+	go func() {
+		defer close(f.done)
+		d.deliverQueue(ctx, f)
+	}()
+	return f
+}
+
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+// newFollowerTail returns a tail that reads the events of a subscription
+// after the given event. New subscriptions start with the events after their
+// creation, not after the next sync.
+func (d *Dispatcher) newFollowerTail(subscription storage.Subscription, resumeID string) *hermes.EventTail {
+	filter := hermes.SubscriptionEventFilter(subscription.Filter)
+	start := d.now()
+	if resumeID == "" && !subscription.CreatedAt.IsZero() {
+		start = subscription.CreatedAt
+	}
+	tail, err := hermes.NewEventTail(filter, subscription.ProjectID, resumeID, d.Lookback, start)
+	if err != nil {
+		logg.Error("subscription %s: cannot resume after %q, starting with new events: %s", subscription.ID, resumeID, err.Error())
+		tail, err = hermes.NewEventTail(filter, subscription.ProjectID, "", d.Lookback, d.now())
+		if err != nil {
+			logg.Error("subscription %s: %s", subscription.ID, err.Error())
+			return nil
+		}
+	}
+	return tail
+}
+
+// Poll reads the new events of all followed projects and queues them for the
+// followers whose subscriptions they match. Followers that are behind read
+// their events afterwards, so that the events which Poll read before they
+// caught up are not missed.
+func (d *Dispatcher) Poll(ctx context.Context) {
+	if d.tail != nil {
+		followers := make(map[string][]*follower)
+		for _, f := range d.followers {
+			followers[f.subscription.ProjectID] = append(followers[f.subscription.ProjectID], f)
+		}
+		for {
+			events, more, err := d.tail.Poll(ctx, d.Storage)
+			if err != nil {
+				if ctx.Err() == nil {
+					logg.Error("cannot read events of webhook subscriptions: %s", err.Error())
+				}
+				// followers must not catch up with events that were not read
+				return
+			}
+			for _, event := range events {
+				d.queueEvent(followers, event)
+			}
+			if !more {
+				break
+			}
+		}
+	}
+
+	for _, f := range d.followers {
+		if f.catchUp != nil {
+			d.catchUp(ctx, f)
+		}
+	}
+}
+
+// queueEvent queues an event for the followers of its project whose
+// subscriptions it matches.
+func (d *Dispatcher) queueEvent(followers map[string][]*follower, event hermes.TailEvent) {
+	tenantID := event.TenantID
+	if tenantID == "" {
+		// the tenant is only returned when several are followed
+		tenantID = d.tenantID
+	}
+	var matchEvent *storage.MatchEvent
+	for _, f := range followers[tenantID] {
+		if f.catchUp != nil {
+			continue
+		}
+		if matchEvent == nil {
+			e, err := storage.NewMatchEvent(event.Payload, event.Tags)
+			if err != nil {
+				logg.Error("cannot match event %s with webhook subscriptions: %s", event.Payload.ID, err.Error())
+				return
+			}
+			matchEvent = &e
+		}
+		if f.matcher.Match(*matchEvent) {
+			d.enqueue(f, event)
+		}
+	}
+}
+
+// catchUp reads the events of a follower that is behind with its own tail,
+// as long as there is space in its queue.
+func (d *Dispatcher) catchUp(ctx context.Context, f *follower) {
+	for len(f.queue) <= cap(f.queue)/2 {
+		events, more, err := f.catchUp.Poll(ctx, d.Storage)
+		if err != nil {
+			if ctx.Err() == nil {
+				logg.Error("subscription %s: cannot read events: %s", f.subscription.ID, err.Error())
+			}
+			return
+		}
+		for _, event := range events {
+			if !d.enqueue(f, event) {
+				return
+			}
+		}
+		if !more {
+			logg.Debug("subscription %s: caught up with the events", f.subscription.ID)
+			f.catchUp = nil
+			return
+		}
+	}
+}
+
+// enqueue queues an event for delivery. If the queue is full, e.g. because
+// the receiver is down, the follower is behind and continues after the last
+// queued event later.
+func (d *Dispatcher) enqueue(f *follower, event hermes.TailEvent) bool {
+	select {
+	case f.queue <- event:
+		f.lastQueuedID = event.ResumeID
+		return true
+	default:
+		logg.Debug("subscription %s: too many queued events, continuing after %s later", f.subscription.ID, f.lastQueuedID)
+		f.catchUp = d.newFollowerTail(f.subscription, f.lastQueuedID)
+		return false
+	}
+}
+
+// deliverQueue delivers the queued events of a subscription until ctx is
+// done. Each event is delivered (or given up on) before the next one, and the
+// progress is recorded after each event, so that a restarted dispatcher
+// continues after the last delivered event.
+func (d *Dispatcher) deliverQueue(ctx context.Context, f *follower) {
+	subscription := f.subscription
+	for {
+		var event hermes.TailEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-f.queue:
+		}
+
+		delivery := d.Deliver(ctx, subscription, event.Payload)
+		if ctx.Err() != nil {
+			// the event is delivered again after the restart
+			return
+		}
+		err := d.Subscriptions.SaveDelivery(ctx, delivery)
+		if err != nil {
+			logg.Error("subscription %s: cannot record delivery of event %s: %s", subscription.ID, delivery.EventID, err.Error())
+		}
+		f.lastEventID = event.ResumeID
+		err = d.Subscriptions.UpdateSubscriptionProgress(ctx, subscription.ID, event.ResumeID)
+		if err != nil {
+			logg.Error("subscription %s: cannot record progress: %s", subscription.ID, err.Error())
+		}
+	}
+}
+
+// Deliver sends an event to the URL of the subscription, and retries failed
+// attempts with exponential backoff. The returned delivery describes the last
+// attempt. Failures that are caused by the request, i.e. responses with a 4xx
+// status code other than 408 and 429, are not retried. The error of the
+// delivery does not contain the details of attempts without a response, which
+// are only logged.
+func (d *Dispatcher) Deliver(ctx context.Context, subscription storage.Subscription, event *cadf.Event) storage.Delivery {
+	delivery := storage.Delivery{
+		ID:             uuid.NewString(),
+		SubscriptionID: subscription.ID,
+		EventID:        event.ID,
+	}
+	body, err := json.Marshal(Payload{SubscriptionID: subscription.ID, ProjectID: subscription.ProjectID, Event: event})
+	if err != nil {
+		delivery.Time = d.now()
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	retryInterval := d.RetryInterval
+	for {
+		delivery.Attempts++
+		delivery.Time = d.now()
+		delivery.StatusCode, err = d.post(ctx, subscription, delivery.ID, event.ID, body)
+		if err == nil {
+			delivery.Success = true
+			delivery.Error = ""
+			break
+		}
+		delivery.Error = deliveryError(delivery.StatusCode, err)
+		if !isRetryable(delivery.StatusCode) || delivery.Attempts >= d.MaxAttempts {
+			break
+		}
+
+		logg.Debug("subscription %s: attempt %d to deliver event %s failed, retrying in %s: %s",
+			subscription.ID, delivery.Attempts, event.ID, retryInterval, err.Error())
+		select {
+		case <-ctx.Done():
+			return delivery
+		case <-time.After(retryInterval):
+		}
+		retryInterval = min(2*retryInterval, d.MaxRetryInterval)
+	}
+
+	if !delivery.Success {
+		logg.Error("subscription %s: could not deliver event %s after %d attempts: %s",
+			subscription.ID, event.ID, delivery.Attempts, err.Error())
+	}
+	deliveriesCounter.WithLabelValues(strconv.FormatBool(delivery.Success)).Inc()
+	return delivery
+}
+
+// post makes a single attempt to deliver the body. The status code is 0 if
+// there was no response.
+func (d *Dispatcher) post(ctx context.Context, subscription storage.Subscription, deliveryID, eventID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hermes-webhooks")
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(EventHeader, eventID)
+	req.Header.Set(SignatureHeader, Sign(subscription.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// read a bit of the response, so that the connection can be reused
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		logg.Debug("subscription %s: could not read response: %s", subscription.ID, err.Error())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the value of the signature header for a body, which receivers
+// can compare with the HMAC-SHA256 of the body that they compute with the
+// secret of the subscription.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryError returns the error of a failed attempt for the delivery log,
+// which the users of the project can read. Errors without a response are not
+// described, since they could reveal which hosts and ports of the network of
+// the dispatcher exist, e.g. "connection refused" or "no such host".
+func deliveryError(statusCode int, err error) string {
+	if statusCode == 0 {
+		return "no response"
+	}
+	return err.Error()
+}
+
+func isRetryable(statusCode int) bool {
+	switch {
+	case statusCode == 0: // no response
+		return true
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return true
+	default:
+		return statusCode >= 500
+	}
+}
+
+func (d *Dispatcher) now() time.Time {
+	if d.TimeNow != nil {
+		return d.TimeNow().UTC()
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,486 @@
+// SPDX-FileCopyrightText: 2022 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sapcc/hermes/pkg/storage"
+)
+
+// receiver records the deliveries it receives, and answers with the given
+// status codes in order, then with 200.
+type receiver struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	statuses []int
+	payloads []Payload
+	requests int
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, statuses: statuses}
+	server := httptest.NewTLSServer(r)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests++
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get(SignatureHeader) != Sign("0123456789abcdef", body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var payload Payload
+	err = json.Unmarshal(body, &payload)
+	if err != nil || req.Header.Get(EventHeader) != payload.Event.ID || req.Header.Get(DeliveryHeader) == "" {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	r.payloads = append(r.payloads, payload)
+}
+
+// eventIDsOf returns the IDs of the events delivered to a subscription.
+func (r *receiver) eventIDsOf(subscriptionID string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ids []string
+	for _, payload := range r.payloads {
+		if payload.SubscriptionID == subscriptionID {
+			ids = append(ids, payload.Event.ID)
+		}
+	}
+	return ids
+}
+
+func (r *receiver) eventIDs() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ids []string
+	for _, payload := range r.payloads {
+		ids = append(ids, payload.Event.ID)
+	}
+	return ids
+}
+
+// eventStore returns its events like a real storage for the queries of the
+// dispatcher: since the time in the filter, in order of their eventTime.
+type eventStore struct {
+	storage.Mock
+	events []*cadf.Event
+}
+
+func (s eventStore) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	from, err := time.Parse(time.RFC3339Nano, filter.Time["gte"])
+	if err != nil {
+		return nil, err
+	}
+	var events []*cadf.Event
+	for _, event := range s.events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.EventTime)
+		if err != nil {
+			return nil, err
+		}
+		if !eventTime.Before(from) {
+			events = append(events, event)
+		}
+	}
+	return &storage.EventPage{Events: events, Total: len(events)}, nil
+}
+
+// projectEventStore keeps the events of several projects, and answers the
+// queries of the dispatcher like a real storage, including the tenants and
+// the action filter. It records the tenants and actions of all queries.
+type projectEventStore struct {
+	storage.Mock
+	mutex   sync.Mutex
+	events  []storage.TenantEvent
+	queries []eventQuery
+}
+
+type eventQuery struct {
+	tenantID string
+	action   string
+}
+
+func (s *projectEventStore) GetEvents(ctx context.Context, filter *storage.EventFilter, tenantID string) (*storage.EventPage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries = append(s.queries, eventQuery{tenantID, filter.Action})
+
+	from, err := time.Parse(time.RFC3339Nano, filter.Time["gte"])
+	if err != nil {
+		return nil, err
+	}
+	page := &storage.EventPage{}
+	for _, event := range s.events {
+		eventTime, err := time.Parse(time.RFC3339Nano, event.Event.EventTime)
+		if err != nil {
+			return nil, err
+		}
+		if eventTime.Before(from) || !slices.Contains(strings.Split(tenantID, ","), event.TenantID) ||
+			(filter.Action != "" && string(event.Event.Action) != filter.Action) {
+			continue
+		}
+		page.Events = append(page.Events, event.Event)
+		if strings.Contains(tenantID, ",") {
+			page.TenantIDs = append(page.TenantIDs, event.TenantID)
+		}
+		if uint(len(page.Events)) == filter.Limit {
+			break
+		}
+	}
+	page.Total = len(page.Events)
+	return page, nil
+}
+
+func (s *projectEventStore) add(tenantID, id string, action cadf.Action, eventTime time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	event := &cadf.Event{ID: id, EventTime: eventTime.UTC().Format(time.RFC3339Nano), Action: action}
+	s.events = append(s.events, storage.TenantEvent{TenantID: tenantID, Event: event})
+}
+
+// countQueries counts the queries for the given tenants and action.
+func (s *projectEventStore) countQueries(tenantID, action string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, query := range s.queries {
+		if query == (eventQuery{tenantID, action}) {
+			count++
+		}
+	}
+	return count
+}
+
+// subscriptionStore keeps subscriptions and deliveries in memory.
+type subscriptionStore struct {
+	storage.Mock
+	mutex         sync.Mutex
+	subscriptions []storage.Subscription
+	deliveries    []storage.Delivery
+}
+
+func (s *subscriptionStore) ListSubscriptions(ctx context.Context, projectID string) ([]storage.Subscription, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]storage.Subscription(nil), s.subscriptions...), nil
+}
+
+func (s *subscriptionStore) UpdateSubscriptionProgress(ctx context.Context, subscriptionID, lastEventID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for idx := range s.subscriptions {
+		if s.subscriptions[idx].ID == subscriptionID {
+			s.subscriptions[idx].LastEventID = lastEventID
+		}
+	}
+	return nil
+}
+
+func (s *subscriptionStore) SaveDelivery(ctx context.Context, delivery storage.Delivery) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+func (s *subscriptionStore) lastEventID(subscriptionID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, subscription := range s.subscriptions {
+		if subscription.ID == subscriptionID {
+			return subscription.LastEventID
+		}
+	}
+	return ""
+}
+
+func newTestDispatcher(server *httptest.Server, store *subscriptionStore) *Dispatcher {
+	client := server.Client()
+	client.Timeout = 5 * time.Second
+	return &Dispatcher{
+		Storage: eventStore{events: []*cadf.Event{
+			{ID: "first", EventTime: "2024-05-01T12:00:01.000+00:00", Action: "delete"},
+			{ID: "second", EventTime: "2024-05-01T12:00:02.000+00:00", Action: "delete"},
+		}},
+		Subscriptions:    store,
+		Client:           client,
+		SyncInterval:     10 * time.Millisecond,
+		PollInterval:     10 * time.Millisecond,
+		Lookback:         time.Minute,
+		MaxAttempts:      3,
+		RetryInterval:    time.Millisecond,
+		MaxRetryInterval: 2 * time.Millisecond,
+	}
+}
+
+func testSubscription(url string) storage.Subscription {
+	return storage.Subscription{
+		ID:        "subscription",
+		ProjectID: "project",
+		URL:       url,
+		Secret:    "0123456789abcdef",
+		Enabled:   true,
+		Filter:    storage.SubscriptionFilter{Action: "delete"},
+	}
+}
+
+func Test_Deliver(t *testing.T) {
+	event := &cadf.Event{ID: "event", EventTime: "2024-05-01T12:00:01.000+00:00", Action: "delete"}
+
+	testCases := []struct {
+		name       string
+		statuses   []int
+		success    bool
+		attempts   int
+		statusCode int
+		error      string
+	}{
+		{name: "Success", success: true, attempts: 1, statusCode: http.StatusOK},
+		{name: "Retried", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, success: true, attempts: 3, statusCode: http.StatusOK},
+		{name: "GivenUp", statuses: []int{500, 502, 503}, attempts: 3, statusCode: 503, error: "503 Service Unavailable"},
+		{name: "NotRetried", statuses: []int{http.StatusGone}, attempts: 1, statusCode: http.StatusGone, error: "410 Gone"},
+		{name: "NoRedirects", statuses: []int{http.StatusFound}, attempts: 1, statusCode: http.StatusFound, error: "302 Found"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, server := newReceiver(t, tc.statuses...)
+			d := newTestDispatcher(server, &subscriptionStore{})
+			d.Client.CheckRedirect = NewClient(0, AddressFilter{}).CheckRedirect
+
+			delivery := d.Deliver(context.Background(), testSubscription(server.URL), event)
+			assert.Equal(t, tc.success, delivery.Success)
+			assert.Equal(t, tc.attempts, delivery.Attempts)
+			assert.Equal(t, tc.statusCode, delivery.StatusCode)
+			assert.Equal(t, tc.error, delivery.Error)
+			assert.Equal(t, "subscription", delivery.SubscriptionID)
+			assert.Equal(t, "event", delivery.EventID)
+			assert.Equal(t, tc.attempts, r.requests)
+		})
+	}
+
+	// deliveries fail with the wrong secret
+	r, server := newReceiver(t)
+	d := newTestDispatcher(server, &subscriptionStore{})
+	subscription := testSubscription(server.URL)
+	subscription.Secret = "wrong-secret-0123"
+	delivery := d.Deliver(context.Background(), subscription, event)
+	assert.False(t, delivery.Success)
+	assert.Equal(t, http.StatusUnauthorized, delivery.StatusCode)
+	assert.Empty(t, r.eventIDs())
+}
+
+func Test_Dispatcher(t *testing.T) {
+	r, server := newReceiver(t, http.StatusServiceUnavailable)
+	subscription := testSubscription(server.URL)
+	subscription.LastEventID = "2024-05-01T12:00:00.000Z/zero"
+	disabled := testSubscription(server.URL)
+	disabled.ID = "disabled"
+	disabled.Enabled = false
+	disabled.LastEventID = subscription.LastEventID
+	store := &subscriptionStore{subscriptions: []storage.Subscription{subscription, disabled}}
+	d := newTestDispatcher(server, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(stopped)
+	}()
+	require.Eventually(t, func() bool {
+		return store.lastEventID("subscription") == "2024-05-01T12:00:02.000Z/second"
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-stopped
+
+	assert.Equal(t, []string{"first", "second"}, r.eventIDs())
+	assert.Equal(t, "2024-05-01T12:00:00.000Z/zero", store.lastEventID("disabled"))
+	require.Len(t, store.deliveries, 2)
+	assert.Equal(t, 2, store.deliveries[0].Attempts, "the first attempt failed with 503")
+	assert.True(t, store.deliveries[0].Success)
+	assert.Equal(t, "second", store.deliveries[1].EventID)
+	for _, payload := range r.payloads {
+		assert.Equal(t, "subscription", payload.SubscriptionID)
+		assert.Equal(t, "project", payload.ProjectID)
+	}
+}
+
+// runDispatcher runs the dispatcher until the test ends.
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+}
+
+func Test_DispatcherPollsOnce(t *testing.T) {
+	r, server := newReceiver(t)
+	deletions := testSubscription(server.URL)
+	deletions.ID = "deletions"
+	updates := testSubscription(server.URL)
+	updates.ID = "updates"
+	updates.Filter = storage.SubscriptionFilter{Action: "update"}
+	other := testSubscription(server.URL)
+	other.ID = "other"
+	other.ProjectID = "other-project"
+	other.Filter = storage.SubscriptionFilter{}
+	eventStore := &projectEventStore{}
+	d := newTestDispatcher(server, &subscriptionStore{subscriptions: []storage.Subscription{deletions, updates, other}})
+	d.Storage = eventStore
+	runDispatcher(t, d)
+
+	// the new subscriptions catch up with their own query, then all events are read at once
+	require.Eventually(t, func() bool {
+		return eventStore.countQueries("other-project,project", "") >= 2
+	}, 5*time.Second, time.Millisecond)
+	now := time.Now()
+	eventStore.add("project", "deleted", "delete", now)
+	eventStore.add("project", "updated", "update", now.Add(time.Millisecond))
+	eventStore.add("other-project", "created", "create", now.Add(2*time.Millisecond))
+	eventStore.add("project", "created", "create", now.Add(3*time.Millisecond))
+	require.Eventually(t, func() bool {
+		return len(r.eventIDs()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []string{"deleted"}, r.eventIDsOf("deletions"))
+	assert.Equal(t, []string{"updated"}, r.eventIDsOf("updates"))
+	assert.Equal(t, []string{"created"}, r.eventIDsOf("other"))
+	assert.Equal(t, 1, eventStore.countQueries("project", "delete"))
+	assert.Equal(t, 1, eventStore.countQueries("project", "update"))
+	assert.Equal(t, 1, eventStore.countQueries("other-project", ""))
+}
+
+func Test_DispatcherQueueFull(t *testing.T) {
+	r, server := newReceiver(t)
+	subscription := testSubscription(server.URL)
+	subscription.LastEventID = "2024-05-01T12:00:00.000Z/zero"
+	eventStore := &projectEventStore{}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for idx, id := range []string{"first", "second", "third"} {
+		eventStore.add("project", id, "delete", start.Add(time.Duration(idx+1)*time.Second))
+	}
+	d := newTestDispatcher(server, &subscriptionStore{subscriptions: []storage.Subscription{subscription}})
+	d.Storage = eventStore
+	d.queueSize = 1
+	runDispatcher(t, d)
+
+	// more events than fit into the queue are read after the queued ones
+	require.Eventually(t, func() bool {
+		return len(r.eventIDs()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	sharedQueries := eventStore.countQueries("project", "")
+	require.Eventually(t, func() bool {
+		return eventStore.countQueries("project", "") >= sharedQueries+2
+	}, 5*time.Second, time.Millisecond)
+
+	// the same happens when the events are read for all subscriptions
+	catchUpQueries := eventStore.countQueries("project", "delete")
+	now := time.Now()
+	for idx, id := range []string{"fourth", "fifth", "sixth"} {
+		eventStore.add("project", id, "delete", now.Add(time.Duration(idx)*time.Millisecond))
+	}
+	require.Eventually(t, func() bool {
+		return len(r.eventIDs()) == 6
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second", "third", "fourth", "fifth", "sixth"}, r.eventIDs())
+	assert.Greater(t, eventStore.countQueries("project", "delete"), catchUpQueries)
+}
+
+func Test_IsPublicAddress(t *testing.T) {
+	testCases := map[string]bool{
+		"203.0.113.7":            true,
+		"2001:db8::1":            true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"10.1.2.3":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"fe80::1":                false,
+		"fd00::1":                false,
+		"100.64.0.1":             false,
+		"0.0.0.0":                false,
+		"224.0.0.1":              false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"64:ff9b::a01:203":       false,
+	}
+	for address, public := range testCases {
+		assert.Equal(t, public, IsPublicAddress(netip.MustParseAddr(address)), address)
+	}
+}
+
+func Test_NewClient(t *testing.T) {
+	r, server := newReceiver(t)
+	event := &cadf.Event{ID: "event", EventTime: "2024-05-01T12:00:01.000+00:00", Action: "delete"}
+	req, err := http.NewRequest(http.MethodGet, server.URL, http.NoBody)
+	require.NoError(t, err)
+
+	// the receiver listens on a loopback address
+	client := NewClient(5*time.Second, AddressFilter{})
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.True(t, errors.Is(err, ErrAddressNotAllowed), "unexpected error: %v", err)
+
+	// the details of the error are not in the delivery log
+	d := newTestDispatcher(server, &subscriptionStore{})
+	d.Client = client
+	delivery := d.Deliver(context.Background(), testSubscription(server.URL), event)
+	assert.False(t, delivery.Success)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, "no response", delivery.Error)
+	assert.Equal(t, 0, r.requests)
+
+	// operators can allow networks
+	networks, err := ParseNetworks([]string{"127.0.0.0/8", "::1/128"})
+	require.NoError(t, err)
+	client = NewClient(5*time.Second, AddressFilter{AllowedNetworks: networks})
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	d.Client = client
+	delivery = d.Deliver(context.Background(), testSubscription(server.URL), event)
+	assert.True(t, delivery.Success)
+	assert.Equal(t, []string{"event"}, r.eventIDs())
+
+	_, err = ParseNetworks([]string{"10.0.0.0"})
+	assert.Error(t, err)
+}